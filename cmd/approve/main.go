@@ -0,0 +1,105 @@
+// Command approve asks a human to approve an action from inside an agent session
+//
+//	approve [flags] ACTION...             exit 0 if approved, 1 if not
+//	approve [flags] --exec COMMAND ARGS   run COMMAND only if approved
+//
+// The request goes to the runner's approval socket named by
+// AGENT_RELAY_APPROVAL_SOCKET, then through HQ to a human reviewer.
+// Anything but an explicit approval is a denial
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/agent"
+)
+
+// Exit codes; both non-zero codes mean the action must not run
+const (
+	exitApproved    = 0
+	exitDenied      = 1
+	exitUnavailable = 2 // No answer could be obtained, e.g. outside a session
+)
+
+func main() {
+	details := flag.String("details", "", "Context shown to the reviewer")
+	action := flag.String("action", "", "Action shown to the reviewer (default: the arguments)")
+	timeout := flag.Duration("timeout", 0, "How long to wait for a decision (default: HQ's default)")
+	run := flag.Bool("exec", false, "Treat the arguments as a command and run it if approved")
+	quiet := flag.Bool("quiet", false, "Do not print the decision")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] ACTION...\n       %s [flags] --exec COMMAND [ARGS...]\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 && *action == "" {
+		flag.Usage()
+		os.Exit(exitUnavailable)
+	}
+	if *run && len(args) == 0 {
+		fail("--exec needs a command")
+	}
+	if *action == "" {
+		*action = strings.Join(args, " ")
+	}
+
+	path := os.Getenv(agent.ApprovalSocketEnv)
+	if path == "" {
+		fail(agent.ApprovalSocketEnv + " is not set; approvals are only available inside agent sessions")
+	}
+
+	// Interrupting withdraws the request
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	answer, err := agent.RequestApproval(ctx, path, agent.ApprovalQuery{
+		Action:  *action,
+		Details: *details,
+		Timeout: int(timeout.Round(time.Second) / time.Second),
+	})
+	if err != nil {
+		fail(err.Error())
+	}
+
+	if !*quiet {
+		msg := "approval " + answer.Status
+		if answer.DecidedBy != "" {
+			msg += " by " + answer.DecidedBy
+		}
+		if answer.Reason != "" {
+			msg += ": " + answer.Reason
+		}
+		fmt.Fprintln(os.Stderr, msg)
+	}
+	if !answer.Approved {
+		os.Exit(exitDenied)
+	}
+	if !*run {
+		os.Exit(exitApproved)
+	}
+
+	stop()
+	binary, err := exec.LookPath(args[0])
+	if err != nil {
+		fail(err.Error())
+	}
+	if err := syscall.Exec(binary, args, os.Environ()); err != nil {
+		fail(fmt.Sprintf("failed to run %s: %v", args[0], err))
+	}
+}
+
+// fail reports why no approval was obtained; the caller must not proceed
+func fail(msg string) {
+	fmt.Fprintln(os.Stderr, "approve: "+msg)
+	os.Exit(exitUnavailable)
+}
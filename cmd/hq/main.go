@@ -1,39 +1,179 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
 
+	"github.com/codervisor/agent-relay/internal/artifact"
+	"github.com/codervisor/agent-relay/internal/audit"
+	"github.com/codervisor/agent-relay/internal/config"
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/recording"
+	"github.com/codervisor/agent-relay/internal/redact"
 	"github.com/codervisor/agent-relay/internal/server"
+	"github.com/codervisor/agent-relay/internal/store"
+	"github.com/codervisor/agent-relay/internal/tlsutil"
+	"github.com/codervisor/agent-relay/internal/tracing"
+	"github.com/codervisor/agent-relay/internal/webui"
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
-	// Get configuration from environment
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	configPath := flag.String("config", os.Getenv("HQ_CONFIG"), "YAML configuration file; environment variables override its settings")
+	webDir := flag.String("web-dir", "", "Serve the web UI from this directory instead of the built-in one, e.g. while developing it")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath, *webDir)
+	if err != nil {
+		// Printed as is: the errors are one per line, and the log format may be what is wrong
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Structured logs; the level can be changed by reloading the configuration
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(cfg.LogLevel())
+	logger, err := logging.NewLeveled(os.Stderr, cfg.Log.Format, logLevel)
+	if err != nil {
+		fatal("Invalid logging config", logging.Err(err))
+	}
+	slog.SetDefault(logger)
+	if cfg.Log.Format == "json" && os.Getenv(gin.EnvGinMode) == "" {
+		// Keeps gin's route listing out of machine-read output
+		gin.SetMode(gin.ReleaseMode)
+	}
+	if *configPath != "" {
+		slog.Info("Loaded configuration", "path", *configPath)
+	}
+
+	// Session startup traces
+	shutdownTracing, err := tracing.Setup(context.Background(), "agent-relay-hq", cfg.Tracing.Exporter, os.Stdout)
+	if err != nil {
+		fatal("Invalid tracing config", logging.Err(err))
+	}
+
+	// Open persistent state store
+	st, err := openStore(cfg.Store.Driver, cfg.Store.Path)
+	if err != nil {
+		fatal("Failed to open store", logging.Err(err))
+	}
+	defer st.Close()
+
+	retention := store.RetentionPolicy{
+		Sessions: cfg.Store.Retention.Sessions,
+		Jobs:     cfg.Store.Retention.Jobs,
+		Runners:  cfg.Store.Retention.Runners,
+	}
+	store.StartPruner(context.Background(), st, retention, time.Hour)
+
+	// Runner tokens, profiles and approval timeouts can change on reload
+	policy := cfg.Policy()
+	if len(policy.RunnerTokens) == 0 {
+		slog.Warn("No runner tokens configured; runners may register with any non-empty token")
+	}
+	if policy.Profiles != nil {
+		slog.Info("Loaded agent profiles", "profiles", len(policy.Profiles.List()))
+	}
+	if slices.Contains(policy.Origins.Allowed, server.AnyOrigin) {
+		slog.Warn("Any origin may use the API and websockets; pages on other sites can drive terminals")
+	} else {
+		slog.Info("Allowed origins", "origins", policy.Origins.Allowed, "dev", policy.Origins.Dev)
+	}
+
+	hubOpts := []server.HubOption{
+		server.WithLogger(logger),
+		server.WithStore(st),
+		server.WithMaxTransferSize(cfg.Limits.MaxTransferSize),
+		server.WithApprovalTimeout(policy.ApprovalTimeout, policy.MaxApprovalTimeout),
+		server.WithLatencyProbes(cfg.LatencyProbeInterval),
+		server.WithRunnerTokens(policy.RunnerTokens),
+		server.WithProfiles(policy.Profiles, policy.RequireProfile),
+		server.WithOriginPolicy(policy.Origins),
+		server.WithQuotas(policy.Quotas),
+		server.WithRunnerCertificates(cfg.TLS.RequireRunnerCert),
+	}
+
+	// Audit log: "file" (hash-chained JSON lines), "stdout" or "off"
+	switch cfg.Audit.Sink {
+	case "file":
+		fileSink, err := audit.NewFileSink(cfg.Audit.Path)
+		if err != nil {
+			fatal("Failed to open audit log", logging.Err(err))
+		}
+		auditLog := audit.NewLogger(fileSink)
+		defer auditLog.Close()
+		hubOpts = append(hubOpts, server.WithAudit(auditLog))
+	case "stdout":
+		hubOpts = append(hubOpts, server.WithAudit(audit.NewLogger(audit.NewWriterSink(os.Stdout))))
+	}
+
+	// Session recording: "off", "requested" (clients opt in) or "all"
+	if cfg.Recording.Mode != "off" {
+		sink, err := recording.NewDirSink(cfg.Recording.Dir)
+		if err != nil {
+			fatal("Failed to open recording sink", logging.Err(err))
+		}
+		policy := recording.Policy{
+			All:   cfg.Recording.Mode == "all",
+			Input: cfg.Recording.Input,
+		}
+		if cfg.Recording.Redact {
+			policy.Redactor, err = redact.New(redact.Config{Patterns: cfg.Recording.RedactPatterns})
+			if err != nil {
+				fatal("Invalid redaction patterns", logging.Err(err))
+			}
+		}
+		hubOpts = append(hubOpts, server.WithRecording(sink, policy))
+	}
+
+	// Artifact storage: "dir" (local filesystem) or "off"
+	if cfg.Artifacts.Store == "dir" {
+		artifacts, err := artifact.NewDirStore(cfg.Artifacts.Dir)
+		if err != nil {
+			fatal("Failed to open artifact store", logging.Err(err))
+		}
+		hubOpts = append(hubOpts, server.WithArtifacts(artifacts))
 	}
 
 	// Create connection hub
-	hub := server.NewHub()
+	hub := server.NewHub(hubOpts...)
 
-	// Setup Gin router
-	r := gin.Default()
+	// Setup Gin router; requests are logged through the hub's logger
+	r := gin.New()
+	r.Use(gin.Recovery(), server.RequestLogger(hub))
+	r.Use(server.ShutdownGuard(hub))
 
-	// CORS for development
-	r.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	// Cross-origin pages may only use the API and websockets from allowed origins
+	r.Use(server.OriginGuard(hub))
 
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
+	// Web UI on every path no other route matches
+	if cfg.Web.Enabled {
+		ui, source, err := webUI(cfg.Web.Dir)
+		switch {
+		case errors.Is(err, webui.ErrNotBuilt):
+			slog.Info("Not serving the web UI", logging.Err(err))
+		case err != nil:
+			fatal("Invalid web UI directory", logging.Err(err))
+		default:
+			r.NoRoute(webui.Handler(ui))
+			slog.Info("Serving web UI", "from", source)
 		}
+	}
 
-		c.Next()
-	})
+	// Prometheus metrics
+	r.GET("/metrics", gin.WrapH(hub.MetricsHandler()))
 
 	// Health check
 	r.GET("/health", func(c *gin.Context) {
@@ -46,16 +186,203 @@ func main() {
 	// WebSocket endpoints
 	r.GET("/ws/runner", server.HandleRunnerConnection(hub))
 	r.GET("/ws/terminal/:runner_id", server.HandleTerminalConnection(hub))
+	r.GET("/ws/replay/:id", server.HandleReplayConnection(hub))
+	r.GET("/ws/approvals", server.HandleApprovalsConnection(hub))
 
 	// API endpoint to list runners
 	r.GET("/api/runners", func(c *gin.Context) {
 		c.JSON(200, gin.H{
-			"runners": hub.ListRunners(),
+			"runners":  hub.ListRunners(),
+			"draining": hub.DrainingRunners(),
 		})
 	})
+	r.POST("/api/runners/:id/drain", server.HandleDrainRunner(hub))
+
+	// File transfer to and from runners
+	r.PUT("/api/runners/:id/files", server.HandleFileUpload(hub))
+	r.GET("/api/runners/:id/files", server.HandleFileDownload(hub))
+
+	// Agent profiles
+	r.GET("/api/profiles", server.HandleListProfiles(hub))
 
-	log.Printf("HQ starting on :%s", port)
-	if err := r.Run(":" + port); err != nil {
-		log.Fatal(err)
+	// Session and job history
+	r.GET("/api/sessions", server.HandleListSessions(hub))
+	r.GET("/api/sessions/:id", server.HandleGetSession(hub))
+	r.GET("/api/sessions/:id/recording", server.HandleRecordingDownload(hub))
+	r.GET("/api/sessions/:id/latency", server.HandleGetSessionLatency(hub))
+	r.GET("/api/sessions/:id/result", server.HandleGetSessionResult(hub))
+	r.GET("/api/sessions/:id/artifacts", server.HandleListArtifacts(hub))
+	r.GET("/api/sessions/:id/artifacts/*name", server.HandleArtifactDownload(hub))
+	r.GET("/api/jobs", server.HandleListJobs(hub))
+	r.POST("/api/jobs", server.HandleCreateJob(hub))
+	r.GET("/api/jobs/:id", server.HandleGetJob(hub))
+	r.GET("/api/jobs/:id/result", server.HandleGetSessionResult(hub))
+	r.GET("/api/jobs/:id/artifacts", server.HandleListArtifacts(hub))
+	r.GET("/api/jobs/:id/artifacts/*name", server.HandleArtifactDownload(hub))
+
+	// Approval gates
+	r.GET("/api/approvals", server.HandleListApprovals(hub))
+	r.GET("/api/approvals/:id", server.HandleGetApproval(hub))
+	r.POST("/api/approvals/:id/approve", server.HandleDecideApproval(hub, true))
+	r.POST("/api/approvals/:id/deny", server.HandleDecideApproval(hub, false))
+
+	// Audit trail
+	r.GET("/api/audit", server.HandleQueryAudit(hub))
+	r.GET("/api/audit/verify", server.HandleVerifyAudit(hub))
+
+	// HTTPS when a certificate is configured; rotated certificate files apply to new connections
+	var tlsConfig *tls.Config
+	if cfg.TLS.Cert != "" {
+		pair, err := tlsutil.LoadKeyPair(cfg.TLS.Cert, cfg.TLS.Key, logger)
+		if err != nil {
+			fatal("Invalid TLS config", logging.Err(err))
+		}
+		var clientCAs *x509.CertPool
+		if cfg.TLS.ClientCA != "" {
+			if clientCAs, err = tlsutil.LoadCertPool(cfg.TLS.ClientCA); err != nil {
+				fatal("Invalid TLS config", logging.Err(err))
+			}
+		}
+		tlsConfig = tlsutil.ServerConfig(pair, clientCAs)
+		slog.Info("TLS enabled", "cert", cfg.TLS.Cert, "not_after", pair.Leaf().NotAfter,
+			"client_ca", cfg.TLS.ClientCA, "require_runner_cert", cfg.TLS.RequireRunnerCert)
+	}
+
+	servers := make([]*http.Server, len(cfg.Listen))
+	serveErr := make(chan error, len(cfg.Listen))
+	for i, addr := range cfg.Listen {
+		srv := &http.Server{Addr: addr, Handler: r, TLSConfig: tlsConfig}
+		servers[i] = srv
+		go func() {
+			slog.Info("HQ starting", "addr", addr, "tls", tlsConfig != nil)
+			if tlsConfig != nil {
+				serveErr <- srv.ListenAndServeTLS("", "")
+				return
+			}
+			serveErr <- srv.ListenAndServe()
+		}()
+	}
+
+	// SIGHUP reloads the settings that can change while HQ runs
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig(*configPath, *webDir, cfg, logLevel, hub)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case err := <-serveErr:
+		fatal("HQ stopped serving", logging.Err(err))
+	case <-ctx.Done():
+	}
+	stop()
+
+	slog.Info("Shutdown signal received, closing connections", "timeout", cfg.Shutdown.Timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Shutdown.Timeout)
+	defer cancel()
+
+	// Stop accepting connections while websockets, which the servers do not track, are closed
+	httpDone := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() {
+			httpDone <- srv.Shutdown(shutdownCtx)
+		}()
+	}
+
+	if err := hub.Shutdown(shutdownCtx, cfg.Shutdown.ReconnectDelay); err != nil {
+		slog.Warn("Some connections did not close in time", logging.Err(err))
+	}
+	for range servers {
+		if err := <-httpDone; err != nil {
+			slog.Warn("Some requests did not finish in time", logging.Err(err))
+			for _, srv := range servers {
+				srv.Close()
+			}
+		}
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Warn("Failed to flush traces", logging.Err(err))
+	}
+	slog.Info("HQ stopped")
+}
+
+// reloadConfig applies the configuration file and environment again
+// Only the log level, runner tokens, profiles, approval timeouts, allowed origins and quotas change; a
+// configuration that fails to load leaves the current settings in place
+func reloadConfig(path, webDir string, running *config.HQ, logLevel *slog.LevelVar, hub *server.Hub) {
+	next, err := loadConfig(path, webDir)
+	if err != nil {
+		slog.Error("Failed to reload configuration; keeping the current settings", logging.Err(err))
+		return
+	}
+	if changed := running.RestartRequired(next); len(changed) > 0 {
+		slog.Warn("Changed settings take effect after a restart", "settings", changed)
+	}
+
+	logLevel.Set(next.LogLevel())
+	policy := next.Policy()
+	hub.SetPolicy(policy)
+
+	profiles := 0
+	if policy.Profiles != nil {
+		profiles = len(policy.Profiles.List())
+	}
+	hub.Audit().Record(audit.Event{
+		Type: audit.EventConfigReloaded,
+		Details: map[string]interface{}{
+			"path":          path,
+			"runner_tokens": len(policy.RunnerTokens),
+			"profiles":      profiles,
+		},
+	})
+	slog.Info("Configuration reloaded", "log_level", next.Log.Level, "runner_tokens", len(policy.RunnerTokens),
+		"profiles", profiles, "require_profile", policy.RequireProfile, "allowed_origins", policy.Origins.Allowed,
+		"quotas", next.Quotas)
+}
+
+// loadConfig loads the configuration and applies the command-line flags that override it
+func loadConfig(path, webDir string) (*config.HQ, error) {
+	cfg, err := config.LoadHQ(path)
+	if err != nil {
+		return nil, err
 	}
+	if webDir != "" {
+		cfg.Web.Enabled, cfg.Web.Dir = true, webDir
+	}
+	return cfg, nil
+}
+
+// webUI returns the web UI to serve and where it comes from
+func webUI(dir string) (fs.FS, string, error) {
+	if dir != "" {
+		ui, err := webui.Dir(dir)
+		return ui, dir, err
+	}
+	ui, err := webui.Embedded()
+	return ui, "embedded", err
+}
+
+// openStore creates the configured state store
+func openStore(driver, path string) (store.Store, error) {
+	switch driver {
+	case "memory":
+		slog.Warn("Using in-memory store; state will not survive restarts")
+		return store.NewMemoryStore(), nil
+	case "sqlite":
+		slog.Info("Using SQLite store", "path", path)
+		return store.NewSQLiteStore(path)
+	default:
+		return nil, fmt.Errorf("unknown store driver %q (expected sqlite or memory)", driver)
+	}
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
@@ -1,55 +1,385 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/codervisor/agent-relay/internal/agent"
+	"github.com/codervisor/agent-relay/internal/config"
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/redact"
+	"github.com/codervisor/agent-relay/internal/tlsutil"
+	"github.com/codervisor/agent-relay/internal/tracing"
 )
 
+// traceFlushTimeout bounds how long exiting waits for pending spans to be exported
+const traceFlushTimeout = 5 * time.Second
+
 func main() {
-	// Parse CLI flags
-	hqURL := flag.String("hq-url", getEnv("HQ_URL", "ws://localhost:8080/ws/runner"), "HQ WebSocket URL")
-	runnerID := flag.String("runner-id", getEnv("RUNNER_ID", getHostname()), "Unique runner ID")
-	token := flag.String("token", getEnv("RUNNER_TOKEN", "dev-token"), "Authentication token")
+	// The runner re-executes itself to set up session sandboxes
+	if agent.IsSandboxInit() {
+		agent.SandboxInit()
+	}
+
+	// The file is read first so its settings become the flags' defaults
+	configPath := findConfigFlag(os.Args[1:], os.Getenv("RUNNER_CONFIG"))
+	cfg, err := config.LoadRunner(configPath)
+	if err != nil {
+		// Printed as is: the errors are one per line, and the log format may be what is wrong
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Parse CLI flags; each overrides the file and environment
+	flag.String("config", configPath, "YAML configuration file; environment variables and flags override its settings")
+	flag.Var((*listFlag)(&cfg.HQ.URLs), "hq-url", "Comma-separated HQ WebSocket URLs to connect to, failing over between them")
+	flag.StringVar(&cfg.HQ.Failover, "hq-failover", cfg.HQ.Failover, "Order to try HQ URLs in: ordered or random")
+	flag.StringVar(&cfg.TLS.CA, "tls-ca", cfg.TLS.CA, "PEM bundle to verify HQ's certificate against instead of the system roots")
+	flag.StringVar(&cfg.TLS.Cert, "tls-cert", cfg.TLS.Cert, "Client certificate to present to HQ for mutual TLS")
+	flag.StringVar(&cfg.TLS.Key, "tls-key", cfg.TLS.Key, "Private key for --tls-cert")
+	flag.StringVar(&cfg.RunnerID, "runner-id", cfg.RunnerID, "Unique runner ID")
+	flag.StringVar(&cfg.Token, "token", cfg.Token, "Authentication token")
+	flag.Var((*labelsFlag)(&cfg.Labels), "labels", "Comma-separated key=value labels agent profiles can require")
+	flag.IntVar(&cfg.Sessions.Max, "max-sessions", cfg.Sessions.Max, "Sessions to run at once; more are refused (0 = no limit)")
+	flag.Var((*listFlag)(&cfg.Sessions.AllowedCommands), "allowed-commands", "Comma-separated programs sessions may run (default: any)")
+	flag.Var((*listFlag)(&cfg.Redaction.Env), "redact-env", "Comma-separated env vars whose values are masked in output")
+	flag.BoolFunc("no-redact", "Disable secret redaction of PTY output", disable(&cfg.Redaction.Enabled))
+	flag.Var((*appendFlag)(&cfg.Redaction.Patterns), "redact-pattern", "Additional regex to mask in output (repeatable)")
+	flag.Var((*listFlag)(&cfg.Transfers.AllowedPaths), "allowed-paths", "Comma-separated directories HQ may upload to and download from")
+	flag.Int64Var(&cfg.Transfers.MaxSize, "max-transfer-size", cfg.Transfers.MaxSize, "Largest file or directory archive to transfer, in bytes (0 = no limit)")
+	flag.BoolFunc("no-file-transfer", "Refuse file uploads and downloads", disable(&cfg.Transfers.Enabled))
+	flag.StringVar(&cfg.Workspaces.Dir, "workspace-dir", cfg.Workspaces.Dir, "Directory for per-session git checkouts and the mirror cache")
+	flag.StringVar(&cfg.Workspaces.Retain, "workspace-retain", cfg.Workspaces.Retain, "Keep session workspaces: never, on-failure or always")
+	flag.BoolFunc("no-workspace-cache", "Clone every workspace instead of adding worktrees from a mirror cache", disable(&cfg.Workspaces.Cache))
+	flag.BoolFunc("no-workspaces", "Refuse sessions that request a git workspace", disable(&cfg.Workspaces.Enabled))
+	flag.StringVar(&cfg.Limits.Mode, "limits", cfg.Limits.Mode, "Enforce session resource limits with: auto, cgroup, rlimit or off")
+	flag.StringVar(&cfg.Limits.CgroupRoot, "cgroup-root", cfg.Limits.CgroupRoot, "cgroup v2 directory to create session cgroups under (default: the runner's own cgroup)")
+	flag.StringVar(&cfg.Approvals.Dir, "approvals-dir", cfg.Approvals.Dir, "Directory for the sockets sessions ask for human approval on")
+	flag.BoolFunc("no-approvals", "Give sessions no approval socket, so every approval request is denied", disable(&cfg.Approvals.Enabled))
+	flag.DurationVar(&cfg.Idle.Timeout, "idle-timeout", cfg.Idle.Timeout, "Close interactive sessions with no input or output for this long (0 = never)")
+	flag.DurationVar(&cfg.Idle.InputTimeout, "input-idle-timeout", cfg.Idle.InputTimeout, "Close interactive sessions with no input for this long, even while they produce output (0 = never)")
+	flag.DurationVar(&cfg.Idle.Warning, "idle-warning", cfg.Idle.Warning, "How long before closing an idle session to warn in its terminal")
+	flag.DurationVar(&cfg.Drain.Timeout, "drain-timeout", cfg.Drain.Timeout, "How long a drain waits for sessions before killing them (0 = indefinitely)")
+	flag.BoolVar(&cfg.Drain.OnSIGTERM, "drain-on-sigterm", cfg.Drain.OnSIGTERM, "Drain on SIGTERM instead of killing sessions right away")
+	flag.StringVar(&cfg.MetricsAddr, "metrics-addr", cfg.MetricsAddr, "Address to serve Prometheus metrics on, e.g. :9090 (default: off)")
+	flag.BoolVar(&cfg.Sandbox.Enabled, "sandbox", cfg.Sandbox.Enabled, "Run sessions in Linux namespaces with a read-only root filesystem")
+	flag.StringVar(&cfg.Sandbox.Network, "sandbox-network", cfg.Sandbox.Network, "Network sandboxed sessions see: none, loopback or host")
+	flag.Var((*listFlag)(&cfg.Sandbox.Hide), "sandbox-hide", "Comma-separated paths hidden from sandboxed sessions")
+	flag.Var((*listFlag)(&cfg.Sandbox.Writable), "sandbox-writable", "Comma-separated paths sandboxed sessions may write besides their workspace and /tmp")
+	flag.StringVar(&cfg.Log.Format, "log-format", cfg.Log.Format, "Log output format: text or json")
+	flag.StringVar(&cfg.Log.Level, "log-level", cfg.Log.Level, "Minimum log level: debug, info, warn or error")
+	flag.StringVar(&cfg.Tracing.Exporter, "traces-exporter", cfg.Tracing.Exporter, "Where session startup traces go: otlp, console or none")
 	flag.Parse()
 
-	log.Printf("Runner starting...")
-	log.Printf("  Runner ID: %s", *runnerID)
-	log.Printf("  HQ URL: %s", *hqURL)
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	logger, err := logging.New(os.Stderr, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		fatal("Invalid logging config", logging.Err(err))
+	}
+	// Code without a logger of its own, and the standard log package, still name the runner
+	slog.SetDefault(logger.With(logging.RunnerID(cfg.RunnerID)))
+
+	shutdownTracing, err := tracing.Setup(context.Background(), "agent-relay-runner", cfg.Tracing.Exporter, os.Stdout)
+	if err != nil {
+		fatal("Invalid tracing config", logging.Err(err))
+	}
+	flushTraces := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), traceFlushTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Warn("Failed to flush traces", logging.Err(err))
+		}
+	}
+
+	slog.Info("Runner starting", "hq_urls", cfg.HQ.URLs, "failover", cfg.HQ.Failover)
+	if configPath != "" {
+		slog.Info("Configuration loaded", "path", configPath)
+	}
+
+	opts := []agent.ClientOption{
+		agent.WithLogger(logger),
+		agent.WithFailover(agent.Failover(cfg.HQ.Failover)),
+		agent.WithSpawnPolicy(cfg.SpawnPolicy()),
+	}
+	if cfg.TLS != (config.ClientTLSConfig{}) {
+		var rootCAs *x509.CertPool
+		if cfg.TLS.CA != "" {
+			if rootCAs, err = tlsutil.LoadCertPool(cfg.TLS.CA); err != nil {
+				fatal("Invalid TLS config", logging.Err(err))
+			}
+		}
+		var pair *tlsutil.KeyPair
+		if cfg.TLS.Cert != "" {
+			if pair, err = tlsutil.LoadKeyPair(cfg.TLS.Cert, cfg.TLS.Key, logger); err != nil {
+				fatal("Invalid TLS config", logging.Err(err))
+			}
+			slog.Info("Client certificate loaded", "cert", cfg.TLS.Cert, "identities", tlsutil.Identities(pair.Leaf()),
+				"not_after", pair.Leaf().NotAfter)
+		}
+		opts = append(opts, agent.WithTLS(tlsutil.ClientConfig(rootCAs, pair)))
+	}
+	if len(cfg.Labels) > 0 {
+		slog.Info("Labels", "labels", cfg.Labels)
+		opts = append(opts, agent.WithLabels(cfg.Labels))
+	}
+	if cfg.Sessions.Max > 0 || len(cfg.Sessions.AllowedCommands) > 0 {
+		slog.Info("Spawn policy", "max_sessions", cfg.Sessions.Max, "allowed_commands", cfg.Sessions.AllowedCommands)
+	}
+	if cfg.Redaction.Enabled {
+		redactor, err := redact.New(redact.Config{
+			EnvVars:  cfg.Redaction.Env,
+			Values:   []string{cfg.Token},
+			Patterns: cfg.Redaction.Patterns,
+		})
+		if err != nil {
+			fatal("Invalid redaction config", logging.Err(err))
+		}
+		opts = append(opts, agent.WithRedactor(redactor))
+	}
+
+	// Allowed paths bound file transfers and the local repositories workspaces may clone
+	var paths *agent.PathPolicy
+	if cfg.Transfers.Enabled || cfg.Workspaces.Enabled {
+		var err error
+		paths, err = agent.NewPathPolicy(cfg.Transfers.AllowedPaths)
+		if err != nil {
+			fatal("Invalid allowed paths", logging.Err(err))
+		}
+	}
+
+	if cfg.Transfers.Enabled {
+		slog.Info("File transfers enabled", "allowed_paths", paths.Roots())
+		opts = append(opts, agent.WithFileTransfers(paths, cfg.Transfers.MaxSize))
+	}
+
+	// The runner's config (which may hold its token), its TLS key, other sessions' workspaces
+	// and approval sockets are always hidden from a sandboxed session
+	hidden := slices.Clone(cfg.Sandbox.Hide)
+	for _, path := range []string{configPath, cfg.TLS.Key} {
+		if path != "" {
+			hidden = append(hidden, path)
+		}
+	}
+
+	if cfg.Workspaces.Enabled {
+		workspaces, err := agent.NewWorkspaceManager(cfg.Workspaces.Dir, agent.WorkspaceOptions{
+			Cache:      cfg.Workspaces.Cache,
+			Isolated:   cfg.Sandbox.Enabled,
+			Retain:     agent.WorkspaceRetention(cfg.Workspaces.Retain),
+			LocalRepos: paths,
+			Logger:     logger,
+		})
+		switch {
+		case errors.Is(err, agent.ErrGitNotFound):
+			slog.Warn("Workspaces disabled", logging.Err(err))
+		case err != nil:
+			fatal("Invalid workspace config", logging.Err(err))
+		default:
+			slog.Info("Workspaces enabled", "dir", workspaces.Root(), "retain", cfg.Workspaces.Retain)
+			opts = append(opts, agent.WithWorkspaces(workspaces))
+			hidden = append(hidden, workspaces.Root())
+		}
+	}
+
+	if cfg.Approvals.Enabled {
+		dir, err := filepath.Abs(cfg.Approvals.Dir)
+		if err != nil {
+			fatal("Invalid approvals directory", logging.Err(err))
+		}
+		slog.Info("Approvals enabled", "dir", dir)
+		opts = append(opts, agent.WithApprovals(dir))
+		hidden = append(hidden, dir)
+	}
+
+	idle := cfg.IdlePolicy()
+	if idle.Timeout > 0 || idle.InputTimeout > 0 {
+		slog.Info("Idle sessions are closed", "idle_timeout", idle.Timeout, "input_idle_timeout", idle.InputTimeout)
+		opts = append(opts, agent.WithIdlePolicy(idle))
+	}
+
+	limiter, err := agent.NewLimiter(agent.LimitMode(cfg.Limits.Mode), cfg.Limits.CgroupRoot, logger)
+	switch {
+	case errors.Is(err, agent.ErrLimitsUnsupported):
+		slog.Warn("Resource limits disabled", logging.Err(err))
+	case err != nil:
+		fatal("Invalid resource limit config", logging.Err(err))
+	case limiter == nil:
+		slog.Info("Resource limits off")
+	case limiter.Mode() == agent.LimitsCgroup:
+		slog.Info("Resource limits enforced", "mode", limiter.Mode(), "cgroup_root", limiter.Root())
+		opts = append(opts, agent.WithLimiter(limiter))
+	default:
+		slog.Info("Resource limits enforced", "mode", limiter.Mode())
+		opts = append(opts, agent.WithLimiter(limiter))
+	}
+
+	if cfg.Sandbox.Enabled {
+		sb, err := agent.NewSandbox(agent.SandboxOptions{
+			Network:  agent.SandboxNetwork(cfg.Sandbox.Network),
+			Hidden:   hidden,
+			Writable: cfg.Sandbox.Writable,
+			HideEnv:  []string{"RUNNER_TOKEN"},
+		})
+		if err != nil {
+			fatal("Invalid sandbox config", logging.Err(err))
+		}
+		slog.Info("Sandbox enabled", "network", sb.Network())
+		opts = append(opts, agent.WithSandbox(sb))
+	}
+
+	opts = append(opts, agent.WithDrainTimeout(cfg.Drain.Timeout))
 
 	// Create client
-	client := agent.NewClient(*hqURL, *runnerID, *token)
+	client := agent.NewClient(cfg.HQ.URLs, cfg.RunnerID, cfg.Token, opts...)
+
+	if cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", client.MetricsHandler())
+		listener, err := net.Listen("tcp", cfg.MetricsAddr)
+		if err != nil {
+			fatal("Failed to listen for metrics", logging.Err(err))
+		}
+		slog.Info("Serving metrics", "url", "http://"+listener.Addr().String()+"/metrics")
+		go func() {
+			if err := http.Serve(listener, mux); err != nil {
+				slog.Error("Metrics listener stopped", logging.Err(err))
+			}
+		}()
+	}
 
-	// Handle shutdown signals
+	// Handle shutdown signals; drain signals let running sessions finish first,
+	// and a second signal of any kind while draining closes right away
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sigChan, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, drainSignals...)...)
 
 	go func() {
-		<-sigChan
-		log.Printf("Shutdown signal received, closing...")
-		client.Close()
-		os.Exit(0)
+		for sig := range sigChan {
+			drain := isDrainSignal(sig) || (sig == syscall.SIGTERM && cfg.Drain.OnSIGTERM)
+			if drain && !client.Draining() {
+				slog.Info("Signal received, draining", "signal", sig)
+				go client.Drain(cfg.Drain.Timeout)
+				continue
+			}
+			slog.Info("Shutdown signal received, closing", "signal", sig)
+			client.Close()
+			flushTraces()
+			os.Exit(0)
+		}
 	}()
 
 	// Run client (blocks until closed)
 	client.Run()
+	flushTraces()
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// findConfigFlag returns the --config flag's value from args, ahead of flag parsing, or fallback if it is not given
+func findConfigFlag(args []string, fallback string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			break // Flags end here, as they do for the flag package
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
+		}
+		if i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return fallback
 }
 
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// listFlag sets a comma-separated list, replacing its previous value
+type listFlag []string
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
 	}
-	return defaultValue
+	return strings.Join(*l, ",")
 }
 
-func getHostname() string {
-	hostname, err := os.Hostname()
+func (l *listFlag) Set(value string) error {
+	*l = config.SplitList(value)
+	return nil
+}
+
+// appendFlag is a repeatable flag adding to a list
+type appendFlag []string
+
+func (a *appendFlag) String() string {
+	if a == nil {
+		return ""
+	}
+	return strings.Join(*a, " ")
+}
+
+func (a *appendFlag) Set(value string) error {
+	*a = append(*a, value)
+	return nil
+}
+
+// labelsFlag sets labels from comma-separated key=value pairs
+type labelsFlag map[string]string
+
+func (l *labelsFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*l))
+	for key, value := range *l {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (l *labelsFlag) Set(value string) error {
+	labels, err := config.ParseLabels(value)
 	if err != nil {
-		return "unknown-runner"
+		return err
+	}
+	*l = labels
+	return nil
+}
+
+// disable returns a --no-* flag's handler, which turns an enabled setting off
+func disable(enabled *bool) func(string) error {
+	return func(value string) error {
+		disabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*enabled = !disabled
+		return nil
 	}
-	return hostname
 }
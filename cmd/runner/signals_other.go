@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// drainSignals is empty where SIGUSR1 does not exist; --drain-on-sigterm still works
+var drainSignals []os.Signal
+
+func isDrainSignal(os.Signal) bool {
+	return false
+}
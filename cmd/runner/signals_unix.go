@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// drainSignals start a drain regardless of --drain-on-sigterm
+var drainSignals = []os.Signal{syscall.SIGUSR1}
+
+func isDrainSignal(sig os.Signal) bool {
+	return sig == syscall.SIGUSR1
+}
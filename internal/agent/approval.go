@@ -0,0 +1,273 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/google/uuid"
+)
+
+// ApprovalSocketEnv points a session at the Unix socket it asks for approvals on
+const ApprovalSocketEnv = "AGENT_RELAY_APPROVAL_SOCKET"
+
+const (
+	approvalSocketName = "approval.sock"
+	approvalReadLimit  = 64 * 1024        // Largest request a session may send
+	approvalReadWait   = 10 * time.Second // How long a session has to send its request after connecting
+	approvalGrace      = 30 * time.Second // Extra wait past the requested timeout before the runner gives up on HQ
+)
+
+// ApprovalQuery is the request a session writes to its approval socket as one JSON line
+type ApprovalQuery struct {
+	Action  string `json:"action"`
+	Details string `json:"details,omitempty"`
+	Timeout int    `json:"timeout,omitempty"` // Seconds; HQ applies its default and cap
+}
+
+// ApprovalAnswer is the runner's reply on the approval socket
+type ApprovalAnswer struct {
+	Approved  bool   `json:"approved"`
+	Status    string `json:"status"` // approved, denied, expired or cancelled
+	Reason    string `json:"reason,omitempty"`
+	DecidedBy string `json:"decided_by,omitempty"`
+}
+
+// RequestApproval asks for approval on the socket at path and blocks until it is answered
+// The connection must stay open while waiting; hanging up withdraws the request
+// An error means no answer arrived and must be treated as a denial
+func RequestApproval(ctx context.Context, path string, query ApprovalQuery) (ApprovalAnswer, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", path)
+	if err != nil {
+		return ApprovalAnswer{}, fmt.Errorf("failed to reach approval socket: %w", err)
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := json.NewEncoder(conn).Encode(query); err != nil {
+		return ApprovalAnswer{}, fmt.Errorf("failed to send approval request: %w", err)
+	}
+
+	var answer ApprovalAnswer
+	if err := json.NewDecoder(conn).Decode(&answer); err != nil {
+		if ctx.Err() != nil {
+			return ApprovalAnswer{}, ctx.Err()
+		}
+		return ApprovalAnswer{}, fmt.Errorf("failed to read approval answer: %w", err)
+	}
+	return answer, nil
+}
+
+// WithApprovals gives every session a socket under dir for asking a human to approve actions
+func WithApprovals(dir string) ClientOption {
+	return func(c *Client) {
+		c.approvalDir = dir
+	}
+}
+
+// approvalWait is a session blocked on an approval_decision from HQ
+type approvalWait struct {
+	sessionID string
+	decision  chan protocol.ApprovalDecisionPayload
+}
+
+// approvalGate is the socket a single session asks for approvals on
+type approvalGate struct {
+	sessionID string
+	dir       string
+	listener  net.Listener
+}
+
+// openApprovalGate creates a session's approval socket and starts serving it
+func (c *Client) openApprovalGate(sessionID string) (*approvalGate, error) {
+	if err := os.MkdirAll(c.approvalDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create approval directory: %w", err)
+	}
+
+	// One directory per session so a sandbox can expose just this socket
+	dir := filepath.Join(c.approvalDir, sessionID)
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create approval directory: %w", err)
+	}
+
+	listener, err := net.Listen("unix", filepath.Join(dir, approvalSocketName))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to listen for approvals: %w", err)
+	}
+
+	g := &approvalGate{sessionID: sessionID, dir: dir, listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go c.serveApproval(sessionID, conn)
+		}
+	}()
+	return g, nil
+}
+
+// path returns the socket's path, as exported to the session
+func (g *approvalGate) path() string {
+	return filepath.Join(g.dir, approvalSocketName)
+}
+
+// close stops accepting requests and removes the socket
+func (g *approvalGate) close() {
+	g.listener.Close()
+	os.RemoveAll(g.dir)
+}
+
+// approvalLog returns the logger for a session's approval requests
+func (c *Client) approvalLog(sessionID string) *slog.Logger {
+	return logging.Component(c.logger, "approval").With(logging.SessionID(sessionID))
+}
+
+// serveApproval answers one approval request from a session
+func (c *Client) serveApproval(sessionID string, conn net.Conn) {
+	defer conn.Close()
+
+	reply := func(answer ApprovalAnswer) {
+		if err := json.NewEncoder(conn).Encode(answer); err != nil {
+			c.approvalLog(sessionID).Warn("Failed to answer session", logging.Err(err))
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(approvalReadWait))
+	reader := bufio.NewReader(io.LimitReader(conn, approvalReadLimit))
+	line, err := reader.ReadBytes('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && len(line) > 0) {
+		reply(denied("unreadable approval request"))
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var query ApprovalQuery
+	if err := json.Unmarshal(line, &query); err != nil || query.Action == "" {
+		reply(denied("approval request needs an action"))
+		return
+	}
+
+	// The session hanging up withdraws the request
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	reply(c.awaitApproval(sessionID, query, gone))
+}
+
+// awaitApproval forwards a request to HQ and blocks until it is decided
+// Anything but an explicit approval, including losing HQ, is a denial
+func (c *Client) awaitApproval(sessionID string, query ApprovalQuery, gone <-chan struct{}) ApprovalAnswer {
+	id := uuid.NewString()
+	wait := &approvalWait{sessionID: sessionID, decision: make(chan protocol.ApprovalDecisionPayload, 1)}
+
+	c.approvalMu.Lock()
+	c.approvals[id] = wait
+	c.approvalMu.Unlock()
+
+	defer func() {
+		c.approvalMu.Lock()
+		delete(c.approvals, id)
+		c.approvalMu.Unlock()
+	}()
+
+	logger := c.approvalLog(sessionID).With("approval_id", id)
+	logger.Info("Session requests approval", "action", query.Action)
+	err := c.writeJSON(protocol.Message{
+		Type: protocol.MessageTypeApprovalRequest,
+		Payload: protocol.ApprovalRequestPayload{
+			ApprovalID: id,
+			SessionID:  sessionID,
+			Action:     query.Action,
+			Details:    query.Details,
+			Timeout:    query.Timeout,
+		},
+	})
+	if err != nil {
+		logger.Warn("Failed to send approval request", logging.Err(err))
+		return denied("hq is unreachable")
+	}
+
+	// HQ enforces the timeout; this only guards against never hearing back
+	var backstop <-chan time.Time
+	if query.Timeout > 0 {
+		timer := time.NewTimer(time.Duration(query.Timeout)*time.Second + approvalGrace)
+		defer timer.Stop()
+		backstop = timer.C
+	}
+
+	select {
+	case d := <-wait.decision:
+		logger.Info("Approval decided", "status", d.Status, "reason", d.Reason, "decided_by", d.DecidedBy)
+		status := d.Status
+		if status == "" {
+			status = "denied"
+		}
+		return ApprovalAnswer{Approved: d.Approved, Status: status, Reason: d.Reason, DecidedBy: d.DecidedBy}
+	case <-backstop:
+		logger.Warn("No decision from HQ")
+		return ApprovalAnswer{Status: "expired", Reason: "no decision from hq"}
+	case <-gone:
+		logger.Info("Session withdrew approval request")
+		return denied("withdrawn")
+	}
+}
+
+// handleApprovalDecision unblocks the session waiting on a decision
+func (c *Client) handleApprovalDecision(msg protocol.Message) {
+	var payload protocol.ApprovalDecisionPayload
+	if err := protocol.DecodePayload(msg, &payload); err != nil {
+		c.connLog.Warn("Malformed message", "type", msg.Type, logging.Err(err))
+		return
+	}
+
+	c.approvalMu.Lock()
+	wait, exists := c.approvals[payload.ApprovalID]
+	c.approvalMu.Unlock()
+
+	if !exists {
+		return
+	}
+	select {
+	case wait.decision <- payload:
+	default:
+	}
+}
+
+// denyApprovals answers every pending request that matches with a denial
+func (c *Client) denyApprovals(match func(sessionID string) bool, status, reason string) {
+	c.approvalMu.Lock()
+	defer c.approvalMu.Unlock()
+
+	for id, wait := range c.approvals {
+		if !match(wait.sessionID) {
+			continue
+		}
+		select {
+		case wait.decision <- protocol.ApprovalDecisionPayload{ApprovalID: id, Status: status, Reason: reason}:
+		default:
+		}
+	}
+}
+
+func denied(reason string) ApprovalAnswer {
+	return ApprovalAnswer{Status: "denied", Reason: reason}
+}
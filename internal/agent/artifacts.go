@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/google/uuid"
+)
+
+// maxArtifacts bounds how many files a single session may send
+const maxArtifacts = 1000
+
+// collectArtifacts sends files matching a session's artifact patterns to HQ
+// Runs after the process exits and before session_ended; returns the number sent.
+// A workspace cwd was already confined to its checkout, so the allowed paths do not apply
+func (c *Client) collectArtifacts(sessionID, cwd string, patterns []string, inWorkspace bool) int {
+	if len(patterns) == 0 {
+		return 0
+	}
+	logger := c.sessionLog(sessionID)
+	if c.paths == nil {
+		logger.Warn("Not collecting artifacts: file transfers are disabled")
+		return 0
+	}
+
+	var valid []string
+	for _, pattern := range patterns {
+		if !validPattern(pattern) {
+			logger.Warn("Ignoring invalid artifact pattern", "pattern", pattern)
+			continue
+		}
+		valid = append(valid, pattern)
+	}
+
+	// The PTY starts in the runner's own directory when no cwd is given
+	if cwd == "" {
+		cwd = "."
+	}
+	dir, err := filepath.Abs(cwd)
+	if err == nil && !inWorkspace {
+		dir, err = c.paths.Resolve(dir)
+	}
+	if err != nil {
+		logger.Warn("Not collecting artifacts", logging.Err(err))
+		return 0
+	}
+
+	names, err := findArtifacts(dir, valid)
+	if err != nil {
+		logger.Warn("Failed to search for artifacts", "dir", dir, logging.Err(err))
+	}
+
+	sent := 0
+	for _, name := range names {
+		if err := c.sendArtifact(sessionID, dir, name); err != nil {
+			logger.Warn("Failed to send artifact", "artifact", name, logging.Err(err))
+			continue
+		}
+		sent++
+	}
+
+	logger.Info("Sent artifacts", "artifacts", sent)
+	return sent
+}
+
+// sendArtifact streams one file as artifact, chunks and file_end
+func (c *Client) sendArtifact(sessionID, dir, name string) error {
+	filePath := filepath.Join(dir, filepath.FromSlash(name))
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if c.maxTransferSize > 0 && info.Size() > c.maxTransferSize {
+		return fmt.Errorf("size %d exceeds the runner's limit of %d bytes", info.Size(), c.maxTransferSize)
+	}
+
+	id := uuid.NewString()
+	if err := c.writeJSON(protocol.Message{
+		Type: protocol.MessageTypeArtifact,
+		Payload: protocol.ArtifactPayload{
+			SessionID:  sessionID,
+			TransferID: id,
+			Name:       name,
+			Size:       info.Size(),
+		},
+	}); err != nil {
+		return err
+	}
+
+	w := &chunkWriter{
+		client: c,
+		id:     id,
+		hash:   sha256.New(),
+		limit:  c.maxTransferSize,
+	}
+	err = copyFile(w, filePath, info.Size())
+	if err == nil {
+		err = w.flush()
+	}
+	if err != nil {
+		c.sendTransferError(id, err)
+		return err
+	}
+
+	return c.writeJSON(protocol.Message{
+		Type: protocol.MessageTypeFileEnd,
+		Payload: protocol.FileEndPayload{
+			TransferID: id,
+			Size:       w.size,
+			SHA256:     hex.EncodeToString(w.hash.Sum(nil)),
+		},
+	})
+}
+
+// findArtifacts walks dir for regular files matching any pattern
+// Symlinks are not followed, so matches cannot lead outside dir
+func findArtifacts(dir string, patterns []string) ([]string, error) {
+	var names []string
+	if len(patterns) == 0 {
+		return names, nil
+	}
+
+	err := filepath.WalkDir(dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			// Skip unreadable subdirectories rather than abandon the search
+			if p == dir {
+				return err
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+
+		for _, pattern := range patterns {
+			if matchPattern(pattern, name) {
+				names = append(names, name)
+				break
+			}
+		}
+		if len(names) >= maxArtifacts {
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return names, err
+}
+
+// validPattern rejects malformed patterns and those that could reach outside the working directory
+func validPattern(pattern string) bool {
+	if pattern == "" || path.IsAbs(pattern) {
+		return false
+	}
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment == ".." {
+			return false
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPattern reports whether a slash-separated name matches a glob pattern
+// "**" matches any number of directories; other segments follow path.Match
+func matchPattern(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,58 @@
+package agent
+
+import "testing"
+
+func TestValidPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{"*.log", true},
+		{"dist/**", true},
+		{"**/*.xml", true},
+		{"reports/[a-z]*.json", true},
+		{"", false},
+		{"/etc/*", false},
+		{"../*", false},
+		{"dist/../../*", false},
+		{"reports/[a-z.json", false},
+	}
+
+	for _, tt := range tests {
+		if got := validPattern(tt.pattern); got != tt.want {
+			t.Errorf("validPattern(%q) = %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.log", "build.log", true},
+		{"*.log", "logs/build.log", false},
+		{"dist/*", "dist/app", true},
+		{"dist/*", "dist/sub/app", false},
+		{"dist/**", "dist/sub/app", true},
+		{"dist/**", "dist/app", true},
+		{"dist/**", "other/app", false},
+		{"**/*.xml", "report.xml", true},
+		{"**/*.xml", "a/b/c/report.xml", true},
+		{"**/*.xml", "a/b/report.json", false},
+		{"a/**/b/*.txt", "a/b/x.txt", true},
+		{"a/**/b/*.txt", "a/x/y/b/x.txt", true},
+		{"a/**/b/*.txt", "a/x/y/c/x.txt", false},
+		{"report.json", "report.json", true},
+		{"report.json", "reports.json", false},
+		{"reports/[a-z]*.json", "reports/daily.json", true},
+		{"reports/[a-z]*.json", "reports/1.json", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
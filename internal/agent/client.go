@@ -1,19 +1,41 @@
 package agent
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/codervisor/agent-relay/internal/logging"
 	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/codervisor/agent-relay/internal/redact"
+	"github.com/codervisor/agent-relay/internal/tracing"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// outputDrainTimeout bounds how long session_ended waits for trailing output
+// Background processes can hold the PTY open after the main process exits
+const outputDrainTimeout = time.Second
+
+// reconnectDelay is how long the runner waits between attempts to reach HQ
+const reconnectDelay = 5 * time.Second
+
+var tracer = tracing.Tracer("agent")
+
 // Client manages the runner's connection to HQ
 type Client struct {
-	hqURL     string
+	hqURLs    []string
+	failover  Failover
+	dialer    websocket.Dialer
 	runnerID  string
 	token     string
 	conn      *websocket.Conn
@@ -22,29 +44,152 @@ type Client struct {
 	writeMu   sync.Mutex
 	reconnect bool
 	closed    bool
+	redactor  *redact.Redactor
+	metrics   *clientMetrics
+	logger    *slog.Logger // Carries the runner ID; each component's logger derives from it
+	log       *slog.Logger
+	epoch     atomic.Uint64 // Connections made to HQ, counted from 1
+
+	// log plus the current connection's epoch; only touched by the Run goroutine
+	connLog *slog.Logger
+
+	// The HQ connected to, and one that announced its shutdown; only touched by the Run goroutine
+	hqURL       string
+	shutdownURL string
+
+	// Set by server_shutdown for the next reconnect; only touched by the Run goroutine
+	reconnectAfter time.Duration
+
+	paths           *PathPolicy // nil disables file transfers
+	maxTransferSize int64
+	uploads         map[string]*upload
+	downloads       map[string]*download
+	transferMu      sync.Mutex
+
+	workspaces *WorkspaceManager // nil disables workspace provisioning
+	limiter    *Limiter          // nil ignores session resource limits
+	sandbox    *Sandbox          // nil runs sessions as plain child processes
+	labels     map[string]string
+
+	approvalDir string // Empty disables approval sockets
+	approvals   map[string]*approvalWait
+	approvalMu  sync.Mutex
+
+	idle IdlePolicy
+
+	spawn SpawnPolicy
+
+	draining      bool
+	drainDeadline time.Time      // Zero when draining without a deadline
+	drainTimeout  time.Duration  // Used for drains HQ asks for without a timeout
+	drainKilled   atomic.Bool    // The drain deadline passed and running sessions were killed
+	running       sync.WaitGroup // Accepted sessions until their session_ended is sent
+	accepted      int            // Accepted sessions not yet counted out; guarded by mu
+}
+
+// ClientOption configures optional Client behavior
+type ClientOption func(*Client)
+
+// WithRedactor masks secrets in PTY output before it leaves the runner
+func WithRedactor(r *redact.Redactor) ClientOption {
+	return func(c *Client) {
+		c.redactor = r
+	}
+}
+
+// WithLabels advertises attributes that agent profiles can require
+func WithLabels(labels map[string]string) ClientOption {
+	return func(c *Client) {
+		c.labels = labels
+	}
+}
+
+// WithLogger writes the client's logs to logger instead of slog's default
+func WithLogger(logger *slog.Logger) ClientOption {
+	return func(c *Client) {
+		c.logger = logger
+	}
+}
+
+// WithTLS verifies HQ and presents a client certificate as cfg says when connecting over wss://
+func WithTLS(cfg *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.dialer.TLSClientConfig = cfg
+	}
 }
 
-// NewClient creates a new runner client
-func NewClient(hqURL, runnerID, token string) *Client {
-	return &Client{
-		hqURL:     hqURL,
+// NewClient creates a new runner client that connects to one of hqURLs
+func NewClient(hqURLs []string, runnerID, token string, opts ...ClientOption) *Client {
+	c := &Client{
+		hqURLs:    hqURLs,
+		failover:  FailoverOrdered,
+		dialer:    *websocket.DefaultDialer,
 		runnerID:  runnerID,
 		token:     token,
 		sessions:  make(map[string]*PTY),
+		uploads:   make(map[string]*upload),
+		downloads: make(map[string]*download),
+		approvals: make(map[string]*approvalWait),
 		reconnect: true,
 	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.logger == nil {
+		c.logger = slog.Default()
+	}
+	c.logger = c.logger.With(logging.RunnerID(runnerID))
+	c.log = logging.Component(c.logger, "client")
+	c.connLog = c.log
+	c.metrics = newClientMetrics(c)
+
+	return c
 }
 
-// Connect establishes connection to HQ and registers
+// sessionLog returns the logger for one session's events
+func (c *Client) sessionLog(sessionID string) *slog.Logger {
+	return c.log.With(logging.SessionID(sessionID))
+}
+
+// Connect establishes a connection to the first HQ URL that accepts one and registers
 func (c *Client) Connect() error {
-	log.Printf("[Client] Connecting to HQ: %s", c.hqURL)
+	urls := c.connectOrder()
+	if len(urls) == 1 {
+		return c.connectTo(urls[0])
+	}
 
-	conn, _, err := websocket.DefaultDialer.Dial(c.hqURL, nil)
+	for _, url := range urls {
+		err := c.connectTo(url)
+		if err == nil {
+			return nil
+		}
+		c.log.Warn("Failed to reach HQ", "url", url, logging.Err(err))
+	}
+	return fmt.Errorf("none of the %d HQ URLs could be reached", len(urls))
+}
+
+// connectTo connects to the HQ at url and registers
+func (c *Client) connectTo(url string) error {
+	c.log.Info("Connecting to HQ", "url", url)
+
+	conn, resp, err := c.dialer.Dial(url, nil)
 	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+			// HQ limits registration attempts; waiting as long as it asks avoids being refused again
+			if seconds, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil {
+				c.reconnectAfter = max(c.reconnectAfter, time.Duration(seconds)*time.Second)
+			}
+			return fmt.Errorf("failed to connect to HQ: %w (%s)", err, resp.Status)
+		}
 		return fmt.Errorf("failed to connect to HQ: %w", err)
 	}
 
 	c.conn = conn
+	c.connLog = c.log.With(logging.Epoch(c.epoch.Add(1)))
+	if len(c.hqURLs) > 1 {
+		c.connLog = c.connLog.With("hq_url", url)
+	}
 
 	// Send registration message
 	if err := c.register(); err != nil {
@@ -52,7 +197,12 @@ func (c *Client) Connect() error {
 		return err
 	}
 
-	log.Printf("[Client] Successfully registered with HQ as %s", c.runnerID)
+	c.hqURL = url
+	c.reconnectAfter = 0
+	if url != c.shutdownURL {
+		c.shutdownURL = ""
+	}
+	c.connLog.Info("Registered with HQ")
 	return nil
 }
 
@@ -63,6 +213,9 @@ func (c *Client) register() error {
 		Payload: protocol.RegisterPayload{
 			RunnerID: c.runnerID,
 			Token:    c.token,
+			Labels:   c.labels,
+			Epoch:    c.epoch.Load(),
+			Draining: c.drainStatus(),
 		},
 	}
 
@@ -75,27 +228,42 @@ func (c *Client) register() error {
 
 // Run starts the main message handling loop
 func (c *Client) Run() {
-	for c.reconnect && !c.closed {
+	for attempt := 0; c.reconnect && !c.closed; attempt++ {
+		if attempt > 0 {
+			c.metrics.reconnects.Inc()
+		}
 		if err := c.Connect(); err != nil {
-			log.Printf("[Client] Connection failed: %v. Retrying in 5s...", err)
-			time.Sleep(5 * time.Second)
+			delay := max(reconnectDelay, c.reconnectAfter)
+			c.reconnectAfter = 0
+			c.log.Warn("Connection failed, retrying", "retry_in", delay, logging.Err(err))
+			time.Sleep(delay)
 			continue
 		}
 
 		// Handle messages until connection closes
 		c.handleMessages()
 
-		// Clean up connection
+		// Clean up connection; transfers cannot resume on a new one
 		c.conn.Close()
+		c.abortTransfers()
+		c.denyApprovals(func(string) bool { return true }, "cancelled", "lost connection to hq")
 
 		// Retry connection if not explicitly closed
 		if c.reconnect && !c.closed {
-			log.Printf("[Client] Connection lost. Reconnecting in 5s...")
-			time.Sleep(5 * time.Second)
+			delay := reconnectDelay
+			if c.reconnectAfter > 0 {
+				delay, c.reconnectAfter = c.reconnectAfter, 0
+				if len(c.hqURLs) > 1 {
+					// Another HQ can take the runner now; the one shutting down is tried last
+					c.shutdownURL, delay = c.hqURL, 0
+				}
+			}
+			c.connLog.Warn("Connection lost, reconnecting", "retry_in", delay)
+			time.Sleep(delay)
 		}
 	}
 
-	log.Printf("[Client] Client stopped")
+	c.log.Info("Client stopped")
 }
 
 // handleMessages processes incoming messages from HQ
@@ -103,8 +271,8 @@ func (c *Client) handleMessages() {
 	for {
 		messageType, data, err := c.conn.ReadMessage()
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("[Client] Read error: %v", err)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseServiceRestart) {
+				c.connLog.Warn("Read error", logging.Err(err))
 			}
 			break
 		}
@@ -121,7 +289,7 @@ func (c *Client) handleMessages() {
 func (c *Client) handleControlMessage(data []byte) {
 	var msg protocol.Message
 	if err := json.Unmarshal(data, &msg); err != nil {
-		log.Printf("[Client] Failed to parse message: %v", err)
+		c.connLog.Warn("Failed to parse message", logging.Err(err))
 		return
 	}
 
@@ -130,8 +298,26 @@ func (c *Client) handleControlMessage(data []byte) {
 		c.handleStartSession(msg)
 	case protocol.MessageTypeResize:
 		c.handleResize(msg)
+	case protocol.MessageTypeApprovalDecision:
+		c.handleApprovalDecision(msg)
+	case protocol.MessageTypeDrain:
+		c.handleDrain(msg)
+	case protocol.MessageTypeServerShutdown:
+		c.handleServerShutdown(msg)
+	case protocol.MessageTypeFileUpload:
+		c.handleFileUpload(msg)
+	case protocol.MessageTypeFileDownload:
+		c.handleFileDownload(msg)
+	case protocol.MessageTypeFileEnd:
+		c.handleFileEnd(msg)
+	case protocol.MessageTypeFileAck:
+		c.handleFileAck(msg)
+	case protocol.MessageTypeFileCancel:
+		c.handleFileCancel(msg)
+	case protocol.MessageTypeError:
+		c.handleError(msg)
 	default:
-		log.Printf("[Client] Unknown message type: %s", msg.Type)
+		c.connLog.Warn("Unknown message type", "type", msg.Type)
 	}
 }
 
@@ -139,23 +325,167 @@ func (c *Client) handleControlMessage(data []byte) {
 func (c *Client) handleStartSession(msg protocol.Message) {
 	payloadBytes, err := json.Marshal(msg.Payload)
 	if err != nil {
-		log.Printf("[Client] Failed to marshal payload: %v", err)
+		c.connLog.Warn("Failed to marshal payload", logging.Err(err))
 		return
 	}
 
 	var payload protocol.StartSessionPayload
 	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
-		log.Printf("[Client] Failed to parse start_session payload: %v", err)
+		c.connLog.Warn("Failed to parse start_session payload", logging.Err(err))
+		return
+	}
+
+	// The span lasts until session_started is sent or the session fails to start
+	ctx, span := tracer.Start(tracing.Extract(context.Background(), msg.Trace), "runner.start_session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String(logging.KeySessionID, payload.SessionID),
+			attribute.String(logging.KeyRunnerID, c.runnerID),
+		))
+
+	payload = c.spawn.apply(payload)
+	if err := c.spawn.Check(payload.Command); err != nil {
+		c.refuseSession(span, payload.SessionID, protocol.ErrCodeCommandNotAllowed, err)
+		return
+	}
+
+	switch c.acceptSession() {
+	case protocol.ErrCodeRunnerDraining:
+		c.refuseSession(span, payload.SessionID, protocol.ErrCodeRunnerDraining, errors.New("runner is draining and accepts no new sessions"))
+		return
+	case protocol.ErrCodeRunnerFull:
+		c.refuseSession(span, payload.SessionID, protocol.ErrCodeRunnerFull,
+			fmt.Errorf("runner is already running its maximum of %d sessions", c.spawn.MaxSessions))
+		return
+	}
+
+	if payload.Workspace == nil {
+		c.startSession(ctx, payload, nil)
+		return
+	}
+
+	if c.workspaces == nil {
+		c.sessionDone()
+		tracing.End(span, errors.New("workspaces are disabled"))
+		c.sendError(payload.SessionID, "Workspaces are disabled on this runner")
 		return
 	}
 
+	// Cloning can take a while, so keep it off the message loop
+	go func() {
+		_, prepareSpan := tracer.Start(ctx, "workspace.prepare",
+			trace.WithAttributes(attribute.String("repo", payload.Workspace.Repo)))
+		ws, err := c.workspaces.Prepare(payload.SessionID, *payload.Workspace)
+		tracing.End(prepareSpan, err)
+		if err != nil {
+			c.sessionLog(payload.SessionID).Error("Failed to prepare workspace", logging.Err(err))
+			c.sessionDone()
+			tracing.End(span, err)
+			c.sendError(payload.SessionID, fmt.Sprintf("Failed to prepare workspace: %v", err))
+			return
+		}
+		c.startSession(ctx, payload, ws)
+	}()
+}
+
+// refuseSession tells HQ why a session was not started and ends its startup span
+func (c *Client) refuseSession(span trace.Span, sessionID, code string, err error) {
+	c.sessionLog(sessionID).Info("Refusing session", "code", code, logging.Err(err))
+	tracing.End(span, err)
+	c.writeJSON(protocol.Message{
+		Type: protocol.MessageTypeError,
+		Payload: protocol.ErrorPayload{
+			SessionID: sessionID,
+			Message:   err.Error(),
+			Code:      code,
+		},
+	})
+}
+
+// startSession runs a session's command in a PTY, inside ws when it is set
+// The session must have been accepted; it is counted out once it ends or fails to start
+// ctx carries the runner.start_session span, which ends here
+func (c *Client) startSession(ctx context.Context, payload protocol.StartSessionPayload, ws *Workspace) {
 	sessionID := payload.SessionID
 	command := payload.Command
+	logger := c.sessionLog(sessionID)
+
+	started := false
+	var startErr error
+	defer func() {
+		if !started {
+			c.sessionDone()
+		}
+		tracing.End(trace.SpanFromContext(ctx), startErr)
+	}()
+
+	cwd := payload.Cwd
+	if ws != nil {
+		var err error
+		if cwd, err = ws.Path(payload.Cwd); err != nil {
+			startErr = err
+			c.workspaces.Release(ws, -1)
+			c.sendError(sessionID, fmt.Sprintf("Invalid working directory: %v", err))
+			return
+		}
+	}
+
+	var limits *sessionLimits
+	if payload.Limits != nil {
+		if c.limiter == nil {
+			logger.Warn("Resource limits are not enforced by this runner")
+		} else {
+			var err error
+			if limits, err = c.limiter.prepare(sessionID, *payload.Limits); err != nil {
+				logger.Error("Failed to apply resource limits", logging.Err(err))
+				startErr = err
+				if ws != nil {
+					c.workspaces.Release(ws, -1)
+				}
+				c.sendError(sessionID, fmt.Sprintf("Failed to apply resource limits: %v", err))
+				return
+			}
+		}
+	}
+
+	ptyOpts := PTYOptions{Dir: cwd, Env: payload.Env, Logger: c.logger.With(logging.SessionID(sessionID)), limits: limits, sandbox: c.sandbox}
+	if ws != nil {
+		ptyOpts.writable = ws.writable()
+	}
+
+	// Sessions ask for human approval through a socket of their own
+	var gate *approvalGate
+	if c.approvalDir != "" {
+		var err error
+		if gate, err = c.openApprovalGate(sessionID); err != nil {
+			// Sessions still run; without the socket every approval request is denied
+			logger.Warn("Approvals unavailable", logging.Err(err))
+		} else {
+			ptyOpts.Env = make(map[string]string, len(payload.Env)+1)
+			for key, value := range payload.Env {
+				ptyOpts.Env[key] = value
+			}
+			ptyOpts.Env[ApprovalSocketEnv] = gate.path()
+			ptyOpts.writable = append(ptyOpts.writable, gate.dir)
+		}
+	}
+	closeGate := func() {
+		if gate != nil {
+			gate.close()
+			c.denyApprovals(func(id string) bool { return id == sessionID }, "cancelled", "session ended")
+		}
+	}
 
 	// Create PTY
-	pty, err := NewPTY(sessionID, command)
+	pty, err := NewPTY(ctx, sessionID, command, ptyOpts)
 	if err != nil {
-		log.Printf("[Client] Failed to create PTY: %v", err)
+		logger.Error("Failed to create PTY", logging.Err(err))
+		startErr = err
+		c.metrics.spawnFailures.Inc()
+		closeGate()
+		if ws != nil {
+			c.workspaces.Release(ws, -1)
+		}
 		c.sendError(sessionID, fmt.Sprintf("Failed to start PTY: %v", err))
 		return
 	}
@@ -166,28 +496,126 @@ func (c *Client) handleStartSession(msg protocol.Message) {
 	c.mu.Unlock()
 
 	// Send session_started confirmation
-	c.sendSessionStarted(sessionID)
+	c.sendSessionStarted(ctx, sessionID)
+	c.metrics.sessionsStarted.Inc()
 
 	// Start reading PTY output
-	go c.streamPTYOutput(pty)
+	redactor := sessionRedactor(c.redactor, payload.Env)
+	output := newSessionOutput(redactor, func(data []byte) error {
+		return c.sendPTYOutput(sessionID, data)
+	})
+	streamDone := make(chan struct{})
+	go func() {
+		c.streamPTYOutput(pty, output)
+		close(streamDone)
+	}()
+
+	// Kill the process once its time is up; session_ended then reports why
+	var timer *time.Timer
+	var timedOut atomic.Bool
+	if payload.Timeout > 0 {
+		timer = time.AfterFunc(time.Duration(payload.Timeout)*time.Second, func() {
+			logger.Info("Session exceeded its timeout", "timeout", payload.Timeout)
+			timedOut.Store(true)
+			if err := pty.Kill(); err != nil {
+				logger.Error("Failed to kill session", logging.Err(err))
+			}
+		})
+	}
+
+	// Interactive sessions nobody is using are reaped; jobs are bounded by their timeout instead
+	var idled atomic.Bool
+	stopIdle := func() {}
+	if c.idle.enabled() && !payload.Headless {
+		stopIdle = c.watchIdle(sessionID, pty, &idled)
+	}
 
 	// Wait for process to exit
+	started = true
 	go func() {
+		defer c.sessionDone()
+
 		exitCode := pty.Wait()
+		if timer != nil {
+			timer.Stop()
+		}
+		stopIdle()
+		closeGate()
+
+		// Let trailing output drain so it reaches HQ before session_ended
+		select {
+		case <-streamDone:
+		case <-time.After(outputDrainTimeout):
+		}
+		output.Close()
+		pty.Close()
+
 		c.mu.Lock()
 		delete(c.sessions, sessionID)
 		c.mu.Unlock()
 
-		c.sendSessionEnded(sessionID, exitCode)
-		log.Printf("[Client] Session %s ended with exit code %d", sessionID, exitCode)
+		// The result and artifacts precede session_ended so HQ has them when the session finishes
+		redactions := output.Redactions()
+		if ws != nil {
+			redactions += c.sendSessionResult(sessionID, ws, redactor)
+		}
+		artifacts := c.collectArtifacts(sessionID, cwd, payload.Artifacts, ws != nil)
+
+		report := pty.LimitReport()
+		ended := protocol.SessionEndedPayload{
+			SessionID:  sessionID,
+			ExitCode:   exitCode,
+			Redactions: redactions,
+			Artifacts:  artifacts,
+			LimitsHit:  report.Hit,
+		}
+		switch {
+		case timedOut.Load():
+			ended.Reason = protocol.SessionEndReasonTimeout
+		case idled.Load():
+			ended.Reason = protocol.SessionEndReasonIdle
+		case report.OOMKilled:
+			ended.Reason = protocol.SessionEndReasonOOM
+		case c.drainKilled.Load():
+			ended.Reason = protocol.SessionEndReasonDrained
+		}
+		c.sendSessionEnded(ended)
+		c.metrics.sessionEnded(ended.Reason)
+		logger.Info("Session ended", "exit_code", exitCode, "redactions", redactions, "reason", ended.Reason)
+
+		if ws != nil {
+			c.workspaces.Release(ws, exitCode)
+		}
 	}()
 }
 
+// handleServerShutdown notes when HQ wants runners back; it closes the connection next
+func (c *Client) handleServerShutdown(msg protocol.Message) {
+	var payload protocol.ServerShutdownPayload
+	if err := protocol.DecodePayload(msg, &payload); err != nil {
+		c.connLog.Warn("Malformed message", "type", msg.Type, logging.Err(err))
+		return
+	}
+
+	c.reconnectAfter = time.Duration(payload.ReconnectAfter) * time.Second
+	c.connLog.Info("HQ is shutting down", "reason", payload.Reason, "reconnect_after", c.reconnectAfter)
+}
+
+// handleError logs an error HQ reports about the connection, such as an exceeded quota
+func (c *Client) handleError(msg protocol.Message) {
+	var payload protocol.ErrorPayload
+	if err := protocol.DecodePayload(msg, &payload); err != nil {
+		c.connLog.Warn("Malformed message", "type", msg.Type, logging.Err(err))
+		return
+	}
+	c.connLog.Warn("Error from HQ", "code", payload.Code, "message", payload.Message, "retry_after", payload.RetryAfter)
+}
+
 // handleResize resizes an active PTY session
 func (c *Client) handleResize(msg protocol.Message) {
 	payloadBytes, err := json.Marshal(msg.Payload)
 	if err != nil {
-		log.Printf("[Client] Failed to marshal payload: %v", err)
+		c.connLog.Warn("Failed to marshal payload", logging.Err(err))
 		return
 	}
 
@@ -197,7 +625,7 @@ func (c *Client) handleResize(msg protocol.Message) {
 		Cols      int    `json:"cols"`
 	}
 	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
-		log.Printf("[Client] Failed to parse resize payload: %v", err)
+		c.connLog.Warn("Failed to parse resize payload", logging.Err(err))
 		return
 	}
 
@@ -206,44 +634,46 @@ func (c *Client) handleResize(msg protocol.Message) {
 	c.mu.RUnlock()
 
 	if !exists {
-		log.Printf("[Client] Session %s not found for resize", payload.SessionID)
+		c.sessionLog(payload.SessionID).Debug("Session not found for resize")
 		return
 	}
 
 	if err := pty.Resize(payload.Rows, payload.Cols); err != nil {
-		log.Printf("[Client] Failed to resize PTY: %v", err)
+		c.sessionLog(payload.SessionID).Warn("Failed to resize PTY", logging.Err(err))
 	}
 }
 
-// handleBinaryMessage processes binary data (terminal input)
+// handleBinaryMessage processes binary data (terminal input or upload chunks)
 func (c *Client) handleBinaryMessage(data []byte) {
 	// Format: [session_id(36 bytes)][input_data]
 	if len(data) < 36 {
-		log.Printf("[Client] Invalid binary message: too short")
+		c.connLog.Warn("Invalid binary message: too short", "bytes", len(data))
 		return
 	}
 
 	sessionID := string(data[:36])
 	inputData := data[36:]
 
+	if c.receiveUploadChunk(sessionID, inputData) {
+		return
+	}
+
 	c.mu.RLock()
 	pty, exists := c.sessions[sessionID]
 	c.mu.RUnlock()
 
 	if !exists {
-		log.Printf("[Client] Session %s not found for input", sessionID)
+		c.sessionLog(sessionID).Debug("Session not found for input")
 		return
 	}
 
 	if err := pty.Write(inputData); err != nil {
-		log.Printf("[Client] Failed to write to PTY: %v", err)
+		c.sessionLog(sessionID).Warn("Failed to write to PTY", logging.Err(err))
 	}
 }
 
-// streamPTYOutput reads PTY output and sends it to HQ
-func (c *Client) streamPTYOutput(pty *PTY) {
-	sessionID := pty.SessionID()
-
+// streamPTYOutput reads PTY output and passes it through the session's output path
+func (c *Client) streamPTYOutput(pty *PTY, output *sessionOutput) {
 	for {
 		data, err := pty.Read()
 		if err != nil {
@@ -251,40 +681,52 @@ func (c *Client) streamPTYOutput(pty *PTY) {
 			break
 		}
 
-		// Send binary message with session ID prefix
-		// Format: [session_id(36 bytes)][pty_data]
-		sessionBytes := []byte(sessionID)
-		paddedSession := make([]byte, 36)
-		copy(paddedSession, sessionBytes)
-
-		fullData := append(paddedSession, data...)
-
-		if err := c.writeMessage(websocket.BinaryMessage, fullData); err != nil {
-			log.Printf("[Client] Failed to send PTY output: %v", err)
+		if err := output.Write(data); err != nil {
+			c.sessionLog(pty.SessionID()).Warn("Failed to send PTY output", logging.Err(err))
 			break
 		}
 	}
 }
 
-// sendSessionStarted sends a session_started message
-func (c *Client) sendSessionStarted(sessionID string) {
+// sendPTYOutput sends a binary message with session ID prefix
+// Format: [session_id(36 bytes)][pty_data]
+func (c *Client) sendPTYOutput(sessionID string, data []byte) error {
+	if err := c.sendFrame(sessionID, data); err != nil {
+		return err
+	}
+	c.metrics.outputFrames.Inc()
+	c.metrics.outputBytes.Add(float64(len(data)))
+	return nil
+}
+
+// sendFrame sends a binary message prefixed with a session or transfer ID
+func (c *Client) sendFrame(id string, data []byte) error {
+	sessionBytes := []byte(id)
+	paddedSession := make([]byte, 36)
+	copy(paddedSession, sessionBytes)
+
+	fullData := append(paddedSession, data...)
+
+	return c.writeMessage(websocket.BinaryMessage, fullData)
+}
+
+// sendSessionStarted sends a session_started message carrying the startup trace
+func (c *Client) sendSessionStarted(ctx context.Context, sessionID string) {
 	msg := protocol.Message{
 		Type: protocol.MessageTypeSessionStarted,
 		Payload: protocol.SessionStartedPayload{
 			SessionID: sessionID,
 		},
+		Trace: tracing.Inject(ctx),
 	}
 	c.writeJSON(msg)
 }
 
 // sendSessionEnded sends a session_ended message
-func (c *Client) sendSessionEnded(sessionID string, exitCode int) {
+func (c *Client) sendSessionEnded(payload protocol.SessionEndedPayload) {
 	msg := protocol.Message{
-		Type: protocol.MessageTypeSessionEnded,
-		Payload: protocol.SessionEndedPayload{
-			SessionID: sessionID,
-			ExitCode:  exitCode,
-		},
+		Type:    protocol.MessageTypeSessionEnded,
+		Payload: payload,
 	}
 	c.writeJSON(msg)
 }
@@ -294,7 +736,8 @@ func (c *Client) sendError(sessionID, errMsg string) {
 	msg := protocol.Message{
 		Type: protocol.MessageTypeError,
 		Payload: protocol.ErrorPayload{
-			Message: errMsg,
+			SessionID: sessionID,
+			Message:   errMsg,
 		},
 	}
 	c.writeJSON(msg)
@@ -304,6 +747,9 @@ func (c *Client) sendError(sessionID, errMsg string) {
 func (c *Client) writeJSON(msg protocol.Message) error {
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
+	if c.conn == nil {
+		return fmt.Errorf("not connected to HQ")
+	}
 	return c.conn.WriteJSON(msg)
 }
 
@@ -330,5 +776,5 @@ func (c *Client) Close() {
 		c.conn.Close()
 	}
 
-	log.Printf("[Client] Client closed")
+	c.log.Info("Client closed")
 }
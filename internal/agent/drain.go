@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+)
+
+// drainReportWait bounds how long sessions killed at the drain deadline have to report their end
+const drainReportWait = 5 * time.Second
+
+// WithDrainTimeout sets how long a drain HQ asks for waits for sessions; 0 waits indefinitely
+func WithDrainTimeout(timeout time.Duration) ClientOption {
+	return func(c *Client) {
+		c.drainTimeout = timeout
+	}
+}
+
+// Drain stops accepting sessions, waits for the running ones to end and then closes the client
+// Sessions still running after timeout are killed; 0 waits indefinitely
+// Calling Drain again while draining does nothing; Close stops a drain early
+func (c *Client) Drain(timeout time.Duration) {
+	c.mu.Lock()
+	if c.draining || c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.draining = true
+	if timeout > 0 {
+		c.drainDeadline = time.Now().Add(timeout)
+	}
+	running := len(c.sessions)
+	c.mu.Unlock()
+
+	if timeout > 0 {
+		c.log.Info("Draining: waiting for sessions to end", "sessions", running, "timeout", timeout)
+	} else {
+		c.log.Info("Draining: waiting for sessions to end", "sessions", running)
+	}
+	c.announceDrain()
+
+	// No session can be accepted any more, so the count only goes down
+	done := make(chan struct{})
+	go func() {
+		c.running.Wait()
+		close(done)
+	}()
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case <-done:
+		c.log.Info("Drained: all sessions ended")
+	case <-deadline:
+		c.drainKilled.Store(true)
+		c.mu.RLock()
+		c.log.Warn("Drain deadline passed, killing sessions", "sessions", len(c.sessions))
+		for sessionID, pty := range c.sessions {
+			if err := pty.Kill(); err != nil {
+				c.sessionLog(sessionID).Error("Failed to kill session", logging.Err(err))
+			}
+		}
+		c.mu.RUnlock()
+
+		// Give the killed sessions a chance to report session_ended
+		select {
+		case <-done:
+		case <-time.After(drainReportWait):
+		}
+	}
+	c.Close()
+}
+
+// Draining reports whether the client has stopped accepting sessions
+func (c *Client) Draining() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.draining
+}
+
+// acceptSession counts a new session in, unless the client is draining or already runs
+// as many sessions as its spawn policy allows; it returns the error code to refuse with
+// Every accepted session must be matched by a call to c.sessionDone
+func (c *Client) acceptSession() (refusal string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining || c.closed {
+		return protocol.ErrCodeRunnerDraining
+	}
+	if c.spawn.MaxSessions > 0 && c.accepted >= c.spawn.MaxSessions {
+		return protocol.ErrCodeRunnerFull
+	}
+	c.accepted++
+	c.running.Add(1)
+	return ""
+}
+
+// sessionDone counts out a session acceptSession let in
+func (c *Client) sessionDone() {
+	c.mu.Lock()
+	c.accepted--
+	c.mu.Unlock()
+	c.running.Done()
+}
+
+// drainStatus describes the drain for HQ, or returns nil when not draining
+func (c *Client) drainStatus() *protocol.RunnerDrainingPayload {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.draining {
+		return nil
+	}
+
+	status := &protocol.RunnerDrainingPayload{Sessions: len(c.sessions)}
+	if !c.drainDeadline.IsZero() {
+		status.Deadline = c.drainDeadline.UTC().Format(time.RFC3339)
+	}
+	return status
+}
+
+// announceDrain tells HQ to schedule nothing more on this runner
+func (c *Client) announceDrain() {
+	if err := c.writeJSON(protocol.Message{Type: protocol.MessageTypeRunnerDraining, Payload: c.drainStatus()}); err != nil {
+		// Registering again after a reconnect tells HQ instead
+		c.log.Warn("Failed to tell HQ about drain", logging.Err(err))
+	}
+}
+
+// handleDrain drains at HQ's request
+func (c *Client) handleDrain(msg protocol.Message) {
+	var payload protocol.DrainPayload
+	if err := protocol.DecodePayload(msg, &payload); err != nil {
+		c.connLog.Warn("Malformed message", "type", msg.Type, logging.Err(err))
+		return
+	}
+
+	timeout := c.drainTimeout
+	if payload.Timeout > 0 {
+		timeout = time.Duration(payload.Timeout) * time.Second
+	}
+	c.connLog.Info("HQ asked this runner to drain", "timeout", timeout)
+	go c.Drain(timeout)
+}
@@ -0,0 +1,36 @@
+package agent
+
+import (
+	"math/rand/v2"
+	"slices"
+)
+
+// Failover decides the order the runner tries HQ URLs in when it connects
+type Failover string
+
+const (
+	FailoverOrdered Failover = "ordered" // First to last, so the first reachable URL is always preferred
+	FailoverRandom  Failover = "random"  // A fresh shuffle for every attempt, spreading runners across HQs
+)
+
+// WithFailover sets the order HQ URLs are tried in; the default is FailoverOrdered
+func WithFailover(f Failover) ClientOption {
+	return func(c *Client) {
+		c.failover = f
+	}
+}
+
+// connectOrder returns the HQ URLs to try, in order, for the next connection attempt
+// A URL that announced its shutdown goes last so the runner moves to another HQ first
+func (c *Client) connectOrder() []string {
+	urls := slices.Clone(c.hqURLs)
+	if c.failover == FailoverRandom {
+		rand.Shuffle(len(urls), func(i, j int) {
+			urls[i], urls[j] = urls[j], urls[i]
+		})
+	}
+	if i := slices.Index(urls, c.shutdownURL); i >= 0 && len(urls) > 1 {
+		urls = append(slices.Delete(urls, i, i+1), c.shutdownURL)
+	}
+	return urls
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+)
+
+// IdlePolicy decides when an interactive session counts as abandoned and is reaped
+// Headless sessions (jobs) are never reaped; their timeout bounds them instead
+type IdlePolicy struct {
+	Timeout      time.Duration // No input and no output for this long; 0 disables
+	InputTimeout time.Duration // No input for this long, even while output continues; 0 disables
+	Warning      time.Duration // How long before reaping a banner is written into the terminal
+}
+
+// WithIdlePolicy reaps interactive sessions that stay idle past the policy's thresholds
+func WithIdlePolicy(p IdlePolicy) ClientOption {
+	return func(c *Client) {
+		c.idle = p
+	}
+}
+
+// enabled reports whether any idle threshold is set
+func (p IdlePolicy) enabled() bool {
+	return p.Timeout > 0 || p.InputTimeout > 0
+}
+
+// deadline returns when a session with the given activity becomes idle
+func (p IdlePolicy) deadline(lastInput, lastOutput time.Time) time.Time {
+	var deadline time.Time
+	if p.Timeout > 0 {
+		latest := lastInput
+		if lastOutput.After(latest) {
+			latest = lastOutput
+		}
+		deadline = latest.Add(p.Timeout)
+	}
+	if p.InputTimeout > 0 {
+		if input := lastInput.Add(p.InputTimeout); deadline.IsZero() || input.Before(deadline) {
+			deadline = input
+		}
+	}
+	return deadline
+}
+
+// watchIdle warns about and then kills a session that stays idle
+// idled is set before the kill so session_ended can report why; stop ends the watch
+func (c *Client) watchIdle(sessionID string, pty *PTY, idled *atomic.Bool) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		var warned time.Time // Deadline the last banner announced
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+
+			// Activity only ever moves the deadline later, so it is recomputed on every wake
+			deadline := c.idle.deadline(pty.LastActivity())
+			now := time.Now()
+			if !now.Before(deadline) {
+				c.sessionLog(sessionID).Info("Session is idle, closing it")
+				idled.Store(true)
+				c.sendIdleBanner(sessionID, "This session was idle for too long and has been closed.")
+				if err := pty.Kill(); err != nil {
+					c.sessionLog(sessionID).Error("Failed to kill session", logging.Err(err))
+				}
+				return
+			}
+
+			next := deadline
+			if c.idle.Warning > 0 && !deadline.Equal(warned) {
+				if warnAt := deadline.Add(-c.idle.Warning); now.Before(warnAt) {
+					next = warnAt
+				} else {
+					warned = deadline
+					c.sendIdleBanner(sessionID, fmt.Sprintf(
+						"This session is idle and will be closed in %s. Press any key to keep it open.",
+						deadline.Sub(now).Round(time.Second)))
+				}
+			}
+			timer.Reset(next.Sub(now))
+		}
+	}()
+	return func() { close(done) }
+}
+
+// sendIdleBanner writes a notice into the session's terminal output
+// It reaches the client like PTY output but never the session's process
+func (c *Client) sendIdleBanner(sessionID, text string) {
+	banner := "\r\n\x1b[33m[agent-relay] " + text + "\x1b[0m\r\n"
+	if err := c.sendPTYOutput(sessionID, []byte(banner)); err != nil {
+		c.sessionLog(sessionID).Warn("Failed to send idle warning", logging.Err(err))
+	}
+}
@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrLimitsUnsupported is returned when resource limits cannot be enforced on this platform
+var ErrLimitsUnsupported = errors.New("resource limits are not supported on this platform")
+
+// LimitMode selects how session resource limits are enforced
+type LimitMode string
+
+const (
+	LimitsAuto   LimitMode = "auto"   // A cgroup per session when delegated, otherwise rlimits
+	LimitsCgroup LimitMode = "cgroup" // A cgroup v2 per session, failing if none can be created
+	LimitsRlimit LimitMode = "rlimit" // setrlimit on the session's process
+	LimitsOff    LimitMode = "off"    // Ignore limits
+)
+
+// LimitReport describes the limits a session ran into
+// Only cgroups can tell; rlimit failures surface inside the session instead
+type LimitReport struct {
+	OOMKilled bool
+	Hit       []string // protocol.Limit* names
+}
+
+// WithLimiter enforces the resource limits sessions are started with
+func WithLimiter(l *Limiter) ClientOption {
+	return func(c *Client) {
+		c.limiter = l
+	}
+}
+
+// parseLimitMode validates a configured limit mode
+func parseLimitMode(mode LimitMode) error {
+	switch mode {
+	case LimitsAuto, LimitsCgroup, LimitsRlimit, LimitsOff:
+		return nil
+	default:
+		return fmt.Errorf("unknown limit mode %q (expected auto, cgroup, rlimit or off)", mode)
+	}
+}
@@ -0,0 +1,363 @@
+//go:build linux
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"golang.org/x/sys/unix"
+)
+
+// cgroupMount is where the cgroup v2 hierarchy is expected
+const cgroupMount = "/sys/fs/cgroup"
+
+// cpuPeriod is the cpu.max period in microseconds
+const cpuPeriod = 100000
+
+// cgroupCleanupTimeout bounds how long a session's leftover processes get to die
+const cgroupCleanupTimeout = 2 * time.Second
+
+// Limiter enforces session resource limits with a cgroup v2 per session,
+// or with rlimits where no cgroup subtree is delegated to the runner
+type Limiter struct {
+	mode        LimitMode       // LimitsCgroup or LimitsRlimit once resolved
+	root        string          // Parent of the session cgroups
+	controllers map[string]bool // Controllers enabled for session cgroups
+	log         *slog.Logger
+}
+
+// NewLimiter resolves mode against what the host allows
+// root is the cgroup to create session cgroups under; empty uses the runner's own
+func NewLimiter(mode LimitMode, root string, logger *slog.Logger) (*Limiter, error) {
+	if err := parseLimitMode(mode); err != nil {
+		return nil, err
+	}
+
+	log := logging.Component(logger, "limits")
+	switch mode {
+	case LimitsOff:
+		return nil, nil
+	case LimitsRlimit:
+		return &Limiter{mode: LimitsRlimit, log: log}, nil
+	}
+
+	root, controllers, err := setupCgroup(root)
+	if err != nil {
+		if mode == LimitsCgroup {
+			return nil, err
+		}
+		log.Warn("cgroups unavailable, falling back to rlimits", logging.Err(err))
+		return &Limiter{mode: LimitsRlimit, log: log}, nil
+	}
+
+	return &Limiter{mode: LimitsCgroup, root: root, controllers: controllers, log: log}, nil
+}
+
+// Mode returns how limits are enforced
+func (l *Limiter) Mode() LimitMode {
+	if l == nil {
+		return LimitsOff
+	}
+	return l.mode
+}
+
+// Root returns the cgroup session cgroups are created under, if any
+func (l *Limiter) Root() string {
+	return l.root
+}
+
+// setupCgroup enables the cpu, memory and pids controllers for root's children
+// A cgroup with processes cannot enable controllers for its children, so a runner
+// limiting from its own cgroup first moves itself into a "runner" leaf
+func setupCgroup(root string) (string, map[string]bool, error) {
+	own, err := ownCgroup()
+	if err != nil {
+		return "", nil, err
+	}
+	if root == "" {
+		root = own
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return "", nil, fmt.Errorf("no cgroup v2 hierarchy at %s: %w", root, err)
+	}
+
+	var enable []string
+	for _, controller := range strings.Fields(string(data)) {
+		switch controller {
+		case "cpu", "memory", "pids":
+			enable = append(enable, "+"+controller)
+		}
+	}
+	if len(enable) == 0 {
+		return "", nil, fmt.Errorf("no cpu, memory or pids controller is available in %s", root)
+	}
+
+	subtree := filepath.Join(root, "cgroup.subtree_control")
+	err = os.WriteFile(subtree, []byte(strings.Join(enable, " ")), 0)
+	if errors.Is(err, syscall.EBUSY) && root == own {
+		leaf := filepath.Join(root, "runner")
+		if err := os.Mkdir(leaf, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+			return "", nil, fmt.Errorf("failed to create %s: %w", leaf, err)
+		}
+		if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+			return "", nil, fmt.Errorf("failed to move runner into %s: %w", leaf, err)
+		}
+		err = os.WriteFile(subtree, []byte(strings.Join(enable, " ")), 0)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to enable controllers in %s: %w", root, err)
+	}
+
+	data, err = os.ReadFile(subtree)
+	if err != nil {
+		return "", nil, err
+	}
+	controllers := make(map[string]bool)
+	for _, controller := range strings.Fields(string(data)) {
+		controllers[controller] = true
+	}
+	return root, controllers, nil
+}
+
+// ownCgroup returns the directory of the runner's cgroup v2
+func ownCgroup() (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return filepath.Join(cgroupMount, path), nil
+		}
+	}
+	return "", errors.New("runner is not in a cgroup v2 hierarchy")
+}
+
+// cgroupSetting is a value written to a session cgroup's interface file
+type cgroupSetting struct {
+	controller, file, value string
+	optional                bool // Missing on some kernels, e.g. memory.swap.max without swap accounting
+}
+
+// sessionLimits enforces one session's limits
+type sessionLimits struct {
+	limits protocol.ResourceLimits
+	cgroup string   // Session cgroup directory; empty with rlimits
+	fd     *os.File // Open cgroup directory the process is cloned into
+	log    *slog.Logger
+}
+
+// prepare creates the session's cgroup, if limits are enforced with cgroups
+func (l *Limiter) prepare(sessionID string, limits protocol.ResourceLimits) (*sessionLimits, error) {
+	s := &sessionLimits{limits: limits, log: l.log.With(logging.SessionID(sessionID))}
+	if l.mode == LimitsRlimit {
+		if limits.CPUs > 0 {
+			s.log.Warn("CPU limit is not enforced without cgroups")
+		}
+		// RLIMIT_NPROC would count every process of the runner's user, not just the session's
+		if limits.PIDs > 0 {
+			s.log.Warn("Process limit is not enforced without cgroups")
+		}
+		return s, nil
+	}
+
+	if sessionID == "" || filepath.Base(sessionID) != sessionID || strings.HasPrefix(sessionID, ".") {
+		return nil, fmt.Errorf("invalid session ID %q", sessionID)
+	}
+
+	var settings []cgroupSetting
+	if limits.MemoryBytes > 0 {
+		settings = append(settings,
+			cgroupSetting{"memory", "memory.max", strconv.FormatInt(limits.MemoryBytes, 10), false},
+			// Without these a session can swap past its limit, and an OOM kill spares its other processes
+			cgroupSetting{"memory", "memory.swap.max", "0", true},
+			cgroupSetting{"memory", "memory.oom.group", "1", true})
+	}
+	if limits.CPUs > 0 {
+		quota := int64(limits.CPUs * cpuPeriod)
+		settings = append(settings, cgroupSetting{"cpu", "cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod), false})
+	}
+	if limits.PIDs > 0 {
+		settings = append(settings, cgroupSetting{"pids", "pids.max", strconv.FormatInt(limits.PIDs, 10), false})
+	}
+	for _, setting := range settings {
+		if !l.controllers[setting.controller] {
+			return nil, fmt.Errorf("the %s controller is not enabled in %s", setting.controller, l.root)
+		}
+	}
+
+	dir := filepath.Join(l.root, "session-"+sessionID)
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	s.cgroup = dir
+
+	for _, setting := range settings {
+		err := os.WriteFile(filepath.Join(dir, setting.file), []byte(setting.value), 0)
+		if err != nil && !setting.optional {
+			s.remove()
+			return nil, fmt.Errorf("failed to set %s: %w", setting.file, err)
+		}
+	}
+
+	fd, err := os.Open(dir)
+	if err != nil {
+		s.remove()
+		return nil, fmt.Errorf("failed to open cgroup: %w", err)
+	}
+	s.fd = fd
+	return s, nil
+}
+
+// apply makes cmd start inside the session's cgroup
+func (s *sessionLimits) apply(cmd *exec.Cmd) {
+	if s == nil || s.fd == nil {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(s.fd.Fd())
+}
+
+// started sets rlimits on the new process
+// They apply from just after exec, and are inherited by everything it starts
+func (s *sessionLimits) started(pid int) error {
+	if s == nil {
+		return nil
+	}
+	if s.fd != nil {
+		s.fd.Close()
+		s.fd = nil
+		return nil
+	}
+	if s.cgroup != "" {
+		return nil
+	}
+
+	if s.limits.MemoryBytes > 0 {
+		limit := uint64(s.limits.MemoryBytes)
+		if err := unix.Prlimit(pid, unix.RLIMIT_AS, &unix.Rlimit{Cur: limit, Max: limit}, nil); err != nil {
+			return fmt.Errorf("failed to limit memory: %w", err)
+		}
+	}
+	return nil
+}
+
+// kill terminates every process in the session's cgroup
+// Returns false without a cgroup, leaving the caller to kill the process
+func (s *sessionLimits) kill() bool {
+	if s == nil || s.cgroup == "" {
+		return false
+	}
+
+	err := os.WriteFile(filepath.Join(s.cgroup, "cgroup.kill"), []byte("1"), 0)
+	if err == nil {
+		return true
+	}
+
+	// cgroup.kill needs Linux 5.14; signal each process instead
+	data, err := os.ReadFile(filepath.Join(s.cgroup, "cgroup.procs"))
+	if err != nil {
+		return false
+	}
+	for _, field := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+	return true
+}
+
+// finish reports the limits the session hit, then kills any processes
+// it left behind and removes its cgroup
+func (s *sessionLimits) finish() LimitReport {
+	var report LimitReport
+	if s == nil {
+		return report
+	}
+	if s.fd != nil {
+		s.fd.Close()
+		s.fd = nil
+	}
+	if s.cgroup == "" {
+		return report
+	}
+
+	memory := readCgroupStats(filepath.Join(s.cgroup, "memory.events"))
+	report.OOMKilled = memory["oom_kill"] > 0
+	if memory["max"] > 0 || report.OOMKilled {
+		report.Hit = append(report.Hit, protocol.LimitMemory)
+	}
+	if s.limits.CPUs > 0 && readCgroupStats(filepath.Join(s.cgroup, "cpu.stat"))["nr_throttled"] > 0 {
+		report.Hit = append(report.Hit, protocol.LimitCPU)
+	}
+	if readCgroupStats(filepath.Join(s.cgroup, "pids.events"))["max"] > 0 {
+		report.Hit = append(report.Hit, protocol.LimitPIDs)
+	}
+
+	if populated(s.cgroup) {
+		s.log.Info("Killing processes the session left behind")
+		s.kill()
+	}
+	s.remove()
+	return report
+}
+
+// remove deletes the session's cgroup once its processes are gone
+func (s *sessionLimits) remove() {
+	deadline := time.Now().Add(cgroupCleanupTimeout)
+	for {
+		err := os.Remove(s.cgroup)
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		if time.Now().After(deadline) {
+			s.log.Error("Failed to remove cgroup", "cgroup", s.cgroup, logging.Err(err))
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// populated reports whether any process is left in a cgroup
+func populated(dir string) bool {
+	return readCgroupStats(filepath.Join(dir, "cgroup.events"))["populated"] > 0
+}
+
+// readCgroupStats parses a flat-keyed cgroup file such as memory.events
+// Missing files read as empty, since not every controller is enabled
+func readCgroupStats(path string) map[string]int64 {
+	stats := make(map[string]int64)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return stats
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			stats[key] = n
+		}
+	}
+	return stats
+}
@@ -0,0 +1,43 @@
+//go:build !linux
+
+package agent
+
+import (
+	"log/slog"
+	"os/exec"
+
+	"github.com/codervisor/agent-relay/internal/protocol"
+)
+
+// Limiter enforces session resource limits; only Linux supports them
+type Limiter struct{}
+
+// NewLimiter fails unless limits are off, since this platform cannot enforce them
+func NewLimiter(mode LimitMode, root string, logger *slog.Logger) (*Limiter, error) {
+	if err := parseLimitMode(mode); err != nil {
+		return nil, err
+	}
+	return nil, ErrLimitsUnsupported
+}
+
+// Mode returns how limits are enforced
+func (l *Limiter) Mode() LimitMode {
+	return LimitsOff
+}
+
+// Root returns the cgroup session cgroups are created under, if any
+func (l *Limiter) Root() string {
+	return ""
+}
+
+// sessionLimits is a no-op on this platform
+type sessionLimits struct{}
+
+func (l *Limiter) prepare(sessionID string, limits protocol.ResourceLimits) (*sessionLimits, error) {
+	return nil, ErrLimitsUnsupported
+}
+
+func (s *sessionLimits) apply(cmd *exec.Cmd)   {}
+func (s *sessionLimits) started(pid int) error { return nil }
+func (s *sessionLimits) kill() bool            { return false }
+func (s *sessionLimits) finish() LimitReport   { return LimitReport{} }
@@ -0,0 +1,15 @@
+package agent
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain lets sandbox tests re-execute the test binary as the sandbox's init, as the runner does
+func TestMain(m *testing.M) {
+	if IsSandboxInit() {
+		SandboxInit()
+		return
+	}
+	os.Exit(m.Run())
+}
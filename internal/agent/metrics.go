@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// clientMetrics are the runner statistics exposed on its optional metrics listener
+type clientMetrics struct {
+	registry *prometheus.Registry
+
+	spawnFailures   prometheus.Counter
+	sessionsStarted prometheus.Counter
+	sessionsEnded   *prometheus.CounterVec
+	reconnects      prometheus.Counter
+	outputBytes     prometheus.Counter
+	outputFrames    prometheus.Counter
+}
+
+// newClientMetrics registers the runner's metrics; the active session gauge is read at scrape time
+func newClientMetrics(c *Client) *clientMetrics {
+	m := &clientMetrics{
+		registry: prometheus.NewRegistry(),
+		spawnFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "agent_relay_runner_pty_spawn_failures_total",
+			Help: "Sessions whose process could not be started in a PTY.",
+		}),
+		sessionsStarted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "agent_relay_runner_sessions_started_total",
+			Help: "Sessions started.",
+		}),
+		sessionsEnded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agent_relay_runner_sessions_ended_total",
+			Help: "Sessions ended, by the reason reported in session_ended, or \"exited\" when the process exited on its own.",
+		}, []string{"reason"}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "agent_relay_runner_reconnect_attempts_total",
+			Help: "Attempts to reach HQ after the first connection attempt.",
+		}),
+		outputBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "agent_relay_runner_output_bytes_total",
+			Help: "Terminal output bytes sent to HQ, after redaction.",
+		}),
+		outputFrames: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "agent_relay_runner_output_frames_total",
+			Help: "Terminal output frames sent to HQ.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.spawnFailures,
+		m.sessionsStarted,
+		m.sessionsEnded,
+		m.reconnects,
+		m.outputBytes,
+		m.outputFrames,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "agent_relay_runner_sessions_active",
+			Help: "Sessions currently running.",
+		}, func() float64 {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			return float64(len(c.sessions))
+		}),
+	)
+	return m
+}
+
+// sessionEnded counts a finished session by why it ended
+func (m *clientMetrics) sessionEnded(reason string) {
+	if reason == "" {
+		reason = "exited"
+	}
+	m.sessionsEnded.WithLabelValues(reason).Inc()
+}
+
+// MetricsHandler serves the runner's metrics in the Prometheus text format
+func (c *Client) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(c.metrics.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/redact"
+)
+
+// redactFlushDelay bounds how long held-back output waits for the next PTY read
+// Long enough for the rest of a split secret to arrive, short enough that
+// interactive echo does not feel delayed
+const redactFlushDelay = 20 * time.Millisecond
+
+// sessionOutput passes PTY output through a redaction stream before sending it
+// Bytes held back because they may begin a secret are flushed on the next
+// read, or after redactFlushDelay if no more output arrives
+type sessionOutput struct {
+	stream *redact.Stream
+	send   func([]byte) error
+	timer  *time.Timer
+	gen    int // Invalidates flush timers armed before the latest write
+	mu     sync.Mutex
+}
+
+// sessionRedactor adds the values of a session's env to the configured secrets
+// so credentials injected for the session, such as by a profile, are masked too
+func sessionRedactor(redactor *redact.Redactor, env map[string]string) *redact.Redactor {
+	values := make([]string, 0, len(env))
+	for _, value := range env {
+		values = append(values, value)
+	}
+	return redactor.WithValues(values...)
+}
+
+// newSessionOutput creates an output path; a nil redactor passes data through
+func newSessionOutput(redactor *redact.Redactor, send func([]byte) error) *sessionOutput {
+	return &sessionOutput{
+		stream: redactor.NewStream(),
+		send:   send,
+	}
+}
+
+// Write redacts a chunk of PTY output and sends whatever is safe to emit
+func (o *sessionOutput) Write(data []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+	o.gen++
+
+	if out := o.stream.Write(data); len(out) > 0 {
+		if err := o.send(out); err != nil {
+			return err
+		}
+	}
+
+	if o.stream.Pending() {
+		gen := o.gen
+		o.timer = time.AfterFunc(redactFlushDelay, func() { o.flush(gen) })
+	}
+	return nil
+}
+
+// flush sends held-back bytes unless newer output arrived since the timer was armed
+func (o *sessionOutput) flush(gen int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if gen != o.gen {
+		return
+	}
+	if out := o.stream.Flush(); len(out) > 0 {
+		o.send(out)
+	}
+}
+
+// Close flushes any remaining output
+func (o *sessionOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+	o.gen++
+
+	if out := o.stream.Flush(); len(out) > 0 {
+		return o.send(out)
+	}
+	return nil
+}
+
+// Redactions returns the number of secrets masked so far
+func (o *sessionOutput) Redactions() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.stream.Count()
+}
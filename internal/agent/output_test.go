@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/codervisor/agent-relay/internal/redact"
+)
+
+func TestSessionOutputMasksSessionEnv(t *testing.T) {
+	base, err := redact.New(redact.Config{Values: []string{"configured-secret"}, DisableBuiltin: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"API_KEY": "profile-api-key-123", "SHORT": "on"}
+
+	tests := []struct {
+		name     string
+		redactor *redact.Redactor
+		chunks   []string
+		want     string
+		count    int
+	}{
+		{
+			name:     "session env value",
+			redactor: sessionRedactor(base, env),
+			chunks:   []string{"key=profile-api-", "key-123\r\n"},
+			want:     "key=[REDACTED]\r\n",
+			count:    1,
+		},
+		{
+			name:     "configured secret still masked",
+			redactor: sessionRedactor(base, env),
+			chunks:   []string{"configured-secret profile-api-key-123"},
+			want:     "[REDACTED] [REDACTED]",
+			count:    2,
+		},
+		{
+			name:     "short values left alone",
+			redactor: sessionRedactor(base, env),
+			chunks:   []string{"debug on\r\n"},
+			want:     "debug on\r\n",
+		},
+		{
+			name:     "other sessions unaffected",
+			redactor: sessionRedactor(base, nil),
+			chunks:   []string{"key=profile-api-key-123"},
+			want:     "key=profile-api-key-123",
+		},
+		{
+			name:     "redaction disabled",
+			redactor: sessionRedactor(nil, env),
+			chunks:   []string{"key=profile-api-key-123"},
+			want:     "key=profile-api-key-123",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent strings.Builder
+			output := newSessionOutput(tt.redactor, func(data []byte) error {
+				sent.Write(data)
+				return nil
+			})
+			for _, chunk := range tt.chunks {
+				if err := output.Write([]byte(chunk)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := output.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := sent.String(); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+			if got := output.Redactions(); got != tt.count {
+				t.Errorf("Redactions() = %d, want %d", got, tt.count)
+			}
+		})
+	}
+}
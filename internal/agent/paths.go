@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrPathNotAllowed is returned for paths outside every allowed root
+var ErrPathNotAllowed = errors.New("path is outside the runner's allowed paths")
+
+// PathPolicy restricts file access to a set of root directories
+type PathPolicy struct {
+	roots []string
+}
+
+// NewPathPolicy creates a policy allowing access beneath each root
+// Roots must exist; symlinks in them are resolved up front
+func NewPathPolicy(roots []string) (*PathPolicy, error) {
+	if len(roots) == 0 {
+		return nil, errors.New("at least one allowed path is required")
+	}
+
+	p := &PathPolicy{}
+	for _, root := range roots {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed path %q: %w", root, err)
+		}
+		resolved, err := filepath.EvalSymlinks(abs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed path %q: %w", root, err)
+		}
+		p.roots = append(p.roots, resolved)
+	}
+	return p, nil
+}
+
+// Roots returns the resolved allowed directories
+func (p *PathPolicy) Roots() []string {
+	return append([]string(nil), p.roots...)
+}
+
+// Resolve maps a requested path to a real path inside an allowed root
+// Relative paths are taken relative to the first root. Symlinks are resolved
+// before the check so a link cannot point outside the roots; a path that does
+// not exist yet is checked through its parent directory
+func (p *PathPolicy) Resolve(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("path is required")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(p.roots[0], path)
+	}
+	path = filepath.Clean(path)
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if errors.Is(err, os.ErrNotExist) {
+		var dir string
+		dir, err = filepath.EvalSymlinks(filepath.Dir(path))
+		resolved = filepath.Join(dir, filepath.Base(path))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	for _, root := range p.roots {
+		if within(root, resolved) {
+			return resolved, nil
+		}
+	}
+	return "", ErrPathNotAllowed
+}
+
+// within reports whether path is root or beneath it
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathPolicyResolve(t *testing.T) {
+	// Resolved so expectations match on systems where the temp dir is behind a symlink
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(base, "root")
+	other := filepath.Join(base, "other")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "sub"), other, outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "sub", "file.txt"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := NewPathPolicy([]string{root, other})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr error
+	}{
+		{name: "relative to the first root", path: "sub/file.txt", want: filepath.Join(root, "sub", "file.txt")},
+		{name: "absolute", path: filepath.Join(root, "sub", "file.txt"), want: filepath.Join(root, "sub", "file.txt")},
+		{name: "root itself", path: root, want: root},
+		{name: "second root", path: filepath.Join(other, "new.txt"), want: filepath.Join(other, "new.txt")},
+		{name: "file not created yet", path: "sub/new.txt", want: filepath.Join(root, "sub", "new.txt")},
+		{name: "symlink inside the roots", path: "link/file.txt", want: filepath.Join(root, "sub", "file.txt")},
+		{name: "dot dot out of the root", path: "../outside/secret", wantErr: ErrPathNotAllowed},
+		{name: "dot dot back into the root", path: "sub/../sub/file.txt", want: filepath.Join(root, "sub", "file.txt")},
+		{name: "absolute outside", path: filepath.Join(outside, "secret"), wantErr: ErrPathNotAllowed},
+		{name: "sibling with the root as prefix", path: root + "2", wantErr: ErrPathNotAllowed},
+		{name: "symlink out of the root", path: "escape/secret", wantErr: ErrPathNotAllowed},
+		{name: "symlink itself out of the root", path: "escape", wantErr: ErrPathNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := policy.Resolve(tt.path)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Resolve(%q) = %q, %v; want error %v", tt.path, got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve(%q) error = %v", tt.path, err)
+			}
+			if got != tt.want {
+				t.Errorf("Resolve(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathPolicyResolveErrors(t *testing.T) {
+	policy, err := NewPathPolicy([]string{t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"", "missing/dir/file.txt"} {
+		if got, err := policy.Resolve(path); err == nil {
+			t.Errorf("Resolve(%q) = %q, want an error", path, got)
+		}
+	}
+}
@@ -1,14 +1,23 @@
 package agent
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/tracing"
 	"github.com/creack/pty"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // PTY represents a pseudo-terminal session
@@ -16,37 +25,104 @@ type PTY struct {
 	cmd       *exec.Cmd
 	ptmx      *os.File
 	sessionID string
+	limits    *sessionLimits
+	report    LimitReport // Set once the process has exited
+	log       *slog.Logger
 	mu        sync.Mutex
 	closed    bool
+
+	lastInput  atomic.Int64 // Unix nanoseconds of the last write from the client
+	lastOutput atomic.Int64 // Unix nanoseconds of the last output from the process
 }
 
+// PTYOptions configures how a session's process is spawned
+type PTYOptions struct {
+	Dir string            // Working directory; empty inherits the runner's
+	Env map[string]string // Added to the runner's environment, overriding it
+
+	// Logger receives the session's PTY events; nil uses slog's default tagged with the session ID
+	Logger *slog.Logger
+
+	limits   *sessionLimits // Cgroup or rlimits the process runs under
+	sandbox  *Sandbox       // Namespaces the process runs in, if any
+	writable []string       // Paths the sandboxed process may write
+}
+
+// defaultCommand runs for sessions that name no command
+var defaultCommand = []string{"/bin/bash"}
+
 // NewPTY creates a new PTY instance
-func NewPTY(sessionID string, command []string) (*PTY, error) {
+// The spawn is traced as a child of ctx's span
+func NewPTY(ctx context.Context, sessionID string, command []string, opts PTYOptions) (p *PTY, err error) {
 	if len(command) == 0 {
-		command = []string{"/bin/bash"}
+		command = defaultCommand
 	}
 
+	_, span := tracer.Start(ctx, "pty.spawn", trace.WithAttributes(
+		attribute.String(logging.KeySessionID, sessionID),
+		attribute.String("command", command[0]),
+		attribute.Bool("sandboxed", opts.sandbox != nil),
+		attribute.Bool("limited", opts.limits != nil),
+	))
+	defer func() { tracing.End(span, err) }()
+
 	cmd := exec.Command(command[0], command[1:]...)
+	env := os.Environ()
+	release := func() {}
+	if opts.sandbox != nil {
+		var err error
+		if cmd, release, err = opts.sandbox.command(command, opts.writable); err != nil {
+			return nil, fmt.Errorf("failed to sandbox session: %w", err)
+		}
+		env = opts.sandbox.env()
+	}
+	defer release()
+	cmd.Dir = opts.Dir
 
 	// Set environment variables
-	cmd.Env = append(os.Environ(),
+	cmd.Env = append(env,
 		"TERM=xterm-256color",
 		"COLORTERM=truecolor",
 	)
+	keys := make([]string, 0, len(opts.Env))
+	for key := range opts.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		cmd.Env = append(cmd.Env, key+"="+opts.Env[key])
+	}
 
+	opts.limits.apply(cmd)
 	ptmx, err := pty.Start(cmd)
 	if err != nil {
+		opts.limits.finish()
 		return nil, fmt.Errorf("failed to start PTY: %w", err)
 	}
 
-	p := &PTY{
+	p = &PTY{
 		cmd:       cmd,
 		ptmx:      ptmx,
 		sessionID: sessionID,
+		limits:    opts.limits,
 		closed:    false,
 	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default().With(logging.SessionID(sessionID))
+	}
+	p.log = logging.Component(opts.Logger, "pty")
+	now := time.Now().UnixNano()
+	p.lastInput.Store(now)
+	p.lastOutput.Store(now)
+
+	if err := opts.limits.started(cmd.Process.Pid); err != nil {
+		p.Close()
+		p.Wait()
+		return nil, err
+	}
 
-	log.Printf("[PTY] Started session %s with command: %v", sessionID, command)
+	span.SetAttributes(attribute.Int("pid", cmd.Process.Pid))
+	p.log.Info("Started session", "command", command, "pid", cmd.Process.Pid)
 	return p, nil
 }
 
@@ -65,6 +141,7 @@ func (p *PTY) Read() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	p.lastOutput.Store(time.Now().UnixNano())
 	return buf[:n], nil
 }
 
@@ -77,10 +154,16 @@ func (p *PTY) Write(data []byte) error {
 		return fmt.Errorf("PTY is closed")
 	}
 
+	p.lastInput.Store(time.Now().UnixNano())
 	_, err := p.ptmx.Write(data)
 	return err
 }
 
+// LastActivity returns when the session last received input and last produced output
+func (p *PTY) LastActivity() (input, output time.Time) {
+	return time.Unix(0, p.lastInput.Load()), time.Unix(0, p.lastOutput.Load())
+}
+
 // Resize changes the PTY dimensions
 func (p *PTY) Resize(rows, cols int) error {
 	p.mu.Lock()
@@ -99,13 +182,16 @@ func (p *PTY) Resize(rows, cols int) error {
 		return fmt.Errorf("failed to resize PTY: %w", err)
 	}
 
-	log.Printf("[PTY] Resized session %s to %dx%d", p.sessionID, cols, rows)
+	p.log.Debug("Resized session", "cols", cols, "rows", rows)
 	return nil
 }
 
 // Wait waits for the PTY process to exit and returns the exit code
+// Processes it left in its cgroup are killed
 func (p *PTY) Wait() int {
-	if err := p.cmd.Wait(); err != nil {
+	err := p.cmd.Wait()
+	p.report = p.limits.finish()
+	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			return exitErr.ExitCode()
 		}
@@ -114,6 +200,26 @@ func (p *PTY) Wait() int {
 	return 0
 }
 
+// LimitReport describes the resource limits the session hit; valid after Wait
+func (p *PTY) LimitReport() LimitReport {
+	return p.report
+}
+
+// Kill terminates the process, and its cgroup if it has one,
+// but leaves the PTY open so remaining output drains
+func (p *PTY) Kill() error {
+	if p.limits.kill() {
+		return nil
+	}
+	if p.cmd.Process == nil {
+		return nil
+	}
+	if err := p.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	return nil
+}
+
 // Close closes the PTY and terminates the process
 func (p *PTY) Close() error {
 	p.mu.Lock()
@@ -127,17 +233,17 @@ func (p *PTY) Close() error {
 
 	// Close the PTY file descriptor
 	if err := p.ptmx.Close(); err != nil {
-		log.Printf("[PTY] Error closing ptmx: %v", err)
+		p.log.Warn("Error closing ptmx", logging.Err(err))
 	}
 
 	// Kill the process if still running
 	if p.cmd.Process != nil {
-		if err := p.cmd.Process.Kill(); err != nil {
-			log.Printf("[PTY] Error killing process: %v", err)
+		if err := p.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			p.log.Warn("Error killing process", logging.Err(err))
 		}
 	}
 
-	log.Printf("[PTY] Closed session %s", p.sessionID)
+	p.log.Info("Closed session")
 	return nil
 }
 
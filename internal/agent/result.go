@@ -0,0 +1,273 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/codervisor/agent-relay/internal/redact"
+)
+
+// Limits on what session_result carries, so one session cannot flood HQ
+const (
+	maxResultCommits = 200
+	maxResultDiff    = 1 << 20
+)
+
+// sendSessionResult reports a workspace's changes to HQ
+// Returns the number of secrets masked in the result
+func (c *Client) sendSessionResult(sessionID string, ws *Workspace, redactor *redact.Redactor) int {
+	result, err := c.workspaces.Result(ws)
+	if err != nil {
+		c.sessionLog(sessionID).Error("Failed to compute result", logging.Err(err))
+		return 0
+	}
+
+	masked := 0
+	if redactor != nil {
+		diff, n := redactor.Redact([]byte(result.Diff))
+		result.Diff = string(diff)
+		masked += n
+		for i := range result.Commits {
+			subject, n := redactor.Redact([]byte(result.Commits[i].Subject))
+			result.Commits[i].Subject = string(subject)
+			masked += n
+		}
+	}
+
+	if err := c.writeJSON(protocol.Message{
+		Type: protocol.MessageTypeSessionResult,
+		Payload: protocol.SessionResultPayload{
+			SessionID:     sessionID,
+			SessionResult: result,
+		},
+	}); err != nil {
+		c.sessionLog(sessionID).Warn("Failed to send result", logging.Err(err))
+		return masked
+	}
+
+	c.sessionLog(sessionID).Info("Sent result", "commits", len(result.Commits), "files", len(result.Files))
+	return masked
+}
+
+// Result summarizes what changed in ws since it was prepared
+// Uncommitted and untracked files are included by staging the working tree
+// into a throwaway index, leaving the session's own index untouched
+func (m *WorkspaceManager) Result(ws *Workspace) (protocol.SessionResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.opts.Timeout)
+	defer cancel()
+
+	result := protocol.SessionResult{
+		BaseCommit: ws.Base,
+		Commits:    []protocol.CommitSummary{},
+		Files:      []protocol.FileChange{},
+	}
+
+	head, err := m.git(ctx, ws.Dir, "rev-parse", "--verify", "HEAD")
+	if err != nil {
+		return result, err
+	}
+	result.HeadCommit = head
+	// Fails on a detached HEAD, which has no branch to report
+	result.Branch, _ = m.git(ctx, ws.Dir, "symbolic-ref", "--quiet", "--short", "HEAD")
+
+	if result.Commits, result.CommitsTruncated, err = m.commits(ctx, ws); err != nil {
+		return result, err
+	}
+
+	index, err := m.stageWorkingTree(ctx, ws.Dir)
+	if err != nil {
+		return result, err
+	}
+	defer os.Remove(index)
+	env := []string{"GIT_INDEX_FILE=" + index}
+
+	nameStatus, err := m.run(ctx, ws.Dir, env, "diff", "--cached", "--name-status", "-z", "-M", ws.Base)
+	if err != nil {
+		return result, err
+	}
+	numstat, err := m.run(ctx, ws.Dir, env, "diff", "--cached", "--numstat", "-z", "-M", ws.Base)
+	if err != nil {
+		return result, err
+	}
+	result.Files = parseFileChanges(nameStatus, numstat)
+
+	diff, err := m.run(ctx, ws.Dir, env, "diff", "--cached", "-M", ws.Base)
+	if err != nil {
+		return result, err
+	}
+	result.Diff, result.DiffTruncated = truncateDiff(diff, maxResultDiff)
+	return result, nil
+}
+
+// commits lists commits made since the workspace was prepared, oldest first
+func (m *WorkspaceManager) commits(ctx context.Context, ws *Workspace) ([]protocol.CommitSummary, bool, error) {
+	out, err := m.git(ctx, ws.Dir, "log", fmt.Sprintf("--max-count=%d", maxResultCommits+1),
+		"--format=%H%x00%an%x00%ae%x00%aI%x00%s", ws.Base+"..HEAD")
+	if err != nil {
+		return nil, false, err
+	}
+
+	commits := []protocol.CommitSummary{}
+	if out != "" {
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.SplitN(line, "\x00", 5)
+			if len(fields) != 5 {
+				continue
+			}
+			commits = append(commits, protocol.CommitSummary{
+				SHA:         fields[0],
+				Author:      fields[1],
+				AuthorEmail: fields[2],
+				Date:        fields[3],
+				Subject:     fields[4],
+			})
+		}
+	}
+
+	truncated := len(commits) > maxResultCommits
+	if truncated {
+		commits = commits[:maxResultCommits]
+	}
+	// git log lists newest first
+	for i, j := 0, len(commits)-1; i < j; i, j = i+1, j-1 {
+		commits[i], commits[j] = commits[j], commits[i]
+	}
+	return commits, truncated, nil
+}
+
+// stageWorkingTree adds every change in dir to a copy of its index
+// Starting from the real index lets git reuse its cached file stats
+func (m *WorkspaceManager) stageWorkingTree(ctx context.Context, dir string) (string, error) {
+	tmp, err := os.CreateTemp("", "agent-relay-index-*")
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	index := tmp.Name()
+
+	current, err := m.git(ctx, dir, "rev-parse", "--git-path", "index")
+	if err != nil {
+		os.Remove(index)
+		return "", err
+	}
+	if !filepath.IsAbs(current) {
+		current = filepath.Join(dir, current)
+	}
+
+	data, err := os.ReadFile(current)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// git creates a fresh index, but not from an empty file
+		os.Remove(index)
+	case err != nil:
+		os.Remove(index)
+		return "", err
+	default:
+		if err := os.WriteFile(index, data, 0o600); err != nil {
+			os.Remove(index)
+			return "", err
+		}
+	}
+
+	if _, err := m.run(ctx, dir, []string{"GIT_INDEX_FILE=" + index}, "add", "--all"); err != nil {
+		os.Remove(index)
+		return "", err
+	}
+	return index, nil
+}
+
+// parseFileChanges combines `git diff --name-status -z` and `--numstat -z` output
+func parseFileChanges(nameStatus, numstat []byte) []protocol.FileChange {
+	type lineCounts struct {
+		additions, deletions int
+		binary               bool
+	}
+
+	// numstat records are "add\tdel\tpath\0", or "add\tdel\t\0old\0new\0" for renames
+	counts := make(map[string]lineCounts)
+	fields := strings.Split(string(numstat), "\x00")
+	for i := 0; i < len(fields); i++ {
+		parts := strings.SplitN(fields[i], "\t", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		path := parts[2]
+		if path == "" && i+2 < len(fields) {
+			path = fields[i+2]
+			i += 2
+		}
+
+		var c lineCounts
+		if parts[0] == "-" {
+			c.binary = true
+		} else {
+			c.additions, _ = strconv.Atoi(parts[0])
+			c.deletions, _ = strconv.Atoi(parts[1])
+		}
+		counts[path] = c
+	}
+
+	// name-status records are "X\0path\0", or "R<score>\0old\0new\0" for renames and copies
+	changes := []protocol.FileChange{}
+	fields = strings.Split(string(nameStatus), "\x00")
+	for i := 0; i+1 < len(fields); i++ {
+		code := fields[i]
+		if code == "" {
+			continue
+		}
+
+		change := protocol.FileChange{Status: fileStatus(code[0]), Path: fields[i+1]}
+		i++
+		if (code[0] == 'R' || code[0] == 'C') && i+1 < len(fields) {
+			change.OldPath = change.Path
+			change.Path = fields[i+1]
+			i++
+		}
+
+		c := counts[change.Path]
+		change.Additions = c.additions
+		change.Deletions = c.deletions
+		change.Binary = c.binary
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// fileStatus names a git diff status letter
+func fileStatus(code byte) string {
+	switch code {
+	case 'A':
+		return "added"
+	case 'D':
+		return "deleted"
+	case 'R':
+		return "renamed"
+	case 'C':
+		return "copied"
+	case 'T':
+		return "type_changed"
+	case 'U':
+		return "unmerged"
+	default:
+		return "modified"
+	}
+}
+
+// truncateDiff cuts diff to at most limit bytes, ending on a line boundary
+func truncateDiff(diff []byte, limit int) (string, bool) {
+	if len(diff) <= limit {
+		return string(diff), false
+	}
+	cut := diff[:limit]
+	if i := strings.LastIndexByte(string(cut), '\n'); i >= 0 {
+		cut = cut[:i+1]
+	}
+	return string(cut), true
+}
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrSandboxUnsupported is returned when sessions cannot be sandboxed on this platform
+var ErrSandboxUnsupported = errors.New("session sandboxing is not supported on this platform")
+
+// sandboxInitArg is the hidden runner subcommand that sets up a sandbox and runs the session inside it
+const sandboxInitArg = "sandbox-init"
+
+// SandboxNetwork decides what network a sandboxed session sees
+type SandboxNetwork string
+
+const (
+	SandboxNetworkNone     SandboxNetwork = "none"     // No interfaces at all
+	SandboxNetworkLoopback SandboxNetwork = "loopback" // Only lo, isolated from the host's
+	SandboxNetworkHost     SandboxNetwork = "host"     // The runner's network
+)
+
+// SandboxOptions configures session sandboxing
+type SandboxOptions struct {
+	Network  SandboxNetwork
+	Hidden   []string // Paths replaced by empty directories or files, e.g. credentials
+	Writable []string // Paths every session may write besides its workspace and /tmp
+	HideEnv  []string // Runner environment variables sessions must not inherit, e.g. its token
+}
+
+// sandboxConfig is what the runner passes to a sandbox-init process
+type sandboxConfig struct {
+	Network  SandboxNetwork `json:"network"`
+	Hidden   []string       `json:"hidden,omitempty"`
+	Writable []string       `json:"writable,omitempty"`
+	Probe    bool           `json:"probe,omitempty"` // Set up the sandbox, then exit without running anything
+}
+
+// WithSandbox runs every session inside s
+func WithSandbox(s *Sandbox) ClientOption {
+	return func(c *Client) {
+		c.sandbox = s
+	}
+}
+
+// IsSandboxInit reports whether the runner was started to set up a session sandbox
+// The runner's main must then call SandboxInit before doing anything else
+func IsSandboxInit() bool {
+	return len(os.Args) > 1 && os.Args[1] == sandboxInitArg
+}
+
+// validate checks sandbox options and makes their paths absolute
+func (o *SandboxOptions) validate() error {
+	switch o.Network {
+	case SandboxNetworkNone, SandboxNetworkLoopback, SandboxNetworkHost:
+	case "":
+		o.Network = SandboxNetworkLoopback
+	default:
+		return fmt.Errorf("unknown sandbox network %q (expected none, loopback or host)", o.Network)
+	}
+
+	for _, paths := range [][]string{o.Hidden, o.Writable} {
+		for i, path := range paths {
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return fmt.Errorf("invalid sandbox path %q: %w", path, err)
+			}
+			paths[i] = abs
+		}
+	}
+	return nil
+}
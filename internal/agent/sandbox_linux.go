@@ -0,0 +1,425 @@
+//go:build linux
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// sandboxProbeTimeout bounds the check that namespaces work on this host
+const sandboxProbeTimeout = 10 * time.Second
+
+// Sandbox runs sessions in their own user, mount, PID, IPC and UTS namespaces,
+// and network namespace unless the host network is allowed
+// The root filesystem is a read-only view of the runner's, with a private /tmp
+type Sandbox struct {
+	exe  string // Runner binary, re-executed as the sandbox's init
+	opts SandboxOptions
+}
+
+// NewSandbox checks that sessions can be sandboxed on this host
+func NewSandbox(opts SandboxOptions) (*Sandbox, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate runner binary: %w", err)
+	}
+	s := &Sandbox{exe: exe, opts: opts}
+
+	if err := s.probe(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Network returns the network sandboxed sessions see
+func (s *Sandbox) Network() SandboxNetwork {
+	return s.opts.Network
+}
+
+// probe sets up a sandbox without running anything in it
+func (s *Sandbox) probe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), sandboxProbeTimeout)
+	defer cancel()
+
+	cmd, wait, release, err := s.build(ctx, sandboxConfig{Network: s.opts.Network, Hidden: s.opts.Hidden, Probe: true}, nil)
+	if err != nil {
+		return err
+	}
+	release.Close()
+	defer wait.Close()
+	cmd.Dir = "/"
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("sandbox unavailable: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// command wraps a session's command in a sandbox where writable, besides /tmp
+// and the configured paths, may be written
+// The sandbox waits to run the command until release is called once it has started
+func (s *Sandbox) command(command []string, writable []string) (*exec.Cmd, func(), error) {
+	cfg := sandboxConfig{
+		Network:  s.opts.Network,
+		Hidden:   s.opts.Hidden,
+		Writable: append(append([]string(nil), s.opts.Writable...), writable...),
+	}
+	cmd, wait, release, err := s.build(context.Background(), cfg, command)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cmd, func() {
+		wait.Close()
+		release.Close()
+	}, nil
+}
+
+// env returns the runner's environment without the variables sessions must not see
+func (s *Sandbox) env() []string {
+	var env []string
+	for _, entry := range os.Environ() {
+		name, _, _ := strings.Cut(entry, "=")
+		if !slices.Contains(s.opts.HideEnv, name) {
+			env = append(env, entry)
+		}
+	}
+	return env
+}
+
+// build prepares the sandbox-init process for cfg
+// It reads its go-ahead from the wait end of a pipe, so limits apply before the command runs;
+// closing the release end lets it proceed
+func (s *Sandbox) build(ctx context.Context, cfg sandboxConfig, command []string) (cmd *exec.Cmd, wait, release *os.File, err error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if wait, release, err = os.Pipe(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	args := append([]string{sandboxInitArg, string(data), "--"}, command...)
+	cmd = exec.CommandContext(ctx, s.exe, args...)
+	cmd.ExtraFiles = []*os.File{wait}
+
+	flags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS)
+	if cfg.Network != SandboxNetworkHost {
+		flags |= syscall.CLONE_NEWNET
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: flags,
+		// Sessions keep the runner's IDs, so files they write are the runner's
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}},
+		GidMappingsEnableSetgroups: false,
+	}
+	return cmd, wait, release, nil
+}
+
+// SandboxInit runs as PID 1 of a new sandbox: it builds the session's
+// filesystem view, drops privileges and runs the command, then exits with its status
+// It never returns
+func SandboxInit() {
+	// Capability bounding sets are per thread; the command is forked from this one
+	runtime.LockOSThread()
+
+	if len(os.Args) < 4 || os.Args[3] != "--" {
+		sandboxFail(errors.New("usage: sandbox-init CONFIG -- COMMAND..."))
+	}
+	var cfg sandboxConfig
+	if err := json.Unmarshal([]byte(os.Args[2]), &cfg); err != nil {
+		sandboxFail(fmt.Errorf("invalid config: %w", err))
+	}
+	command := os.Args[4:]
+
+	// Wait for the runner to finish setting up limits
+	release := os.NewFile(3, "release")
+	io.Copy(io.Discard, release)
+	release.Close()
+
+	if err := setupSandbox(cfg); err != nil {
+		sandboxFail(err)
+	}
+	if cfg.Probe {
+		os.Exit(0)
+	}
+	if len(command) == 0 {
+		sandboxFail(errors.New("no command"))
+	}
+	if err := dropPrivileges(); err != nil {
+		sandboxFail(err)
+	}
+
+	os.Exit(superviseCommand(command))
+}
+
+// sandboxFail reports a setup error on the session's terminal
+func sandboxFail(err error) {
+	fmt.Fprintf(os.Stderr, "agent-relay sandbox: %v\r\n", err)
+	os.Exit(127)
+}
+
+// setupSandbox replaces the root filesystem with a read-only view of the host's
+// It works inside a tmpfs mounted over /tmp: the host root is moved to /tmp/oldroot,
+// a read-only copy is assembled at /tmp/newroot, and that becomes the root
+func setupSandbox(cfg sandboxConfig) error {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Sethostname([]byte("sandbox")); err != nil {
+		return fmt.Errorf("failed to set hostname: %w", err)
+	}
+	if cfg.Network == SandboxNetworkLoopback {
+		if err := loopbackUp(); err != nil {
+			return err
+		}
+	}
+
+	// Nothing done here may propagate back to the host
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	base := "/tmp"
+	if err := unix.Mount("tmpfs", base, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=0700"); err != nil {
+		return fmt.Errorf("failed to mount staging tmpfs: %w", err)
+	}
+	for _, dir := range []string{"newroot", "oldroot"} {
+		if err := os.Mkdir(filepath.Join(base, dir), 0o700); err != nil {
+			return err
+		}
+	}
+	if err := unix.PivotRoot(base, filepath.Join(base, "oldroot")); err != nil {
+		return fmt.Errorf("failed to pivot to staging root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+
+	// A read-only copy of every host mount
+	if err := unix.Mount("/oldroot", "/newroot", "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind root: %w", err)
+	}
+	if err := unix.MountSetattr(-1, "/newroot", unix.AT_RECURSIVE, &unix.MountAttr{Attr_set: unix.MOUNT_ATTR_RDONLY}); err != nil {
+		return fmt.Errorf("failed to make root read-only (needs Linux 5.12+): %w", err)
+	}
+
+	// Private scratch space, replacing the host's /tmp
+	for _, dir := range []string{"/tmp", "/dev/shm"} {
+		if _, err := os.Stat(filepath.Join("/newroot", dir)); err != nil {
+			continue
+		}
+		if err := unix.Mount("tmpfs", filepath.Join("/newroot", dir), "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("failed to mount %s: %w", dir, err)
+		}
+	}
+
+	// The host's /proc would show other sessions' and the runner's processes
+	if err := unix.Mount("proc", "/newroot/proc", "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		if err := unix.Mount("tmpfs", "/newroot/proc", "tmpfs", unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+			return fmt.Errorf("failed to hide /proc: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "agent-relay sandbox: /proc is unavailable in this sandbox: %v\r\n", err)
+	}
+
+	for _, path := range cfg.Hidden {
+		if err := hidePath(path); err != nil {
+			return err
+		}
+	}
+	for _, path := range cfg.Writable {
+		if err := bindWritable(path); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Chdir("/newroot"); err != nil {
+		return err
+	}
+	// Stacks the new root on the staging root, which is then detached from underneath it
+	if err := unix.PivotRoot(".", "."); err != nil {
+		return fmt.Errorf("failed to pivot to sandbox root: %w", err)
+	}
+	if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to detach host root: %w", err)
+	}
+
+	if err := os.Chdir(cwd); err != nil {
+		return fmt.Errorf("working directory %s is not visible in the sandbox", cwd)
+	}
+	return nil
+}
+
+// hidePath covers a host path with an empty read-only directory or file
+func hidePath(path string) error {
+	target := filepath.Join("/newroot", path)
+	info, err := os.Lstat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		err = unix.Mount("tmpfs", target, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "mode=0755,size=1m")
+	} else {
+		err = unix.Mount("/oldroot/dev/null", target, "", unix.MS_BIND, "")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to hide %s: %w", path, err)
+	}
+	return nil
+}
+
+// bindWritable exposes a host path read-write, creating its mount point
+// if a hidden directory or tmpfs now covers it
+func bindWritable(path string) error {
+	source := filepath.Join("/oldroot", path)
+	info, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("writable path %s: %w", path, err)
+	}
+
+	target := filepath.Join("/newroot", path)
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0o755)
+	} else if _, err = os.Stat(target); errors.Is(err, os.ErrNotExist) {
+		if err = os.MkdirAll(filepath.Dir(target), 0o755); err == nil {
+			err = os.WriteFile(target, nil, 0o600)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create mount point for %s: %w", path, err)
+	}
+
+	if err := unix.Mount(source, target, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind %s: %w", path, err)
+	}
+	return nil
+}
+
+// loopbackUp brings up lo in the sandbox's network namespace
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("failed to read lo flags: %w", err)
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("failed to bring up lo: %w", err)
+	}
+	return nil
+}
+
+// dropPrivileges leaves the command no capabilities in the sandbox,
+// so it cannot undo the mounts that hide the host
+func dropPrivileges() error {
+	last := 40
+	if data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			last = n
+		}
+	}
+	for c := 0; c <= last; c++ {
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0); err != nil && !errors.Is(err, unix.EINVAL) {
+			return fmt.Errorf("failed to drop capability %d: %w", c, err)
+		}
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to set no_new_privs: %w", err)
+	}
+	// Keep the command from attaching to init, which still holds its capabilities
+	return unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0)
+}
+
+// superviseCommand runs the command as init's child, forwarding termination
+// signals and reaping orphans, and returns its exit status
+// The command shares init's process group, so it gets terminal signals directly
+func superviseCommand(command []string) int {
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		sandboxFail(err)
+	}
+
+	// Caught, not ignored: ignored signals would stay ignored in the command
+	signals := make(chan os.Signal, 8)
+	signal.Notify(signals)
+
+	proc, err := os.StartProcess(path, command, &os.ProcAttr{
+		Env:   os.Environ(),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	})
+	if err != nil {
+		sandboxFail(err)
+	}
+
+	exited := make(chan int, 1)
+	go func() {
+		for {
+			var status unix.WaitStatus
+			pid, err := unix.Wait4(-1, &status, 0, nil)
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			if err != nil {
+				exited <- 1
+				return
+			}
+			if pid != proc.Pid {
+				continue
+			}
+			if status.Signaled() {
+				exited <- 128 + int(status.Signal())
+			} else {
+				exited <- status.ExitStatus()
+			}
+			return
+		}
+	}()
+
+	for {
+		select {
+		case code := <-exited:
+			return code
+		case sig := <-signals:
+			switch sig {
+			case syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2:
+				proc.Signal(sig)
+			}
+		}
+	}
+}
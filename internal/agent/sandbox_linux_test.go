@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codervisor/agent-relay/internal/protocol"
+)
+
+func TestSandboxedSessionCannotWriteMirror(t *testing.T) {
+	// Sandboxes get a private /tmp, so the workspaces live outside it as on a real runner
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.MkdirTemp(wd, ".sandbox-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	repo := newTestRepo(t, t.TempDir())
+	repos, err := NewPathPolicy([]string{repo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewWorkspaceManager(root, WorkspaceOptions{Cache: true, Isolated: true, LocalRepos: repos})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sandbox, err := NewSandbox(SandboxOptions{Network: SandboxNetworkNone, Hidden: []string{m.Root()}})
+	if err != nil {
+		t.Skipf("sandboxes unavailable: %v", err)
+	}
+
+	ws, err := m.Prepare("s1", protocol.WorkspaceSpec{Repo: repo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Release(ws, 0)
+	mirror := m.mirrorPath(repo)
+	head, err := os.ReadFile(filepath.Join(mirror, "HEAD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The write to the workspace shows the session ran; the one to the mirror must fail
+	script := "echo ok > session.txt; echo pwned > " + filepath.Join(mirror, "HEAD") +
+		"; touch " + filepath.Join(mirror, "objects", "planted")
+	p, err := NewPTY(context.Background(), "s1", []string{"/bin/sh", "-c", script}, PTYOptions{
+		Dir:      ws.Dir,
+		sandbox:  sandbox,
+		writable: ws.writable(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			if _, err := p.Read(); err != nil {
+				return
+			}
+		}
+	}()
+	p.Wait()
+	p.Close()
+
+	if _, err := os.Stat(filepath.Join(ws.Dir, "session.txt")); err != nil {
+		t.Fatalf("session did not write its workspace: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(mirror, "HEAD")); err != nil || string(got) != string(head) {
+		t.Errorf("mirror HEAD = %q, %v; want it unchanged", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(mirror, "objects", "planted")); err == nil {
+		t.Error("session planted a file in the mirror's objects")
+	}
+}
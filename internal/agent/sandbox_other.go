@@ -0,0 +1,39 @@
+//go:build !linux
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Sandbox runs sessions in Linux namespaces; other platforms cannot
+type Sandbox struct{}
+
+// NewSandbox fails, since this platform has no namespaces
+func NewSandbox(opts SandboxOptions) (*Sandbox, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	return nil, ErrSandboxUnsupported
+}
+
+// Network returns the network sandboxed sessions see
+func (s *Sandbox) Network() SandboxNetwork {
+	return ""
+}
+
+// SandboxInit is never reached on this platform, since sandboxes are never started
+func SandboxInit() {
+	fmt.Fprintln(os.Stderr, ErrSandboxUnsupported)
+	os.Exit(127)
+}
+
+func (s *Sandbox) command(command []string, writable []string) (*exec.Cmd, func(), error) {
+	return nil, nil, ErrSandboxUnsupported
+}
+
+func (s *Sandbox) env() []string {
+	return os.Environ()
+}
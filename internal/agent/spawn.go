@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"fmt"
+
+	"github.com/codervisor/agent-relay/internal/protocol"
+)
+
+// SpawnPolicy bounds which sessions the runner starts and fills in what start requests leave out
+type SpawnPolicy struct {
+	MaxSessions     int      // Sessions running at once; 0 = no limit
+	AllowedCommands []string // Programs sessions may run, matched exactly against the command's first word; empty allows any
+
+	Shell  []string                 // Command for sessions that name none; empty uses /bin/bash
+	Env    map[string]string        // Set for every session unless its request sets the same variable
+	Limits *protocol.ResourceLimits // Limits for sessions that request none
+}
+
+// WithSpawnPolicy applies p to every start_session request
+func WithSpawnPolicy(p SpawnPolicy) ClientOption {
+	return func(c *Client) {
+		c.spawn = p
+	}
+}
+
+// apply fills in the policy's defaults for what req leaves out
+func (p SpawnPolicy) apply(req protocol.StartSessionPayload) protocol.StartSessionPayload {
+	if len(req.Command) == 0 {
+		req.Command = p.Shell
+	}
+	if len(p.Env) > 0 {
+		env := make(map[string]string, len(p.Env)+len(req.Env))
+		for key, value := range p.Env {
+			env[key] = value
+		}
+		for key, value := range req.Env {
+			env[key] = value
+		}
+		req.Env = env
+	}
+	if req.Limits == nil {
+		req.Limits = p.Limits
+	}
+	return req
+}
+
+// Check returns why the policy forbids spawning command, or nil if it may run
+func (p SpawnPolicy) Check(command []string) error {
+	if len(p.AllowedCommands) == 0 {
+		return nil
+	}
+	if len(command) == 0 {
+		command = defaultCommand
+	}
+	for _, allowed := range p.AllowedCommands {
+		if command[0] == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("command %q is not allowed on this runner", command[0])
+}
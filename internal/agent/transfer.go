@@ -0,0 +1,611 @@
+package agent
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+)
+
+// errTransferCanceled stops a download that HQ abandoned
+var errTransferCanceled = errors.New("transfer canceled")
+
+// transferError carries a protocol error code alongside the cause
+type transferError struct {
+	code string
+	err  error
+}
+
+func (e *transferError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transferError) Unwrap() error {
+	return e.err
+}
+
+// transferErr builds an error reported to HQ with the given code
+func transferErr(code, format string, args ...interface{}) error {
+	return &transferError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// WithFileTransfers enables file upload and download within the allowed paths
+// maxSize caps a single file or directory archive in bytes; 0 means no limit
+func WithFileTransfers(paths *PathPolicy, maxSize int64) ClientOption {
+	return func(c *Client) {
+		c.paths = paths
+		c.maxTransferSize = maxSize
+	}
+}
+
+// upload receives a file into a temporary sibling of its destination
+// It is only touched from the message loop, so it needs no locking of its own
+type upload struct {
+	id       string
+	path     string
+	mode     os.FileMode
+	tmp      *os.File
+	hash     hash.Hash
+	size     int64
+	expected int64
+}
+
+// finish verifies the received bytes and moves the file into place
+func (u *upload) finish(end protocol.FileEndPayload) error {
+	sum := hex.EncodeToString(u.hash.Sum(nil))
+	if u.size != end.Size || sum != end.SHA256 {
+		u.discard()
+		return transferErr(protocol.ErrCodeChecksumMismatch,
+			"received %d bytes with sha256 %s, expected %d bytes with sha256 %s", u.size, sum, end.Size, end.SHA256)
+	}
+
+	if err := u.tmp.Chmod(u.mode); err != nil {
+		u.discard()
+		return err
+	}
+	if err := u.tmp.Sync(); err != nil {
+		u.discard()
+		return err
+	}
+	if err := u.tmp.Close(); err != nil {
+		os.Remove(u.tmp.Name())
+		return err
+	}
+	if err := os.Rename(u.tmp.Name(), u.path); err != nil {
+		os.Remove(u.tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// discard removes the partial file
+func (u *upload) discard() {
+	u.tmp.Close()
+	os.Remove(u.tmp.Name())
+}
+
+// download streams a file or directory to HQ
+// The runner may have FileWindowChunks unacknowledged chunks in flight so a
+// slow HTTP client cannot stall HQ's read loop for the whole runner
+type download struct {
+	id      string
+	credits chan struct{}
+	cancel  chan struct{}
+	once    sync.Once
+}
+
+func newDownload(id string) *download {
+	d := &download{
+		id:      id,
+		credits: make(chan struct{}, protocol.FileWindowChunks),
+		cancel:  make(chan struct{}),
+	}
+	for i := 0; i < protocol.FileWindowChunks; i++ {
+		d.credits <- struct{}{}
+	}
+	return d
+}
+
+// stop aborts the download at its next chunk
+func (d *download) stop() {
+	d.once.Do(func() {
+		close(d.cancel)
+	})
+}
+
+// handleFileUpload prepares to receive a file from HQ
+func (c *Client) handleFileUpload(msg protocol.Message) {
+	var payload protocol.FileUploadPayload
+	if err := protocol.DecodePayload(msg, &payload); err != nil {
+		c.connLog.Warn("Malformed message", "type", msg.Type, logging.Err(err))
+		return
+	}
+	id := payload.TransferID
+
+	u, err := c.createUpload(payload)
+	if err != nil {
+		c.log.Warn("Rejected upload", "transfer_id", id, "path", payload.Path, logging.Err(err))
+		c.sendTransferError(id, err)
+		return
+	}
+
+	c.transferMu.Lock()
+	c.uploads[id] = u
+	c.transferMu.Unlock()
+
+	c.log.Info("Receiving upload", "transfer_id", id, "path", u.path, "bytes", u.expected)
+	c.writeJSON(protocol.Message{
+		Type: protocol.MessageTypeFileReady,
+		Payload: protocol.FileReadyPayload{
+			TransferID: id,
+			Path:       u.path,
+			Size:       u.expected,
+			Mode:       uint32(u.mode),
+		},
+	})
+}
+
+// createUpload checks an upload against policy and opens its temporary file
+func (c *Client) createUpload(payload protocol.FileUploadPayload) (*upload, error) {
+	path, err := c.resolveTransferPath(payload.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if payload.Size < 0 {
+		return nil, transferErr(protocol.ErrCodeTransferFailed, "invalid size %d", payload.Size)
+	}
+	if c.maxTransferSize > 0 && payload.Size > c.maxTransferSize {
+		return nil, transferErr(protocol.ErrCodeTooLarge,
+			"file size %d exceeds the runner's limit of %d bytes", payload.Size, c.maxTransferSize)
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		if info.IsDir() {
+			return nil, transferErr(protocol.ErrCodeExists, "%s is a directory", path)
+		}
+		if !payload.Overwrite {
+			return nil, transferErr(protocol.ErrCodeExists, "%s already exists", path)
+		}
+	}
+
+	mode := os.FileMode(payload.Mode).Perm()
+	if mode == 0 {
+		mode = 0o644
+	}
+
+	// Write beside the destination so the final rename is atomic
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".upload-*")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, transferErr(protocol.ErrCodeNotFound, "directory %s does not exist", filepath.Dir(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &upload{
+		id:       payload.TransferID,
+		path:     path,
+		mode:     mode,
+		tmp:      tmp,
+		hash:     sha256.New(),
+		expected: payload.Size,
+	}, nil
+}
+
+// receiveUploadChunk appends a binary frame to an upload
+// Returns false if id is not an upload, so the frame is treated as PTY input
+func (c *Client) receiveUploadChunk(id string, data []byte) bool {
+	c.transferMu.Lock()
+	u, exists := c.uploads[id]
+	c.transferMu.Unlock()
+
+	if !exists {
+		return false
+	}
+
+	var err error
+	if u.size+int64(len(data)) > u.expected {
+		err = transferErr(protocol.ErrCodeTooLarge, "received more than the announced %d bytes", u.expected)
+	} else if _, err = u.tmp.Write(data); err == nil {
+		u.hash.Write(data)
+		u.size += int64(len(data))
+		return true
+	}
+
+	c.log.Warn("Upload failed", "transfer_id", id, logging.Err(err))
+	c.takeUpload(id)
+	u.discard()
+	c.sendTransferError(id, err)
+	return true
+}
+
+// handleFileEnd verifies and commits a completed upload
+func (c *Client) handleFileEnd(msg protocol.Message) {
+	var payload protocol.FileEndPayload
+	if err := protocol.DecodePayload(msg, &payload); err != nil {
+		c.connLog.Warn("Malformed message", "type", msg.Type, logging.Err(err))
+		return
+	}
+
+	u := c.takeUpload(payload.TransferID)
+	if u == nil {
+		c.log.Warn("Upload not found", "transfer_id", payload.TransferID)
+		return
+	}
+
+	if err := u.finish(payload); err != nil {
+		c.log.Warn("Upload failed", "transfer_id", u.id, logging.Err(err))
+		c.sendTransferError(u.id, err)
+		return
+	}
+
+	c.log.Info("Upload complete", "transfer_id", u.id, "path", u.path, "bytes", u.size)
+	c.writeJSON(protocol.Message{
+		Type: protocol.MessageTypeFileComplete,
+		Payload: protocol.FileCompletePayload{
+			TransferID: u.id,
+			Path:       u.path,
+			Size:       u.size,
+			SHA256:     payload.SHA256,
+		},
+	})
+}
+
+// handleFileDownload starts streaming a file or directory to HQ
+func (c *Client) handleFileDownload(msg protocol.Message) {
+	var payload protocol.FileDownloadPayload
+	if err := protocol.DecodePayload(msg, &payload); err != nil {
+		c.connLog.Warn("Malformed message", "type", msg.Type, logging.Err(err))
+		return
+	}
+	id := payload.TransferID
+
+	ready, err := c.prepareDownload(payload)
+	if err != nil {
+		c.log.Warn("Rejected download", "transfer_id", id, "path", payload.Path, logging.Err(err))
+		c.sendTransferError(id, err)
+		return
+	}
+
+	d := newDownload(id)
+	c.transferMu.Lock()
+	c.downloads[id] = d
+	c.transferMu.Unlock()
+
+	if err := c.writeJSON(protocol.Message{Type: protocol.MessageTypeFileReady, Payload: ready}); err != nil {
+		c.takeDownload(id)
+		return
+	}
+
+	c.log.Info("Sending download", "transfer_id", id, "path", ready.Path)
+	go c.streamDownload(d, ready)
+}
+
+// prepareDownload checks a download against policy and describes its content
+func (c *Client) prepareDownload(payload protocol.FileDownloadPayload) (protocol.FileReadyPayload, error) {
+	path, err := c.resolveTransferPath(payload.Path)
+	if err != nil {
+		return protocol.FileReadyPayload{}, err
+	}
+
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return protocol.FileReadyPayload{}, transferErr(protocol.ErrCodeNotFound, "%s does not exist", path)
+	}
+	if err != nil {
+		return protocol.FileReadyPayload{}, err
+	}
+
+	ready := protocol.FileReadyPayload{
+		TransferID: payload.TransferID,
+		Path:       path,
+		Mode:       uint32(info.Mode().Perm()),
+	}
+
+	switch {
+	case info.IsDir():
+		ready.IsDir = true
+	case info.Mode().IsRegular():
+		if c.maxTransferSize > 0 && info.Size() > c.maxTransferSize {
+			return protocol.FileReadyPayload{}, transferErr(protocol.ErrCodeTooLarge,
+				"file size %d exceeds the runner's limit of %d bytes", info.Size(), c.maxTransferSize)
+		}
+		ready.Size = info.Size()
+	default:
+		return protocol.FileReadyPayload{}, transferErr(protocol.ErrCodeTransferFailed, "%s is not a regular file or directory", path)
+	}
+
+	return ready, nil
+}
+
+// streamDownload sends a download's chunks followed by file_end
+func (c *Client) streamDownload(d *download, ready protocol.FileReadyPayload) {
+	defer c.takeDownload(d.id)
+
+	w := &chunkWriter{
+		client: c,
+		id:     d.id,
+		d:      d,
+		hash:   sha256.New(),
+		limit:  c.maxTransferSize,
+	}
+
+	var err error
+	if ready.IsDir {
+		err = writeTar(w, ready.Path)
+	} else {
+		err = copyFile(w, ready.Path, ready.Size)
+	}
+	if err == nil {
+		err = w.flush()
+	}
+
+	if errors.Is(err, errTransferCanceled) {
+		c.log.Info("Download canceled", "transfer_id", d.id)
+		return
+	}
+	if err != nil {
+		c.log.Warn("Download failed", "transfer_id", d.id, logging.Err(err))
+		c.sendTransferError(d.id, err)
+		return
+	}
+
+	sum := hex.EncodeToString(w.hash.Sum(nil))
+	c.writeJSON(protocol.Message{
+		Type: protocol.MessageTypeFileEnd,
+		Payload: protocol.FileEndPayload{
+			TransferID: d.id,
+			Size:       w.size,
+			SHA256:     sum,
+		},
+	})
+	c.log.Info("Download complete", "transfer_id", d.id, "path", ready.Path, "bytes", w.size)
+}
+
+// handleFileAck returns flow-control credit to a download
+func (c *Client) handleFileAck(msg protocol.Message) {
+	var payload protocol.FileAckPayload
+	if err := protocol.DecodePayload(msg, &payload); err != nil {
+		c.connLog.Warn("Malformed message", "type", msg.Type, logging.Err(err))
+		return
+	}
+
+	c.transferMu.Lock()
+	d, exists := c.downloads[payload.TransferID]
+	c.transferMu.Unlock()
+
+	if !exists {
+		return
+	}
+
+	for i := 0; i < payload.Chunks; i++ {
+		select {
+		case d.credits <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// handleFileCancel abandons an upload or download
+func (c *Client) handleFileCancel(msg protocol.Message) {
+	var payload protocol.FileCancelPayload
+	if err := protocol.DecodePayload(msg, &payload); err != nil {
+		c.connLog.Warn("Malformed message", "type", msg.Type, logging.Err(err))
+		return
+	}
+
+	if u := c.takeUpload(payload.TransferID); u != nil {
+		u.discard()
+		c.log.Info("Upload canceled", "transfer_id", u.id, "reason", payload.Reason)
+	}
+
+	c.transferMu.Lock()
+	d, exists := c.downloads[payload.TransferID]
+	c.transferMu.Unlock()
+	if exists {
+		d.stop()
+	}
+}
+
+// abortTransfers discards all in-flight transfers after the connection drops
+func (c *Client) abortTransfers() {
+	c.transferMu.Lock()
+	defer c.transferMu.Unlock()
+
+	for id, u := range c.uploads {
+		u.discard()
+		delete(c.uploads, id)
+	}
+	for _, d := range c.downloads {
+		d.stop()
+	}
+}
+
+// takeUpload removes and returns an upload, or nil
+func (c *Client) takeUpload(id string) *upload {
+	c.transferMu.Lock()
+	defer c.transferMu.Unlock()
+
+	u := c.uploads[id]
+	delete(c.uploads, id)
+	return u
+}
+
+// takeDownload removes a download
+func (c *Client) takeDownload(id string) {
+	c.transferMu.Lock()
+	defer c.transferMu.Unlock()
+	delete(c.downloads, id)
+}
+
+// resolveTransferPath applies the allowed-path policy to a requested path
+func (c *Client) resolveTransferPath(path string) (string, error) {
+	if c.paths == nil {
+		return "", transferErr(protocol.ErrCodeTransfersDisabled, "file transfers are disabled on this runner")
+	}
+
+	resolved, err := c.paths.Resolve(path)
+	if errors.Is(err, ErrPathNotAllowed) {
+		return "", &transferError{code: protocol.ErrCodePathNotAllowed, err: err}
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return "", transferErr(protocol.ErrCodeNotFound, "%s does not exist", path)
+	}
+	return resolved, err
+}
+
+// sendTransferError reports a failed transfer to HQ
+func (c *Client) sendTransferError(transferID string, err error) {
+	code := protocol.ErrCodeTransferFailed
+	var terr *transferError
+	if errors.As(err, &terr) {
+		code = terr.code
+	}
+
+	c.writeJSON(protocol.Message{
+		Type: protocol.MessageTypeError,
+		Payload: protocol.ErrorPayload{
+			TransferID: transferID,
+			Message:    err.Error(),
+			Code:       code,
+		},
+	})
+}
+
+// chunkWriter splits a stream into binary frames
+// For downloads it waits for flow-control credit before each frame; artifacts,
+// which HQ writes straight to its store, are sent without it
+type chunkWriter struct {
+	client *Client
+	id     string
+	d      *download // Nil for artifacts
+	buf    []byte
+	hash   hash.Hash
+	size   int64
+	limit  int64
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.limit > 0 && w.size+int64(len(p)) > w.limit {
+		return 0, transferErr(protocol.ErrCodeTooLarge, "download exceeds the runner's limit of %d bytes", w.limit)
+	}
+
+	n := len(p)
+	w.size += int64(n)
+	w.hash.Write(p)
+
+	for len(p) > 0 {
+		take := min(protocol.FileChunkSize-len(w.buf), len(p))
+		w.buf = append(w.buf, p[:take]...)
+		p = p[take:]
+
+		if len(w.buf) == protocol.FileChunkSize {
+			if err := w.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush sends buffered bytes as one chunk
+func (w *chunkWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	if w.d != nil {
+		select {
+		case <-w.d.credits:
+		case <-w.d.cancel:
+			return errTransferCanceled
+		}
+	}
+
+	if err := w.client.sendFrame(w.id, w.buf); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// copyFile streams exactly size bytes of a regular file
+func copyFile(w io.Writer, path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.CopyN(w, f, size); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeTar streams a directory as a tar archive rooted at its base name
+// Symlinks are archived as links rather than followed, so nothing outside
+// the directory is read; sockets, devices and pipes are skipped
+func writeTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	base := filepath.Base(dir)
+
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		var link string
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case !info.IsDir() && !info.Mode().IsRegular():
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(filepath.Join(base, rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			return copyFile(tw, path, hdr.Size)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
@@ -0,0 +1,480 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+)
+
+// ErrGitNotFound is returned when workspaces are configured on a host without git
+var ErrGitNotFound = errors.New("git is required for workspaces but was not found in PATH")
+
+// WorkspaceRetention decides whether a session's workspace outlives the session
+type WorkspaceRetention string
+
+const (
+	RetainNever     WorkspaceRetention = "never"
+	RetainOnFailure WorkspaceRetention = "on-failure" // Keep workspaces of sessions that exit non-zero
+	RetainAlways    WorkspaceRetention = "always"
+)
+
+// defaultGitTimeout bounds preparing or removing a single workspace
+const defaultGitTimeout = 10 * time.Minute
+
+// WorkspaceOptions configures a WorkspaceManager
+type WorkspaceOptions struct {
+	// Cache keeps a bare mirror per repository and adds a worktree per session;
+	// otherwise every session gets a full clone
+	Cache bool
+	// Isolated gives cached checkouts a clone of their own with objects copied from the mirror,
+	// since a worktree's session must be able to write the mirror, which holds every other
+	// session's worktrees and branches; sandboxed sessions need this
+	Isolated bool
+	Retain   WorkspaceRetention
+	// LocalRepos restricts which local repositories may be checked out; nil refuses them
+	LocalRepos *PathPolicy
+	Timeout    time.Duration
+	Logger     *slog.Logger // Defaults to slog's default logger
+}
+
+// WorkspaceManager prepares an isolated git checkout per session
+// Layout: <root>/sessions/<session_id> for checkouts, <root>/mirrors/<hash>.git for the cache
+type WorkspaceManager struct {
+	root    string
+	opts    WorkspaceOptions
+	locks   map[string]*sync.Mutex // mirror path -> lock serializing git commands on it
+	locksMu sync.Mutex
+	log     *slog.Logger
+}
+
+// Workspace is a checkout prepared for one session
+type Workspace struct {
+	Dir    string
+	Base   string // Commit the workspace was prepared at
+	Branch string // Branch created for the session, empty for a detached HEAD
+	mirror string // Bare mirror the worktree belongs to, empty for a standalone clone
+}
+
+// WithWorkspaces lets sessions request a fresh git checkout to run in
+func WithWorkspaces(m *WorkspaceManager) ClientOption {
+	return func(c *Client) {
+		c.workspaces = m
+	}
+}
+
+// NewWorkspaceManager creates the workspace directories under root
+func NewWorkspaceManager(root string, opts WorkspaceOptions) (*WorkspaceManager, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, ErrGitNotFound
+	}
+
+	switch opts.Retain {
+	case "":
+		opts.Retain = RetainNever
+	case RetainNever, RetainOnFailure, RetainAlways:
+	default:
+		return nil, fmt.Errorf("invalid workspace retention %q (expected never, on-failure or always)", opts.Retain)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultGitTimeout
+	}
+
+	for _, dir := range []string{"sessions", "mirrors"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o750); err != nil {
+			return nil, fmt.Errorf("failed to create workspace directory: %w", err)
+		}
+	}
+
+	// Resolve symlinks so session directories can be checked with within()
+	abs, err := filepath.Abs(root)
+	if err == nil {
+		abs, err = filepath.EvalSymlinks(abs)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid workspace directory %q: %w", root, err)
+	}
+
+	return &WorkspaceManager{
+		root:  abs,
+		opts:  opts,
+		locks: make(map[string]*sync.Mutex),
+		log:   logging.Component(opts.Logger, "workspace"),
+	}, nil
+}
+
+// Root returns the directory holding workspaces and the mirror cache
+func (m *WorkspaceManager) Root() string {
+	return m.root
+}
+
+// Prepare checks out spec into a new directory for sessionID
+func (m *WorkspaceManager) Prepare(sessionID string, spec protocol.WorkspaceSpec) (*Workspace, error) {
+	if sessionID == "" || sessionID == "." || sessionID == ".." || filepath.Base(sessionID) != sessionID {
+		return nil, fmt.Errorf("invalid session ID %q", sessionID)
+	}
+	if strings.HasPrefix(spec.Ref, "-") {
+		return nil, fmt.Errorf("invalid ref %q", spec.Ref)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.opts.Timeout)
+	defer cancel()
+
+	if spec.Branch != "" {
+		invalid := strings.HasPrefix(spec.Branch, "-")
+		if !invalid {
+			_, err := m.git(ctx, m.root, "check-ref-format", "--branch", spec.Branch)
+			invalid = err != nil
+		}
+		if invalid {
+			return nil, fmt.Errorf("invalid branch name %q", spec.Branch)
+		}
+	}
+
+	source, err := m.source(spec.Repo)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(m.root, "sessions", sessionID)
+	if _, err := os.Lstat(dir); err == nil {
+		return nil, fmt.Errorf("workspace for session %s already exists", sessionID)
+	}
+
+	var ws *Workspace
+	switch {
+	case m.opts.Cache && m.opts.Isolated:
+		ws, err = m.cloneMirror(ctx, source, dir, spec)
+	case m.opts.Cache:
+		ws, err = m.addWorktree(ctx, source, dir, spec)
+	default:
+		ws, err = m.clone(ctx, source, dir, spec)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	m.log.Info("Prepared workspace", logging.SessionID(sessionID), "dir", dir)
+	return ws, nil
+}
+
+// Release removes a session's workspace unless the retention policy keeps it
+func (m *WorkspaceManager) Release(ws *Workspace, exitCode int) {
+	if m.opts.Retain == RetainAlways || (m.opts.Retain == RetainOnFailure && exitCode != 0) {
+		m.log.Info("Retaining workspace", "dir", ws.Dir, "exit_code", exitCode)
+		return
+	}
+	if err := m.remove(ws); err != nil {
+		m.log.Error("Failed to remove workspace", "dir", ws.Dir, logging.Err(err))
+	}
+}
+
+// writable lists what a sandboxed session needs to write: the checkout, and
+// the mirror a worktree stores its objects and refs in
+func (w *Workspace) writable() []string {
+	if w.mirror == "" {
+		return []string{w.Dir}
+	}
+	return []string{w.Dir, w.mirror}
+}
+
+// Path resolves a session's working directory inside the workspace
+// cwd must be relative; symlinks in the checkout cannot lead outside it
+func (w *Workspace) Path(cwd string) (string, error) {
+	if cwd == "" {
+		return w.Dir, nil
+	}
+	if filepath.IsAbs(cwd) {
+		return "", fmt.Errorf("cwd %q must be relative to the workspace", cwd)
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(w.Dir, cwd))
+	if err != nil {
+		return "", err
+	}
+	if !within(w.Dir, resolved) {
+		return "", fmt.Errorf("cwd %q is outside the workspace", cwd)
+	}
+	return resolved, nil
+}
+
+// source validates a repository location, checking local ones against the allowed paths
+func (m *WorkspaceManager) source(repo string) (string, error) {
+	if repo == "" {
+		return "", errors.New("workspace repository is required")
+	}
+	if strings.HasPrefix(repo, "-") {
+		return "", fmt.Errorf("invalid repository %q", repo)
+	}
+
+	local, isLocal := localRepoPath(repo)
+	if !isLocal {
+		return repo, nil
+	}
+	if m.opts.LocalRepos == nil {
+		return "", errors.New("local repositories are not allowed on this runner")
+	}
+	return m.opts.LocalRepos.Resolve(local)
+}
+
+// localRepoPath returns the filesystem path of a file:// URL or plain path
+func localRepoPath(repo string) (string, bool) {
+	if rest, ok := strings.CutPrefix(repo, "file://"); ok {
+		return rest, true
+	}
+	if strings.Contains(repo, "://") {
+		return "", false
+	}
+	// scp-like syntax (host:path) names a remote unless a slash precedes the colon
+	if i := strings.Index(repo, ":"); i >= 0 && !strings.Contains(repo[:i], "/") {
+		return "", false
+	}
+	return repo, true
+}
+
+// mirrorPath returns where the mirror of source is cached
+func (m *WorkspaceManager) mirrorPath(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return filepath.Join(m.root, "mirrors", hex.EncodeToString(sum[:16])+".git")
+}
+
+// addWorktree checks out spec from the repository's mirror as a new worktree
+func (m *WorkspaceManager) addWorktree(ctx context.Context, source, dir string, spec protocol.WorkspaceSpec) (*Workspace, error) {
+	mirror := m.mirrorPath(source)
+
+	unlock := m.lock(mirror)
+	defer unlock()
+
+	if err := m.syncMirror(ctx, source, mirror); err != nil {
+		return nil, err
+	}
+
+	commit, err := m.resolveRef(ctx, mirror, spec.Ref)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"worktree", "add", "--quiet"}
+	if spec.Branch != "" {
+		args = append(args, "-b", spec.Branch)
+	} else {
+		args = append(args, "--detach")
+	}
+	if _, err := m.git(ctx, mirror, append(args, dir, commit)...); err != nil {
+		return nil, err
+	}
+
+	return &Workspace{Dir: dir, Base: commit, Branch: spec.Branch, mirror: mirror}, nil
+}
+
+// syncMirror creates or refreshes the bare mirror of source
+// Remote branches live under refs/remotes/origin, so fetches never touch the
+// branches sessions create in the mirror
+func (m *WorkspaceManager) syncMirror(ctx context.Context, source, mirror string) error {
+	dir := mirror
+	_, err := os.Stat(mirror)
+	if errors.Is(err, os.ErrNotExist) {
+		dir = mirror + ".tmp"
+		os.RemoveAll(dir)
+		if err := os.Mkdir(dir, 0o750); err != nil {
+			return err
+		}
+		for _, args := range [][]string{
+			{"init", "--quiet", "--bare"},
+			{"remote", "add", "origin", source},
+			{"config", "remote.origin.fetch", "+refs/heads/*:refs/remotes/origin/*"},
+		} {
+			if _, err := m.git(ctx, dir, args...); err != nil {
+				os.RemoveAll(dir)
+				return err
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := m.git(ctx, dir, "fetch", "--quiet", "--prune", "--tags", "origin"); err != nil {
+		if dir != mirror {
+			os.RemoveAll(dir)
+		}
+		return err
+	}
+	// Track the remote's default branch for sessions that do not name a ref;
+	// an empty remote has none
+	m.git(ctx, dir, "remote", "set-head", "origin", "--auto")
+
+	if dir != mirror {
+		if err := os.Rename(dir, mirror); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	return nil
+}
+
+// cloneMirror checks out spec into a standalone clone filled from the repository's mirror
+// Fetching from a local path copies the objects rather than linking them, so nothing in the
+// clone refers back to the mirror; origin is the repository itself, as in any clone
+func (m *WorkspaceManager) cloneMirror(ctx context.Context, source, dir string, spec protocol.WorkspaceSpec) (*Workspace, error) {
+	mirror := m.mirrorPath(source)
+
+	unlock := m.lock(mirror)
+	defer unlock()
+
+	if err := m.syncMirror(ctx, source, mirror); err != nil {
+		return nil, err
+	}
+
+	if err := os.Mkdir(dir, 0o750); err != nil {
+		return nil, err
+	}
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"remote", "add", "origin", source},
+		{"fetch", "--quiet", "--no-tags", mirror, "+refs/remotes/origin/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"},
+	} {
+		if _, err := m.git(ctx, dir, args...); err != nil {
+			return nil, err
+		}
+	}
+	// The wildcard copied the mirror's origin/HEAD as a plain ref; keep it following the default branch
+	if head, err := m.git(ctx, mirror, "symbolic-ref", "--quiet", "refs/remotes/origin/HEAD"); err == nil {
+		if _, err := m.git(ctx, dir, "symbolic-ref", "refs/remotes/origin/HEAD", head); err != nil {
+			return nil, err
+		}
+	}
+
+	return m.checkout(ctx, dir, spec)
+}
+
+// clone checks out spec into a standalone clone
+func (m *WorkspaceManager) clone(ctx context.Context, source, dir string, spec protocol.WorkspaceSpec) (*Workspace, error) {
+	if _, err := m.git(ctx, m.root, "clone", "--quiet", "--no-checkout", "--", source, dir); err != nil {
+		return nil, err
+	}
+	return m.checkout(ctx, dir, spec)
+}
+
+// checkout checks out spec in a clone that has no checkout yet
+func (m *WorkspaceManager) checkout(ctx context.Context, dir string, spec protocol.WorkspaceSpec) (*Workspace, error) {
+	commit, err := m.resolveRef(ctx, dir, spec.Ref)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"checkout", "--quiet"}
+	if spec.Branch != "" {
+		args = append(args, "-b", spec.Branch)
+	} else {
+		args = append(args, "--detach")
+	}
+	if _, err := m.git(ctx, dir, append(args, commit)...); err != nil {
+		return nil, err
+	}
+
+	return &Workspace{Dir: dir, Base: commit, Branch: spec.Branch}, nil
+}
+
+// resolveRef finds the commit for ref, preferring remote branches over tags
+// An empty ref means the remote's default branch
+func (m *WorkspaceManager) resolveRef(ctx context.Context, repo, ref string) (string, error) {
+	candidates := []string{"refs/remotes/origin/HEAD"}
+	if ref != "" {
+		candidates = []string{"refs/remotes/origin/" + ref, "refs/tags/" + ref, ref}
+	}
+
+	for _, candidate := range candidates {
+		commit, err := m.git(ctx, repo, "rev-parse", "--verify", "--quiet", "--end-of-options", candidate+"^{commit}")
+		if err == nil {
+			return commit, nil
+		}
+	}
+
+	if ref == "" {
+		return "", errors.New("repository has no default branch")
+	}
+	return "", fmt.Errorf("ref %q not found", ref)
+}
+
+// remove deletes a workspace and, for worktrees, the session's branch
+func (m *WorkspaceManager) remove(ws *Workspace) error {
+	if ws.mirror == "" {
+		return os.RemoveAll(ws.Dir)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.opts.Timeout)
+	defer cancel()
+
+	unlock := m.lock(ws.mirror)
+	defer unlock()
+
+	if _, err := m.git(ctx, ws.mirror, "worktree", "remove", "--force", ws.Dir); err != nil {
+		// Fall back to deleting the files and pruning the stale registration
+		if err := os.RemoveAll(ws.Dir); err != nil {
+			return err
+		}
+		if _, err := m.git(ctx, ws.mirror, "worktree", "prune"); err != nil {
+			return err
+		}
+	}
+
+	if ws.Branch != "" {
+		if _, err := m.git(ctx, ws.mirror, "branch", "--quiet", "-D", ws.Branch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lock serializes git commands on a mirror and returns the unlock function
+func (m *WorkspaceManager) lock(mirror string) func() {
+	m.locksMu.Lock()
+	l, exists := m.locks[mirror]
+	if !exists {
+		l = &sync.Mutex{}
+		m.locks[mirror] = l
+	}
+	m.locksMu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// git runs a git command in dir and returns its trimmed output
+func (m *WorkspaceManager) git(ctx context.Context, dir string, args ...string) (string, error) {
+	out, err := m.run(ctx, dir, nil, args...)
+	return strings.TrimSpace(string(out)), err
+}
+
+// run runs a git command with extra environment variables and returns its raw output
+// Prompts are disabled so a repository needing credentials fails instead of hanging
+func (m *WorkspaceManager) run(ctx context.Context, dir string, env []string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), env...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("git %s: %s", args[0], msg)
+	}
+	return out, nil
+}
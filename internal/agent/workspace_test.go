@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/codervisor/agent-relay/internal/protocol"
+)
+
+// newTestRepo creates a repository in dir with one commit on main and returns dir
+func newTestRepo(t *testing.T, dir string) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "README.md"), []byte("hello\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"init", "--quiet", "--initial-branch=main"},
+		{"add", "README.md"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "initial"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v: %s", args[0], err, out)
+		}
+	}
+	return dir
+}
+
+func TestWorkspacePrepare(t *testing.T) {
+	repo := newTestRepo(t, t.TempDir())
+	repos, err := NewPathPolicy([]string{repo})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		opts       WorkspaceOptions
+		wantMirror bool // Whether the session must be able to write the mirror
+	}{
+		{name: "clone", opts: WorkspaceOptions{}},
+		{name: "worktree", opts: WorkspaceOptions{Cache: true}, wantMirror: true},
+		{name: "isolated clone from the mirror", opts: WorkspaceOptions{Cache: true, Isolated: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.LocalRepos = repos
+			m, err := NewWorkspaceManager(t.TempDir(), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ws, err := m.Prepare("s1", protocol.WorkspaceSpec{Repo: repo, Branch: "agent/s1"})
+			if err != nil {
+				t.Fatalf("Prepare() error = %v", err)
+			}
+			if data, err := os.ReadFile(filepath.Join(ws.Dir, "README.md")); err != nil || string(data) != "hello\n" {
+				t.Errorf("checkout README.md = %q, %v", data, err)
+			}
+			if ws.Base == "" || ws.Branch != "agent/s1" {
+				t.Errorf("workspace = %+v, want a base commit on branch agent/s1", ws)
+			}
+
+			writable := ws.writable()
+			mirrors := filepath.Join(m.Root(), "mirrors")
+			exposed := slices.ContainsFunc(writable, func(path string) bool { return within(mirrors, path) })
+			if exposed != tt.wantMirror {
+				t.Errorf("writable() = %v; exposes the mirror cache: %v, want %v", writable, exposed, tt.wantMirror)
+			}
+			if _, err := os.Stat(filepath.Join(ws.Dir, ".git", "objects", "info", "alternates")); err == nil {
+				t.Error("checkout borrows objects through alternates")
+			}
+
+			m.Release(ws, 0)
+			if _, err := os.Stat(ws.Dir); !os.IsNotExist(err) {
+				t.Errorf("workspace still exists after Release: %v", err)
+			}
+		})
+	}
+}
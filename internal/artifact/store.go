@@ -0,0 +1,122 @@
+package artifact
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned when an artifact has no stored content
+var ErrNotFound = errors.New("artifact not found")
+
+// Writer receives an artifact's content
+// Nothing is visible to Open until Commit succeeds
+type Writer interface {
+	io.Writer
+	// Commit makes the content available under its name
+	Commit() error
+	// Abort discards the content
+	Abort() error
+}
+
+// Store holds artifact content keyed by session ID and artifact name
+// Metadata such as size and checksum is kept in the state store
+type Store interface {
+	// Create begins writing an artifact, replacing any existing one on commit
+	Create(sessionID, name string) (Writer, error)
+	// Open returns an artifact for reading, or ErrNotFound
+	Open(sessionID, name string) (io.ReadCloser, error)
+}
+
+// ValidName reports whether name is a clean, relative, slash-separated path
+// Names come from runners, so they must not be trusted as path components
+func ValidName(name string) bool {
+	if name == "" || strings.ContainsAny(name, "\\\x00") || path.IsAbs(name) || path.Clean(name) != name {
+		return false
+	}
+	return name != ".." && !strings.HasPrefix(name, "../")
+}
+
+// DirStore stores artifacts as files under <dir>/<session_id>/<name>
+type DirStore struct {
+	dir string
+}
+
+// NewDirStore creates the directory if needed and returns a store rooted there
+func NewDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create artifact directory: %w", err)
+	}
+	return &DirStore{dir: dir}, nil
+}
+
+// Create begins writing an artifact into a temporary file beside its destination
+func (d *DirStore) Create(sessionID, name string) (Writer, error) {
+	dest, err := d.path(sessionID, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create artifact directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{File: tmp, dest: dest}, nil
+}
+
+// Open returns an artifact for reading
+func (d *DirStore) Open(sessionID, name string) (io.ReadCloser, error) {
+	p, err := d.path(sessionID, name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// path maps a session ID and artifact name to a file inside the store
+func (d *DirStore) path(sessionID, name string) (string, error) {
+	if sessionID == "" || sessionID == "." || sessionID == ".." ||
+		strings.ContainsAny(sessionID, `/\`) || strings.ContainsRune(sessionID, 0) {
+		return "", fmt.Errorf("invalid session ID %q", sessionID)
+	}
+	if !ValidName(name) {
+		return "", fmt.Errorf("invalid artifact name %q", name)
+	}
+	return filepath.Join(d.dir, sessionID, filepath.FromSlash(name)), nil
+}
+
+// fileWriter renames its temporary file into place on commit
+type fileWriter struct {
+	*os.File
+	dest string
+}
+
+func (w *fileWriter) Commit() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	if err := os.Rename(w.File.Name(), w.dest); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	return nil
+}
+
+func (w *fileWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
@@ -0,0 +1,33 @@
+package artifact
+
+import "testing"
+
+func TestValidName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"report.txt", true},
+		{"dist/app.tar.gz", true},
+		{"a/b/c", true},
+		{".hidden", true},
+		{"dir/..file", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"..", false},
+		{"../escape", false},
+		{"dir/../../escape", false},
+		{"dir/../file", false},
+		{"./file", false},
+		{"dir/", false},
+		{"dir//file", false},
+		{`dir\file`, false},
+		{"file\x00.txt", false},
+	}
+
+	for _, tt := range tests {
+		if got := ValidName(tt.name); got != tt.want {
+			t.Errorf("ValidName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
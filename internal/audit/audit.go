@@ -0,0 +1,158 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+)
+
+// EventType identifies a security-relevant action
+type EventType string
+
+const (
+	EventRunnerRegistered     EventType = "runner.registered"
+	EventRunnerRejected       EventType = "runner.rejected"
+	EventRunnerDrainRequested EventType = "runner.drain_requested"
+	EventClientAuthenticated  EventType = "client.authenticated"
+	EventSessionStarted       EventType = "session.started"
+	EventSessionEnded         EventType = "session.ended"
+	EventControlTaken         EventType = "session.control_taken"
+	EventControlReleased      EventType = "session.control_released"
+	EventSessionKilled        EventType = "session.killed"
+	EventPolicyDenied         EventType = "policy.denied"
+	EventFileUploaded         EventType = "file.uploaded"
+	EventFileDownloaded       EventType = "file.downloaded"
+	EventApprovalRequested    EventType = "approval.requested"
+	EventApprovalDecided      EventType = "approval.decided"
+	EventConfigReloaded       EventType = "config.reloaded"
+)
+
+// Event is a single audit record
+// Seq, PrevHash and Hash are assigned by sinks that chain records
+type Event struct {
+	Seq        uint64                 `json:"seq,omitempty"`
+	Time       time.Time              `json:"time"`
+	Type       EventType              `json:"type"`
+	User       string                 `json:"user,omitempty"`
+	RunnerID   string                 `json:"runner_id,omitempty"`
+	SessionID  string                 `json:"session_id,omitempty"`
+	RemoteAddr string                 `json:"remote_addr,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	PrevHash   string                 `json:"prev_hash,omitempty"`
+	Hash       string                 `json:"hash,omitempty"`
+}
+
+// Filter narrows Query results; zero values match everything
+type Filter struct {
+	Since     time.Time
+	Until     time.Time
+	Type      EventType
+	User      string
+	RunnerID  string
+	SessionID string
+	Limit     int
+}
+
+// Matches reports whether ev satisfies the filter
+func (f Filter) Matches(ev Event) bool {
+	if !f.Since.IsZero() && ev.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !ev.Time.Before(f.Until) {
+		return false
+	}
+	if f.Type != "" && ev.Type != f.Type {
+		return false
+	}
+	if f.User != "" && ev.User != f.User {
+		return false
+	}
+	if f.RunnerID != "" && ev.RunnerID != f.RunnerID {
+		return false
+	}
+	if f.SessionID != "" && ev.SessionID != f.SessionID {
+		return false
+	}
+	return true
+}
+
+// ErrQueryUnsupported is returned when the sink cannot be read back or verified
+var ErrQueryUnsupported = errors.New("audit sink does not support queries")
+
+// Sink receives audit events; implementations must only ever append
+type Sink interface {
+	Write(ev Event) error
+	Close() error
+}
+
+// Querier is implemented by sinks that can read events back
+type Querier interface {
+	Query(ctx context.Context, filter Filter) ([]Event, error)
+}
+
+// Verifier is implemented by sinks that can check their own integrity
+type Verifier interface {
+	// Verify returns the number of intact events, or an error at the first broken link
+	Verify() (uint64, error)
+}
+
+// Logger records audit events to a sink
+// A nil *Logger discards events, so callers need not check whether auditing is enabled
+type Logger struct {
+	sink Sink
+}
+
+// NewLogger creates a logger writing to sink
+func NewLogger(sink Sink) *Logger {
+	return &Logger{sink: sink}
+}
+
+// Record stamps and writes an event
+// Failures are logged rather than returned; auditing must not break the relay
+func (l *Logger) Record(ev Event) {
+	if l == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+
+	if err := l.sink.Write(ev); err != nil {
+		slog.Error("Failed to record audit event", logging.KeyComponent, "audit", "type", ev.Type, logging.Err(err))
+	}
+}
+
+// Query reads back events from the sink if it supports it
+func (l *Logger) Query(ctx context.Context, filter Filter) ([]Event, error) {
+	if l == nil {
+		return nil, ErrQueryUnsupported
+	}
+	q, ok := l.sink.(Querier)
+	if !ok {
+		return nil, ErrQueryUnsupported
+	}
+	return q.Query(ctx, filter)
+}
+
+// Verify checks the sink's integrity if it supports it
+func (l *Logger) Verify() (uint64, error) {
+	if l == nil {
+		return 0, ErrQueryUnsupported
+	}
+	v, ok := l.sink.(Verifier)
+	if !ok {
+		return 0, ErrQueryUnsupported
+	}
+	return v.Verify()
+}
+
+// Close closes the underlying sink
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.sink.Close()
+}
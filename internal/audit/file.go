@@ -0,0 +1,215 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// maxLineSize bounds a single audit record when reading the log back
+const maxLineSize = 1 << 20
+
+// FileSink appends events to a JSON lines file
+// Each event carries the hash of its predecessor, so editing or deleting a
+// line breaks the chain and is detected by Verify
+type FileSink struct {
+	path     string
+	f        *os.File
+	seq      uint64
+	prevHash string
+	mu       sync.Mutex
+}
+
+// NewFileSink opens path for appending, resuming the hash chain from its last event
+func NewFileSink(path string) (*FileSink, error) {
+	s := &FileSink{path: path}
+
+	// Resume the chain; refuse to append to a log that has already been tampered with
+	last, err := verifyFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("existing audit log failed verification: %w", err)
+	}
+	s.seq = last.Seq
+	s.prevHash = last.Hash
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	s.f = f
+
+	return s, nil
+}
+
+// Write chains and appends an event
+func (s *FileSink) Write(ev Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ev.Seq = s.seq + 1
+	ev.PrevHash = s.prevHash
+	hash, err := eventHash(ev)
+	if err != nil {
+		return err
+	}
+	ev.Hash = hash
+
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if _, err := s.f.Write(line); err != nil {
+		return fmt.Errorf("failed to append audit event: %w", err)
+	}
+	if err := s.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync audit log: %w", err)
+	}
+
+	s.seq = ev.Seq
+	s.prevHash = ev.Hash
+	return nil
+}
+
+// Query scans the log for matching events, oldest first
+// With a limit, the most recent matching events are returned
+func (s *FileSink) Query(ctx context.Context, filter Filter) ([]Event, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+
+	events := make([]Event, 0)
+	err = scanEvents(f, func(ev Event) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if filter.Matches(ev) {
+			events = append(events, ev)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[len(events)-filter.Limit:]
+	}
+	return events, nil
+}
+
+// Verify checks the log's hash chain
+func (s *FileSink) Verify() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last, err := verifyFile(s.path)
+	return last.Seq, err
+}
+
+// Close closes the log file
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+// verifyFile checks every link of the chain and returns the last event
+func verifyFile(path string) (Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Event{}, err
+	}
+	defer f.Close()
+
+	var last Event
+	err = scanEvents(f, func(ev Event) error {
+		if ev.Seq != last.Seq+1 {
+			return fmt.Errorf("event %d: expected sequence %d", ev.Seq, last.Seq+1)
+		}
+		if ev.PrevHash != last.Hash {
+			return fmt.Errorf("event %d: previous hash mismatch", ev.Seq)
+		}
+		hash, err := eventHash(ev)
+		if err != nil {
+			return err
+		}
+		if hash != ev.Hash {
+			return fmt.Errorf("event %d: content does not match its hash", ev.Seq)
+		}
+		last = ev
+		return nil
+	})
+	return last, err
+}
+
+// scanEvents decodes each line of r
+func scanEvents(r io.Reader, fn func(Event) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return fmt.Errorf("malformed audit record: %w", err)
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// eventHash is the SHA-256 of the event's JSON encoding with Hash cleared
+// PrevHash is included, which links each event to the one before it
+func eventHash(ev Event) (string, error) {
+	ev.Hash = ""
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode audit event: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// WriterSink writes unchained JSON lines to w, e.g. stdout for a log collector
+type WriterSink struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// NewWriterSink creates a sink writing to w
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// Write appends an event as a JSON line
+func (s *WriterSink) Write(ev Event) error {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// Close is a no-op; the caller owns w
+func (s *WriterSink) Close() error {
+	return nil
+}
@@ -0,0 +1,134 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeLog writes three chained events for runnerID to a new log and returns its lines
+func writeLog(t *testing.T, path, runnerID string) []string {
+	t.Helper()
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range []EventType{EventRunnerRegistered, EventSessionStarted, EventSessionEnded} {
+		if err := sink.Write(Event{Type: typ, RunnerID: runnerID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestFileSinkVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(lines []string) []string
+		wantSeq uint64
+		wantErr string
+	}{
+		{
+			name:    "untouched",
+			tamper:  func(lines []string) []string { return lines },
+			wantSeq: 3,
+		},
+		{
+			name:    "last event removed",
+			tamper:  func(lines []string) []string { return lines[:2] },
+			wantSeq: 2,
+		},
+		{
+			name: "field edited",
+			tamper: func(lines []string) []string {
+				lines[1] = strings.Replace(lines[1], `"runner_id":"r1"`, `"runner_id":"r2"`, 1)
+				return lines
+			},
+			wantErr: "event 2: content does not match its hash",
+		},
+		{
+			name:    "event removed",
+			tamper:  func(lines []string) []string { return []string{lines[0], lines[2]} },
+			wantErr: "event 3: expected sequence 2",
+		},
+		{
+			name:    "events reordered",
+			tamper:  func(lines []string) []string { return []string{lines[1], lines[0], lines[2]} },
+			wantErr: "event 2: expected sequence 1",
+		},
+		{
+			name: "event replaced by one from another log",
+			tamper: func(lines []string) []string {
+				other := writeLog(t, filepath.Join(t.TempDir(), "other.log"), "r2")
+				lines[1] = other[1]
+				return lines
+			},
+			wantErr: "event 2: previous hash mismatch",
+		},
+		{
+			name: "malformed line",
+			tamper: func(lines []string) []string {
+				return append(lines, "{not json")
+			},
+			wantErr: "malformed audit record",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			lines := tt.tamper(writeLog(t, path, "r1"))
+			if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			last, err := verifyFile(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("verifyFile() error = %v, want %q", err, tt.wantErr)
+				}
+				if _, err := NewFileSink(path); err == nil {
+					t.Error("NewFileSink() appended to a tampered log")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyFile() error = %v", err)
+			}
+			if last.Seq != tt.wantSeq {
+				t.Errorf("last sequence = %d, want %d", last.Seq, tt.wantSeq)
+			}
+		})
+	}
+}
+
+func TestFileSinkResumesChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeLog(t, path, "r1")
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	if err := sink.Write(Event{Type: EventConfigReloaded}); err != nil {
+		t.Fatal(err)
+	}
+
+	seq, err := sink.Verify()
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if seq != 4 {
+		t.Errorf("Verify() = %d, want 4", seq)
+	}
+}
@@ -0,0 +1,139 @@
+// Package config loads HQ's and the runner's configuration files and the environment variables that override them
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+)
+
+// envVar overrides a setting from the environment when it is set
+type envVar struct {
+	name string
+	set  func(value string) error
+}
+
+// readFile decodes a YAML configuration file into v, refusing unknown keys
+func readFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := yaml.UnmarshalWithOptions(data, v, yaml.Strict()); err != nil {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv applies every set environment variable, reporting each one that does not parse
+func applyEnv(lookup func(string) (string, bool), vars []envVar) error {
+	var errs []error
+	for _, v := range vars {
+		value, ok := lookup(v.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := v.set(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", v.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func envString(name string, dst *string) envVar {
+	return envVar{name, func(value string) error {
+		*dst = value
+		return nil
+	}}
+}
+
+func envBool(name string, dst *bool) envVar {
+	return envVar{name, func(value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", value)
+		}
+		*dst = b
+		return nil
+	}}
+}
+
+func envDuration(name string, dst *time.Duration) envVar {
+	return envVar{name, func(value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("expected a duration such as 30s or 720h, got %q", value)
+		}
+		*dst = d
+		return nil
+	}}
+}
+
+func envInt64(name string, dst *int64) envVar {
+	return envVar{name, func(value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", value)
+		}
+		*dst = n
+		return nil
+	}}
+}
+
+func envInt(name string, dst *int) envVar {
+	return envVar{name, func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", value)
+		}
+		*dst = n
+		return nil
+	}}
+}
+
+// envList splits a list on sep; strings.Fields is used when sep is empty
+func envList(name, sep string, dst *[]string) envVar {
+	return envVar{name, func(value string) error {
+		if sep == "" {
+			*dst = strings.Fields(value)
+			return nil
+		}
+		var list []string
+		for _, item := range strings.Split(value, sep) {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*dst = list
+		return nil
+	}}
+}
+
+// checker collects validation errors, each prefixed with the setting's path in the file
+type checker struct {
+	errs []error
+}
+
+func (c *checker) check(ok bool, key, format string, args ...interface{}) {
+	if !ok {
+		c.errs = append(c.errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+}
+
+func (c *checker) oneOf(key, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	c.check(false, key, "unknown value %q (expected %s)", value, strings.Join(allowed, ", "))
+}
+
+func (c *checker) err() error {
+	return errors.Join(c.errs...)
+}
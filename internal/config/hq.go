@@ -0,0 +1,441 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/profile"
+	"github.com/codervisor/agent-relay/internal/server"
+	"github.com/codervisor/agent-relay/internal/tracing"
+)
+
+// HQ is HQ's configuration
+// Settings come from the defaults, then the YAML file, then environment variables
+type HQ struct {
+	Listen               []string        `yaml:"listen"` // Addresses HQ serves on, e.g. ":8080"
+	TLS                  ServerTLSConfig `yaml:"tls"`
+	Origins              OriginsConfig   `yaml:"origins"`
+	Web                  WebConfig       `yaml:"web"`
+	Log                  LogConfig       `yaml:"log"`
+	Tracing              TracingConfig   `yaml:"tracing"`
+	Auth                 AuthConfig      `yaml:"auth"`
+	Store                StoreConfig     `yaml:"store"`
+	Audit                AuditConfig     `yaml:"audit"`
+	Recording            RecordingConfig `yaml:"recording"`
+	Artifacts            ArtifactsConfig `yaml:"artifacts"`
+	Profiles             ProfilesConfig  `yaml:"profiles"`
+	Approvals            ApprovalsConfig `yaml:"approvals"`
+	Limits               LimitsConfig    `yaml:"limits"`
+	Quotas               QuotasConfig    `yaml:"quotas"`
+	LatencyProbeInterval time.Duration   `yaml:"latency_probe_interval"` // 0 disables probes
+	Shutdown             ShutdownConfig  `yaml:"shutdown"`
+
+	profileSet *profile.Set
+}
+
+// ServerTLSConfig configures HTTPS and runner client certificates; no cert serves plain HTTP
+type ServerTLSConfig struct {
+	Cert              string `yaml:"cert"` // PEM files, reloaded when they change
+	Key               string `yaml:"key"`
+	ClientCA          string `yaml:"client_ca"`           // CA bundle runner client certificates are verified against
+	RequireRunnerCert bool   `yaml:"require_runner_cert"` // Refuse runners without a certificate from client_ca
+}
+
+// OriginsConfig lists the web origins besides HQ's own that may use its API and websockets
+type OriginsConfig struct {
+	Allowed []string `yaml:"allowed"` // e.g. https://agents.example.com; "*" allows any
+	Dev     bool     `yaml:"dev"`     // Also allow pages on localhost, for the web UI's dev server
+}
+
+// WebConfig configures the web UI HQ serves from /
+type WebConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"` // Serve the UI from this directory instead of the one built into the binary
+}
+
+// LogConfig configures structured logging
+type LogConfig struct {
+	Format string `yaml:"format"` // text or json
+	Level  string `yaml:"level"`  // debug, info, warn or error
+}
+
+// TracingConfig configures OpenTelemetry traces
+type TracingConfig struct {
+	Exporter string `yaml:"exporter"` // otlp, console or none
+}
+
+// AuthConfig configures who may connect to HQ
+type AuthConfig struct {
+	RunnerTokens []string `yaml:"runner_tokens"` // Empty accepts any non-empty token
+}
+
+// StoreConfig configures where runner, session and job state is kept
+type StoreConfig struct {
+	Driver    string          `yaml:"driver"` // sqlite or memory
+	Path      string          `yaml:"path"`
+	Retention RetentionConfig `yaml:"retention"`
+}
+
+// RetentionConfig sets how long finished records are kept; 0 keeps them forever
+type RetentionConfig struct {
+	Sessions time.Duration `yaml:"sessions"`
+	Jobs     time.Duration `yaml:"jobs"`
+	Runners  time.Duration `yaml:"runners"`
+}
+
+// AuditConfig configures the audit log
+type AuditConfig struct {
+	Sink string `yaml:"sink"` // file, stdout or off
+	Path string `yaml:"path"`
+}
+
+// RecordingConfig configures session recording
+type RecordingConfig struct {
+	Mode           string   `yaml:"mode"` // off, requested or all
+	Dir            string   `yaml:"dir"`
+	Input          bool     `yaml:"input"`
+	Redact         bool     `yaml:"redact"`
+	RedactPatterns []string `yaml:"redact_patterns"`
+}
+
+// ArtifactsConfig configures where collected artifacts are stored
+type ArtifactsConfig struct {
+	Store string `yaml:"store"` // dir or off
+	Dir   string `yaml:"dir"`
+}
+
+// ProfilesConfig configures agent profiles, from a file or defined inline
+type ProfilesConfig struct {
+	Path        string                     `yaml:"path"`
+	Definitions map[string]profile.Profile `yaml:"definitions"`
+	Require     bool                       `yaml:"require"`
+}
+
+// ApprovalsConfig configures how long approval requests wait for a human
+type ApprovalsConfig struct {
+	Timeout    time.Duration `yaml:"timeout"`
+	MaxTimeout time.Duration `yaml:"max_timeout"`
+}
+
+// LimitsConfig caps what a single request may use
+type LimitsConfig struct {
+	MaxTransferSize int64 `yaml:"max_transfer_size"` // Bytes per file transfer; 0 = no limit
+}
+
+// QuotasConfig caps what one user, runner, address or connection may use; 0 = no limit
+type QuotasConfig struct {
+	SessionsPerUser         int   `yaml:"sessions_per_user"` // Sessions running at once, jobs included
+	SessionsPerRunner       int   `yaml:"sessions_per_runner"`
+	SessionsPerMinute       int   `yaml:"sessions_per_minute"`        // New sessions and jobs per user
+	RegistrationsPerMinute  int   `yaml:"registrations_per_minute"`   // Runner registration attempts per client IP
+	MaxFrameSize            int64 `yaml:"max_frame_size"`             // Bytes per websocket message from a client
+	MessagesPerSecond       int   `yaml:"messages_per_second"`        // Per client connection
+	RunnerMessagesPerSecond int   `yaml:"runner_messages_per_second"` // Per runner connection, read more slowly when exceeded
+
+	// Addresses or CIDR ranges of the authenticating proxy; only its X-Forwarded-User
+	// keys the per-user quotas, anyone else's sessions count against their address
+	TrustedProxies []string `yaml:"trusted_proxies"`
+}
+
+// ShutdownConfig configures graceful shutdown
+type ShutdownConfig struct {
+	Timeout        time.Duration `yaml:"timeout"`
+	ReconnectDelay time.Duration `yaml:"reconnect_delay"`
+}
+
+// DefaultHQ returns HQ's configuration when nothing is set
+func DefaultHQ() *HQ {
+	return &HQ{
+		Listen:  []string{":8080"},
+		Web:     WebConfig{Enabled: true},
+		Log:     LogConfig{Format: "text", Level: "info"},
+		Tracing: TracingConfig{Exporter: tracing.ExporterNone},
+		Store: StoreConfig{
+			Driver: "sqlite",
+			Path:   "agent-relay.db",
+			Retention: RetentionConfig{
+				Sessions: 30 * 24 * time.Hour,
+				Jobs:     30 * 24 * time.Hour,
+				Runners:  7 * 24 * time.Hour,
+			},
+		},
+		Audit:                AuditConfig{Sink: "file", Path: "audit.log"},
+		Recording:            RecordingConfig{Mode: "requested", Dir: "recordings", Redact: true},
+		Artifacts:            ArtifactsConfig{Store: "dir", Dir: "artifacts"},
+		Approvals:            ApprovalsConfig{Timeout: server.DefaultApprovalTimeout, MaxTimeout: server.DefaultMaxApprovalTimeout},
+		Limits:               LimitsConfig{MaxTransferSize: server.DefaultMaxTransferSize},
+		LatencyProbeInterval: server.DefaultLatencyProbeInterval,
+		Shutdown:             ShutdownConfig{Timeout: 30 * time.Second, ReconnectDelay: 5 * time.Second},
+	}
+}
+
+// LoadHQ reads the file at path, if any, over the defaults, applies environment
+// overrides and validates the result, loading the agent profiles it names
+func LoadHQ(path string) (*HQ, error) {
+	c := DefaultHQ()
+	if path != "" {
+		if err := readFile(path, c); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyEnv(os.LookupEnv, c.env()); err != nil {
+		return nil, fmt.Errorf("invalid environment:\n%w", err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	if err := c.loadProfiles(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// env lists the environment variables that override file settings
+func (c *HQ) env() []envVar {
+	return []envVar{
+		{"PORT", func(port string) error {
+			c.Listen = []string{":" + port}
+			return nil
+		}},
+		envList("LISTEN", ",", &c.Listen),
+		envString("TLS_CERT", &c.TLS.Cert),
+		envString("TLS_KEY", &c.TLS.Key),
+		envString("TLS_CLIENT_CA", &c.TLS.ClientCA),
+		envBool("TLS_REQUIRE_RUNNER_CERT", &c.TLS.RequireRunnerCert),
+		envList("ALLOWED_ORIGINS", ",", &c.Origins.Allowed),
+		envBool("ORIGINS_DEV", &c.Origins.Dev),
+		envBool("WEB_UI", &c.Web.Enabled),
+		envString("WEB_DIR", &c.Web.Dir),
+		envString("LOG_FORMAT", &c.Log.Format),
+		envString("LOG_LEVEL", &c.Log.Level),
+		envString("OTEL_TRACES_EXPORTER", &c.Tracing.Exporter),
+		envList("RUNNER_TOKENS", ",", &c.Auth.RunnerTokens),
+		envString("STORE_DRIVER", &c.Store.Driver),
+		envString("STORE_PATH", &c.Store.Path),
+		envDuration("RETENTION_SESSIONS", &c.Store.Retention.Sessions),
+		envDuration("RETENTION_JOBS", &c.Store.Retention.Jobs),
+		envDuration("RETENTION_RUNNERS", &c.Store.Retention.Runners),
+		envString("AUDIT_SINK", &c.Audit.Sink),
+		envString("AUDIT_PATH", &c.Audit.Path),
+		envString("RECORD_SESSIONS", &c.Recording.Mode),
+		envString("RECORDING_DIR", &c.Recording.Dir),
+		envBool("RECORD_INPUT", &c.Recording.Input),
+		envBool("RECORD_REDACT", &c.Recording.Redact),
+		envList("REDACT_PATTERNS", "", &c.Recording.RedactPatterns), // Use \s inside a pattern
+		envString("ARTIFACT_STORE", &c.Artifacts.Store),
+		envString("ARTIFACT_DIR", &c.Artifacts.Dir),
+		envString("PROFILES_PATH", &c.Profiles.Path),
+		envBool("REQUIRE_PROFILE", &c.Profiles.Require),
+		envDuration("APPROVAL_TIMEOUT", &c.Approvals.Timeout),
+		envDuration("APPROVAL_MAX_TIMEOUT", &c.Approvals.MaxTimeout),
+		envInt64("TRANSFER_MAX_SIZE", &c.Limits.MaxTransferSize),
+		envInt("QUOTA_SESSIONS_PER_USER", &c.Quotas.SessionsPerUser),
+		envInt("QUOTA_SESSIONS_PER_RUNNER", &c.Quotas.SessionsPerRunner),
+		envInt("QUOTA_SESSIONS_PER_MINUTE", &c.Quotas.SessionsPerMinute),
+		envInt("QUOTA_REGISTRATIONS_PER_MINUTE", &c.Quotas.RegistrationsPerMinute),
+		envInt64("QUOTA_MAX_FRAME_SIZE", &c.Quotas.MaxFrameSize),
+		envInt("QUOTA_MESSAGES_PER_SECOND", &c.Quotas.MessagesPerSecond),
+		envInt("QUOTA_RUNNER_MESSAGES_PER_SECOND", &c.Quotas.RunnerMessagesPerSecond),
+		envList("QUOTA_TRUSTED_PROXIES", ",", &c.Quotas.TrustedProxies),
+		envDuration("LATENCY_PROBE_INTERVAL", &c.LatencyProbeInterval),
+		envDuration("SHUTDOWN_TIMEOUT", &c.Shutdown.Timeout),
+		envDuration("SHUTDOWN_RECONNECT_DELAY", &c.Shutdown.ReconnectDelay),
+	}
+}
+
+// validate reports every invalid setting, named by its path in the file
+func (c *HQ) validate() error {
+	var v checker
+
+	v.check(len(c.Listen) > 0, "listen", "at least one address is required")
+	for i, addr := range c.Listen {
+		v.check(strings.Contains(addr, ":"), fmt.Sprintf("listen[%d]", i), "expected host:port or :port, got %q", addr)
+	}
+
+	v.check((c.TLS.Cert == "") == (c.TLS.Key == ""), "tls", "set both cert and key, or neither")
+	v.check(c.TLS.ClientCA == "" || c.TLS.Cert != "", "tls.client_ca", "needs cert and key")
+	v.check(!c.TLS.RequireRunnerCert || c.TLS.ClientCA != "", "tls.require_runner_cert", "needs client_ca")
+
+	for i, origin := range c.Origins.Allowed {
+		if origin != server.AnyOrigin {
+			_, err := server.NormalizeOrigin(origin)
+			v.check(err == nil, fmt.Sprintf("origins.allowed[%d]", i), "%v", err)
+		}
+	}
+
+	v.check(c.Web.Enabled || c.Web.Dir == "", "web.dir", "needs the web UI enabled")
+
+	v.oneOf("log.format", c.Log.Format, "text", "json")
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		v.check(false, "log.level", "%v", err)
+	}
+	v.oneOf("tracing.exporter", strings.ToLower(c.Tracing.Exporter), tracing.ExporterOTLP, tracing.ExporterConsole, tracing.ExporterNone)
+
+	for i, token := range c.Auth.RunnerTokens {
+		v.check(token != "", fmt.Sprintf("auth.runner_tokens[%d]", i), "must not be empty")
+	}
+
+	v.oneOf("store.driver", c.Store.Driver, "sqlite", "memory")
+	v.check(c.Store.Driver != "sqlite" || c.Store.Path != "", "store.path", "required for the sqlite driver")
+	v.check(c.Store.Retention.Sessions >= 0, "store.retention.sessions", "must not be negative")
+	v.check(c.Store.Retention.Jobs >= 0, "store.retention.jobs", "must not be negative")
+	v.check(c.Store.Retention.Runners >= 0, "store.retention.runners", "must not be negative")
+
+	v.oneOf("audit.sink", c.Audit.Sink, "file", "stdout", "off")
+	v.check(c.Audit.Sink != "file" || c.Audit.Path != "", "audit.path", "required for the file sink")
+
+	v.oneOf("recording.mode", c.Recording.Mode, "off", "requested", "all")
+	v.check(c.Recording.Mode == "off" || c.Recording.Dir != "", "recording.dir", "required unless recording is off")
+	for i, pattern := range c.Recording.RedactPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			v.check(false, fmt.Sprintf("recording.redact_patterns[%d]", i), "%v", err)
+		}
+	}
+
+	v.oneOf("artifacts.store", c.Artifacts.Store, "dir", "off")
+	v.check(c.Artifacts.Store != "dir" || c.Artifacts.Dir != "", "artifacts.dir", "required for the dir store")
+
+	v.check(c.Profiles.Path == "" || len(c.Profiles.Definitions) == 0, "profiles", "set either path or definitions, not both")
+	v.check(!c.Profiles.Require || c.Profiles.Path != "" || len(c.Profiles.Definitions) > 0,
+		"profiles.require", "needs profiles from path or definitions")
+
+	v.check(c.Approvals.Timeout > 0, "approvals.timeout", "must be positive")
+	v.check(c.Approvals.MaxTimeout >= 0, "approvals.max_timeout", "must not be negative")
+	v.check(c.Limits.MaxTransferSize >= 0, "limits.max_transfer_size", "must not be negative")
+	v.check(c.Quotas.SessionsPerUser >= 0, "quotas.sessions_per_user", "must not be negative")
+	v.check(c.Quotas.SessionsPerRunner >= 0, "quotas.sessions_per_runner", "must not be negative")
+	v.check(c.Quotas.SessionsPerMinute >= 0, "quotas.sessions_per_minute", "must not be negative")
+	v.check(c.Quotas.RegistrationsPerMinute >= 0, "quotas.registrations_per_minute", "must not be negative")
+	v.check(c.Quotas.MaxFrameSize == 0 || c.Quotas.MaxFrameSize >= server.MinFrameSizeLimit, "quotas.max_frame_size",
+		"must be 0 or at least %d bytes, so file transfer chunks fit", server.MinFrameSizeLimit)
+	v.check(c.Quotas.MessagesPerSecond >= 0, "quotas.messages_per_second", "must not be negative")
+	v.check(c.Quotas.RunnerMessagesPerSecond >= 0, "quotas.runner_messages_per_second", "must not be negative")
+	for i, proxy := range c.Quotas.TrustedProxies {
+		if _, err := parsePrefix(proxy); err != nil {
+			v.check(false, fmt.Sprintf("quotas.trusted_proxies[%d]", i), "%v", err)
+		}
+	}
+	v.check(c.LatencyProbeInterval >= 0, "latency_probe_interval", "must not be negative")
+	v.check(c.Shutdown.Timeout > 0, "shutdown.timeout", "must be positive")
+	v.check(c.Shutdown.ReconnectDelay >= 0, "shutdown.reconnect_delay", "must not be negative")
+
+	return v.err()
+}
+
+// loadProfiles reads or builds the configured profiles
+func (c *HQ) loadProfiles() error {
+	var err error
+	switch {
+	case c.Profiles.Path != "":
+		c.profileSet, err = profile.Load(c.Profiles.Path)
+	case len(c.Profiles.Definitions) > 0:
+		c.profileSet, err = profile.New(c.Profiles.Definitions)
+	}
+	if err != nil {
+		return fmt.Errorf("profiles: %w", err)
+	}
+	return nil
+}
+
+// ProfileSet returns the loaded agent profiles, or nil if none are configured
+func (c *HQ) ProfileSet() *profile.Set {
+	return c.profileSet
+}
+
+// LogLevel returns the parsed log level
+func (c *HQ) LogLevel() slog.Level {
+	level, _ := logging.ParseLevel(c.Log.Level) // Checked by validate
+	return level
+}
+
+// Policy returns the hub settings that can change while HQ runs
+func (c *HQ) Policy() server.Policy {
+	return server.Policy{
+		Profiles:           c.profileSet,
+		RequireProfile:     c.Profiles.Require,
+		ApprovalTimeout:    c.Approvals.Timeout,
+		MaxApprovalTimeout: c.Approvals.MaxTimeout,
+		RunnerTokens:       c.Auth.RunnerTokens,
+		Origins:            c.originPolicy(),
+		Quotas: server.Quotas{
+			SessionsPerUser:   c.Quotas.SessionsPerUser,
+			SessionsPerRunner: c.Quotas.SessionsPerRunner,
+			SessionRate:       server.Rate{Events: c.Quotas.SessionsPerMinute, Per: time.Minute},
+			RegistrationRate:  server.Rate{Events: c.Quotas.RegistrationsPerMinute, Per: time.Minute},
+			MaxFrameSize:      c.Quotas.MaxFrameSize,
+			MessageRate:       server.Rate{Events: c.Quotas.MessagesPerSecond, Per: time.Second},
+			RunnerMessageRate: server.Rate{Events: c.Quotas.RunnerMessagesPerSecond, Per: time.Second},
+			TrustedProxies:    c.trustedProxies(),
+		},
+	}
+}
+
+// trustedProxies returns the proxies the quotas trust as address ranges
+func (c *HQ) trustedProxies() []netip.Prefix {
+	var proxies []netip.Prefix
+	for _, proxy := range c.Quotas.TrustedProxies {
+		if prefix, err := parsePrefix(proxy); err == nil { // Checked by validate
+			proxies = append(proxies, prefix)
+		}
+	}
+	return proxies
+}
+
+// parsePrefix parses a CIDR range or a single address, which is a range of one
+func parsePrefix(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("expected an address or CIDR range such as 10.0.0.0/8, got %q", s)
+	}
+	return prefix.Masked(), nil
+}
+
+// originPolicy returns the allowed origins in the form browsers send them
+func (c *HQ) originPolicy() server.OriginPolicy {
+	p := server.OriginPolicy{Dev: c.Origins.Dev}
+	for _, origin := range c.Origins.Allowed {
+		if normalized, err := server.NormalizeOrigin(origin); err == nil {
+			origin = normalized // Checked by validate; AnyOrigin is kept as is
+		}
+		p.Allowed = append(p.Allowed, origin)
+	}
+	return p
+}
+
+// RestartRequired lists the top-level settings that differ in next and only take
+// effect after a restart; the log level and Policy's settings apply on reload
+func (c *HQ) RestartRequired(next *HQ) []string {
+	a, b := *c, *next
+	for _, cfg := range []*HQ{&a, &b} {
+		cfg.Log.Level = ""
+		cfg.Auth.RunnerTokens = nil
+		cfg.Profiles = ProfilesConfig{}
+		cfg.Approvals = ApprovalsConfig{}
+		cfg.Origins = OriginsConfig{}
+		cfg.Quotas = QuotasConfig{}
+	}
+
+	var changed []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < va.NumField(); i++ {
+		field := va.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			changed = append(changed, field.Tag.Get("yaml"))
+		}
+	}
+	return changed
+}
@@ -0,0 +1,341 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/agent"
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/codervisor/agent-relay/internal/tracing"
+)
+
+// DefaultRedactEnv lists env vars whose values are masked in PTY output by default
+var DefaultRedactEnv = []string{
+	"RUNNER_TOKEN", "ANTHROPIC_API_KEY", "OPENAI_API_KEY", "GITHUB_TOKEN", "GH_TOKEN", "GITLAB_TOKEN",
+	"AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "GOOGLE_API_KEY", "GEMINI_API_KEY", "NPM_TOKEN", "HF_TOKEN",
+}
+
+// Runner is the runner's configuration
+// Settings come from the defaults, then the YAML file, then environment variables, then flags
+type Runner struct {
+	HQ          HQConnectionConfig `yaml:"hq"`
+	TLS         ClientTLSConfig    `yaml:"tls"`
+	RunnerID    string             `yaml:"runner_id"`
+	Token       string             `yaml:"token"`
+	Labels      map[string]string  `yaml:"labels"` // Attributes agent profiles can require
+	Sessions    SessionsConfig     `yaml:"sessions"`
+	Workspaces  WorkspacesConfig   `yaml:"workspaces"`
+	Transfers   TransfersConfig    `yaml:"transfers"`
+	Limits      ResourceConfig     `yaml:"limits"`
+	Sandbox     SandboxConfig      `yaml:"sandbox"`
+	Redaction   RedactionConfig    `yaml:"redaction"`
+	Approvals   ApprovalGateConfig `yaml:"approvals"`
+	Idle        IdleConfig         `yaml:"idle"`
+	Drain       DrainConfig        `yaml:"drain"`
+	MetricsAddr string             `yaml:"metrics_addr"` // Empty serves no metrics
+	Log         LogConfig          `yaml:"log"`
+	Tracing     TracingConfig      `yaml:"tracing"`
+}
+
+// HQConnectionConfig lists the HQ instances a runner may connect to
+type HQConnectionConfig struct {
+	URLs     []string `yaml:"urls"`
+	Failover string   `yaml:"failover"` // ordered or random
+}
+
+// ClientTLSConfig configures how the runner verifies HQ over wss:// and proves its own identity
+type ClientTLSConfig struct {
+	CA   string `yaml:"ca"`   // PEM bundle HQ's certificate is verified against instead of the system roots
+	Cert string `yaml:"cert"` // Client certificate for mutual TLS, reloaded when its files change
+	Key  string `yaml:"key"`
+}
+
+// SessionsConfig is the runner's spawn policy and the defaults sessions start with
+type SessionsConfig struct {
+	Max             int                      `yaml:"max"`              // Sessions running at once; 0 = no limit
+	AllowedCommands []string                 `yaml:"allowed_commands"` // Empty allows any
+	Shell           []string                 `yaml:"shell"`            // Command for sessions that name none
+	Env             map[string]string        `yaml:"env"`              // Set unless the session sets it
+	Limits          *protocol.ResourceLimits `yaml:"limits"`           // For sessions that request none
+}
+
+// WorkspacesConfig configures per-session git checkouts
+type WorkspacesConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`
+	Retain  string `yaml:"retain"` // never, on-failure or always
+	Cache   bool   `yaml:"cache"`
+}
+
+// TransfersConfig configures file uploads and downloads
+type TransfersConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	AllowedPaths []string `yaml:"allowed_paths"` // Also bounds the local repositories workspaces may clone
+	MaxSize      int64    `yaml:"max_size"`      // Bytes per file or archive; 0 = no limit
+}
+
+// ResourceConfig configures how session resource limits are enforced
+type ResourceConfig struct {
+	Mode       string `yaml:"mode"`        // auto, cgroup, rlimit or off
+	CgroupRoot string `yaml:"cgroup_root"` // Empty uses the runner's own cgroup
+}
+
+// SandboxConfig configures session sandboxing
+type SandboxConfig struct {
+	Enabled  bool     `yaml:"enabled"`
+	Network  string   `yaml:"network"` // none, loopback or host
+	Hide     []string `yaml:"hide"`
+	Writable []string `yaml:"writable"`
+}
+
+// RedactionConfig configures masking secrets in PTY output
+type RedactionConfig struct {
+	Enabled  bool     `yaml:"enabled"`
+	Env      []string `yaml:"env"`      // Variables whose values are masked
+	Patterns []string `yaml:"patterns"` // Regexes masked besides the built-in credential formats
+}
+
+// ApprovalGateConfig configures the sockets sessions ask for human approval on
+type ApprovalGateConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`
+}
+
+// IdleConfig configures reaping abandoned interactive sessions; 0 disables a threshold
+type IdleConfig struct {
+	Timeout      time.Duration `yaml:"timeout"`
+	InputTimeout time.Duration `yaml:"input_timeout"`
+	Warning      time.Duration `yaml:"warning"`
+}
+
+// DrainConfig configures draining
+type DrainConfig struct {
+	Timeout   time.Duration `yaml:"timeout"` // 0 waits indefinitely
+	OnSIGTERM bool          `yaml:"on_sigterm"`
+}
+
+// DefaultRunner returns the runner's configuration when nothing is set
+func DefaultRunner() *Runner {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown-runner"
+	}
+	return &Runner{
+		HQ:       HQConnectionConfig{URLs: []string{"ws://localhost:8080/ws/runner"}, Failover: string(agent.FailoverOrdered)},
+		RunnerID: hostname,
+		Token:    "dev-token",
+		Workspaces: WorkspacesConfig{
+			Enabled: true,
+			Dir:     filepath.Join(os.TempDir(), "agent-relay-workspaces"),
+			Retain:  string(agent.RetainNever),
+			Cache:   true,
+		},
+		Transfers: TransfersConfig{Enabled: true, AllowedPaths: []string{"."}, MaxSize: 100 << 20},
+		Limits:    ResourceConfig{Mode: string(agent.LimitsAuto)},
+		Sandbox:   SandboxConfig{Network: string(agent.SandboxNetworkLoopback)},
+		Redaction: RedactionConfig{Enabled: true, Env: DefaultRedactEnv},
+		Approvals: ApprovalGateConfig{Enabled: true, Dir: filepath.Join(os.TempDir(), "agent-relay-approvals")},
+		Idle:      IdleConfig{Timeout: time.Hour, Warning: 5 * time.Minute},
+		Drain:     DrainConfig{Timeout: 30 * time.Minute},
+		Log:       LogConfig{Format: "text", Level: "info"},
+		Tracing:   TracingConfig{Exporter: tracing.ExporterNone},
+	}
+}
+
+// LoadRunner reads the file at path, if any, over the defaults and applies environment overrides
+// Flags may override the result further, so it is not validated until Validate is called
+func LoadRunner(path string) (*Runner, error) {
+	c := DefaultRunner()
+	if path != "" {
+		if err := readFile(path, c); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyEnv(os.LookupEnv, c.env()); err != nil {
+		return nil, fmt.Errorf("invalid environment:\n%w", err)
+	}
+	return c, nil
+}
+
+// env lists the environment variables that override file settings
+func (c *Runner) env() []envVar {
+	return []envVar{
+		envList("HQ_URL", ",", &c.HQ.URLs),
+		envString("HQ_FAILOVER", &c.HQ.Failover),
+		envString("RUNNER_TLS_CA", &c.TLS.CA),
+		envString("RUNNER_TLS_CERT", &c.TLS.Cert),
+		envString("RUNNER_TLS_KEY", &c.TLS.Key),
+		envString("RUNNER_ID", &c.RunnerID),
+		envString("RUNNER_TOKEN", &c.Token),
+		{"RUNNER_LABELS", func(value string) error {
+			labels, err := ParseLabels(value)
+			if err != nil {
+				return err
+			}
+			c.Labels = labels
+			return nil
+		}},
+		envInt("MAX_SESSIONS", &c.Sessions.Max),
+		envList("ALLOWED_COMMANDS", ",", &c.Sessions.AllowedCommands),
+		envDisable("WORKSPACE_DISABLE", &c.Workspaces.Enabled),
+		envString("WORKSPACE_DIR", &c.Workspaces.Dir),
+		envString("WORKSPACE_RETAIN", &c.Workspaces.Retain),
+		envDisable("WORKSPACE_CACHE_DISABLE", &c.Workspaces.Cache),
+		envDisable("FILE_TRANSFER_DISABLE", &c.Transfers.Enabled),
+		envList("ALLOWED_PATHS", ",", &c.Transfers.AllowedPaths),
+		envInt64("MAX_TRANSFER_SIZE", &c.Transfers.MaxSize),
+		envString("LIMITS_MODE", &c.Limits.Mode),
+		envString("CGROUP_ROOT", &c.Limits.CgroupRoot),
+		envBool("SANDBOX", &c.Sandbox.Enabled),
+		envString("SANDBOX_NETWORK", &c.Sandbox.Network),
+		envList("SANDBOX_HIDE", ",", &c.Sandbox.Hide),
+		envList("SANDBOX_WRITABLE", ",", &c.Sandbox.Writable),
+		envDisable("REDACT_DISABLE", &c.Redaction.Enabled),
+		envList("REDACT_ENV", ",", &c.Redaction.Env),
+		envList("REDACT_PATTERNS", "", &c.Redaction.Patterns), // Use \s inside a pattern
+		envDisable("APPROVALS_DISABLE", &c.Approvals.Enabled),
+		envString("APPROVALS_DIR", &c.Approvals.Dir),
+		envDuration("IDLE_TIMEOUT", &c.Idle.Timeout),
+		envDuration("INPUT_IDLE_TIMEOUT", &c.Idle.InputTimeout),
+		envDuration("IDLE_WARNING", &c.Idle.Warning),
+		envDuration("DRAIN_TIMEOUT", &c.Drain.Timeout),
+		envBool("DRAIN_ON_SIGTERM", &c.Drain.OnSIGTERM),
+		envString("METRICS_ADDR", &c.MetricsAddr),
+		envString("LOG_FORMAT", &c.Log.Format),
+		envString("LOG_LEVEL", &c.Log.Level),
+		envString("OTEL_TRACES_EXPORTER", &c.Tracing.Exporter),
+	}
+}
+
+// envDisable clears an enabled setting when a *_DISABLE variable is true
+func envDisable(name string, enabled *bool) envVar {
+	var disabled bool
+	parse := envBool(name, &disabled)
+	return envVar{name, func(value string) error {
+		if err := parse.set(value); err != nil {
+			return err
+		}
+		*enabled = !disabled
+		return nil
+	}}
+}
+
+// Validate reports every invalid setting, named by its path in the file
+func (c *Runner) Validate() error {
+	var v checker
+
+	v.check(len(c.HQ.URLs) > 0, "hq.urls", "at least one URL is required")
+	for i, raw := range c.HQ.URLs {
+		u, err := url.Parse(raw)
+		v.check(err == nil && (u.Scheme == "ws" || u.Scheme == "wss") && u.Host != "",
+			fmt.Sprintf("hq.urls[%d]", i), "expected a ws:// or wss:// URL, got %q", raw)
+	}
+	v.oneOf("hq.failover", c.HQ.Failover, string(agent.FailoverOrdered), string(agent.FailoverRandom))
+
+	v.check((c.TLS.Cert == "") == (c.TLS.Key == ""), "tls", "set both cert and key, or neither")
+	if c.TLS != (ClientTLSConfig{}) {
+		for i, raw := range c.HQ.URLs {
+			v.check(strings.HasPrefix(raw, "wss://"), fmt.Sprintf("hq.urls[%d]", i), "tls settings need a wss:// URL, got %q", raw)
+		}
+	}
+
+	v.check(c.RunnerID != "", "runner_id", "must not be empty")
+	v.check(c.Token != "", "token", "must not be empty")
+	for key := range c.Labels {
+		v.check(key != "", "labels", "keys must not be empty")
+	}
+
+	v.check(c.Sessions.Max >= 0, "sessions.max", "must not be negative")
+	for i, command := range c.Sessions.AllowedCommands {
+		v.check(command != "", fmt.Sprintf("sessions.allowed_commands[%d]", i), "must not be empty")
+	}
+	if len(c.Sessions.Shell) > 0 {
+		v.check(c.SpawnPolicy().Check(c.Sessions.Shell) == nil, "sessions.shell", "%q is not in allowed_commands", c.Sessions.Shell[0])
+	}
+	for key := range c.Sessions.Env {
+		v.check(key != "" && !strings.Contains(key, "="), "sessions.env", "invalid variable name %q", key)
+	}
+	if l := c.Sessions.Limits; l != nil {
+		v.check(l.MemoryBytes >= 0 && l.CPUs >= 0 && l.PIDs >= 0, "sessions.limits", "must not be negative")
+	}
+
+	v.check(!c.Workspaces.Enabled || c.Workspaces.Dir != "", "workspaces.dir", "required unless workspaces are disabled")
+	v.oneOf("workspaces.retain", c.Workspaces.Retain,
+		string(agent.RetainNever), string(agent.RetainOnFailure), string(agent.RetainAlways))
+	v.check(c.Transfers.MaxSize >= 0, "transfers.max_size", "must not be negative")
+
+	v.oneOf("limits.mode", c.Limits.Mode,
+		string(agent.LimitsAuto), string(agent.LimitsCgroup), string(agent.LimitsRlimit), string(agent.LimitsOff))
+	v.oneOf("sandbox.network", c.Sandbox.Network,
+		string(agent.SandboxNetworkNone), string(agent.SandboxNetworkLoopback), string(agent.SandboxNetworkHost))
+
+	for i, pattern := range c.Redaction.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			v.check(false, fmt.Sprintf("redaction.patterns[%d]", i), "%v", err)
+		}
+	}
+	v.check(!c.Approvals.Enabled || c.Approvals.Dir != "", "approvals.dir", "required unless approvals are disabled")
+
+	v.check(c.Idle.Timeout >= 0, "idle.timeout", "must not be negative")
+	v.check(c.Idle.InputTimeout >= 0, "idle.input_timeout", "must not be negative")
+	v.check(c.Idle.Warning >= 0, "idle.warning", "must not be negative")
+	v.check(c.Drain.Timeout >= 0, "drain.timeout", "must not be negative")
+
+	v.oneOf("log.format", c.Log.Format, "text", "json")
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		v.check(false, "log.level", "%v", err)
+	}
+	v.oneOf("tracing.exporter", strings.ToLower(c.Tracing.Exporter), tracing.ExporterOTLP, tracing.ExporterConsole, tracing.ExporterNone)
+
+	if err := v.err(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return nil
+}
+
+// SpawnPolicy returns the limits and defaults every session starts under
+func (c *Runner) SpawnPolicy() agent.SpawnPolicy {
+	return agent.SpawnPolicy{
+		MaxSessions:     c.Sessions.Max,
+		AllowedCommands: c.Sessions.AllowedCommands,
+		Shell:           c.Sessions.Shell,
+		Env:             c.Sessions.Env,
+		Limits:          c.Sessions.Limits,
+	}
+}
+
+// IdlePolicy returns when interactive sessions are reaped
+func (c *Runner) IdlePolicy() agent.IdlePolicy {
+	return agent.IdlePolicy{Timeout: c.Idle.Timeout, InputTimeout: c.Idle.InputTimeout, Warning: c.Idle.Warning}
+}
+
+// SplitList splits a comma-separated list, dropping empty entries
+func SplitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ParseLabels parses a comma-separated list of key=value pairs
+func ParseLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, item := range SplitList(value) {
+		key, val, ok := strings.Cut(item, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("label %q is not key=value", item)
+		}
+		labels[key] = strings.TrimSpace(val)
+	}
+	return labels, nil
+}
@@ -0,0 +1,90 @@
+// Package logging configures the structured logs HQ and the runner write
+// Both sides use the same attribute keys so a session can be followed across their logs
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Attribute keys shared by HQ and runner logs
+const (
+	KeyComponent  = "component"
+	KeyRunnerID   = "runner_id"
+	KeySessionID  = "session_id"
+	KeyClientID   = "client_id"
+	KeyRemoteAddr = "remote_addr"
+	KeyEpoch      = "epoch" // Which connection of a runner to HQ, counted by the runner from 1
+	KeyError      = "error"
+)
+
+// New creates a logger writing format ("text" or "json") to w at level ("debug", "info", "warn" or "error")
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	return NewLeveled(w, format, lvl)
+}
+
+// NewLeveled is New with a level that may be a *slog.LevelVar, so it can change while the logger is in use
+func NewLeveled(w io.Writer, format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: readableDurations}
+
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q (expected text or json)", format)
+	}
+}
+
+// readableDurations writes durations as "1m30s" rather than JSON's nanosecond counts
+func readableDurations(_ []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindDuration {
+		a.Value = slog.StringValue(a.Value.Duration().String())
+	}
+	return a
+}
+
+// ParseLevel parses a level name such as "info" or "debug"
+func ParseLevel(level string) (slog.Level, error) {
+	if level == "" {
+		return slog.LevelInfo, nil
+	}
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q (expected debug, info, warn or error)", level)
+	}
+	return lvl, nil
+}
+
+// Component returns logger tagged with the part of the system writing to it
+func Component(logger *slog.Logger, name string) *slog.Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger.With(KeyComponent, name)
+}
+
+// RunnerID tags a record with the runner it concerns
+func RunnerID(id string) slog.Attr { return slog.String(KeyRunnerID, id) }
+
+// SessionID tags a record with the session it concerns
+func SessionID(id string) slog.Attr { return slog.String(KeySessionID, id) }
+
+// ClientID tags a record with the browser connection it concerns
+func ClientID(id string) slog.Attr { return slog.String(KeyClientID, id) }
+
+// RemoteAddr tags a record with the peer's network address
+func RemoteAddr(addr string) slog.Attr { return slog.String(KeyRemoteAddr, addr) }
+
+// Epoch tags a record with the runner connection it happened on
+func Epoch(n uint64) slog.Attr { return slog.Uint64(KeyEpoch, n) }
+
+// Err attaches an error to a record
+func Err(err error) slog.Attr { return slog.Any(KeyError, err) }
@@ -0,0 +1,193 @@
+package profile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/goccy/go-yaml"
+)
+
+// ErrNotFound is returned for a profile name that is not configured
+var ErrNotFound = errors.New("profile not found")
+
+// validName matches profile names such as "claude-code" or "aider.v2"
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// Profile is a named, server-side template for starting sessions
+// Clients name a profile instead of sending a raw command
+type Profile struct {
+	Name         string                   `yaml:"-"`
+	Description  string                   `yaml:"description"`
+	Command      []string                 `yaml:"command"`
+	Env          map[string]string        `yaml:"env"` // Defaults; the client may override them
+	Cwd          string                   `yaml:"cwd"` // Default; the client may override it
+	Workspace    *protocol.WorkspaceSpec  `yaml:"workspace"`
+	Artifacts    []string                 `yaml:"artifacts"`
+	RunnerLabels map[string]string        `yaml:"runner_labels"` // Labels a runner must have to run the profile
+	Limits       *protocol.ResourceLimits `yaml:"limits"`
+	Timeout      time.Duration            `yaml:"timeout"`
+}
+
+// file is the on-disk profile configuration
+type file struct {
+	Profiles map[string]Profile `yaml:"profiles"`
+}
+
+// Set is an immutable collection of profiles
+type Set struct {
+	profiles map[string]Profile
+}
+
+// Load reads profiles from a YAML file
+func Load(path string) (*Set, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles: %w", err)
+	}
+	return Parse(data)
+}
+
+// Parse decodes and validates YAML profile configuration
+func Parse(data []byte) (*Set, error) {
+	var f file
+	if err := yaml.UnmarshalWithOptions(data, &f, yaml.Strict()); err != nil {
+		return nil, fmt.Errorf("invalid profiles: %w", err)
+	}
+	return New(f.Profiles)
+}
+
+// New validates profiles keyed by name, such as ones embedded in HQ's configuration file
+func New(profiles map[string]Profile) (*Set, error) {
+	s := &Set{profiles: make(map[string]Profile, len(profiles))}
+	for name, p := range profiles {
+		p.Name = name
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("invalid profile %q: %w", name, err)
+		}
+		s.profiles[name] = p
+	}
+	return s, nil
+}
+
+// Get returns a profile by name
+func (s *Set) Get(name string) (Profile, error) {
+	p, exists := s.profiles[name]
+	if !exists {
+		return Profile{}, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	return p, nil
+}
+
+// List returns all profiles ordered by name
+func (s *Set) List() []Profile {
+	profiles := make([]Profile, 0, len(s.profiles))
+	for _, p := range s.profiles {
+		profiles = append(profiles, p)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
+
+func (p Profile) validate() error {
+	if !validName.MatchString(p.Name) {
+		return errors.New("name must be lowercase letters, digits, '.', '_' or '-'")
+	}
+	if len(p.Command) == 0 || p.Command[0] == "" {
+		return errors.New("command is required")
+	}
+	if p.Workspace != nil && p.Workspace.Repo == "" {
+		return errors.New("workspace.repo is required")
+	}
+	if p.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	if p.Timeout > 0 && p.Timeout < time.Second {
+		return errors.New("timeout must be at least 1s")
+	}
+	if l := p.Limits; l != nil && (l.MemoryBytes < 0 || l.CPUs < 0 || l.PIDs < 0) {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
+
+// MatchesRunner reports whether a runner's labels satisfy the profile
+func (p Profile) MatchesRunner(labels map[string]string) bool {
+	for key, want := range p.RunnerLabels {
+		if have, exists := labels[key]; !exists || have != want {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply expands a start request into the session the profile describes
+// The profile fixes the command, limits and timeout; the request may set cwd,
+// env overrides, extra artifacts, and the ref and branch of the profile's repository
+func (p Profile) Apply(req protocol.StartSessionPayload) (protocol.StartSessionPayload, error) {
+	if len(req.Command) > 0 {
+		return req, fmt.Errorf("profile %s sets the command", p.Name)
+	}
+	if req.Limits != nil || req.Timeout != 0 {
+		return req, fmt.Errorf("profile %s sets limits and timeout", p.Name)
+	}
+
+	out := req
+	out.Profile = p.Name
+	out.Command = append([]string(nil), p.Command...)
+	out.Limits = p.Limits
+	out.Timeout = int(p.Timeout / time.Second)
+
+	if out.Cwd == "" {
+		out.Cwd = p.Cwd
+	}
+
+	if len(p.Env) > 0 || len(req.Env) > 0 {
+		out.Env = make(map[string]string, len(p.Env)+len(req.Env))
+		for key, value := range p.Env {
+			out.Env[key] = value
+		}
+		for key, value := range req.Env {
+			out.Env[key] = value
+		}
+	}
+
+	out.Artifacts = mergePatterns(p.Artifacts, req.Artifacts)
+
+	if p.Workspace != nil {
+		ws := *p.Workspace
+		if req.Workspace != nil {
+			if req.Workspace.Repo != "" && req.Workspace.Repo != ws.Repo {
+				return req, fmt.Errorf("profile %s sets the workspace repository", p.Name)
+			}
+			if req.Workspace.Ref != "" {
+				ws.Ref = req.Workspace.Ref
+			}
+			if req.Workspace.Branch != "" {
+				ws.Branch = req.Workspace.Branch
+			}
+		}
+		out.Workspace = &ws
+	}
+
+	return out, nil
+}
+
+// mergePatterns combines artifact patterns, dropping duplicates
+func mergePatterns(lists ...[]string) []string {
+	var merged []string
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		for _, pattern := range list {
+			if !seen[pattern] {
+				seen[pattern] = true
+				merged = append(merged, pattern)
+			}
+		}
+	}
+	return merged
+}
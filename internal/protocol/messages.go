@@ -1,5 +1,10 @@
 package protocol
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
 // MessageType defines the type of control message sent over WebSocket
 type MessageType string
 
@@ -15,6 +20,48 @@ const (
 	MessageTypeSessionStarted MessageType = "session_started"
 	MessageTypeSessionEnded   MessageType = "session_ended"
 	MessageTypeError          MessageType = "error"
+
+	// HQ -> Runner file transfers
+	MessageTypeFileUpload   MessageType = "file_upload"
+	MessageTypeFileDownload MessageType = "file_download"
+	MessageTypeFileAck      MessageType = "file_ack"
+	MessageTypeFileCancel   MessageType = "file_cancel"
+
+	// Runner -> HQ file transfer progress
+	MessageTypeFileReady    MessageType = "file_ready"
+	MessageTypeFileComplete MessageType = "file_complete"
+
+	// Runner -> HQ artifact collected from a finished session
+	MessageTypeArtifact MessageType = "artifact"
+
+	// Runner -> HQ changes made by a workspace session, sent before session_ended
+	MessageTypeSessionResult MessageType = "session_result"
+
+	// Sent by whichever side streams the file once all chunks are written
+	MessageTypeFileEnd MessageType = "file_end"
+
+	// Runner -> HQ -> clients: a session asks a human to allow an action
+	MessageTypeApprovalRequest MessageType = "approval_request"
+	// Client -> HQ -> Runner: the human's answer, or HQ's on timeout
+	MessageTypeApprovalDecision MessageType = "approval_decision"
+
+	// HQ -> Runner: finish the running sessions, accept no new ones, then exit
+	MessageTypeDrain MessageType = "drain"
+	// Runner -> HQ: the runner is draining; reconnects carry this in register instead
+	MessageTypeRunnerDraining MessageType = "runner_draining"
+
+	// HQ -> Runners and clients: HQ is going away; the connection closes right after
+	MessageTypeServerShutdown MessageType = "server_shutdown"
+
+	// HQ -> client: the session's latest measured round trips, after each latency probe
+	MessageTypeLatency MessageType = "latency"
+)
+
+// File transfer data travels in binary frames prefixed with the 36-byte
+// transfer ID, like PTY I/O: [transfer_id(36 bytes)][chunk]
+const (
+	FileChunkSize    = 64 * 1024 // Maximum chunk per binary frame
+	FileWindowChunks = 16        // Download chunks a runner may send before HQ acknowledges them
 )
 
 // Message is the base structure for all control messages
@@ -22,18 +69,54 @@ const (
 type Message struct {
 	Type    MessageType `json:"type"`
 	Payload interface{} `json:"payload,omitempty"`
+
+	// W3C trace context (traceparent, tracestate) of the span that sent the message, if traced
+	Trace map[string]string `json:"trace,omitempty"`
 }
 
 // RegisterPayload is sent by Runner to HQ to register itself
 type RegisterPayload struct {
-	RunnerID string `json:"runner_id"` // Unique identifier for this runner
-	Token    string `json:"token"`     // Authentication token
+	RunnerID string            `json:"runner_id"`        // Unique identifier for this runner
+	Token    string            `json:"token"`            // Authentication token
+	Labels   map[string]string `json:"labels,omitempty"` // Attributes profiles can require, e.g. {"gpu": "true"}
+	Epoch    uint64            `json:"epoch,omitempty"`  // Counts this runner process's connections, so both sides' logs name the same one
+
+	// Set when a draining runner reconnects, so HQ never schedules work on it
+	Draining *RunnerDrainingPayload `json:"draining,omitempty"`
 }
 
 // StartSessionPayload is sent by client to start a new PTY session
 type StartSessionPayload struct {
-	SessionID string   `json:"session_id"` // Client-generated session ID
-	Command   []string `json:"command"`    // Command to execute (default: ["/bin/bash"])
+	SessionID string   `json:"session_id"`          // UUID never used before, or empty for HQ to generate one
+	Command   []string `json:"command"`             // Command to execute (default: ["/bin/bash"])
+	Cwd       string   `json:"cwd,omitempty"`       // Working directory (default: runner's cwd)
+	Record    bool     `json:"record,omitempty"`    // Ask HQ to record this session
+	Artifacts []string `json:"artifacts,omitempty"` // Glob patterns, relative to Cwd, collected after the process exits
+
+	// Workspace runs the session in a fresh checkout; Cwd is then relative to the checkout
+	Workspace *WorkspaceSpec `json:"workspace,omitempty"`
+
+	Profile string            `json:"profile,omitempty"` // Agent profile HQ expands before routing to the runner
+	Env     map[string]string `json:"env,omitempty"`     // Extra environment variables for the process
+	Limits  *ResourceLimits   `json:"limits,omitempty"`
+	Timeout int               `json:"timeout,omitempty"` // Seconds before the runner kills the session; 0 = none
+
+	// Headless sessions (jobs) have no client typing into them, so they are never reaped as idle
+	Headless bool `json:"headless,omitempty"`
+}
+
+// ResourceLimits caps what a session's processes may use; zero fields are unlimited
+type ResourceLimits struct {
+	MemoryBytes int64   `json:"memory_bytes,omitempty"`
+	CPUs        float64 `json:"cpus,omitempty"` // CPU time in cores, e.g. 1.5
+	PIDs        int64   `json:"pids,omitempty"` // Maximum processes and threads
+}
+
+// WorkspaceSpec describes a git checkout prepared for a single session
+type WorkspaceSpec struct {
+	Repo   string `json:"repo"`             // Clone URL, file:// URL or local repository path
+	Ref    string `json:"ref,omitempty"`    // Branch, tag or commit to check out (default: the remote's HEAD)
+	Branch string `json:"branch,omitempty"` // New local branch to create at Ref (default: detached HEAD)
 }
 
 // ResizePayload is sent when terminal dimensions change
@@ -49,12 +132,231 @@ type SessionStartedPayload struct {
 
 // SessionEndedPayload notifies session termination
 type SessionEndedPayload struct {
+	SessionID  string `json:"session_id"`
+	ExitCode   int    `json:"exit_code"`
+	Redactions int    `json:"redactions,omitempty"` // Secrets masked in the session's output
+	Artifacts  int    `json:"artifacts,omitempty"`  // Artifacts sent before this message
+	Reason     string `json:"reason,omitempty"`     // Why the runner ended the session, if it did
+
+	// LimitsHit names the resource limits the session ran into, e.g. "memory"
+	LimitsHit []string `json:"limits_hit,omitempty"`
+}
+
+// Reasons a runner ends a session itself
+const (
+	SessionEndReasonTimeout = "timeout" // Exceeded the session's timeout
+	SessionEndReasonOOM     = "oom"     // Killed for exceeding its memory limit
+	SessionEndReasonIdle    = "idle"    // Reaped after no activity for longer than the runner allows
+	SessionEndReasonDrained = "drained" // Killed when the runner's drain deadline passed
+)
+
+// Resource limits reported in SessionEndedPayload.LimitsHit
+const (
+	LimitMemory = "memory"
+	LimitCPU    = "cpu" // Throttled to its CPU quota
+	LimitPIDs   = "pids"
+)
+
+// SessionResultPayload reports what a workspace session changed in its repository
+type SessionResultPayload struct {
 	SessionID string `json:"session_id"`
-	ExitCode  int    `json:"exit_code"`
+	SessionResult
+}
+
+// SessionResult summarizes a workspace's changes since it was prepared
+type SessionResult struct {
+	BaseCommit       string          `json:"base_commit"` // Commit the workspace was prepared at
+	HeadCommit       string          `json:"head_commit"` // HEAD when the process exited
+	Branch           string          `json:"branch,omitempty"`
+	Commits          []CommitSummary `json:"commits"`                     // Commits made during the session, oldest first
+	CommitsTruncated bool            `json:"commits_truncated,omitempty"` // Only the most recent commits are listed
+	Files            []FileChange    `json:"files"`                       // Changes from BaseCommit to the working tree
+	Diff             string          `json:"diff"`                        // Unified diff from BaseCommit to the working tree
+	DiffTruncated    bool            `json:"diff_truncated,omitempty"`
+}
+
+// CommitSummary describes one commit made during a session
+type CommitSummary struct {
+	SHA         string `json:"sha"`
+	Author      string `json:"author"`
+	AuthorEmail string `json:"author_email"`
+	Date        string `json:"date"` // RFC 3339 author date
+	Subject     string `json:"subject"`
+}
+
+// FileChange describes one changed path, including uncommitted and untracked files
+type FileChange struct {
+	Path      string `json:"path"`
+	OldPath   string `json:"old_path,omitempty"` // Previous path of a renamed or copied file
+	Status    string `json:"status"`             // added, modified, deleted, renamed, copied or type_changed
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+	Binary    bool   `json:"binary,omitempty"`
 }
 
 // ErrorPayload contains error information
 type ErrorPayload struct {
-	Message string `json:"message"`
-	Code    string `json:"code,omitempty"`
+	SessionID  string `json:"session_id,omitempty"`  // Session the error relates to, if any
+	TransferID string `json:"transfer_id,omitempty"` // File transfer the error relates to, if any
+	Message    string `json:"message"`
+	Code       string `json:"code,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"` // Seconds until a rate limit allows the request again
+}
+
+// Error codes reported for failed file transfers
+const (
+	ErrCodeTransfersDisabled = "transfers_disabled"
+	ErrCodePathNotAllowed    = "path_not_allowed"
+	ErrCodeNotFound          = "not_found"
+	ErrCodeExists            = "exists"
+	ErrCodeTooLarge          = "too_large"
+	ErrCodeChecksumMismatch  = "checksum_mismatch"
+	ErrCodeTransferFailed    = "transfer_failed"
+)
+
+// Error codes reported for start_session requests HQ or the runner refuses
+const (
+	ErrCodeProfileRequired   = "profile_required"
+	ErrCodeInvalidProfile    = "invalid_profile"
+	ErrCodeRunnerDraining    = "runner_draining"
+	ErrCodeRunnerFull        = "runner_full"
+	ErrCodeCommandNotAllowed = "command_not_allowed"
+	ErrCodeForbidden         = "forbidden"
+)
+
+// Error codes reported when a client or runner exceeds one of HQ's quotas
+const (
+	ErrCodeSessionQuota     = "session_quota"     // Too many sessions running for the user or runner
+	ErrCodeSessionRate      = "session_rate"      // The user started new sessions too quickly
+	ErrCodeRegistrationRate = "registration_rate" // Too many registration attempts from one address
+	ErrCodeFrameTooLarge    = "frame_too_large"   // A message was over the size limit and was dropped
+	ErrCodeMessageRate      = "message_rate"      // Messages arrived too quickly and some were dropped or delayed
+)
+
+// FileUploadPayload asks the runner to receive a file
+// Chunks follow once the runner replies with file_ready
+type FileUploadPayload struct {
+	TransferID string `json:"transfer_id"`
+	Path       string `json:"path"`                // Destination; relative paths resolve against the first allowed root
+	Size       int64  `json:"size"`                // Exact number of bytes that will be sent
+	Mode       uint32 `json:"mode,omitempty"`      // Permission bits (default 0644)
+	Overwrite  bool   `json:"overwrite,omitempty"` // Replace an existing file
+}
+
+// FileDownloadPayload asks the runner to send a file, or a directory as a tar stream
+type FileDownloadPayload struct {
+	TransferID string `json:"transfer_id"`
+	Path       string `json:"path"`
+}
+
+// FileReadyPayload accepts a transfer
+// For downloads it describes what will be streamed
+type FileReadyPayload struct {
+	TransferID string `json:"transfer_id"`
+	Path       string `json:"path"`           // Resolved path on the runner
+	Size       int64  `json:"size,omitempty"` // File size; unknown in advance for directories
+	Mode       uint32 `json:"mode,omitempty"`
+	IsDir      bool   `json:"is_dir,omitempty"` // Content is a tar stream of the directory
+}
+
+// FileEndPayload marks the end of a transfer's chunks so the receiver can verify them
+type FileEndPayload struct {
+	TransferID string `json:"transfer_id"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"` // Hex digest of all chunks
+}
+
+// FileCompletePayload confirms an upload was verified and moved into place
+type FileCompletePayload struct {
+	TransferID string `json:"transfer_id"`
+	Path       string `json:"path"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+}
+
+// FileAckPayload returns download flow-control credit to the runner
+type FileAckPayload struct {
+	TransferID string `json:"transfer_id"`
+	Chunks     int    `json:"chunks"`
+}
+
+// FileCancelPayload abandons a transfer; the runner discards partial uploads
+type FileCancelPayload struct {
+	TransferID string `json:"transfer_id"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// ArtifactPayload announces an artifact; its chunks follow as binary frames
+// keyed by TransferID and end with file_end. Artifacts are sent before the
+// session's session_ended
+type ArtifactPayload struct {
+	SessionID  string `json:"session_id"`
+	TransferID string `json:"transfer_id"`
+	Name       string `json:"name"` // Slash-separated path relative to the session's working directory
+	Size       int64  `json:"size"`
+}
+
+// ApprovalRequestPayload asks a human to allow an action in a session
+// The session blocks until an approval_decision with the same ApprovalID arrives
+type ApprovalRequestPayload struct {
+	ApprovalID string `json:"approval_id"`
+	SessionID  string `json:"session_id"`
+	Action     string `json:"action"`               // Short description, e.g. the command about to run
+	Details    string `json:"details,omitempty"`    // Free-form context for the reviewer
+	Timeout    int    `json:"timeout,omitempty"`    // Seconds to wait; HQ applies its default and cap
+	User       string `json:"user,omitempty"`       // Owner of the session, filled in by HQ
+	ExpiresAt  string `json:"expires_at,omitempty"` // RFC 3339, filled in by HQ
+}
+
+// ApprovalDecisionPayload answers an approval request
+// Anything but an explicit approval is a denial
+type ApprovalDecisionPayload struct {
+	ApprovalID string `json:"approval_id"`
+	SessionID  string `json:"session_id,omitempty"`
+	Approved   bool   `json:"approved"`
+	Status     string `json:"status,omitempty"` // approved, denied, expired or cancelled; filled in by HQ
+	Reason     string `json:"reason,omitempty"`
+	DecidedBy  string `json:"decided_by,omitempty"` // Filled in by HQ from the authenticated user
+}
+
+// DrainPayload asks a runner to drain
+type DrainPayload struct {
+	Timeout int `json:"timeout,omitempty"` // Seconds to wait for sessions before killing them; 0 = runner's default
+}
+
+// RunnerDrainingPayload tells HQ a runner will start no new sessions
+type RunnerDrainingPayload struct {
+	Sessions int    `json:"sessions"`           // Sessions still running
+	Deadline string `json:"deadline,omitempty"` // RFC 3339; remaining sessions are killed then. Empty = no deadline
+}
+
+// ServerShutdownPayload tells peers when to try reconnecting to HQ
+type ServerShutdownPayload struct {
+	ReconnectAfter int    `json:"reconnect_after"` // Seconds to wait before reconnecting
+	Reason         string `json:"reason,omitempty"`
+}
+
+// LatencyPayload reports how long a keystroke takes to reach the runner and its echo to come back
+// HQ measures both legs with websocket ping frames; a leg not yet measured is 0
+type LatencyPayload struct {
+	SessionID   string  `json:"session_id"`
+	ClientRTTMs float64 `json:"client_rtt_ms"` // Client <-> HQ
+	RunnerRTTMs float64 `json:"runner_rtt_ms"` // HQ <-> runner
+	RTTMs       float64 `json:"rtt_ms"`        // Client <-> runner, the sum of both legs
+}
+
+// DecodePayload converts a generic message payload into a typed struct
+// Payloads arrive as map[string]interface{} after JSON decoding, so they are
+// re-marshaled and unmarshaled into the target
+func DecodePayload(msg Message, v interface{}) error {
+	payloadBytes, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	if err := json.Unmarshal(payloadBytes, v); err != nil {
+		return fmt.Errorf("failed to parse %s payload: %w", msg.Type, err)
+	}
+
+	return nil
 }
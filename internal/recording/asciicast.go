@@ -0,0 +1,259 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/codervisor/agent-relay/internal/redact"
+)
+
+// Event types defined by asciicast v2
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+	EventResize = "r"
+)
+
+// Header is the first line of an asciicast v2 file
+// See https://docs.asciinema.org/manual/asciicast/v2/
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Event is a single timed entry in an asciicast v2 file
+// Encoded as a JSON array: [time, type, data]
+type Event struct {
+	Time float64 // Seconds since the start of the recording
+	Type string
+	Data string
+}
+
+// MarshalJSON encodes the event in asciicast array form
+func (e Event) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{e.Time, e.Type, e.Data})
+}
+
+// UnmarshalJSON decodes the event from asciicast array form
+func (e *Event) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("event has %d fields, expected 3", len(fields))
+	}
+
+	if err := json.Unmarshal(fields[0], &e.Time); err != nil {
+		return fmt.Errorf("invalid event time: %w", err)
+	}
+	if err := json.Unmarshal(fields[1], &e.Type); err != nil {
+		return fmt.Errorf("invalid event type: %w", err)
+	}
+	if err := json.Unmarshal(fields[2], &e.Data); err != nil {
+		return fmt.Errorf("invalid event data: %w", err)
+	}
+	return nil
+}
+
+// Recorder writes a session to an asciicast v2 stream
+// It is safe for concurrent use; output, input and resize events may arrive
+// from different connections
+type Recorder struct {
+	w             io.WriteCloser
+	buf           *bufio.Writer
+	start         time.Time
+	redactOutput  *redact.Stream
+	redactInput   *redact.Stream
+	pendingOutput []byte // Trailing bytes of an incomplete UTF-8 sequence
+	pendingInput  []byte
+	mu            sync.Mutex
+	closed        bool
+}
+
+// NewRecorder writes the header and returns a recorder for subsequent events
+// Output and input are passed through redactor, which may be nil
+func NewRecorder(w io.WriteCloser, header Header, redactor *redact.Redactor) (*Recorder, error) {
+	header.Version = 2
+	start := time.Now()
+	if header.Timestamp == 0 {
+		header.Timestamp = start.Unix()
+	}
+
+	r := &Recorder{
+		w:            w,
+		buf:          bufio.NewWriter(w),
+		start:        start,
+		redactOutput: redactor.NewStream(),
+		redactInput:  redactor.NewStream(),
+	}
+
+	if err := r.writeLine(header); err != nil {
+		return nil, fmt.Errorf("failed to write header: %w", err)
+	}
+
+	return r, nil
+}
+
+// Output records data written by the session's process
+func (r *Recorder) Output(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeData(EventOutput, &r.pendingOutput, r.redactOutput.Write(data))
+}
+
+// Input records data typed into the session
+func (r *Recorder) Input(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeData(EventInput, &r.pendingInput, r.redactInput.Write(data))
+}
+
+// Resize records a change of terminal dimensions
+func (r *Recorder) Resize(cols, rows int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return io.ErrClosedPipe
+	}
+	return r.writeEvent(EventResize, fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// Close flushes buffered events and closes the underlying writer
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	// Release bytes held back by redaction before finishing UTF-8 sequences
+	r.writeData(EventOutput, &r.pendingOutput, r.redactOutput.Flush())
+	r.writeData(EventInput, &r.pendingInput, r.redactInput.Flush())
+	r.closed = true
+
+	// Emit whatever is left of a truncated UTF-8 sequence rather than drop it
+	if len(r.pendingOutput) > 0 {
+		r.writeEvent(EventOutput, string(r.pendingOutput))
+	}
+	if len(r.pendingInput) > 0 {
+		r.writeEvent(EventInput, string(r.pendingInput))
+	}
+
+	flushErr := r.buf.Flush()
+	if err := r.w.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// writeData emits a data event, holding back a trailing partial UTF-8 rune
+// so multi-byte characters split across PTY reads are not mangled
+func (r *Recorder) writeData(kind string, pending *[]byte, data []byte) error {
+	if r.closed {
+		return io.ErrClosedPipe
+	}
+
+	data = append(*pending, data...)
+	complete, rest := splitIncompleteUTF8(data)
+	*pending = append([]byte(nil), rest...)
+
+	if len(complete) == 0 {
+		return nil
+	}
+	return r.writeEvent(kind, string(complete))
+}
+
+func (r *Recorder) writeEvent(kind, data string) error {
+	elapsed := time.Since(r.start).Seconds()
+	if err := r.writeLine(Event{Time: elapsed, Type: kind, Data: data}); err != nil {
+		return err
+	}
+
+	// Flush per event so in-progress recordings can be downloaded and replayed
+	return r.buf.Flush()
+}
+
+func (r *Recorder) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	_, err = r.buf.Write(line)
+	return err
+}
+
+// splitIncompleteUTF8 separates a trailing partial multi-byte rune from b
+func splitIncompleteUTF8(b []byte) (complete, rest []byte) {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return b[:i], b[i:]
+			}
+			break
+		}
+	}
+	return b, nil
+}
+
+// Reader parses an asciicast v2 stream
+type Reader struct {
+	r      *bufio.Reader
+	Header Header
+}
+
+// NewReader reads the header and returns a reader positioned at the first event
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+
+	line, err := br.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, fmt.Errorf("failed to read header: %w", err)
+	}
+
+	var header Header
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, fmt.Errorf("invalid header: %w", err)
+	}
+	if header.Version != 2 {
+		return nil, fmt.Errorf("unsupported asciicast version %d", header.Version)
+	}
+
+	return &Reader{r: br, Header: header}, nil
+}
+
+// Next returns the next event, or io.EOF at the end of the stream
+func (r *Reader) Next() (Event, error) {
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			return Event{}, err
+		}
+
+		// Skip blank lines; a trailing partial line means the recording is still being written
+		if len(line) <= 1 {
+			continue
+		}
+
+		var ev Event
+		if jsonErr := json.Unmarshal(line, &ev); jsonErr != nil {
+			if err == io.EOF {
+				return Event{}, io.EOF
+			}
+			return Event{}, fmt.Errorf("invalid event: %w", jsonErr)
+		}
+		return ev, nil
+	}
+}
@@ -0,0 +1,76 @@
+package recording
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/codervisor/agent-relay/internal/redact"
+)
+
+// ErrNotFound is returned when no recording exists for a session
+var ErrNotFound = errors.New("recording not found")
+
+// Sink stores recordings keyed by session ID
+type Sink interface {
+	// Create opens a new recording for writing
+	Create(sessionID string) (io.WriteCloser, error)
+	// Open returns a recording for reading, or ErrNotFound
+	Open(sessionID string) (io.ReadCloser, error)
+}
+
+// Policy controls which sessions are recorded and what is captured
+type Policy struct {
+	All      bool             // Record every session, not only those that request it
+	Input    bool             // Include keystrokes; this may capture secrets typed by users
+	Redactor *redact.Redactor // Masks secrets before they are written; nil disables
+}
+
+// DirSink stores recordings as <session_id>.cast files in a local directory
+type DirSink struct {
+	dir string
+}
+
+// NewDirSink creates the directory if needed and returns a sink rooted there
+func NewDirSink(dir string) (*DirSink, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+	return &DirSink{dir: dir}, nil
+}
+
+// Create opens a new recording for writing
+func (d *DirSink) Create(sessionID string) (io.WriteCloser, error) {
+	path, err := d.path(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+}
+
+// Open returns a recording for reading
+func (d *DirSink) Open(sessionID string) (io.ReadCloser, error) {
+	path, err := d.path(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// path maps a session ID to a file, rejecting IDs that could escape the directory
+// Session IDs are chosen by clients, so they must not be trusted as path components
+func (d *DirSink) path(sessionID string) (string, error) {
+	if sessionID == "" || sessionID == "." || sessionID == ".." ||
+		strings.ContainsAny(sessionID, `/\`) || strings.ContainsRune(sessionID, 0) {
+		return "", fmt.Errorf("invalid session ID %q", sessionID)
+	}
+	return filepath.Join(d.dir, sessionID+".cast"), nil
+}
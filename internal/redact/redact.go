@@ -0,0 +1,292 @@
+package redact
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+)
+
+// DefaultMask replaces each redacted secret
+const DefaultMask = "[REDACTED]"
+
+// MaxTokenLen bounds how many trailing token bytes a Stream holds back while
+// waiting to see whether a pattern match continues in the next chunk
+const MaxTokenLen = 512
+
+// minSecretLen ignores env values too short to be meaningful secrets;
+// masking "1" or "true" everywhere would make output unreadable
+const minSecretLen = 6
+
+// BuiltinPatterns match common credential formats
+var BuiltinPatterns = []string{
+	`AKIA[0-9A-Z]{16}`,                                                 // AWS access key ID
+	`gh[pousr]_[A-Za-z0-9]{36,255}`,                                    // GitHub tokens
+	`github_pat_[A-Za-z0-9_]{22,255}`,                                  // GitHub fine-grained tokens
+	`glpat-[A-Za-z0-9_\-]{20,}`,                                        // GitLab personal access tokens
+	`xox[abposr]-[A-Za-z0-9\-]{10,}`,                                   // Slack tokens
+	`sk-ant-[A-Za-z0-9_\-]{20,}`,                                       // Anthropic API keys
+	`sk-(?:proj-)?[A-Za-z0-9_\-]{32,}`,                                 // OpenAI API keys
+	`AIza[0-9A-Za-z_\-]{35}`,                                           // Google API keys
+	`eyJ[A-Za-z0-9_\-]{8,}\.eyJ[A-Za-z0-9_\-]{8,}\.[A-Za-z0-9_\-]{8,}`, // JWTs
+}
+
+// Config selects which secrets a Redactor masks
+type Config struct {
+	EnvVars        []string // Names of environment variables whose values are masked
+	Values         []string // Additional literal secrets
+	Patterns       []string // Custom regular expressions; should match token-like strings
+	DisableBuiltin bool     // Skip BuiltinPatterns
+	Mask           string   // Replacement text (default: DefaultMask)
+}
+
+// Redactor masks secrets in byte streams
+// It is immutable after construction and safe for concurrent use
+type Redactor struct {
+	literals [][]byte
+	patterns []*regexp.Regexp
+	mask     []byte
+}
+
+// New compiles a Redactor, reading env var values from the current process
+func New(cfg Config) (*Redactor, error) {
+	r := &Redactor{mask: []byte(cfg.Mask)}
+	if len(r.mask) == 0 {
+		r.mask = []byte(DefaultMask)
+	}
+
+	values := append([]string(nil), cfg.Values...)
+	for _, name := range cfg.EnvVars {
+		values = append(values, os.Getenv(name))
+	}
+	r.literals = literalSet(values)
+
+	sources := cfg.Patterns
+	if !cfg.DisableBuiltin {
+		sources = append(append([]string(nil), BuiltinPatterns...), cfg.Patterns...)
+	}
+	for _, src := range sources {
+		re, err := regexp.Compile(src)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", src, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+
+	return r, nil
+}
+
+// WithValues returns a copy of r that additionally masks the given literals
+// Used for per-session secrets such as env injected by a profile
+func (r *Redactor) WithValues(values ...string) *Redactor {
+	if r == nil {
+		return nil
+	}
+
+	merged := make([]string, 0, len(r.literals)+len(values))
+	for _, lit := range r.literals {
+		merged = append(merged, string(lit))
+	}
+	merged = append(merged, values...)
+
+	return &Redactor{
+		literals: literalSet(merged),
+		patterns: r.patterns,
+		mask:     r.mask,
+	}
+}
+
+// literalSet deduplicates values, drops short ones and sorts longest first
+// so overlapping secrets are masked as a whole
+func literalSet(values []string) [][]byte {
+	seen := make(map[string]bool)
+	var literals [][]byte
+	for _, v := range values {
+		if len(v) < minSecretLen || seen[v] {
+			continue
+		}
+		seen[v] = true
+		literals = append(literals, []byte(v))
+	}
+	sort.Slice(literals, func(i, j int) bool { return len(literals[i]) > len(literals[j]) })
+	return literals
+}
+
+// Redact masks every secret in data and returns the result and match count
+// Use a Stream when data arrives in chunks
+func (r *Redactor) Redact(data []byte) ([]byte, int) {
+	if r == nil {
+		return data, 0
+	}
+	spans := r.matches(data)
+	return r.apply(data, spans), len(spans)
+}
+
+// NewStream returns a Stream that redacts a chunked byte stream
+func (r *Redactor) NewStream() *Stream {
+	return &Stream{r: r}
+}
+
+// span is a half-open byte range [start, end)
+type span struct {
+	start, end int
+}
+
+// matches returns the merged, sorted ranges of all secrets in data
+func (r *Redactor) matches(data []byte) []span {
+	var spans []span
+
+	for _, lit := range r.literals {
+		for offset := 0; ; {
+			i := bytes.Index(data[offset:], lit)
+			if i < 0 {
+				break
+			}
+			start := offset + i
+			spans = append(spans, span{start, start + len(lit)})
+			offset = start + len(lit)
+		}
+	}
+
+	for _, re := range r.patterns {
+		for _, loc := range re.FindAllIndex(data, -1) {
+			if loc[1] > loc[0] {
+				spans = append(spans, span{loc[0], loc[1]})
+			}
+		}
+	}
+
+	if len(spans) < 2 {
+		return spans
+	}
+
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	merged := spans[:1]
+	for _, s := range spans[1:] {
+		last := &merged[len(merged)-1]
+		if s.start <= last.end {
+			if s.end > last.end {
+				last.end = s.end
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// apply replaces each span in data with the mask
+func (r *Redactor) apply(data []byte, spans []span) []byte {
+	if len(spans) == 0 {
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+	prev := 0
+	for _, s := range spans {
+		out = append(out, data[prev:s.start]...)
+		out = append(out, r.mask...)
+		prev = s.end
+	}
+	return append(out, data[prev:]...)
+}
+
+// holdback returns how many trailing bytes of data could be the beginning of
+// a secret that continues in the next chunk
+func (r *Redactor) holdback(data []byte) int {
+	hold := 0
+
+	// Longest suffix that is a proper prefix of a literal secret
+	for _, lit := range r.literals {
+		max := len(lit) - 1
+		if max > len(data) {
+			max = len(data)
+		}
+		for k := max; k > hold; k-- {
+			if bytes.HasPrefix(lit, data[len(data)-k:]) {
+				hold = k
+				break
+			}
+		}
+	}
+
+	// Trailing run of token characters that a pattern might still extend
+	if len(r.patterns) > 0 {
+		run := 0
+		for run < len(data) && run < MaxTokenLen && isTokenByte(data[len(data)-1-run]) {
+			run++
+		}
+		if run > hold {
+			hold = run
+		}
+	}
+
+	return hold
+}
+
+// isTokenByte reports whether b can appear inside a credential token
+func isTokenByte(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' ||
+		b == '_' || b == '-' || b == '.' || b == '+' || b == '/' || b == '='
+}
+
+// Stream redacts data that arrives in chunks, such as 4096-byte PTY reads
+// A secret split across chunk boundaries is held back until it can be seen
+// whole. Stream is not safe for concurrent use
+type Stream struct {
+	r       *Redactor
+	pending []byte
+	count   int
+}
+
+// Write consumes a chunk and returns the bytes that are safe to emit
+// Trailing bytes that may start a secret are retained until the next Write or Flush
+func (s *Stream) Write(chunk []byte) []byte {
+	if s.r == nil {
+		return chunk
+	}
+
+	data := append(s.pending, chunk...)
+	cut := len(data) - s.r.holdback(data)
+	spans := s.r.matches(data)
+
+	// A complete match straddling the cut is safe to emit in full
+	var emitted []span
+	for _, sp := range spans {
+		if sp.start >= cut {
+			break
+		}
+		if sp.end > cut {
+			cut = sp.end
+		}
+		emitted = append(emitted, sp)
+	}
+
+	s.count += len(emitted)
+	out := s.r.apply(data[:cut], emitted)
+	s.pending = append([]byte(nil), data[cut:]...)
+	return out
+}
+
+// Flush redacts and returns everything still held back
+func (s *Stream) Flush() []byte {
+	if s.r == nil || len(s.pending) == 0 {
+		return nil
+	}
+
+	out, n := s.r.Redact(s.pending)
+	s.count += n
+	s.pending = nil
+	return out
+}
+
+// Pending reports whether bytes are being held back
+func (s *Stream) Pending() bool {
+	return len(s.pending) > 0
+}
+
+// Count returns the number of secrets redacted so far
+func (s *Stream) Count() int {
+	return s.count
+}
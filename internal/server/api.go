@@ -0,0 +1,317 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/audit"
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/codervisor/agent-relay/internal/store"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// requestUser returns the identity of the caller
+// HQ has no built-in authentication yet, so this trusts the X-Forwarded-User
+// header set by an authenticating reverse proxy
+func requestUser(c *gin.Context) string {
+	if user := c.GetHeader("X-Forwarded-User"); user != "" {
+		return user
+	}
+	return "anonymous"
+}
+
+// peerAddr returns the address a request's connection comes from, ignoring forwarding headers
+func peerAddr(r *http.Request) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	return addr.Unmap(), err
+}
+
+// authMethod describes how requestUser identified the caller, for audit records
+func authMethod(c *gin.Context) string {
+	if c.GetHeader("X-Forwarded-User") != "" {
+		return "forwarded-header"
+	}
+	return "anonymous"
+}
+
+// queryLimit parses the optional ?limit= query parameter
+func queryLimit(c *gin.Context) int {
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// HandleListSessions returns persisted session metadata
+// Endpoint: GET /api/sessions?runner_id=&user=&status=&limit=
+func HandleListSessions(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sessions, err := hub.Store().ListSessions(c.Request.Context(), store.SessionFilter{
+			RunnerID: c.Query("runner_id"),
+			User:     c.Query("user"),
+			Status:   store.SessionStatus(c.Query("status")),
+			Limit:    queryLimit(c),
+		})
+		if err != nil {
+			requestLog(hub, c).Error("Failed to list sessions", logging.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list sessions"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+	}
+}
+
+// HandleGetSession returns a single session's metadata
+// Endpoint: GET /api/sessions/:id
+func HandleGetSession(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, err := hub.Store().GetSession(c.Request.Context(), c.Param("id"))
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		if err != nil {
+			requestLog(hub, c).Error("Failed to get session", logging.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get session"})
+			return
+		}
+
+		c.JSON(http.StatusOK, session)
+	}
+}
+
+// HandleGetSessionResult returns the repository changes made by a workspace session
+// Endpoint: GET /api/sessions/:id/result?format=, GET /api/jobs/:id/result?format=
+// format=patch returns only the unified diff, suitable for git apply
+func HandleGetSessionResult(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		result, err := hub.Store().GetSessionResult(c.Request.Context(), c.Param("id"))
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session result not found"})
+			return
+		}
+		if err != nil {
+			requestLog(hub, c).Error("Failed to get session result", logging.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get session result"})
+			return
+		}
+
+		switch c.Query("format") {
+		case "", "json":
+			c.JSON(http.StatusOK, result)
+		case "patch":
+			if result.DiffTruncated {
+				c.Header("X-Diff-Truncated", "true")
+			}
+			c.Data(http.StatusOK, "text/x-diff; charset=utf-8", []byte(result.Diff))
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or patch"})
+		}
+	}
+}
+
+// HandleListJobs returns persisted job records
+// Endpoint: GET /api/jobs?runner_id=&status=&limit=
+func HandleListJobs(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		jobs, err := hub.Store().ListJobs(c.Request.Context(), store.JobFilter{
+			RunnerID: c.Query("runner_id"),
+			Status:   store.JobStatus(c.Query("status")),
+			Limit:    queryLimit(c),
+		})
+		if err != nil {
+			requestLog(hub, c).Error("Failed to list jobs", logging.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list jobs"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"jobs": jobs})
+	}
+}
+
+// HandleGetJob returns a single job record
+// Endpoint: GET /api/jobs/:id
+func HandleGetJob(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job, err := hub.Store().GetJob(c.Request.Context(), c.Param("id"))
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+			return
+		}
+		if err != nil {
+			requestLog(hub, c).Error("Failed to get job", logging.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get job"})
+			return
+		}
+
+		c.JSON(http.StatusOK, job)
+	}
+}
+
+// createJobRequest is the body of POST /api/jobs
+// Either command or profile is required
+type createJobRequest struct {
+	RunnerID string            `json:"runner_id" binding:"required"`
+	Command  []string          `json:"command"`
+	Profile  string            `json:"profile"` // Agent profile that supplies the command and its settings
+	Env      map[string]string `json:"env"`
+	Cwd      string            `json:"cwd"`
+	Record   bool              `json:"record"`
+	// Artifacts are glob patterns, relative to cwd, collected after the command exits
+	Artifacts []string `json:"artifacts"`
+	// Workspace runs the command in a fresh git checkout; cwd is then relative to it
+	Workspace *protocol.WorkspaceSpec `json:"workspace"`
+}
+
+// HandleCreateJob queues a non-interactive command on a runner
+// The job starts immediately if the runner is connected, otherwise when it registers
+// Endpoint: POST /api/jobs
+func HandleCreateJob(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req createJobRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(req.Command) == 0 && req.Profile == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "command or profile is required"})
+			return
+		}
+
+		id := uuid.NewString()
+		payload, err := hub.PrepareSession(req.RunnerID, protocol.StartSessionPayload{
+			SessionID: id,
+			Command:   req.Command,
+			Cwd:       req.Cwd,
+			Artifacts: req.Artifacts,
+			Workspace: req.Workspace,
+			Profile:   req.Profile,
+			Env:       req.Env,
+		})
+		user := requestUser(c)
+		denied := audit.Event{User: user, RunnerID: req.RunnerID, RemoteAddr: c.ClientIP()}
+		if err != nil {
+			hub.recordPolicyDenied(denied, c.Request.Method+" "+c.FullPath(), profileErrorCode(err), err.Error())
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if payload.Workspace != nil && payload.Workspace.Repo == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "workspace.repo is required"})
+			return
+		}
+
+		quotaKey := hub.quotaKey(c)
+		if quotaErr := hub.AdmitJob(quotaKey, req.RunnerID); quotaErr != nil {
+			requestLog(hub, c).Warn("Refusing job", "code", quotaErr.Code, logging.Err(quotaErr))
+			hub.recordPolicyDenied(denied, c.Request.Method+" "+c.FullPath(), quotaErr.Code, quotaErr.Message)
+			abortWithQuota(c, quotaErr)
+			return
+		}
+
+		job, err := hub.SubmitJob(store.JobRecord{
+			ID:        id,
+			RunnerID:  req.RunnerID,
+			User:      user,
+			QuotaKey:  quotaKey,
+			Command:   payload.Command,
+			Cwd:       payload.Cwd,
+			Record:    req.Record,
+			Artifacts: payload.Artifacts,
+			Workspace: payload.Workspace,
+			Profile:   payload.Profile,
+			Env:       payload.Env,
+			Limits:    payload.Limits,
+			Timeout:   payload.Timeout,
+		})
+		if err != nil {
+			requestLog(hub, c).Error("Failed to create job", logging.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create job"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, job)
+	}
+}
+
+// HandleQueryAudit returns audit events matching the query
+// Endpoint: GET /api/audit?since=&until=&type=&user=&runner_id=&session_id=&limit=
+// since and until are RFC 3339 timestamps
+func HandleQueryAudit(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := audit.Filter{
+			Type:      audit.EventType(c.Query("type")),
+			User:      c.Query("user"),
+			RunnerID:  c.Query("runner_id"),
+			SessionID: c.Query("session_id"),
+			Limit:     queryLimit(c),
+		}
+
+		var err error
+		if filter.Since, err = queryTime(c, "since"); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if filter.Until, err = queryTime(c, "until"); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		events, err := hub.Audit().Query(c.Request.Context(), filter)
+		if errors.Is(err, audit.ErrQueryUnsupported) {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			requestLog(hub, c).Error("Failed to query audit log", logging.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query audit log"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"events": events})
+	}
+}
+
+// HandleVerifyAudit checks the audit log's hash chain
+// Endpoint: GET /api/audit/verify
+func HandleVerifyAudit(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		count, err := hub.Audit().Verify()
+		if errors.Is(err, audit.ErrQueryUnsupported) {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusConflict, gin.H{"valid": false, "events": count, "error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"valid": true, "events": count})
+	}
+}
+
+// queryTime parses an optional RFC 3339 query parameter
+func queryTime(c *gin.Context, key string) (time.Time, error) {
+	value := c.Query(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: expected RFC 3339 timestamp", key)
+	}
+	return t, nil
+}
@@ -0,0 +1,559 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/audit"
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/codervisor/agent-relay/internal/store"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// DefaultApprovalTimeout is how long a request waits when the session does not ask for a timeout
+	DefaultApprovalTimeout = 5 * time.Minute
+	// DefaultMaxApprovalTimeout caps the timeout a session may ask for
+	DefaultMaxApprovalTimeout = time.Hour
+)
+
+// ErrApprovalNotPending is returned when deciding an approval nobody is waiting on
+var ErrApprovalNotPending = errors.New("approval not found or already resolved")
+
+// ErrDecisionFromRunnerHost is returned for a decision the session could have sent itself
+var ErrDecisionFromRunnerHost = errors.New("decisions from the runner's host must come from a browser")
+
+// Decider is who decided an approval and where the decision came from
+type Decider struct {
+	User       string
+	RemoteAddr netip.Addr // Peer address of the decision's connection
+	Origin     string     // Origin header of the request; browsers always send one
+}
+
+// requestDecider describes the caller deciding an approval
+func requestDecider(c *gin.Context) Decider {
+	addr, _ := peerAddr(c.Request)
+	return Decider{User: requestUser(c), RemoteAddr: addr, Origin: c.GetHeader("Origin")}
+}
+
+// pendingApproval is a request a session is blocked on
+type pendingApproval struct {
+	record     store.ApprovalRecord
+	timer      *time.Timer // Denies the request once it expires
+	runnerAddr netip.Addr  // Where the requesting runner connected from
+}
+
+// approvalSubscriber is a reviewer connection on /ws/approvals
+type approvalSubscriber struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+}
+
+// WriteJSON serializes writes to the subscriber connection
+func (s *approvalSubscriber) WriteJSON(msg protocol.Message) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteJSON(msg)
+}
+
+// WithApprovalTimeout sets how long approval requests wait for a decision by default
+// and the longest timeout a session may ask for
+func WithApprovalTimeout(timeout, max time.Duration) HubOption {
+	return func(h *Hub) {
+		h.approvalTimeout = timeout
+		h.maxApprovalTimeout = max
+	}
+}
+
+// RequestApproval records an approval request from a runner and notifies reviewers
+// Requests HQ cannot accept are denied straight away so the session does not hang
+func (h *Hub) RequestApproval(runnerID string, req protocol.ApprovalRequestPayload) {
+	deny := func(reason string) {
+		h.runnerLog(runnerID).Warn("Denying approval", logging.SessionID(req.SessionID), "approval_id", req.ApprovalID, "reason", reason)
+		h.sendToRunner(runnerID, protocol.Message{
+			Type: protocol.MessageTypeApprovalDecision,
+			Payload: protocol.ApprovalDecisionPayload{
+				ApprovalID: req.ApprovalID,
+				SessionID:  req.SessionID,
+				Status:     string(store.ApprovalStatusDenied),
+				Reason:     reason,
+			},
+		})
+	}
+
+	if req.ApprovalID == "" || req.Action == "" {
+		deny("approval_id and action are required")
+		return
+	}
+	if owner, exists := h.GetRunnerForSession(req.SessionID); !exists || owner != runnerID {
+		deny("session is not active on this runner")
+		return
+	}
+	var runnerAddr netip.Addr
+	if runner, exists := h.GetRunner(runnerID); exists {
+		runnerAddr = runner.addr
+	}
+
+	timeout, maxTimeout := h.approvalTimeouts()
+	if req.Timeout > 0 {
+		timeout = time.Duration(req.Timeout) * time.Second
+	}
+	if maxTimeout > 0 && timeout > maxTimeout {
+		timeout = maxTimeout
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+	rec := store.ApprovalRecord{
+		ID:          req.ApprovalID,
+		SessionID:   req.SessionID,
+		RunnerID:    runnerID,
+		Action:      req.Action,
+		Details:     req.Details,
+		Status:      store.ApprovalStatusPending,
+		RequestedAt: now,
+		ExpiresAt:   now.Add(timeout),
+	}
+	if session, err := h.store.GetSession(ctx, req.SessionID); err == nil {
+		rec.User = session.User
+	}
+
+	h.approvalMu.Lock()
+	if _, exists := h.approvals[rec.ID]; exists {
+		h.approvalMu.Unlock()
+		deny("duplicate approval_id")
+		return
+	}
+	if err := h.store.CreateApproval(ctx, rec); err != nil {
+		h.approvalMu.Unlock()
+		h.log.Error("Failed to persist approval", logging.SessionID(rec.SessionID), "approval_id", rec.ID, logging.Err(err))
+		deny("failed to record approval request")
+		return
+	}
+	h.approvals[rec.ID] = &pendingApproval{
+		record: rec,
+		timer: time.AfterFunc(timeout, func() {
+			h.resolveApproval(rec.ID, store.ApprovalStatusExpired, Decider{}, "timed out waiting for a decision")
+		}),
+		runnerAddr: runnerAddr,
+	}
+	subs := h.approvalSubscribers()
+	h.approvalMu.Unlock()
+
+	h.audit.Record(audit.Event{
+		Type:      audit.EventApprovalRequested,
+		User:      rec.User,
+		RunnerID:  runnerID,
+		SessionID: rec.SessionID,
+		Details: map[string]interface{}{
+			"approval_id": rec.ID,
+			"action":      rec.Action,
+			"details":     rec.Details,
+			"expires_at":  rec.ExpiresAt,
+		},
+	})
+	h.runnerLog(runnerID).Info("Approval requested", logging.SessionID(rec.SessionID), "approval_id", rec.ID, "action", rec.Action, "timeout", timeout)
+
+	h.broadcastApproval(rec.SessionID, approvalRequestMessage(rec), subs)
+}
+
+// DecideApproval resolves a pending approval on behalf of a reviewer
+// Code in a session can reach HQ from its runner's host, so a decision from there
+// without an Origin header is refused: it cannot be told apart from the session's own
+func (h *Hub) DecideApproval(id string, approved bool, by Decider, reason string) (store.ApprovalRecord, error) {
+	h.approvalMu.Lock()
+	pending, exists := h.approvals[id]
+	h.approvalMu.Unlock()
+	if exists && by.Origin == "" && pending.runnerAddr.IsValid() && by.RemoteAddr == pending.runnerAddr {
+		rec := pending.record
+		h.log.Warn("Refusing approval decision from the runner's host", logging.RunnerID(rec.RunnerID),
+			logging.SessionID(rec.SessionID), "approval_id", id, "decided_by", by.User, logging.RemoteAddr(by.RemoteAddr.String()))
+		h.recordPolicyDenied(audit.Event{
+			User:       by.User,
+			RunnerID:   rec.RunnerID,
+			SessionID:  rec.SessionID,
+			RemoteAddr: by.RemoteAddr.String(),
+			Details:    map[string]interface{}{"approval_id": id},
+		}, "approval_decision", protocol.ErrCodeForbidden, ErrDecisionFromRunnerHost.Error())
+		return store.ApprovalRecord{}, ErrDecisionFromRunnerHost
+	}
+
+	status := store.ApprovalStatusDenied
+	if approved {
+		status = store.ApprovalStatusApproved
+	}
+	return h.resolveApproval(id, status, by, reason)
+}
+
+// PendingApproval returns an approval a session is still waiting on
+func (h *Hub) PendingApproval(id string) (store.ApprovalRecord, bool) {
+	h.approvalMu.Lock()
+	defer h.approvalMu.Unlock()
+
+	pending, exists := h.approvals[id]
+	if !exists {
+		return store.ApprovalRecord{}, false
+	}
+	return pending.record, true
+}
+
+// resolveApproval records the outcome of a pending approval and unblocks its session
+// Only an approved status lets the session proceed
+// by is the zero Decider when HQ resolves it itself
+func (h *Hub) resolveApproval(id string, status store.ApprovalStatus, by Decider, reason string) (store.ApprovalRecord, error) {
+	decidedBy := by.User
+	h.approvalMu.Lock()
+	pending, exists := h.approvals[id]
+	if exists {
+		pending.timer.Stop()
+		delete(h.approvals, id)
+	}
+	subs := h.approvalSubscribers()
+	h.approvalMu.Unlock()
+
+	if !exists {
+		return store.ApprovalRecord{}, ErrApprovalNotPending
+	}
+
+	now := time.Now()
+	rec := pending.record
+	rec.Status = status
+	rec.DecidedAt = &now
+	rec.DecidedBy = decidedBy
+	rec.Reason = reason
+
+	if err := h.store.DecideApproval(context.Background(), id, store.ApprovalDecision{
+		Status:    status,
+		DecidedAt: now,
+		DecidedBy: decidedBy,
+		Reason:    reason,
+	}); err != nil {
+		h.log.Error("Failed to persist approval decision", logging.SessionID(rec.SessionID), "approval_id", id, logging.Err(err))
+	}
+
+	details := map[string]interface{}{
+		"approval_id": id,
+		"action":      rec.Action,
+		"status":      status,
+	}
+	if reason != "" {
+		details["reason"] = reason
+	}
+	if decidedBy != "" {
+		details["decided_by"] = decidedBy
+	}
+	if by.Origin != "" {
+		details["origin"] = by.Origin
+	}
+	var decidedFrom string
+	if by.RemoteAddr.IsValid() {
+		decidedFrom = by.RemoteAddr.String()
+	}
+	h.audit.Record(audit.Event{
+		Type:       audit.EventApprovalDecided,
+		User:       rec.User,
+		RunnerID:   rec.RunnerID,
+		SessionID:  rec.SessionID,
+		RemoteAddr: decidedFrom,
+		Details:    details,
+	})
+	h.log.Info("Approval resolved", logging.RunnerID(rec.RunnerID), logging.SessionID(rec.SessionID),
+		"approval_id", id, "status", status, "decided_by", decidedBy, "reason", reason)
+
+	msg := protocol.Message{
+		Type: protocol.MessageTypeApprovalDecision,
+		Payload: protocol.ApprovalDecisionPayload{
+			ApprovalID: id,
+			SessionID:  rec.SessionID,
+			Approved:   status == store.ApprovalStatusApproved,
+			Status:     string(status),
+			Reason:     reason,
+			DecidedBy:  decidedBy,
+		},
+	}
+	h.sendToRunner(rec.RunnerID, msg)
+	h.broadcastApproval(rec.SessionID, msg, subs)
+	return rec, nil
+}
+
+// cancelApprovals resolves every pending approval that matches as cancelled
+func (h *Hub) cancelApprovals(match func(store.ApprovalRecord) bool, reason string) {
+	h.approvalMu.Lock()
+	var ids []string
+	for id, pending := range h.approvals {
+		if match(pending.record) {
+			ids = append(ids, id)
+		}
+	}
+	h.approvalMu.Unlock()
+
+	for _, id := range ids {
+		h.resolveApproval(id, store.ApprovalStatusCancelled, Decider{}, reason)
+	}
+}
+
+// cancelStaleApprovals closes approvals left pending by a previous HQ process
+// Their sessions are gone, so nobody is waiting on them any more
+func (h *Hub) cancelStaleApprovals(now time.Time) int {
+	ctx := context.Background()
+	approvals, err := h.store.ListApprovals(ctx, store.ApprovalFilter{Status: store.ApprovalStatusPending})
+	if err != nil {
+		h.log.Error("Failed to load pending approvals", logging.Err(err))
+		return 0
+	}
+	for _, a := range approvals {
+		if err := h.store.DecideApproval(ctx, a.ID, store.ApprovalDecision{
+			Status:    store.ApprovalStatusCancelled,
+			DecidedAt: now,
+			Reason:    "hq restarted",
+		}); err != nil {
+			h.log.Error("Failed to cancel approval", logging.SessionID(a.SessionID), "approval_id", a.ID, logging.Err(err))
+		}
+	}
+	return len(approvals)
+}
+
+// sendToRunner writes a control message to a runner if it is still connected
+func (h *Hub) sendToRunner(runnerID string, msg protocol.Message) {
+	runner, exists := h.GetRunner(runnerID)
+	if !exists {
+		return
+	}
+	if err := runner.WriteJSON(msg); err != nil {
+		runner.log.Warn("Failed to send message to runner", "type", msg.Type, logging.Err(err))
+	}
+}
+
+// broadcastApproval sends an approval message to the session's client and to reviewers
+// subs is taken together with the change being announced, so a reviewer sees each
+// approval either in its pending snapshot or in a broadcast, never both
+func (h *Hub) broadcastApproval(sessionID string, msg protocol.Message, subs []*approvalSubscriber) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		h.log.Error("Failed to encode message", "type", msg.Type, logging.Err(err))
+		return
+	}
+	if err := h.RouteToClient(sessionID, websocket.TextMessage, data); err != nil {
+		h.log.Debug("Failed to route message to client", logging.SessionID(sessionID), "type", msg.Type, logging.Err(err))
+	}
+
+	for _, sub := range subs {
+		if err := sub.WriteJSON(msg); err != nil {
+			// The subscriber's read loop notices the broken connection and unsubscribes
+			sub.conn.Close()
+		}
+	}
+}
+
+// approvalSubscribers lists the current reviewers; callers hold approvalMu
+func (h *Hub) approvalSubscribers() []*approvalSubscriber {
+	subs := make([]*approvalSubscriber, 0, len(h.approvalSubs))
+	for sub := range h.approvalSubs {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// subscribeApprovals registers a reviewer and sends it the approvals currently pending
+// Broadcasts wait for the snapshot, so they cannot overtake it
+func (h *Hub) subscribeApprovals(sub *approvalSubscriber) error {
+	sub.writeMu.Lock()
+	defer sub.writeMu.Unlock()
+
+	h.approvalMu.Lock()
+	h.approvalSubs[sub] = struct{}{}
+	pending := make([]store.ApprovalRecord, 0, len(h.approvals))
+	for _, p := range h.approvals {
+		pending = append(pending, p.record)
+	}
+	h.approvalMu.Unlock()
+
+	sort.Slice(pending, func(i, j int) bool { return pending[i].RequestedAt.Before(pending[j].RequestedAt) })
+	for _, rec := range pending {
+		if err := sub.conn.WriteJSON(approvalRequestMessage(rec)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Hub) unsubscribeApprovals(sub *approvalSubscriber) {
+	h.approvalMu.Lock()
+	defer h.approvalMu.Unlock()
+	delete(h.approvalSubs, sub)
+}
+
+// approvalRequestMessage builds the approval_request reviewers receive
+func approvalRequestMessage(rec store.ApprovalRecord) protocol.Message {
+	return protocol.Message{
+		Type: protocol.MessageTypeApprovalRequest,
+		Payload: protocol.ApprovalRequestPayload{
+			ApprovalID: rec.ID,
+			SessionID:  rec.SessionID,
+			Action:     rec.Action,
+			Details:    rec.Details,
+			Timeout:    int(rec.ExpiresAt.Sub(rec.RequestedAt).Seconds()),
+			User:       rec.User,
+			ExpiresAt:  rec.ExpiresAt.Format(time.RFC3339),
+		},
+	}
+}
+
+// decideFromMessage applies an approval_decision sent by a reviewer over WebSocket
+// When sessionID is set the decision must belong to that session
+func decideFromMessage(hub *Hub, msg protocol.Message, sessionID string, by Decider) error {
+	var payload protocol.ApprovalDecisionPayload
+	if err := protocol.DecodePayload(msg, &payload); err != nil {
+		return err
+	}
+	if sessionID != "" {
+		if rec, pending := hub.PendingApproval(payload.ApprovalID); !pending || rec.SessionID != sessionID {
+			return ErrApprovalNotPending
+		}
+	}
+	_, err := hub.DecideApproval(payload.ApprovalID, payload.Approved, by, payload.Reason)
+	return err
+}
+
+// HandleApprovalsConnection streams approval requests and decisions to reviewers
+// Pending requests are sent on connect; reviewers answer with approval_decision
+// Endpoint: /ws/approvals
+func HandleApprovalsConnection(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		decider := requestDecider(c)
+		logger := logging.Component(hub.Logger(), "ws").With(
+			logging.ClientID(uuid.NewString()), logging.RemoteAddr(c.ClientIP()), "user", decider.User)
+
+		conn, err := hub.upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			logger.Warn("Failed to upgrade approvals connection", logging.Err(err))
+			return
+		}
+		defer conn.Close()
+
+		sub := &approvalSubscriber{conn: conn}
+		defer hub.unsubscribeApprovals(sub)
+		if err := hub.subscribeApprovals(sub); err != nil {
+			return
+		}
+
+		logger.Info("Approval reviewer connected")
+
+		for {
+			var msg protocol.Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseServiceRestart) {
+					logger.Warn("Approvals read error", logging.Err(err))
+				}
+				break
+			}
+			if msg.Type != protocol.MessageTypeApprovalDecision {
+				continue
+			}
+			if err := decideFromMessage(hub, msg, "", decider); err != nil {
+				sub.WriteJSON(approvalError(err))
+			}
+		}
+
+		logger.Info("Approval reviewer disconnected")
+	}
+}
+
+// approvalError reports a decision HQ could not apply
+func approvalError(err error) protocol.Message {
+	payload := protocol.ErrorPayload{Message: err.Error()}
+	switch {
+	case errors.Is(err, ErrApprovalNotPending):
+		payload.Code = protocol.ErrCodeNotFound
+	case errors.Is(err, ErrDecisionFromRunnerHost):
+		payload.Code = protocol.ErrCodeForbidden
+	}
+	return protocol.Message{Type: protocol.MessageTypeError, Payload: payload}
+}
+
+// HandleListApprovals returns approval requests and their outcomes
+// Endpoint: GET /api/approvals?session_id=&status=&limit=
+func HandleListApprovals(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		approvals, err := hub.Store().ListApprovals(c.Request.Context(), store.ApprovalFilter{
+			SessionID: c.Query("session_id"),
+			Status:    store.ApprovalStatus(c.Query("status")),
+			Limit:     queryLimit(c),
+		})
+		if err != nil {
+			requestLog(hub, c).Error("Failed to list approvals", logging.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list approvals"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"approvals": approvals})
+	}
+}
+
+// HandleGetApproval returns a single approval
+// Endpoint: GET /api/approvals/:id
+func HandleGetApproval(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		approval, err := hub.Store().GetApproval(c.Request.Context(), c.Param("id"))
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "approval not found"})
+			return
+		}
+		if err != nil {
+			requestLog(hub, c).Error("Failed to get approval", logging.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get approval"})
+			return
+		}
+
+		c.JSON(http.StatusOK, approval)
+	}
+}
+
+// decideApprovalRequest is the optional body of an approve or deny call
+type decideApprovalRequest struct {
+	Reason string `json:"reason"`
+}
+
+// HandleDecideApproval approves or denies a pending approval
+// Endpoint: POST /api/approvals/:id/approve, POST /api/approvals/:id/deny
+func HandleDecideApproval(hub *Hub, approved bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req decideApprovalRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		approval, err := hub.DecideApproval(c.Param("id"), approved, requestDecider(c), req.Reason)
+		if errors.Is(err, ErrDecisionFromRunnerHost) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "code": protocol.ErrCodeForbidden})
+			return
+		}
+		if errors.Is(err, ErrApprovalNotPending) {
+			if _, getErr := hub.Store().GetApproval(c.Request.Context(), c.Param("id")); errors.Is(getErr, store.ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "approval not found"})
+				return
+			}
+			c.JSON(http.StatusConflict, gin.H{"error": "approval is no longer pending"})
+			return
+		}
+		if err != nil {
+			requestLog(hub, c).Error("Failed to decide approval", logging.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decide approval"})
+			return
+		}
+
+		c.JSON(http.StatusOK, approval)
+	}
+}
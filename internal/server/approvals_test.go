@@ -0,0 +1,53 @@
+package server
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/store"
+)
+
+func TestDecideApprovalFromRunnerHost(t *testing.T) {
+	runnerAddr := netip.MustParseAddr("10.0.0.7")
+
+	tests := []struct {
+		name    string
+		by      Decider
+		wantErr error
+	}{
+		{name: "runner host without an origin", by: Decider{User: "alice", RemoteAddr: runnerAddr}, wantErr: ErrDecisionFromRunnerHost},
+		{name: "runner host from a browser", by: Decider{User: "alice", RemoteAddr: runnerAddr, Origin: "https://agents.example.com"}},
+		{name: "another host without an origin", by: Decider{User: "alice", RemoteAddr: netip.MustParseAddr("10.0.0.8")}},
+		{name: "unknown address", by: Decider{User: "alice"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub()
+			hub.approvals["a1"] = &pendingApproval{
+				record:     store.ApprovalRecord{ID: "a1", SessionID: "s1", RunnerID: "r1", Status: store.ApprovalStatusPending},
+				timer:      time.NewTimer(time.Hour),
+				runnerAddr: runnerAddr,
+			}
+
+			rec, err := hub.DecideApproval("a1", true, tt.by, "")
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("DecideApproval() = %+v, %v; want error %v", rec, err, tt.wantErr)
+				}
+				if _, pending := hub.PendingApproval("a1"); !pending {
+					t.Error("refused decision resolved the approval")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DecideApproval() error = %v", err)
+			}
+			if rec.Status != store.ApprovalStatusApproved || rec.DecidedBy != tt.by.User {
+				t.Errorf("DecideApproval() = %+v, want approved by %s", rec, tt.by.User)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/artifact"
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/codervisor/agent-relay/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// WithArtifacts stores files collected from finished sessions in s
+// Without it, artifacts sent by runners are discarded
+func WithArtifacts(s artifact.Store) HubOption {
+	return func(h *Hub) {
+		h.artifacts = s
+	}
+}
+
+// Artifacts returns the artifact store, or nil when artifacts are disabled
+func (h *Hub) Artifacts() artifact.Store {
+	return h.artifacts
+}
+
+// incomingArtifact is an artifact being streamed from a runner into the store
+type incomingArtifact struct {
+	runnerID string
+	record   store.ArtifactRecord
+	w        artifact.Writer // nil once the artifact is rejected or dropped
+	hash     hash.Hash
+	size     int64
+}
+
+// StartArtifact prepares to receive an artifact announced by a runner
+// A rejected artifact is still tracked so its chunks are discarded rather than routed as PTY output
+func (h *Hub) StartArtifact(runnerID string, payload protocol.ArtifactPayload) error {
+	in := &incomingArtifact{
+		runnerID: runnerID,
+		record: store.ArtifactRecord{
+			SessionID: payload.SessionID,
+			Name:      payload.Name,
+			Size:      payload.Size,
+		},
+		hash: sha256.New(),
+	}
+
+	err := h.checkArtifact(runnerID, payload)
+	if err == nil {
+		in.w, err = h.artifacts.Create(payload.SessionID, payload.Name)
+	}
+
+	h.transferMu.Lock()
+	h.incoming[payload.TransferID] = in
+	h.transferMu.Unlock()
+	return err
+}
+
+// checkArtifact checks whether an announced artifact may be stored
+func (h *Hub) checkArtifact(runnerID string, payload protocol.ArtifactPayload) error {
+	if h.artifacts == nil {
+		return errors.New("artifact storage is disabled")
+	}
+	if owner, exists := h.GetRunnerForSession(payload.SessionID); !exists || owner != runnerID {
+		return fmt.Errorf("session %s is not active on runner %s", payload.SessionID, runnerID)
+	}
+	if !artifact.ValidName(payload.Name) {
+		return fmt.Errorf("invalid artifact name %q", payload.Name)
+	}
+	if h.maxTransferSize > 0 && payload.Size > h.maxTransferSize {
+		return fmt.Errorf("artifact %s exceeds the %d byte transfer limit", payload.Name, h.maxTransferSize)
+	}
+	return nil
+}
+
+// takeIncoming removes and returns a runner's incoming artifact, or nil
+func (h *Hub) takeIncoming(runnerID, id string) *incomingArtifact {
+	h.transferMu.Lock()
+	defer h.transferMu.Unlock()
+
+	in, exists := h.incoming[id]
+	if !exists || in.runnerID != runnerID {
+		return nil
+	}
+	delete(h.incoming, id)
+	return in
+}
+
+// ReceiveArtifactChunk writes a binary frame to an incoming artifact
+// Returns false if id is not an incoming artifact
+func (h *Hub) ReceiveArtifactChunk(runnerID, id string, data []byte) bool {
+	h.transferMu.Lock()
+	in, exists := h.incoming[id]
+	h.transferMu.Unlock()
+
+	if !exists || in.runnerID != runnerID {
+		return false
+	}
+	if in.w == nil {
+		return true
+	}
+
+	var err error
+	if in.size+int64(len(data)) > in.record.Size {
+		err = fmt.Errorf("received more than the announced %d bytes", in.record.Size)
+	} else if _, err = in.w.Write(data); err == nil {
+		in.hash.Write(data)
+		in.size += int64(len(data))
+		return true
+	}
+
+	// Discard the rest of the stream until file_end
+	h.log.Warn("Dropping artifact", logging.SessionID(in.record.SessionID), "artifact", in.record.Name, logging.Err(err))
+	in.w.Abort()
+	in.w = nil
+	return true
+}
+
+// FinishArtifact verifies and commits an incoming artifact
+// Returns false if the transfer is not an incoming artifact
+func (h *Hub) FinishArtifact(runnerID string, end protocol.FileEndPayload) bool {
+	in := h.takeIncoming(runnerID, end.TransferID)
+	if in == nil {
+		return false
+	}
+	if in.w == nil {
+		return true
+	}
+
+	sum := hex.EncodeToString(in.hash.Sum(nil))
+	if in.size != end.Size || sum != end.SHA256 {
+		h.log.Warn("Dropping artifact: checksum mismatch", logging.SessionID(in.record.SessionID), "artifact", in.record.Name)
+		in.w.Abort()
+		return true
+	}
+
+	if err := in.w.Commit(); err != nil {
+		h.log.Error("Failed to store artifact", logging.SessionID(in.record.SessionID), "artifact", in.record.Name, logging.Err(err))
+		return true
+	}
+
+	in.record.SHA256 = sum
+	in.record.CreatedAt = time.Now()
+	if err := h.store.PutArtifact(context.Background(), in.record); err != nil {
+		h.log.Error("Failed to persist artifact", logging.SessionID(in.record.SessionID), "artifact", in.record.Name, logging.Err(err))
+		return true
+	}
+
+	h.log.Info("Stored artifact", logging.SessionID(in.record.SessionID), "artifact", in.record.Name, "bytes", in.size)
+	return true
+}
+
+// AbortArtifact discards an incoming artifact the runner failed to send
+// Returns false if the transfer is not an incoming artifact
+func (h *Hub) AbortArtifact(runnerID, id string) bool {
+	in := h.takeIncoming(runnerID, id)
+	if in == nil {
+		return false
+	}
+	if in.w != nil {
+		in.w.Abort()
+	}
+	return true
+}
+
+// abortRunnerArtifacts discards incoming artifacts from a runner that disconnected
+func (h *Hub) abortRunnerArtifacts(runnerID string) {
+	h.transferMu.Lock()
+	defer h.transferMu.Unlock()
+
+	for id, in := range h.incoming {
+		if in.runnerID == runnerID {
+			if in.w != nil {
+				in.w.Abort()
+			}
+			delete(h.incoming, id)
+		}
+	}
+}
+
+// HandleListArtifacts returns the artifacts collected from a job or session
+// Endpoint: GET /api/jobs/:id/artifacts, GET /api/sessions/:id/artifacts
+func HandleListArtifacts(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if !sessionOrJobExists(c.Request.Context(), hub, id) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "job or session not found"})
+			return
+		}
+
+		artifacts, err := hub.Store().ListArtifacts(c.Request.Context(), id)
+		if err != nil {
+			requestLog(hub, c).Error("Failed to list artifacts", logging.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list artifacts"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"artifacts": artifacts})
+	}
+}
+
+// HandleArtifactDownload serves a single artifact
+// Endpoint: GET /api/jobs/:id/artifacts/*name, GET /api/sessions/:id/artifacts/*name
+func HandleArtifactDownload(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		name := strings.TrimPrefix(c.Param("name"), "/")
+
+		record, err := hub.Store().GetArtifact(c.Request.Context(), id, name)
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "artifact not found"})
+			return
+		}
+		if err != nil {
+			requestLog(hub, c).Error("Failed to get artifact", logging.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get artifact"})
+			return
+		}
+
+		if hub.Artifacts() == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "artifact storage is disabled"})
+			return
+		}
+
+		r, err := hub.Artifacts().Open(id, name)
+		if errors.Is(err, artifact.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "artifact not found"})
+			return
+		}
+		if err != nil {
+			requestLog(hub, c).Error("Failed to open artifact", logging.Err(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to open artifact"})
+			return
+		}
+		defer r.Close()
+
+		c.Header("Content-Type", "application/octet-stream")
+		c.Header("Content-Length", strconv.FormatInt(record.Size, 10))
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+		c.Header(checksumHeader, record.SHA256)
+		c.Status(http.StatusOK)
+		if _, err := io.Copy(c.Writer, r); err != nil {
+			requestLog(hub, c).Error("Failed to stream artifact", logging.Err(err))
+		}
+	}
+}
+
+// sessionOrJobExists reports whether id names a known session or job
+// Queued jobs have no session yet but may still be asked for artifacts
+func sessionOrJobExists(ctx context.Context, hub *Hub, id string) bool {
+	if _, err := hub.Store().GetSession(ctx, id); err == nil {
+		return true
+	}
+	_, err := hub.Store().GetJob(ctx, id)
+	return err == nil
+}
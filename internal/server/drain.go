@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/codervisor/agent-relay/internal/audit"
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/gin-gonic/gin"
+)
+
+// Draining reports whether the runner has stopped accepting sessions
+func (r *RunnerConn) Draining() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.drain != nil
+}
+
+// RunnerDraining records that a runner will start no new sessions
+// Its queued jobs stay queued until a runner with its ID registers without draining
+func (h *Hub) RunnerDraining(runnerID string, payload protocol.RunnerDrainingPayload) {
+	runner, exists := h.GetRunner(runnerID)
+	if !exists {
+		return
+	}
+
+	runner.mu.Lock()
+	runner.drain = &payload
+	runner.mu.Unlock()
+
+	deadline := payload.Deadline
+	if deadline == "" {
+		deadline = "none"
+	}
+	runner.log.Info("Runner is draining", "sessions", payload.Sessions, "deadline", deadline)
+}
+
+// DrainRunner asks a connected runner to finish its sessions and exit
+// timeoutSecs of 0 leaves the deadline to the runner
+func (h *Hub) DrainRunner(runnerID string, timeoutSecs int, user string) error {
+	runner, exists := h.GetRunner(runnerID)
+	if !exists {
+		return fmt.Errorf("runner %s not found", runnerID)
+	}
+
+	err := runner.WriteJSON(protocol.Message{
+		Type:    protocol.MessageTypeDrain,
+		Payload: protocol.DrainPayload{Timeout: timeoutSecs},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send drain: %w", err)
+	}
+
+	h.audit.Record(audit.Event{
+		Type:     audit.EventRunnerDrainRequested,
+		User:     user,
+		RunnerID: runnerID,
+		Details:  map[string]interface{}{"timeout": timeoutSecs},
+	})
+	runner.log.Info("Asked runner to drain", "timeout", timeoutSecs, "user", user)
+	return nil
+}
+
+// DrainingRunners returns the IDs of connected runners that are draining
+func (h *Hub) DrainingRunners() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ids := []string{}
+	for id, runner := range h.runners {
+		if runner.Draining() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// drainRequest is the optional body of POST /api/runners/:id/drain
+type drainRequest struct {
+	Timeout int `json:"timeout"` // Seconds before remaining sessions are killed; 0 = runner's --drain-timeout
+}
+
+// HandleDrainRunner puts a runner into drain mode: it starts no new sessions,
+// waits for the running ones to end and then exits
+// Endpoint: POST /api/runners/:id/drain
+func HandleDrainRunner(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req drainRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if req.Timeout < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "timeout must not be negative"})
+			return
+		}
+
+		runnerID := c.Param("id")
+		if _, exists := hub.GetRunner(runnerID); !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "runner not found"})
+			return
+		}
+
+		if err := hub.DrainRunner(runnerID, req.Timeout, requestUser(c)); err != nil {
+			requestLog(hub, c).Error("Failed to drain runner", logging.RunnerID(runnerID), logging.Err(err))
+			c.JSON(http.StatusBadGateway, gin.H{"error": "failed to reach runner"})
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"runner_id": runnerID, "status": "draining"})
+	}
+}
@@ -0,0 +1,380 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/audit"
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// checksumHeader carries the hex SHA-256 of a transferred file
+// Clients may send it with an upload; downloads return it as a trailer
+const checksumHeader = "X-Content-SHA256"
+
+// HandleFileUpload writes the request body to a file on a runner
+// Endpoint: PUT /api/runners/:id/files?path=&mode=&overwrite=
+// Content-Length is required. If the X-Content-SHA256 header is set, the runner
+// only commits the file when the body matches it
+func HandleFileUpload(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		runnerID := c.Param("id")
+		filePath := c.Query("path")
+		if filePath == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "path required"})
+			return
+		}
+
+		size := c.Request.ContentLength
+		if size < 0 {
+			c.JSON(http.StatusLengthRequired, gin.H{"error": "Content-Length required"})
+			return
+		}
+		if limit := hub.MaxTransferSize(); limit > 0 && size > limit {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("file exceeds the %d byte transfer limit", limit)})
+			return
+		}
+
+		var mode uint64
+		if value := c.Query("mode"); value != "" {
+			var err error
+			if mode, err = strconv.ParseUint(value, 8, 32); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid mode: expected octal permission bits"})
+				return
+			}
+		}
+		expected := strings.ToLower(c.GetHeader(checksumHeader))
+
+		t, runner, err := hub.openTransfer(runnerID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "runner not found"})
+			return
+		}
+		defer hub.closeTransfer(t)
+
+		// Unless the runner commits the file, tell it to discard the partial upload
+		committed := false
+		defer func() {
+			if !committed {
+				cancelTransfer(runner, t, "upload abandoned")
+			}
+		}()
+
+		if err := runner.WriteJSON(protocol.Message{
+			Type: protocol.MessageTypeFileUpload,
+			Payload: protocol.FileUploadPayload{
+				TransferID: t.id,
+				Path:       filePath,
+				Size:       size,
+				Mode:       uint32(mode),
+				Overwrite:  c.Query("overwrite") == "true",
+			},
+		}); err != nil {
+			respondTransferError(c, hub, runnerID, filePath, fmt.Errorf("failed to contact runner: %w", err))
+			return
+		}
+
+		var ready protocol.FileReadyPayload
+		if err := t.await(c.Request.Context(), protocol.MessageTypeFileReady, &ready); err != nil {
+			respondTransferError(c, hub, runnerID, filePath, err)
+			return
+		}
+
+		// Stream the body in chunks, stopping early if the runner gives up
+		hash := sha256.New()
+		var sent int64
+		buf := make([]byte, protocol.FileChunkSize)
+		for {
+			n, readErr := io.ReadFull(c.Request.Body, buf)
+			if n > 0 {
+				if err := runner.WriteMessage(websocket.BinaryMessage, transferFrame(t.id, buf[:n])); err != nil {
+					respondTransferError(c, hub, runnerID, filePath, fmt.Errorf("failed to send chunk to runner: %w", err))
+					return
+				}
+				hash.Write(buf[:n])
+				sent += int64(n)
+			}
+			if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+				break
+			}
+			if readErr != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read request body"})
+				return
+			}
+			if err := t.check(); err != nil {
+				respondTransferError(c, hub, runnerID, filePath, err)
+				return
+			}
+		}
+
+		if sent != size {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "request body does not match Content-Length"})
+			return
+		}
+
+		sum := hex.EncodeToString(hash.Sum(nil))
+		if expected != "" && expected != sum {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "checksum mismatch", "sha256": sum})
+			return
+		}
+
+		if err := runner.WriteJSON(protocol.Message{
+			Type: protocol.MessageTypeFileEnd,
+			Payload: protocol.FileEndPayload{
+				TransferID: t.id,
+				Size:       sent,
+				SHA256:     sum,
+			},
+		}); err != nil {
+			respondTransferError(c, hub, runnerID, filePath, fmt.Errorf("failed to contact runner: %w", err))
+			return
+		}
+
+		var complete protocol.FileCompletePayload
+		if err := t.await(c.Request.Context(), protocol.MessageTypeFileComplete, &complete); err != nil {
+			respondTransferError(c, hub, runnerID, filePath, err)
+			return
+		}
+		committed = true
+
+		hub.Audit().Record(audit.Event{
+			Type:       audit.EventFileUploaded,
+			User:       requestUser(c),
+			RunnerID:   runnerID,
+			RemoteAddr: c.ClientIP(),
+			Details: map[string]interface{}{
+				"path":   complete.Path,
+				"size":   complete.Size,
+				"sha256": complete.SHA256,
+			},
+		})
+		requestLog(hub, c).Info("Uploaded file", logging.RunnerID(runnerID), "path", complete.Path, "bytes", complete.Size)
+
+		c.JSON(http.StatusCreated, gin.H{
+			"runner_id": runnerID,
+			"path":      complete.Path,
+			"size":      complete.Size,
+			"sha256":    complete.SHA256,
+		})
+	}
+}
+
+// HandleFileDownload streams a file from a runner, or a directory as a tar archive
+// Endpoint: GET /api/runners/:id/files?path=
+// The body's SHA-256 follows in the X-Content-SHA256 trailer. A transfer that fails
+// after the headers are sent drops the connection so it cannot pass as complete
+func HandleFileDownload(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		runnerID := c.Param("id")
+		filePath := c.Query("path")
+		if filePath == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "path required"})
+			return
+		}
+
+		t, runner, err := hub.openTransfer(runnerID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "runner not found"})
+			return
+		}
+		defer hub.closeTransfer(t)
+
+		finished := false
+		defer func() {
+			if !finished {
+				cancelTransfer(runner, t, "download abandoned")
+			}
+		}()
+
+		if err := runner.WriteJSON(protocol.Message{
+			Type: protocol.MessageTypeFileDownload,
+			Payload: protocol.FileDownloadPayload{
+				TransferID: t.id,
+				Path:       filePath,
+			},
+		}); err != nil {
+			respondTransferError(c, hub, runnerID, filePath, fmt.Errorf("failed to contact runner: %w", err))
+			return
+		}
+
+		ctx := c.Request.Context()
+		var ready protocol.FileReadyPayload
+		if err := t.await(ctx, protocol.MessageTypeFileReady, &ready); err != nil {
+			respondTransferError(c, hub, runnerID, filePath, err)
+			return
+		}
+
+		limit := hub.MaxTransferSize()
+		if limit > 0 && ready.Size > limit {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("file exceeds the %d byte transfer limit", limit)})
+			return
+		}
+
+		name := path.Base(ready.Path)
+		contentType := "application/octet-stream"
+		if ready.IsDir {
+			name += ".tar"
+			contentType = "application/x-tar"
+		} else {
+			c.Header("Content-Length", strconv.FormatInt(ready.Size, 10))
+		}
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		c.Header("Trailer", checksumHeader)
+		c.Status(http.StatusOK)
+
+		hash := sha256.New()
+		var received int64
+		write := func(chunk []byte) error {
+			received += int64(len(chunk))
+			if limit > 0 && received > limit {
+				return fmt.Errorf("download exceeds the %d byte transfer limit", limit)
+			}
+			hash.Write(chunk)
+			if _, err := c.Writer.Write(chunk); err != nil {
+				return err
+			}
+			return runner.WriteJSON(protocol.Message{
+				Type:    protocol.MessageTypeFileAck,
+				Payload: protocol.FileAckPayload{TransferID: t.id, Chunks: 1},
+			})
+		}
+
+		end, err := receiveDownload(ctx, t, write)
+		if err != nil {
+			if ctx.Err() == nil {
+				requestLog(hub, c).Warn("Download failed", logging.RunnerID(runnerID), "path", ready.Path, logging.Err(err))
+			}
+			abortResponse(c)
+			return
+		}
+
+		sum := hex.EncodeToString(hash.Sum(nil))
+		if received != end.Size || sum != end.SHA256 {
+			requestLog(hub, c).Warn("Download failed integrity check", logging.RunnerID(runnerID), "path", ready.Path)
+			abortResponse(c)
+			return
+		}
+		c.Writer.Header().Set(checksumHeader, sum)
+		finished = true
+
+		hub.Audit().Record(audit.Event{
+			Type:       audit.EventFileDownloaded,
+			User:       requestUser(c),
+			RunnerID:   runnerID,
+			RemoteAddr: c.ClientIP(),
+			Details: map[string]interface{}{
+				"path":   ready.Path,
+				"size":   received,
+				"sha256": sum,
+				"is_dir": ready.IsDir,
+			},
+		})
+		requestLog(hub, c).Info("Downloaded file", logging.RunnerID(runnerID), "path", ready.Path, "bytes", received)
+	}
+}
+
+// receiveDownload writes a download's chunks until the runner's file_end, which it returns
+func receiveDownload(ctx context.Context, t *transfer, write func([]byte) error) (protocol.FileEndPayload, error) {
+	var end protocol.FileEndPayload
+	timeout := time.NewTimer(transferTimeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case chunk := <-t.data:
+			if err := write(chunk); err != nil {
+				return end, err
+			}
+			timeout.Reset(transferTimeout)
+		case msg := <-t.control:
+			// Chunks sent before this message are already queued; write them first
+			for len(t.data) > 0 {
+				if err := write(<-t.data); err != nil {
+					return end, err
+				}
+			}
+			err := decodeTransferControl(msg, protocol.MessageTypeFileEnd, &end)
+			return end, err
+		case <-t.aborted:
+			return end, t.err
+		case <-ctx.Done():
+			return end, ctx.Err()
+		case <-timeout.C:
+			return end, errors.New("timed out waiting for runner")
+		}
+	}
+}
+
+// cancelTransfer tells the runner to stop a transfer; best effort
+func cancelTransfer(runner *RunnerConn, t *transfer, reason string) {
+	runner.WriteJSON(protocol.Message{
+		Type:    protocol.MessageTypeFileCancel,
+		Payload: protocol.FileCancelPayload{TransferID: t.id, Reason: reason},
+	})
+}
+
+// respondTransferError maps a transfer failure to an HTTP response
+// Policy refusals from the runner are audited
+func respondTransferError(c *gin.Context, hub *Hub, runnerID, filePath string, err error) {
+	if c.Request.Context().Err() != nil {
+		return
+	}
+
+	var terr *transferError
+	if !errors.As(err, &terr) {
+		requestLog(hub, c).Warn("Transfer failed", logging.RunnerID(runnerID), logging.Err(err))
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	status := http.StatusBadGateway
+	switch terr.Code {
+	case protocol.ErrCodeTransfersDisabled, protocol.ErrCodePathNotAllowed:
+		status = http.StatusForbidden
+		hub.Audit().Record(audit.Event{
+			Type:       audit.EventPolicyDenied,
+			User:       requestUser(c),
+			RunnerID:   runnerID,
+			RemoteAddr: c.ClientIP(),
+			Details: map[string]interface{}{
+				"action": c.Request.Method + " " + c.FullPath(),
+				"path":   filePath,
+				"reason": terr.Message,
+			},
+		})
+	case protocol.ErrCodeNotFound:
+		status = http.StatusNotFound
+	case protocol.ErrCodeExists:
+		status = http.StatusConflict
+	case protocol.ErrCodeTooLarge:
+		status = http.StatusRequestEntityTooLarge
+	case protocol.ErrCodeChecksumMismatch:
+		status = http.StatusUnprocessableEntity
+	}
+
+	c.JSON(status, gin.H{"error": terr.Message, "code": terr.Code})
+}
+
+// abortResponse drops the connection mid-body so a truncated download is not
+// mistaken for a complete one
+func abortResponse(c *gin.Context) {
+	conn, _, err := c.Writer.Hijack()
+	if err != nil {
+		return
+	}
+	conn.Close()
+}
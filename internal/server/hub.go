@@ -1,19 +1,57 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/netip"
 	"sync"
-
+	"sync/atomic"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/artifact"
+	"github.com/codervisor/agent-relay/internal/audit"
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/profile"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/codervisor/agent-relay/internal/recording"
+	"github.com/codervisor/agent-relay/internal/store"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // RunnerConn represents a connected runner agent
 type RunnerConn struct {
 	ID       string
 	Conn     *websocket.Conn
-	Sessions map[string]*ClientConn // session_id -> client
+	Labels   map[string]string               // Reported at registration; matched against profile requirements
+	Sessions map[string]*ClientConn          // session_id -> client
+	drain    *protocol.RunnerDrainingPayload // Set once the runner announces it is draining
 	mu       sync.RWMutex
+	writeMu  sync.Mutex
+	writes   prometheus.Observer // Times writes; nil when not measured
+	log      *slog.Logger        // Carries the runner's ID, address and connection epoch
+	rtt      atomic.Int64        // Latest round trip in nanoseconds; 0 until measured
+	token    string              // Registered with; checked again when runner tokens are reloaded
+	addr     netip.Addr          // Where the runner connected from; invalid if unknown
+}
+
+// WriteMessage serializes writes to the runner connection
+func (r *RunnerConn) WriteMessage(messageType int, data []byte) error {
+	defer observeSince(r.writes, time.Now())
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	return r.Conn.WriteMessage(messageType, data)
+}
+
+// WriteJSON serializes writes of control messages to the runner connection
+func (r *RunnerConn) WriteJSON(msg protocol.Message) error {
+	defer observeSince(r.writes, time.Now())
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	return r.Conn.WriteJSON(msg)
 }
 
 // ClientConn represents a connected browser client
@@ -21,41 +59,241 @@ type ClientConn struct {
 	SessionID string
 	RunnerID  string
 	Conn      *websocket.Conn
+	writeMu   sync.Mutex
+	writes    prometheus.Observer // Times writes; nil when not measured
+	log       *slog.Logger        // Carries the client, session and runner IDs
+	latency   sessionLatency
+}
+
+// WriteMessage serializes writes to the client connection
+func (c *ClientConn) WriteMessage(messageType int, data []byte) error {
+	defer observeSince(c.writes, time.Now())
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// WriteJSON serializes writes of control messages to the client connection
+func (c *ClientConn) WriteJSON(msg protocol.Message) error {
+	defer observeSince(c.writes, time.Now())
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.Conn.WriteJSON(msg)
+}
+
+// sessionOwner is who started a session and whom it counts against for the user quotas
+type sessionOwner struct {
+	user     string
+	quotaKey string
 }
 
 // Hub manages all active connections and routes messages between clients and runners
 type Hub struct {
-	runners  map[string]*RunnerConn // runner_id -> runner
-	clients  map[string]*ClientConn // session_id -> client
-	sessions map[string]string      // session_id -> runner_id
+	runners  map[string]*RunnerConn  // runner_id -> runner
+	clients  map[string]*ClientConn  // session_id -> client
+	sessions map[string]string       // session_id -> runner_id (includes headless job sessions)
+	owners   map[string]sessionOwner // session_id -> who started it, for session quotas
+	store    store.Store
+	audit    *audit.Logger
+	logger   *slog.Logger // Base for each component's logger
+	log      *slog.Logger
 	mu       sync.RWMutex
+
+	recordings   recording.Sink
+	recordPolicy recording.Policy
+	recorders    map[string]*recording.Recorder // session_id -> active recording
+	recMu        sync.Mutex
+
+	transfers       map[string]*transfer // transfer_id -> in-flight file transfer
+	maxTransferSize int64
+	artifacts       artifact.Store
+	incoming        map[string]*incomingArtifact // transfer_id -> artifact being received
+	transferMu      sync.Mutex
+
+	// Policy settings, which SetPolicy may replace while HQ runs; guarded by policyMu
+	profiles           *profile.Set
+	requireProfile     bool
+	approvalTimeout    time.Duration
+	maxApprovalTimeout time.Duration
+	runnerTokens       []string
+	origins            OriginPolicy
+	quotas             Quotas
+	sessionRates       *limiter // New sessions per user; nil when unlimited
+	registrationRates  *limiter // Runner registrations per address; nil when unlimited
+	policyMu           sync.RWMutex
+
+	heldJobs atomic.Bool // A queued job was held back by a session quota
+
+	requireRunnerCert bool // Runners must present a verified client certificate
+	upgrader          websocket.Upgrader
+
+	approvals    map[string]*pendingApproval // approval_id -> request a session is blocked on
+	approvalSubs map[*approvalSubscriber]struct{}
+	approvalMu   sync.Mutex
+
+	metrics       *hubMetrics
+	probeInterval time.Duration // How often runners and clients are pinged; 0 = never
+
+	starting map[string]trace.Span // session_id -> hq.start_session span awaiting the runner's answer
+	traceMu  sync.Mutex
+
+	shutdown       chan struct{} // Closed once Shutdown starts
+	shutdownOnce   sync.Once
+	reconnectAfter time.Duration // Suggested to peers during shutdown; guarded by mu
+}
+
+// HubOption configures optional Hub dependencies
+type HubOption func(*Hub)
+
+// WithStore persists runner, session and job state to s
+// Without it the hub uses an in-memory store that does not survive restarts
+func WithStore(s store.Store) HubOption {
+	return func(h *Hub) {
+		h.store = s
+	}
+}
+
+// WithAudit records security-relevant events to logger
+func WithAudit(logger *audit.Logger) HubOption {
+	return func(h *Hub) {
+		h.audit = logger
+	}
+}
+
+// WithLogger writes the hub's logs to logger instead of slog's default
+func WithLogger(logger *slog.Logger) HubOption {
+	return func(h *Hub) {
+		h.logger = logger
+	}
 }
 
 // NewHub creates a new connection hub
-func NewHub() *Hub {
-	return &Hub{
-		runners:  make(map[string]*RunnerConn),
-		clients:  make(map[string]*ClientConn),
-		sessions: make(map[string]string),
+func NewHub(opts ...HubOption) *Hub {
+	h := &Hub{
+		runners:   make(map[string]*RunnerConn),
+		clients:   make(map[string]*ClientConn),
+		sessions:  make(map[string]string),
+		owners:    make(map[string]sessionOwner),
+		recorders: make(map[string]*recording.Recorder),
+		transfers: make(map[string]*transfer),
+		incoming:  make(map[string]*incomingArtifact),
+
+		approvals:    make(map[string]*pendingApproval),
+		approvalSubs: make(map[*approvalSubscriber]struct{}),
+		shutdown:     make(chan struct{}),
+		starting:     make(map[string]trace.Span),
+
+		maxTransferSize:    DefaultMaxTransferSize,
+		probeInterval:      DefaultLatencyProbeInterval,
+		approvalTimeout:    DefaultApprovalTimeout,
+		maxApprovalTimeout: DefaultMaxApprovalTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	if h.store == nil {
+		h.store = store.NewMemoryStore()
+	}
+	if h.logger == nil {
+		h.logger = slog.Default()
+	}
+	h.log = logging.Component(h.logger, "hub")
+	h.metrics = newHubMetrics(h)
+	h.upgrader.CheckOrigin = h.AllowOrigin
+	h.setQuotas(h.quotas)
+
+	h.recoverState()
+	return h
+}
+
+// Store returns the hub's persistence backend
+func (h *Hub) Store() store.Store {
+	return h.store
+}
+
+// Audit returns the audit logger; a nil logger discards events
+func (h *Hub) Audit() *audit.Logger {
+	return h.audit
+}
+
+// recordPolicyDenied audits a request refused by policy, such as a profile requirement or a quota
+// action names what was refused and code, if any, the error code it was refused with
+func (h *Hub) recordPolicyDenied(ev audit.Event, action, code, reason string) {
+	ev.Type = audit.EventPolicyDenied
+	if ev.Details == nil {
+		ev.Details = make(map[string]interface{})
 	}
+	ev.Details["action"] = action
+	ev.Details["reason"] = reason
+	if code != "" {
+		ev.Details["code"] = code
+	}
+	h.audit.Record(ev)
+}
+
+// Logger returns the logger HQ's components derive theirs from
+func (h *Hub) Logger() *slog.Logger {
+	return h.logger
+}
+
+// runnerLog returns the connected runner's logger, or one naming the runner if it is gone
+func (h *Hub) runnerLog(runnerID string) *slog.Logger {
+	if runner, ok := h.GetRunner(runnerID); ok {
+		return runner.log
+	}
+	return h.log.With(logging.RunnerID(runnerID))
 }
 
 // RegisterRunner adds a new runner to the hub
-func (h *Hub) RegisterRunner(id string, conn *websocket.Conn) error {
+// reg.Draining is set for a runner that was already draining when it connected;
+// logger carries the connection's attributes
+func (h *Hub) RegisterRunner(conn *websocket.Conn, reg protocol.RegisterPayload, logger *slog.Logger) error {
+	id, labels := reg.RunnerID, reg.Labels
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	if h.ShuttingDown() {
+		return fmt.Errorf("hq is shutting down")
+	}
 	if _, exists := h.runners[id]; exists {
 		return fmt.Errorf("runner %s already registered", id)
 	}
 
-	h.runners[id] = &RunnerConn{
+	runner := &RunnerConn{
 		ID:       id,
 		Conn:     conn,
+		Labels:   labels,
 		Sessions: make(map[string]*ClientConn),
+		drain:    reg.Draining,
+		writes:   h.metrics.writeTimer("runner"),
+		log:      logger,
+		token:    reg.Token,
+	}
+	if conn != nil {
+		if addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String()); err == nil {
+			runner.addr = addrPort.Addr().Unmap()
+		}
 	}
+	h.runners[id] = runner
+	h.probeLatency(conn, func(rtt time.Duration) { h.runnerPong(runner, rtt) })
+
+	now := time.Now()
+	if err := h.store.UpsertRunner(context.Background(), store.RunnerRecord{
+		ID:            id,
+		RemoteAddr:    conn.RemoteAddr().String(),
+		Labels:        labels,
+		FirstSeen:     now,
+		LastConnected: now,
+	}); err != nil {
+		logger.Error("Failed to persist runner", logging.Err(err))
+	}
+
+	logger.Info("Runner registered", "labels", labels, "draining", reg.Draining != nil)
 
-	log.Printf("[Hub] Runner registered: %s", id)
+	// Start any work that was queued while the runner was away
+	go h.dispatchJobs(id)
 	return nil
 }
 
@@ -76,42 +314,91 @@ func (h *Hub) UnregisterRunner(id string) {
 			client.Conn.Close()
 		}
 		delete(h.clients, sessionID)
-		delete(h.sessions, sessionID)
+		h.sessionStartAnswered(sessionID, errRunnerGone)
 	}
 	runner.mu.RUnlock()
 
+	for sessionID, runnerID := range h.sessions {
+		if runnerID == id {
+			delete(h.sessions, sessionID)
+			delete(h.owners, sessionID)
+		}
+	}
+	h.sessionEnded()
+
+	// Sessions and jobs still running on this runner can no longer finish normally
+	now := time.Now()
+	h.markRunnerWorkLost(id, now)
+	h.abortRunnerTransfers(id)
+	h.abortRunnerArtifacts(id)
+
+	// Resolving approvals notifies clients, which needs h.mu
+	go h.cancelApprovals(func(a store.ApprovalRecord) bool { return a.RunnerID == id }, "runner disconnected")
+
+	if err := h.store.MarkRunnerDisconnected(context.Background(), id, now); err != nil {
+		runner.log.Error("Failed to persist runner disconnect", logging.Err(err))
+	}
+
 	delete(h.runners, id)
-	log.Printf("[Hub] Runner unregistered: %s", id)
+	runner.log.Info("Runner unregistered")
 }
 
-// RegisterClient links a browser client to a runner session
-func (h *Hub) RegisterClient(sessionID, runnerID string, conn *websocket.Conn) error {
+// sessionIDUsed reports whether a session or job, even a finished or queued one, has the ID
+// IDs are never reused, so naming a job's or an earlier session's ID cannot attach to it,
+// and claiming a queued job's ID cannot keep the job from starting
+func (h *Hub) sessionIDUsed(id string) bool {
+	ctx := context.Background()
+	if _, err := h.store.GetSession(ctx, id); !errors.Is(err, store.ErrNotFound) {
+		return true
+	}
+	_, err := h.store.GetJob(ctx, id)
+	return !errors.Is(err, store.ErrNotFound)
+}
+
+// RegisterClient links a browser client to a runner session started by user, counting it against quotaKey
+// logger carries the connection's attributes; a session over a quota is refused with a *QuotaError
+func (h *Hub) RegisterClient(sessionID, runnerID, user, quotaKey string, conn *websocket.Conn, logger *slog.Logger) error {
+	if h.sessionIDUsed(sessionID) {
+		return fmt.Errorf("session %s already exists", sessionID)
+	}
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	if h.ShuttingDown() {
+		return fmt.Errorf("hq is shutting down")
+	}
 	runner, exists := h.runners[runnerID]
 	if !exists {
 		return fmt.Errorf("runner %s not found", runnerID)
 	}
 
-	if _, exists := h.clients[sessionID]; exists {
+	if _, exists := h.sessions[sessionID]; exists {
+		// Includes headless job sessions, which have no client
 		return fmt.Errorf("session %s already exists", sessionID)
 	}
+	if err := h.admitSession(quotaKey, runnerID); err != nil {
+		return err
+	}
 
 	client := &ClientConn{
 		SessionID: sessionID,
 		RunnerID:  runnerID,
 		Conn:      conn,
+		writes:    h.metrics.writeTimer("client"),
+		log:       logger,
 	}
 
 	h.clients[sessionID] = client
 	h.sessions[sessionID] = runnerID
+	h.owners[sessionID] = sessionOwner{user: user, quotaKey: quotaKey}
+	h.probeLatency(conn, func(rtt time.Duration) { h.clientPong(client, rtt) })
 
 	runner.mu.Lock()
 	runner.Sessions[sessionID] = client
 	runner.mu.Unlock()
 
-	log.Printf("[Hub] Client registered: session=%s runner=%s", sessionID, runnerID)
+	logger.Info("Client registered")
 	return nil
 }
 
@@ -132,28 +419,41 @@ func (h *Hub) UnregisterClient(sessionID string) {
 		runner.mu.Unlock()
 	}
 
+	h.audit.Record(audit.Event{
+		Type:      audit.EventControlReleased,
+		User:      h.owners[sessionID].user,
+		RunnerID:  client.RunnerID,
+		SessionID: sessionID,
+	})
+
 	delete(h.clients, sessionID)
 	delete(h.sessions, sessionID)
+	delete(h.owners, sessionID)
+	h.sessionEnded()
+	h.stopRecording(sessionID)
+	h.sessionStartAnswered(sessionID, errClientGone)
 
-	log.Printf("[Hub] Client unregistered: session=%s", sessionID)
+	client.log.Info("Client unregistered", client.latencySummary()...)
 }
 
 // RouteToRunner sends a message from a client to its associated runner
-func (h *Hub) RouteToRunner(sessionID string, messageType int, data []byte) error {
+func (h *Hub) RouteToRunner(sessionID string, messageType int, data []byte) (err error) {
+	defer func() { h.metrics.routed(directionToRunner, len(data), err) }()
+
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
-	client, exists := h.clients[sessionID]
+	runnerID, exists := h.sessions[sessionID]
 	if !exists {
 		return fmt.Errorf("session %s not found", sessionID)
 	}
 
-	runner, exists := h.runners[client.RunnerID]
+	runner, exists := h.runners[runnerID]
 	if !exists {
-		return fmt.Errorf("runner %s not found", client.RunnerID)
+		return fmt.Errorf("runner %s not found", runnerID)
 	}
 
-	return runner.Conn.WriteMessage(messageType, data)
+	return runner.WriteMessage(messageType, data)
 }
 
 // RouteToClient sends a message from a runner to a specific client
@@ -163,10 +463,18 @@ func (h *Hub) RouteToClient(sessionID string, messageType int, data []byte) erro
 
 	client, exists := h.clients[sessionID]
 	if !exists {
-		return fmt.Errorf("session %s not found", sessionID)
+		if _, headless := h.sessions[sessionID]; headless {
+			// Job sessions have no attached client; output is dropped
+			return nil
+		}
+		err := fmt.Errorf("session %s not found", sessionID)
+		h.metrics.routed(directionToClient, len(data), err)
+		return err
 	}
 
-	return client.Conn.WriteMessage(messageType, data)
+	err := client.WriteMessage(messageType, data)
+	h.metrics.routed(directionToClient, len(data), err)
+	return err
 }
 
 // GetRunner returns a runner connection by ID
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/codervisor/agent-relay/internal/store"
+)
+
+func TestSessionIDUsed(t *testing.T) {
+	hub := NewHub()
+	ctx := context.Background()
+
+	if err := hub.store.CreateJob(ctx, store.JobRecord{ID: "queued-job", RunnerID: "r1", Status: store.JobStatusQueued}); err != nil {
+		t.Fatal(err)
+	}
+	if err := hub.store.CreateSession(ctx, store.SessionRecord{ID: "old-session", RunnerID: "r1", Status: store.SessionStatusEnded}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"queued-job", true},
+		{"old-session", true},
+		{"new-session", false},
+	}
+
+	for _, tt := range tests {
+		if got := hub.sessionIDUsed(tt.id); got != tt.want {
+			t.Errorf("sessionIDUsed(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+		if tt.want {
+			if err := hub.RegisterClient(tt.id, "r1", "alice", "alice", nil, nil); err == nil {
+				t.Errorf("RegisterClient(%q) claimed an ID already in use", tt.id)
+			}
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/audit"
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/codervisor/agent-relay/internal/store"
+	"github.com/gorilla/websocket"
+)
+
+// recoverState reconciles persisted state after an HQ restart
+// Connections did not survive, so anything that was running is lost;
+// queued jobs stay queued until their runner registers again
+func (h *Hub) recoverState() {
+	ctx := context.Background()
+	now := time.Now()
+
+	sessions, err := h.store.ListSessions(ctx, store.SessionFilter{Status: store.SessionStatusRunning})
+	if err != nil {
+		h.log.Error("Failed to load running sessions", logging.Err(err))
+	}
+	for _, s := range sessions {
+		if err := h.store.EndSession(ctx, s.ID, store.SessionEnd{Status: store.SessionStatusLost, EndedAt: now}); err != nil {
+			h.log.Error("Failed to mark session lost", logging.SessionID(s.ID), logging.Err(err))
+		}
+	}
+
+	jobs, err := h.store.ListJobs(ctx, store.JobFilter{Status: store.JobStatusRunning})
+	if err != nil {
+		h.log.Error("Failed to load running jobs", logging.Err(err))
+	}
+	for _, j := range jobs {
+		h.finishJob(j, store.JobStatusLost, nil, now)
+	}
+
+	if len(sessions) > 0 || len(jobs) > 0 {
+		h.log.Info("Marked work lost after restart", "sessions", len(sessions), "jobs", len(jobs))
+	}
+
+	if n := h.cancelStaleApprovals(now); n > 0 {
+		h.log.Info("Cancelled approvals left pending before restart", "approvals", n)
+	}
+}
+
+// markRunnerWorkLost ends every running session and job on a runner that went away
+// Called with h.mu held
+func (h *Hub) markRunnerWorkLost(runnerID string, now time.Time) {
+	ctx := context.Background()
+	logger := h.log.With(logging.RunnerID(runnerID))
+
+	sessions, err := h.store.ListSessions(ctx, store.SessionFilter{RunnerID: runnerID, Status: store.SessionStatusRunning})
+	if err != nil {
+		logger.Error("Failed to load sessions", logging.Err(err))
+	}
+	for _, s := range sessions {
+		h.stopRecording(s.ID)
+		if err := h.store.EndSession(ctx, s.ID, store.SessionEnd{Status: store.SessionStatusLost, EndedAt: now}); err != nil {
+			logger.Error("Failed to mark session lost", logging.SessionID(s.ID), logging.Err(err))
+		}
+		h.audit.Record(audit.Event{
+			Type:      audit.EventSessionEnded,
+			User:      s.User,
+			RunnerID:  runnerID,
+			SessionID: s.ID,
+			Details:   map[string]interface{}{"status": store.SessionStatusLost},
+		})
+	}
+
+	jobs, err := h.store.ListJobs(ctx, store.JobFilter{RunnerID: runnerID, Status: store.JobStatusRunning})
+	if err != nil {
+		logger.Error("Failed to load jobs", logging.Err(err))
+	}
+	for _, j := range jobs {
+		h.finishJob(j, store.JobStatusLost, nil, now)
+	}
+}
+
+// RecordSessionStart persists metadata for a newly started session and
+// starts recording it if requested or required by policy
+func (h *Hub) RecordSessionStart(rec store.SessionRecord, record bool) {
+	if rec.StartedAt.IsZero() {
+		rec.StartedAt = time.Now()
+	}
+	rec.Status = store.SessionStatusRunning
+	rec.Recorded = h.startRecording(rec.ID, rec.Command, record)
+
+	if err := h.store.CreateSession(context.Background(), rec); err != nil {
+		h.log.Error("Failed to persist session", logging.RunnerID(rec.RunnerID), logging.SessionID(rec.ID), logging.Err(err))
+	}
+
+	details := map[string]interface{}{
+		"command":  rec.Command,
+		"cwd":      rec.Cwd,
+		"recorded": rec.Recorded,
+	}
+	if rec.JobID != "" {
+		details["job_id"] = rec.JobID
+	}
+	if rec.Profile != "" {
+		details["profile"] = rec.Profile
+	}
+	h.audit.Record(audit.Event{
+		Type:       audit.EventSessionStarted,
+		User:       rec.User,
+		RunnerID:   rec.RunnerID,
+		SessionID:  rec.ID,
+		RemoteAddr: rec.RemoteAddr,
+		Details:    details,
+	})
+}
+
+// SessionEnded records a session_ended report from runnerID
+func (h *Hub) SessionEnded(runnerID string, payload protocol.SessionEndedPayload) {
+	if !h.RunsSession(runnerID, payload.SessionID) {
+		h.log.Warn("Ignoring end of session not running on runner", logging.RunnerID(runnerID), logging.SessionID(payload.SessionID))
+		return
+	}
+	exitCode := payload.ExitCode
+	h.endSession(payload.SessionID, store.SessionEnd{
+		ExitCode:   &exitCode,
+		Reason:     payload.Reason,
+		LimitsHit:  payload.LimitsHit,
+		Redactions: payload.Redactions,
+	})
+}
+
+// SessionResult stores the repository changes reported for a workspace session
+func (h *Hub) SessionResult(runnerID string, payload protocol.SessionResultPayload) {
+	if owner, exists := h.GetRunnerForSession(payload.SessionID); !exists || owner != runnerID {
+		h.log.Warn("Ignoring result for session not active on runner", logging.RunnerID(runnerID), logging.SessionID(payload.SessionID))
+		return
+	}
+	if err := h.store.PutSessionResult(context.Background(), payload.SessionID, payload.SessionResult); err != nil {
+		h.log.Error("Failed to persist session result", logging.RunnerID(runnerID), logging.SessionID(payload.SessionID), logging.Err(err))
+	}
+}
+
+// SessionFailed records a session that runnerID could not start
+func (h *Hub) SessionFailed(runnerID, sessionID string) {
+	if !h.RunsSession(runnerID, sessionID) {
+		h.log.Warn("Ignoring failure of session not running on runner", logging.RunnerID(runnerID), logging.SessionID(sessionID))
+		return
+	}
+	h.endSession(sessionID, store.SessionEnd{})
+}
+
+// RunsSession reports whether runnerID is running sessionID, so that one runner
+// cannot end or fail another's sessions
+// Interactive sessions whose client has left are only in the store until the runner reports their end
+func (h *Hub) RunsSession(runnerID, sessionID string) bool {
+	if owner, exists := h.GetRunnerForSession(sessionID); exists {
+		return owner == runnerID
+	}
+	rec, err := h.store.GetSession(context.Background(), sessionID)
+	return err == nil && rec.RunnerID == runnerID && rec.Status == store.SessionStatusRunning
+}
+
+// endSession persists the end of a session and completes its job, if any
+func (h *Hub) endSession(sessionID string, end store.SessionEnd) {
+	ctx := context.Background()
+	now := time.Now()
+	end.Status = store.SessionStatusEnded
+	end.EndedAt = now
+	exitCode := end.ExitCode
+
+	// Headless job sessions have no client to unregister them
+	h.mu.Lock()
+	if _, hasClient := h.clients[sessionID]; !hasClient {
+		delete(h.sessions, sessionID)
+		delete(h.owners, sessionID)
+		h.sessionEnded()
+	}
+	h.mu.Unlock()
+
+	h.stopRecording(sessionID)
+	h.cancelApprovals(func(a store.ApprovalRecord) bool { return a.SessionID == sessionID }, "session ended")
+
+	if err := h.store.EndSession(ctx, sessionID, end); err != nil {
+		h.log.Error("Failed to persist end of session", logging.SessionID(sessionID), logging.Err(err))
+		return
+	}
+
+	rec, err := h.store.GetSession(ctx, sessionID)
+	if err != nil {
+		return
+	}
+
+	details := map[string]interface{}{"status": end.Status, "redactions": end.Redactions}
+	if exitCode != nil {
+		details["exit_code"] = *exitCode
+	}
+	if end.Reason != "" {
+		details["reason"] = end.Reason
+	}
+	if len(end.LimitsHit) > 0 {
+		details["limits_hit"] = end.LimitsHit
+	}
+	if end.Reason != "" {
+		// The runner only gives a reason for sessions it killed
+		h.audit.Record(audit.Event{
+			Type:      audit.EventSessionKilled,
+			User:      rec.User,
+			RunnerID:  rec.RunnerID,
+			SessionID: sessionID,
+			Details:   map[string]interface{}{"reason": end.Reason},
+		})
+	}
+	h.audit.Record(audit.Event{
+		Type:      audit.EventSessionEnded,
+		User:      rec.User,
+		RunnerID:  rec.RunnerID,
+		SessionID: sessionID,
+		Details:   details,
+	})
+
+	if rec.JobID == "" {
+		return
+	}
+
+	job, err := h.store.GetJob(ctx, rec.JobID)
+	if err != nil {
+		h.log.Error("Failed to load job", logging.SessionID(sessionID), "job_id", rec.JobID, logging.Err(err))
+		return
+	}
+
+	status := store.JobStatusFailed
+	if exitCode != nil && *exitCode == 0 {
+		status = store.JobStatusSucceeded
+	}
+	h.finishJob(job, status, exitCode, now)
+}
+
+// finishJob moves a job to a terminal state
+func (h *Hub) finishJob(job store.JobRecord, status store.JobStatus, exitCode *int, at time.Time) {
+	if job.Status.Finished() {
+		return
+	}
+
+	job.Status = status
+	job.ExitCode = exitCode
+	job.FinishedAt = &at
+
+	logger := h.log.With(logging.RunnerID(job.RunnerID), logging.SessionID(job.ID), "job_id", job.ID)
+	if err := h.store.UpdateJob(context.Background(), job); err != nil {
+		logger.Error("Failed to persist job", logging.Err(err))
+		return
+	}
+
+	logger.Info("Job finished", "status", status)
+}
+
+// SubmitJob persists a new job and starts it if its runner is connected
+func (h *Hub) SubmitJob(job store.JobRecord) (store.JobRecord, error) {
+	job.Status = store.JobStatusQueued
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = time.Now()
+	}
+
+	if err := h.store.CreateJob(context.Background(), job); err != nil {
+		return store.JobRecord{}, err
+	}
+
+	logger := h.log.With(logging.RunnerID(job.RunnerID), logging.SessionID(job.ID), "job_id", job.ID)
+	logger.Info("Job queued")
+
+	if _, connected := h.GetRunner(job.RunnerID); connected {
+		if err := h.startJob(job); err != nil {
+			logger.Error("Failed to start job", logging.Err(err))
+		}
+	}
+
+	return h.store.GetJob(context.Background(), job.ID)
+}
+
+// dispatchJobs starts every queued job for a runner
+func (h *Hub) dispatchJobs(runnerID string) {
+	jobs, err := h.store.ListJobs(context.Background(), store.JobFilter{RunnerID: runnerID, Status: store.JobStatusQueued})
+	if err != nil {
+		h.runnerLog(runnerID).Error("Failed to load queued jobs", logging.Err(err))
+		return
+	}
+
+	for _, job := range jobs {
+		if err := h.startJob(job); err != nil {
+			h.runnerLog(runnerID).Error("Failed to start job", logging.SessionID(job.ID), "job_id", job.ID, logging.Err(err))
+			return
+		}
+	}
+}
+
+// dispatchAllJobs starts the queued jobs of every connected runner
+func (h *Hub) dispatchAllJobs() {
+	for _, runnerID := range h.ListRunners() {
+		h.dispatchJobs(runnerID)
+	}
+}
+
+// startJob sends a headless start_session for a queued job
+// The job ID doubles as the session ID so output and exit status route back to it
+func (h *Hub) startJob(job store.JobRecord) error {
+	h.mu.Lock()
+	runner, exists := h.runners[job.RunnerID]
+	if !exists {
+		h.mu.Unlock()
+		return fmt.Errorf("runner %s not found", job.RunnerID)
+	}
+	if _, started := h.sessions[job.ID]; started {
+		h.mu.Unlock()
+		return nil
+	}
+	if runner.Draining() {
+		// Stays queued for whichever runner registers with this ID next
+		h.mu.Unlock()
+		runner.log.Info("Job stays queued: runner is draining", logging.SessionID(job.ID), "job_id", job.ID)
+		return nil
+	}
+
+	// The runner may have re-registered with different labels since the job was queued
+	if job.Profile != "" {
+		if p, err := h.profile(job.Profile); err == nil && !p.MatchesRunner(runner.Labels) {
+			h.mu.Unlock()
+			runner.log.Warn("Job cannot start: runner lacks the labels its profile requires", logging.SessionID(job.ID), "job_id", job.ID, "profile", p.Name)
+			h.finishJob(job, store.JobStatusFailed, nil, time.Now())
+			return nil
+		}
+	}
+
+	if err := h.checkRunningSessions(job.QuotaKey, job.RunnerID); err != nil {
+		// Stays queued until one of the sessions in the way ends
+		h.heldJobs.Store(true)
+		h.mu.Unlock()
+		runner.log.Info("Job stays queued: a session quota is reached", logging.SessionID(job.ID), "job_id", job.ID, logging.Err(err))
+		return nil
+	}
+
+	h.sessions[job.ID] = job.RunnerID
+	h.owners[job.ID] = sessionOwner{user: job.User, quotaKey: job.QuotaKey}
+	h.mu.Unlock()
+
+	// Record before sending so the first output frames are captured
+	now := time.Now()
+	h.RecordSessionStart(store.SessionRecord{
+		ID:        job.ID,
+		RunnerID:  job.RunnerID,
+		User:      job.User,
+		Command:   job.Command,
+		Cwd:       job.Cwd,
+		JobID:     job.ID,
+		Profile:   job.Profile,
+		StartedAt: now,
+	}, job.Record)
+
+	msg := protocol.Message{
+		Type: protocol.MessageTypeStartSession,
+		Payload: protocol.StartSessionPayload{
+			SessionID: job.ID,
+			Command:   job.Command,
+			Cwd:       job.Cwd,
+			Artifacts: job.Artifacts,
+			Workspace: job.Workspace,
+			Profile:   job.Profile,
+			Env:       job.Env,
+			Limits:    job.Limits,
+			Timeout:   job.Timeout,
+			Headless:  true,
+		},
+	}
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		h.SessionFailed(job.RunnerID, job.ID)
+		return fmt.Errorf("failed to encode start_session: %w", err)
+	}
+
+	if err := runner.WriteMessage(websocket.TextMessage, msgBytes); err != nil {
+		h.SessionFailed(job.RunnerID, job.ID)
+		return fmt.Errorf("failed to send start_session: %w", err)
+	}
+
+	job.Status = store.JobStatusRunning
+	job.StartedAt = &now
+	if err := h.store.UpdateJob(context.Background(), job); err != nil {
+		runner.log.Error("Failed to persist job", logging.SessionID(job.ID), "job_id", job.ID, logging.Err(err))
+	}
+
+	runner.log.Info("Job started", logging.SessionID(job.ID), "job_id", job.ID)
+	return nil
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/codervisor/agent-relay/internal/store"
+)
+
+func TestRunsSession(t *testing.T) {
+	hub := NewHub()
+	ctx := context.Background()
+
+	// active is tracked by the hub; detached is an interactive session whose client has left
+	hub.sessions["active"] = "r1"
+	for _, rec := range []store.SessionRecord{
+		{ID: "detached", RunnerID: "r1", Status: store.SessionStatusRunning},
+		{ID: "finished", RunnerID: "r1", Status: store.SessionStatusRunning},
+	} {
+		if err := hub.store.CreateSession(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := hub.store.EndSession(ctx, "finished", store.SessionEnd{Status: store.SessionStatusEnded}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		runnerID  string
+		sessionID string
+		want      bool
+	}{
+		{"r1", "active", true},
+		{"r2", "active", false},
+		{"r1", "detached", true},
+		{"r2", "detached", false},
+		{"r1", "finished", false},
+		{"r1", "unknown", false},
+	}
+
+	for _, tt := range tests {
+		if got := hub.RunsSession(tt.runnerID, tt.sessionID); got != tt.want {
+			t.Errorf("RunsSession(%q, %q) = %v, want %v", tt.runnerID, tt.sessionID, got, tt.want)
+		}
+	}
+}
+
+func TestSessionEndedFromAnotherRunner(t *testing.T) {
+	hub := NewHub()
+	ctx := context.Background()
+
+	hub.sessions["s1"] = "r1"
+	if err := hub.store.CreateSession(ctx, store.SessionRecord{ID: "s1", RunnerID: "r1", Status: store.SessionStatusRunning}); err != nil {
+		t.Fatal(err)
+	}
+
+	hub.SessionEnded("r2", protocol.SessionEndedPayload{SessionID: "s1", ExitCode: 1})
+	hub.SessionFailed("r2", "s1")
+	if rec, err := hub.store.GetSession(ctx, "s1"); err != nil || rec.Status != store.SessionStatusRunning {
+		t.Fatalf("session after reports from another runner = %+v, %v; want it still running", rec, err)
+	}
+	if _, exists := hub.GetRunnerForSession("s1"); !exists {
+		t.Fatal("another runner's report removed the session")
+	}
+
+	hub.SessionEnded("r1", protocol.SessionEndedPayload{SessionID: "s1"})
+	if rec, err := hub.store.GetSession(ctx, "s1"); err != nil || rec.Status != store.SessionStatusEnded {
+		t.Errorf("session after its runner's report = %+v, %v; want it ended", rec, err)
+	}
+}
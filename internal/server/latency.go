@@ -0,0 +1,247 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// DefaultLatencyProbeInterval is how often HQ pings each runner and terminal client
+const DefaultLatencyProbeInterval = 5 * time.Second
+
+// probeWriteWait bounds how long a ping may wait to be written
+const probeWriteWait = time.Second
+
+// latencyBuckets are the upper bounds of the per-session round trip histograms
+var latencyBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+}
+
+// WithLatencyProbes pings runners and terminal clients every interval to measure round trips
+// 0 disables probing
+func WithLatencyProbes(interval time.Duration) HubOption {
+	return func(h *Hub) {
+		h.probeInterval = interval
+	}
+}
+
+// LatencyBucket counts round trips up to Le that did not fit a smaller bucket
+type LatencyBucket struct {
+	Le    string `json:"le"` // e.g. "50ms"; "+Inf" for the last bucket
+	Count uint64 `json:"count"`
+}
+
+// LatencyStats summarizes the round trips measured on one leg of a session
+type LatencyStats struct {
+	Samples uint64          `json:"samples"`
+	LastMs  float64         `json:"last_ms"`
+	MeanMs  float64         `json:"mean_ms"`
+	MinMs   float64         `json:"min_ms"`
+	MaxMs   float64         `json:"max_ms"`
+	Buckets []LatencyBucket `json:"buckets"`
+}
+
+// SessionLatency is what HQ has measured of an attached session's round trips
+type SessionLatency struct {
+	SessionID   string       `json:"session_id"`
+	RunnerID    string       `json:"runner_id"`
+	RunnerRTTMs float64      `json:"runner_rtt_ms"` // Latest HQ <-> runner round trip; 0 until measured
+	Client      LatencyStats `json:"client"`        // Client <-> HQ
+	RoundTrip   LatencyStats `json:"round_trip"`    // Client <-> runner: each client round trip plus the runner's latest
+}
+
+// latencyHistogram accumulates round trips into latencyBuckets
+type latencyHistogram struct {
+	counts []uint64 // One per bucket, plus the overflow
+	count  uint64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+	last   time.Duration
+}
+
+func (l *latencyHistogram) observe(d time.Duration) {
+	if l.counts == nil {
+		l.counts = make([]uint64, len(latencyBuckets)+1)
+	}
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	l.counts[i]++
+	if l.count == 0 || d < l.min {
+		l.min = d
+	}
+	if d > l.max {
+		l.max = d
+	}
+	l.count++
+	l.sum += d
+	l.last = d
+}
+
+func (l *latencyHistogram) stats() LatencyStats {
+	stats := LatencyStats{
+		Samples: l.count,
+		LastMs:  milliseconds(l.last),
+		MinMs:   milliseconds(l.min),
+		MaxMs:   milliseconds(l.max),
+		Buckets: make([]LatencyBucket, len(latencyBuckets)+1),
+	}
+	if l.count > 0 {
+		stats.MeanMs = milliseconds(l.sum / time.Duration(l.count))
+	}
+	for i := range stats.Buckets {
+		stats.Buckets[i].Le = "+Inf"
+		if i < len(latencyBuckets) {
+			stats.Buckets[i].Le = latencyBuckets[i].String()
+		}
+		if l.counts != nil {
+			stats.Buckets[i].Count = l.counts[i]
+		}
+	}
+	return stats
+}
+
+// sessionLatency holds the round trips measured for a terminal client's session
+type sessionLatency struct {
+	mu        sync.Mutex
+	client    latencyHistogram
+	roundTrip latencyHistogram
+}
+
+// milliseconds converts d for JSON, keeping sub-millisecond precision
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// probeLatency pings conn every probe interval until a ping cannot be written,
+// which happens once the connection is closed
+// Pings carry their send time, which the peer echoes in its pong; record gets the round trip
+// Must be called before conn's read loop starts, since pongs are handled there
+func (h *Hub) probeLatency(conn *websocket.Conn, record func(rtt time.Duration)) {
+	if h.probeInterval <= 0 {
+		return
+	}
+
+	conn.SetPongHandler(func(appData string) error {
+		sent, err := strconv.ParseInt(appData, 10, 64)
+		if err != nil {
+			return nil // Not a probe of ours
+		}
+		record(time.Since(time.Unix(0, sent)))
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(h.probeInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			now := time.Now()
+			ping := []byte(strconv.FormatInt(now.UnixNano(), 10))
+			if err := conn.WriteControl(websocket.PingMessage, ping, now.Add(probeWriteWait)); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// runnerPong records a runner's round trip; its sessions' clients report it with their own
+func (h *Hub) runnerPong(runner *RunnerConn, rtt time.Duration) {
+	runner.rtt.Store(int64(rtt))
+	h.metrics.probeRTT.WithLabelValues("runner").Observe(rtt.Seconds())
+}
+
+// clientPong records a client's round trip and tells the client its session's latency
+func (h *Hub) clientPong(client *ClientConn, rtt time.Duration) {
+	h.metrics.probeRTT.WithLabelValues("client").Observe(rtt.Seconds())
+
+	runnerRTT := h.runnerRTT(client.RunnerID)
+	client.latency.mu.Lock()
+	client.latency.client.observe(rtt)
+	client.latency.roundTrip.observe(rtt + runnerRTT)
+	client.latency.mu.Unlock()
+
+	err := client.WriteJSON(protocol.Message{
+		Type: protocol.MessageTypeLatency,
+		Payload: protocol.LatencyPayload{
+			SessionID:   client.SessionID,
+			ClientRTTMs: milliseconds(rtt),
+			RunnerRTTMs: milliseconds(runnerRTT),
+			RTTMs:       milliseconds(rtt + runnerRTT),
+		},
+	})
+	if err != nil {
+		client.log.Debug("Failed to send latency", logging.Err(err))
+	}
+}
+
+// runnerRTT returns a runner's latest round trip, or 0 if it has not been measured
+func (h *Hub) runnerRTT(runnerID string) time.Duration {
+	h.mu.RLock()
+	runner, ok := h.runners[runnerID]
+	h.mu.RUnlock()
+	if !ok {
+		return 0
+	}
+	return time.Duration(runner.rtt.Load())
+}
+
+// SessionLatency returns the round trips measured for a session with an attached client
+func (h *Hub) SessionLatency(sessionID string) (SessionLatency, bool) {
+	h.mu.RLock()
+	client, ok := h.clients[sessionID]
+	h.mu.RUnlock()
+	if !ok {
+		return SessionLatency{}, false
+	}
+
+	latency := SessionLatency{
+		SessionID:   sessionID,
+		RunnerID:    client.RunnerID,
+		RunnerRTTMs: milliseconds(h.runnerRTT(client.RunnerID)),
+	}
+	client.latency.mu.Lock()
+	latency.Client = client.latency.client.stats()
+	latency.RoundTrip = client.latency.roundTrip.stats()
+	client.latency.mu.Unlock()
+	return latency, true
+}
+
+// latencySummary returns log attributes summarizing a client's round trips, if any were measured
+func (c *ClientConn) latencySummary() []any {
+	c.latency.mu.Lock()
+	defer c.latency.mu.Unlock()
+	rt := c.latency.roundTrip
+	if rt.count == 0 {
+		return nil
+	}
+	return []any{"rtt_samples", rt.count, "rtt_mean", rt.sum / time.Duration(rt.count), "rtt_max", rt.max}
+}
+
+// HandleGetSessionLatency returns the round trips measured for a session while a client is attached
+// Endpoint: GET /api/sessions/:id/latency
+func HandleGetSessionLatency(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		latency, ok := hub.SessionLatency(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "session has no attached client"})
+			return
+		}
+		c.JSON(http.StatusOK, latency)
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/gin-gonic/gin"
+)
+
+// requestLog returns a logger for an API request, tagged with the caller's address
+func requestLog(hub *Hub, c *gin.Context) *slog.Logger {
+	return logging.Component(hub.Logger(), "api").With(logging.RemoteAddr(c.ClientIP()))
+}
+
+// RequestLogger logs each HTTP request through the hub's logger, in place of gin's own request log
+// Websocket upgrades are logged when they close
+func RequestLogger(hub *Hub) gin.HandlerFunc {
+	logger := logging.Component(hub.Logger(), "http")
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		level := slog.LevelInfo
+		switch status := c.Writer.Status(); {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		logger.Log(c.Request.Context(), level, "Request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration", time.Since(start),
+			logging.RemoteAddr(c.ClientIP()),
+		)
+	}
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Directions frames are routed in, used as the "direction" label
+const (
+	directionToClient = "runner_to_client"
+	directionToRunner = "client_to_runner"
+)
+
+// hubMetrics are the relay statistics HQ exposes on /metrics
+type hubMetrics struct {
+	registry *prometheus.Registry
+
+	routedFrames     *prometheus.CounterVec
+	routedBytes      *prometheus.CounterVec
+	routingErrors    *prometheus.CounterVec
+	registrationsRej prometheus.Counter
+	quotaRejections  *prometheus.CounterVec
+	writeDuration    *prometheus.HistogramVec
+	probeRTT         *prometheus.HistogramVec
+}
+
+// newHubMetrics registers HQ's metrics; gauges are read from the hub at scrape time
+func newHubMetrics(h *Hub) *hubMetrics {
+	m := &hubMetrics{
+		registry: prometheus.NewRegistry(),
+		routedFrames: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agent_relay_hq_routed_frames_total",
+			Help: "Websocket frames routed between runners and clients.",
+		}, []string{"direction"}),
+		routedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agent_relay_hq_routed_bytes_total",
+			Help: "Payload bytes routed between runners and clients.",
+		}, []string{"direction"}),
+		routingErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agent_relay_hq_routing_errors_total",
+			Help: "Frames that could not be routed because the session or peer was gone or the write failed.",
+		}, []string{"direction"}),
+		registrationsRej: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "agent_relay_hq_runner_registrations_rejected_total",
+			Help: "Runner connections refused during registration.",
+		}),
+		quotaRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "agent_relay_hq_quota_rejections_total",
+			Help: "Sessions, registrations and messages refused because a quota was exceeded, by error code.",
+		}, []string{"code"}),
+		writeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "agent_relay_hq_ws_write_duration_seconds",
+			Help:    "Time to write a frame to a runner or client websocket, including waiting for other writers.",
+			Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+		}, []string{"peer"}),
+		probeRTT: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "agent_relay_hq_probe_rtt_seconds",
+			Help:    "Round trips of HQ's websocket ping probes to runners and terminal clients.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		}, []string{"peer"}),
+	}
+
+	// Both directions show up from the first scrape, even before any traffic
+	for _, direction := range []string{directionToClient, directionToRunner} {
+		m.routedFrames.WithLabelValues(direction)
+		m.routedBytes.WithLabelValues(direction)
+		m.routingErrors.WithLabelValues(direction)
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.routedFrames,
+		m.routedBytes,
+		m.routingErrors,
+		m.registrationsRej,
+		m.quotaRejections,
+		m.writeDuration,
+		m.probeRTT,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "agent_relay_hq_runners_connected",
+			Help: "Runners currently connected.",
+		}, func() float64 { return float64(h.count(func(h *Hub) int { return len(h.runners) })) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "agent_relay_hq_sessions_active",
+			Help: "Sessions currently running, including headless job sessions.",
+		}, func() float64 { return float64(h.count(func(h *Hub) int { return len(h.sessions) })) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "agent_relay_hq_clients_attached",
+			Help: "Terminal clients currently attached to sessions.",
+		}, func() float64 { return float64(h.count(func(h *Hub) int { return len(h.clients) })) }),
+	)
+	return m
+}
+
+// routed counts a frame routed in direction, or the error that stopped it
+func (m *hubMetrics) routed(direction string, size int, err error) {
+	if err != nil {
+		m.routingErrors.WithLabelValues(direction).Inc()
+		return
+	}
+	m.routedFrames.WithLabelValues(direction).Inc()
+	m.routedBytes.WithLabelValues(direction).Add(float64(size))
+}
+
+// writeTimer returns the observer for frame writes to a kind of peer
+func (m *hubMetrics) writeTimer(peer string) prometheus.Observer {
+	return m.writeDuration.WithLabelValues(peer)
+}
+
+// observeSince records how long a write took, if writes are being timed
+func observeSince(o prometheus.Observer, start time.Time) {
+	if o != nil {
+		o.Observe(time.Since(start).Seconds())
+	}
+}
+
+// count reads a size from the hub's connection maps
+func (h *Hub) count(size func(*Hub) int) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return size(h)
+}
+
+// MetricsHandler serves HQ's metrics in the Prometheus text format
+func (h *Hub) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(h.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// RunnerRejected counts a runner connection refused during registration
+func (h *Hub) RunnerRejected() {
+	h.metrics.registrationsRej.Inc()
+}
+
+// quotaExceeded counts a request refused with a quota error code
+func (m *hubMetrics) quotaExceeded(code string) {
+	m.quotaRejections.WithLabelValues(code).Inc()
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/codervisor/agent-relay/internal/audit"
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/gin-gonic/gin"
+)
+
+// AnyOrigin in an allowlist lets every origin through, as HQ did before origins were checked
+const AnyOrigin = "*"
+
+// OriginPolicy decides which web origins may call HQ's API and open its websockets
+// Requests without an Origin header (runners, the approve helper, curl) and pages HQ
+// serves itself are always allowed
+type OriginPolicy struct {
+	Allowed []string // Origins such as https://agents.example.com, or AnyOrigin
+	Dev     bool     // Also allow http and https pages on localhost, 127.0.0.1 and [::1], on any port
+}
+
+// WithOriginPolicy sets which cross-origin pages may use HQ; by default none may
+func WithOriginPolicy(p OriginPolicy) HubOption {
+	return func(h *Hub) {
+		h.origins = p
+	}
+}
+
+// NormalizeOrigin returns origin as browsers send it: lower-case scheme://host[:port]
+func NormalizeOrigin(origin string) (string, error) {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+		return "", fmt.Errorf("expected an origin such as https://agents.example.com, got %q", origin)
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
+
+// allows reports whether a page from origin may use HQ, which it reached as host
+func (p OriginPolicy) allows(origin, host string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, host) {
+		return true // Same origin
+	}
+	if slices.Contains(p.Allowed, AnyOrigin) || slices.Contains(p.Allowed, strings.ToLower(u.Scheme+"://"+u.Host)) {
+		return true
+	}
+	if p.Dev && (u.Scheme == "http" || u.Scheme == "https") {
+		hostname := u.Hostname()
+		if hostname == "localhost" {
+			return true
+		}
+		if ip := net.ParseIP(hostname); ip != nil && ip.IsLoopback() {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowOrigin reports whether r may be served, logging requests from origins that are not allowed
+func (h *Hub) AllowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	h.policyMu.RLock()
+	allowed := h.origins.allows(origin, r.Host)
+	h.policyMu.RUnlock()
+	if !allowed {
+		remoteAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			remoteAddr = r.RemoteAddr
+		}
+		h.log.Warn("Rejected request from a disallowed origin", "origin", origin, "method", r.Method,
+			"path", r.URL.Path, logging.RemoteAddr(remoteAddr))
+		h.recordPolicyDenied(audit.Event{
+			User:       r.Header.Get("X-Forwarded-User"),
+			RemoteAddr: remoteAddr,
+			Details:    map[string]interface{}{"origin": origin},
+		}, r.Method+" "+r.URL.Path, "", "origin not allowed")
+	}
+	return allowed
+}
+
+// OriginGuard refuses requests from origins the policy does not allow and answers CORS
+// preflights for those it does
+// Disallowed requests are refused outright rather than only hidden from the page, since
+// a cross-site form post would otherwise still take effect
+func OriginGuard(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+		if !hub.AllowOrigin(c.Request) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "origin not allowed"})
+			return
+		}
+
+		c.Header("Access-Control-Allow-Origin", origin)
+		c.Header("Vary", "Origin")
+		if c.Request.Method == http.MethodOptions {
+			c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
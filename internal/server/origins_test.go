@@ -0,0 +1,44 @@
+package server
+
+import "testing"
+
+func TestOriginPolicyAllows(t *testing.T) {
+	const host = "hq.example.com"
+	allowlist := OriginPolicy{Allowed: []string{"https://agents.example.com", "http://localhost:5173"}}
+	dev := OriginPolicy{Dev: true}
+
+	tests := []struct {
+		name   string
+		policy OriginPolicy
+		origin string
+		want   bool
+	}{
+		{"same origin", OriginPolicy{}, "https://hq.example.com", true},
+		{"same origin in another case", OriginPolicy{}, "https://HQ.example.com", true},
+		{"other origin by default", OriginPolicy{}, "https://evil.example", false},
+		{"allowed origin", allowlist, "https://agents.example.com", true},
+		{"allowed origin in another case", allowlist, "HTTPS://Agents.Example.com", true},
+		{"allowed host with another scheme", allowlist, "http://agents.example.com", false},
+		{"allowed host with another port", allowlist, "https://agents.example.com:8443", false},
+		{"allowed origin with a port", allowlist, "http://localhost:5173", true},
+		{"subdomain of an allowed origin", allowlist, "https://evil.agents.example.com", false},
+		{"any origin", OriginPolicy{Allowed: []string{AnyOrigin}}, "https://evil.example", true},
+		{"dev localhost", dev, "http://localhost:3000", true},
+		{"dev loopback IPv4", dev, "https://127.0.0.1:8443", true},
+		{"dev loopback IPv6", dev, "http://[::1]:5173", true},
+		{"dev other host", dev, "http://192.168.1.10:3000", false},
+		{"dev localhost lookalike", dev, "http://localhost.evil.example", false},
+		{"dev non-web scheme", dev, "file://localhost", false},
+		{"localhost without dev", OriginPolicy{}, "http://localhost:3000", false},
+		{"null origin", allowlist, "null", false},
+		{"malformed origin", allowlist, "://agents.example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.allows(tt.origin, host); got != tt.want {
+				t.Errorf("allows(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/subtle"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/profile"
+)
+
+// Policy is the part of the hub's configuration that can change while HQ runs
+type Policy struct {
+	Profiles           *profile.Set // nil when no profiles are configured
+	RequireProfile     bool
+	ApprovalTimeout    time.Duration
+	MaxApprovalTimeout time.Duration
+	RunnerTokens       []string // Tokens runners may register with; empty accepts any non-empty token
+	Origins            OriginPolicy
+	Quotas             Quotas
+}
+
+// WithRunnerTokens only lets runners register with one of tokens
+func WithRunnerTokens(tokens []string) HubOption {
+	return func(h *Hub) {
+		h.runnerTokens = tokens
+	}
+}
+
+// SetPolicy replaces the hub's policy; sessions and approvals already started keep what they were given
+// Runners connected with a token that is no longer accepted are disconnected
+func (h *Hub) SetPolicy(p Policy) {
+	h.policyMu.Lock()
+	h.profiles = p.Profiles
+	h.requireProfile = p.RequireProfile
+	h.approvalTimeout = p.ApprovalTimeout
+	h.maxApprovalTimeout = p.MaxApprovalTimeout
+	h.runnerTokens = p.RunnerTokens
+	h.origins = p.Origins
+	h.setQuotas(p.Quotas)
+	h.policyMu.Unlock()
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, runner := range h.runners {
+		if !h.AuthenticateRunner(runner.token) {
+			runner.log.Warn("Disconnecting runner: its token is no longer accepted")
+			runner.Conn.Close()
+		}
+	}
+}
+
+// AuthenticateRunner reports whether a runner may register with token
+func (h *Hub) AuthenticateRunner(token string) bool {
+	h.policyMu.RLock()
+	defer h.policyMu.RUnlock()
+
+	if token == "" {
+		return false
+	}
+	if len(h.runnerTokens) == 0 {
+		return true
+	}
+	accepted := false
+	for _, t := range h.runnerTokens {
+		// Every token is compared, so timing reveals nothing about which one matched
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			accepted = true
+		}
+	}
+	return accepted
+}
+
+// profileSettings returns the configured profiles and whether sessions must name one
+func (h *Hub) profileSettings() (*profile.Set, bool) {
+	h.policyMu.RLock()
+	defer h.policyMu.RUnlock()
+	return h.profiles, h.requireProfile
+}
+
+// approvalTimeouts returns the default and longest time approval requests wait for a decision
+func (h *Hub) approvalTimeouts() (time.Duration, time.Duration) {
+	h.policyMu.RLock()
+	defer h.policyMu.RUnlock()
+	return h.approvalTimeout, h.maxApprovalTimeout
+}
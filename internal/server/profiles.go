@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/codervisor/agent-relay/internal/profile"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrProfileRequired is returned for a session that names no profile when HQ requires one
+var ErrProfileRequired = errors.New("sessions must be started from an agent profile")
+
+// WithProfiles lets clients start sessions by agent profile name
+// With require set, raw commands are refused and every session must name a profile
+func WithProfiles(set *profile.Set, require bool) HubOption {
+	return func(h *Hub) {
+		h.profiles = set
+		h.requireProfile = require
+	}
+}
+
+// PrepareSession expands and validates a start request for a runner
+// Requests naming a profile get its command, env, workspace, limits and timeout
+func (h *Hub) PrepareSession(runnerID string, req protocol.StartSessionPayload) (protocol.StartSessionPayload, error) {
+	if req.Profile == "" {
+		if _, require := h.profileSettings(); require {
+			return req, ErrProfileRequired
+		}
+		return req, nil
+	}
+
+	p, err := h.profile(req.Profile)
+	if err != nil {
+		return req, err
+	}
+
+	if runner, exists := h.GetRunner(runnerID); exists && !p.MatchesRunner(runner.Labels) {
+		return req, fmt.Errorf("runner %s does not have the labels profile %s requires", runnerID, p.Name)
+	}
+
+	return p.Apply(req)
+}
+
+// profileErrorCode returns the error code a request PrepareSession refused is answered with
+func profileErrorCode(err error) string {
+	if errors.Is(err, ErrProfileRequired) {
+		return protocol.ErrCodeProfileRequired
+	}
+	return protocol.ErrCodeInvalidProfile
+}
+
+// profile looks up a configured profile by name
+func (h *Hub) profile(name string) (profile.Profile, error) {
+	profiles, _ := h.profileSettings()
+	if profiles == nil {
+		return profile.Profile{}, fmt.Errorf("%w: %s", profile.ErrNotFound, name)
+	}
+	return profiles.Get(name)
+}
+
+// profileResponse describes a profile without revealing its env values
+type profileResponse struct {
+	Name         string                   `json:"name"`
+	Description  string                   `json:"description,omitempty"`
+	Command      []string                 `json:"command"`
+	Env          []string                 `json:"env,omitempty"` // Variable names only
+	Cwd          string                   `json:"cwd,omitempty"`
+	Workspace    *protocol.WorkspaceSpec  `json:"workspace,omitempty"`
+	Artifacts    []string                 `json:"artifacts,omitempty"`
+	RunnerLabels map[string]string        `json:"runner_labels,omitempty"`
+	Limits       *protocol.ResourceLimits `json:"limits,omitempty"`
+	Timeout      string                   `json:"timeout,omitempty"`
+}
+
+// HandleListProfiles returns the configured agent profiles
+// Endpoint: GET /api/profiles
+func HandleListProfiles(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		set, require := hub.profileSettings()
+		profiles := []profileResponse{}
+		if set != nil {
+			for _, p := range set.List() {
+				resp := profileResponse{
+					Name:         p.Name,
+					Description:  p.Description,
+					Command:      p.Command,
+					Cwd:          p.Cwd,
+					Workspace:    p.Workspace,
+					Artifacts:    p.Artifacts,
+					RunnerLabels: p.RunnerLabels,
+					Limits:       p.Limits,
+				}
+				for name := range p.Env {
+					resp.Env = append(resp.Env, name)
+				}
+				sort.Strings(resp.Env)
+				if p.Timeout > 0 {
+					resp.Timeout = p.Timeout.String()
+				}
+				profiles = append(profiles, resp)
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"profiles":        profiles,
+			"require_profile": require,
+		})
+	}
+}
@@ -0,0 +1,384 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// MinFrameSizeLimit is the smallest frame size limit that still lets file transfer chunks through
+const MinFrameSizeLimit = protocol.FileChunkSize + 36 // Chunks are prefixed with their session ID
+
+// Quotas cap what one user, runner, address or connection may use; zero values are unlimited
+type Quotas struct {
+	SessionsPerUser   int   // Sessions a user may have running at once, jobs included
+	SessionsPerRunner int   // Sessions one runner may have running at once, jobs included
+	SessionRate       Rate  // New sessions and jobs per user
+	RegistrationRate  Rate  // Runner registration attempts per client IP
+	MaxFrameSize      int64 // Largest websocket message read from a client, in bytes
+	MessageRate       Rate  // Messages read per client connection
+	RunnerMessageRate Rate  // Messages read per runner connection, which is read more slowly rather than dropping any
+
+	// TrustedProxies are the authenticating proxies whose X-Forwarded-User the user quotas
+	// key on; requests from anywhere else count against their address
+	TrustedProxies []netip.Prefix
+}
+
+// Rate allows Events per Per, in bursts of up to Events; the zero Rate is unlimited
+type Rate struct {
+	Events int
+	Per    time.Duration
+}
+
+// Unlimited reports whether r lets everything through
+func (r Rate) Unlimited() bool {
+	return r.Events <= 0 || r.Per <= 0
+}
+
+// WithQuotas limits sessions, registrations and messages; by default nothing is limited
+func WithQuotas(q Quotas) HubOption {
+	return func(h *Hub) {
+		h.quotas = q
+	}
+}
+
+// QuotaError is returned for a request that would exceed one of the hub's quotas
+type QuotaError struct {
+	Code       string // One of the protocol's quota error codes
+	Message    string
+	RetryAfter time.Duration // When a rate limit allows the request again; 0 for limits on running sessions
+}
+
+func (e *QuotaError) Error() string {
+	return e.Message
+}
+
+// retryAfterSeconds rounds the wait up, so a client that waits as told is not refused again
+func (e *QuotaError) retryAfterSeconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+// payload describes the refusal as an error frame
+func (e *QuotaError) payload(sessionID string) protocol.ErrorPayload {
+	return protocol.ErrorPayload{
+		SessionID:  sessionID,
+		Message:    e.Message,
+		Code:       e.Code,
+		RetryAfter: e.retryAfterSeconds(),
+	}
+}
+
+// abortWithQuota answers a REST request with 429 Too Many Requests
+func abortWithQuota(c *gin.Context, err *QuotaError) {
+	if err.RetryAfter > 0 {
+		c.Header("Retry-After", strconv.Itoa(err.retryAfterSeconds()))
+	}
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Message, "code": err.Code})
+}
+
+// bucket is a token bucket refilled at a Rate
+type bucket struct {
+	tokens float64
+	at     time.Time // When tokens was last brought up to date; zero for a full bucket
+}
+
+// take spends a token if one is left, otherwise returns how long until one is
+func (b *bucket) take(r Rate, now time.Time) time.Duration {
+	perSecond := float64(r.Events) / r.Per.Seconds()
+	if b.at.IsZero() {
+		b.tokens = float64(r.Events)
+	} else {
+		b.tokens = min(float64(r.Events), b.tokens+now.Sub(b.at).Seconds()*perSecond)
+	}
+	b.at = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+}
+
+// limiter keeps a token bucket per key, such as a user or an address
+type limiter struct {
+	rate    Rate
+	buckets map[string]*bucket
+	swept   time.Time
+	mu      sync.Mutex
+}
+
+// newLimiter returns a limiter for r, or nil if r is unlimited
+func newLimiter(r Rate) *limiter {
+	if r.Unlimited() {
+		return nil
+	}
+	return &limiter{rate: r, buckets: make(map[string]*bucket), swept: time.Now()}
+}
+
+// take spends one of key's tokens, returning how long to wait if none is left
+// A nil limiter allows everything
+func (l *limiter) take(key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.swept) >= l.rate.Per {
+		// Buckets idle for a whole period are full again, the same as ones never used
+		for k, b := range l.buckets {
+			if now.Sub(b.at) >= l.rate.Per {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{}
+		l.buckets[key] = b
+	}
+	return b.take(l.rate, now)
+}
+
+// quotaKey returns who a request's sessions count against for the user quotas
+// X-Forwarded-User is only believed from a trusted proxy; other callers could
+// name a different user on each request, so they are told apart by address
+func (h *Hub) quotaKey(c *gin.Context) string {
+	addr, err := peerAddr(c.Request)
+	if err != nil {
+		return "address " + c.Request.RemoteAddr
+	}
+	for _, proxy := range h.quotaSettings().TrustedProxies {
+		if proxy.Contains(addr) {
+			return requestUser(c)
+		}
+	}
+	return "address " + addr.String()
+}
+
+// quotaSettings returns the current quotas
+func (h *Hub) quotaSettings() Quotas {
+	h.policyMu.RLock()
+	defer h.policyMu.RUnlock()
+	return h.quotas
+}
+
+// setQuotas replaces the quotas; h.policyMu must be held
+// Rate limiters start afresh only when their rate changes
+func (h *Hub) setQuotas(q Quotas) {
+	if q.SessionRate != h.quotas.SessionRate || h.sessionRates == nil {
+		h.sessionRates = newLimiter(q.SessionRate)
+	}
+	if q.RegistrationRate != h.quotas.RegistrationRate || h.registrationRates == nil {
+		h.registrationRates = newLimiter(q.RegistrationRate)
+	}
+	h.quotas = q
+}
+
+// limiters returns the session and registration rate limiters
+func (h *Hub) limiters() (sessions, registrations *limiter) {
+	h.policyMu.RLock()
+	defer h.policyMu.RUnlock()
+	return h.sessionRates, h.registrationRates
+}
+
+// admitSession checks whether the user quotaKey names may start another session on runnerID
+// Sessions already running are checked first, so a refused session does not spend
+// the user's rate; h.mu must be held
+func (h *Hub) admitSession(quotaKey, runnerID string) *QuotaError {
+	if err := h.checkRunningSessions(quotaKey, runnerID); err != nil {
+		return err
+	}
+	sessions, _ := h.limiters()
+	if wait := sessions.take(quotaKey); wait > 0 {
+		h.metrics.quotaExceeded(protocol.ErrCodeSessionRate)
+		return &QuotaError{
+			Code:       protocol.ErrCodeSessionRate,
+			Message:    fmt.Sprintf("%s is starting sessions too quickly", quotaKey),
+			RetryAfter: wait,
+		}
+	}
+	return nil
+}
+
+// checkRunningSessions checks the limits on sessions running at once; h.mu must be held
+func (h *Hub) checkRunningSessions(quotaKey, runnerID string) *QuotaError {
+	q := h.quotaSettings()
+	if q.SessionsPerRunner > 0 && countSessions(h.sessions, runnerID) >= q.SessionsPerRunner {
+		h.metrics.quotaExceeded(protocol.ErrCodeSessionQuota)
+		return &QuotaError{
+			Code:    protocol.ErrCodeSessionQuota,
+			Message: fmt.Sprintf("runner %s already has %d sessions running", runnerID, q.SessionsPerRunner),
+		}
+	}
+	if q.SessionsPerUser > 0 && countOwned(h.owners, quotaKey) >= q.SessionsPerUser {
+		h.metrics.quotaExceeded(protocol.ErrCodeSessionQuota)
+		return &QuotaError{
+			Code:    protocol.ErrCodeSessionQuota,
+			Message: fmt.Sprintf("%s already has %d sessions running", quotaKey, q.SessionsPerUser),
+		}
+	}
+	return nil
+}
+
+// countSessions counts the sessions m maps to value
+func countSessions(m map[string]string, value string) int {
+	n := 0
+	for _, v := range m {
+		if v == value {
+			n++
+		}
+	}
+	return n
+}
+
+// countOwned counts the sessions that count against quotaKey
+func countOwned(owners map[string]sessionOwner, quotaKey string) int {
+	n := 0
+	for _, owner := range owners {
+		if owner.quotaKey == quotaKey {
+			n++
+		}
+	}
+	return n
+}
+
+// AdmitJob checks whether the user quotaKey names may submit a job for runnerID,
+// spending one of their new sessions
+func (h *Hub) AdmitJob(quotaKey, runnerID string) *QuotaError {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.admitSession(quotaKey, runnerID)
+}
+
+// admitRegistration checks the registration rate for a runner connecting from addr
+func (h *Hub) admitRegistration(addr string) *QuotaError {
+	_, registrations := h.limiters()
+	if wait := registrations.take(addr); wait > 0 {
+		h.metrics.quotaExceeded(protocol.ErrCodeRegistrationRate)
+		return &QuotaError{
+			Code:       protocol.ErrCodeRegistrationRate,
+			Message:    "too many registration attempts from " + addr,
+			RetryAfter: wait,
+		}
+	}
+	return nil
+}
+
+// sessionEnded starts jobs a quota held back now that a session has stopped counting
+func (h *Hub) sessionEnded() {
+	if h.heldJobs.Swap(false) {
+		go h.dispatchAllJobs()
+	}
+}
+
+// connLimits enforces the frame size and message rate quotas on one connection
+// The quotas are those in place when the connection opened
+type connLimits struct {
+	maxFrameSize int64
+	rate         Rate
+	slow         bool // Wait out the rate instead of dropping messages over it
+	bucket       bucket
+	throttled    bool // Messages have been dropped or delayed since one was last allowed
+}
+
+// newConnLimits returns the limits for a client connection opening now
+func (h *Hub) newConnLimits() *connLimits {
+	q := h.quotaSettings()
+	return &connLimits{maxFrameSize: q.MaxFrameSize, rate: q.MessageRate}
+}
+
+// newRunnerLimits returns the limits for a runner connection opening now
+// Runners carry every session's output and control messages, so none are dropped:
+// their frames are not size limited and reads slow down to their rate instead
+func (h *Hub) newRunnerLimits() *connLimits {
+	return &connLimits{rate: h.quotaSettings().RunnerMessageRate, slow: true}
+}
+
+// readMessage returns the next message the limits allow
+// Messages over them are dropped, or for slow limits delayed, and reported to refuse,
+// once per run of such messages for the rate, so that a flood is not answered with one
+func (l *connLimits) readMessage(conn *websocket.Conn, refuse func(*QuotaError)) (int, []byte, error) {
+	for {
+		messageType, data, tooLarge, err := l.read(conn)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if !l.rate.Unlimited() {
+			if wait := l.bucket.take(l.rate, time.Now()); wait > 0 {
+				if !l.throttled {
+					l.throttled = true
+					refuse(l.rateError(wait))
+				}
+				if !l.slow {
+					continue
+				}
+				// Not reading meanwhile pushes back on the sender through the connection
+				time.Sleep(wait)
+				l.bucket.tokens, l.bucket.at = 0, time.Now() // The token the wait refilled is this message's
+			} else {
+				l.throttled = false
+			}
+		}
+
+		if tooLarge {
+			refuse(&QuotaError{
+				Code:    protocol.ErrCodeFrameTooLarge,
+				Message: fmt.Sprintf("dropped a message larger than %d bytes", l.maxFrameSize),
+			})
+			continue
+		}
+		return messageType, data, nil
+	}
+}
+
+// rateError describes messages arriving faster than the rate
+func (l *connLimits) rateError(wait time.Duration) *QuotaError {
+	message := "messages are arriving too quickly; dropping them"
+	if l.slow {
+		message = "messages are arriving too quickly; reading them more slowly"
+	}
+	return &QuotaError{Code: protocol.ErrCodeMessageRate, Message: message, RetryAfter: wait}
+}
+
+// read reads one message, reading no more than the frame size limit of it
+func (l *connLimits) read(conn *websocket.Conn) (messageType int, data []byte, tooLarge bool, err error) {
+	if l.maxFrameSize <= 0 {
+		messageType, data, err = conn.ReadMessage()
+		return messageType, data, false, err
+	}
+
+	messageType, r, err := conn.NextReader()
+	if err != nil {
+		return 0, nil, false, err
+	}
+	// The rest of an oversized message is discarded by the next NextReader
+	data, err = io.ReadAll(io.LimitReader(r, l.maxFrameSize+1))
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if int64(len(data)) > l.maxFrameSize {
+		return messageType, nil, true, nil
+	}
+	return messageType, data, false, nil
+}
+
+// quotaFrame encodes a refusal as an error frame
+func quotaFrame(sessionID string, err *QuotaError) []byte {
+	data, _ := json.Marshal(protocol.Message{Type: protocol.MessageTypeError, Payload: err.payload(sessionID)})
+	return data
+}
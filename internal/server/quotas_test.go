@@ -0,0 +1,155 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBucketTake(t *testing.T) {
+	type step struct {
+		at   time.Duration // Since the first take
+		wait time.Duration // Expected result; 0 means a token was spent
+	}
+
+	tests := []struct {
+		name  string
+		rate  Rate
+		steps []step
+	}{
+		{
+			name:  "burst up to the rate",
+			rate:  Rate{Events: 3, Per: time.Second},
+			steps: []step{{0, 0}, {0, 0}, {0, 0}},
+		},
+		{
+			name: "refused once empty",
+			rate: Rate{Events: 2, Per: time.Second},
+			steps: []step{
+				{0, 0}, {0, 0},
+				{0, 500 * time.Millisecond},
+				{250 * time.Millisecond, 250 * time.Millisecond},
+			},
+		},
+		{
+			name: "refills over time",
+			rate: Rate{Events: 2, Per: time.Second},
+			steps: []step{
+				{0, 0}, {0, 0},
+				{500 * time.Millisecond, 0},
+				{500 * time.Millisecond, 500 * time.Millisecond},
+				{time.Second, 0},
+			},
+		},
+		{
+			name: "refill is capped at the burst",
+			rate: Rate{Events: 2, Per: time.Second},
+			steps: []step{
+				{0, 0},
+				{time.Hour, 0}, {time.Hour, 0},
+				{time.Hour, 500 * time.Millisecond},
+			},
+		},
+		{
+			name: "slow rate",
+			rate: Rate{Events: 1, Per: time.Minute},
+			steps: []step{
+				{0, 0},
+				{15 * time.Second, 45 * time.Second},
+				{time.Minute, 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			var b bucket
+			for i, s := range tt.steps {
+				got := b.take(tt.rate, start.Add(s.at))
+				if diff := got - s.wait; diff < -time.Millisecond || diff > time.Millisecond {
+					t.Errorf("take %d at +%v = %v, want %v", i+1, s.at, got, s.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterKeys(t *testing.T) {
+	l := newLimiter(Rate{Events: 1, Per: time.Minute})
+	if wait := l.take("alice"); wait != 0 {
+		t.Fatalf("first take for alice waited %v", wait)
+	}
+	if wait := l.take("alice"); wait <= 0 {
+		t.Error("second take for alice was allowed")
+	}
+	if wait := l.take("bob"); wait != 0 {
+		t.Errorf("bob waited %v for alice's limit", wait)
+	}
+
+	var unlimited *limiter
+	if newLimiter(Rate{}) != nil {
+		t.Error("newLimiter() returned a limiter for an unlimited rate")
+	}
+	for i := 0; i < 3; i++ {
+		if wait := unlimited.take("alice"); wait != 0 {
+			t.Errorf("nil limiter waited %v", wait)
+		}
+	}
+}
+
+func TestQuotaKey(t *testing.T) {
+	proxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.5/32"), netip.MustParsePrefix("fd00::/8")}
+
+	tests := []struct {
+		name       string
+		trusted    []netip.Prefix
+		remoteAddr string
+		user       string // X-Forwarded-User
+		want       string
+	}{
+		{name: "no trusted proxies", remoteAddr: "192.0.2.1:5000", user: "alice", want: "address 192.0.2.1"},
+		{name: "header from a trusted proxy", trusted: proxies, remoteAddr: "10.0.0.5:5000", user: "alice", want: "alice"},
+		{name: "no header from a trusted proxy", trusted: proxies, remoteAddr: "10.0.0.5:5000", want: "anonymous"},
+		{name: "header from elsewhere", trusted: proxies, remoteAddr: "10.0.0.6:5000", user: "alice", want: "address 10.0.0.6"},
+		{name: "no header from elsewhere", trusted: proxies, remoteAddr: "10.0.0.6:5000", want: "address 10.0.0.6"},
+		{name: "trusted IPv6 range", trusted: proxies, remoteAddr: "[fd12::1]:5000", user: "bob", want: "bob"},
+		{name: "IPv4-mapped trusted proxy", trusted: proxies, remoteAddr: "[::ffff:10.0.0.5]:5000", user: "bob", want: "bob"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub(WithQuotas(Quotas{TrustedProxies: tt.trusted}))
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/jobs", nil)
+			c.Request.RemoteAddr = tt.remoteAddr
+			if tt.user != "" {
+				c.Request.Header.Set("X-Forwarded-User", tt.user)
+			}
+
+			if got := hub.quotaKey(c); got != tt.want {
+				t.Errorf("quotaKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionRateIgnoresUntrustedUser(t *testing.T) {
+	hub := NewHub(WithQuotas(Quotas{SessionRate: Rate{Events: 1, Per: time.Minute}}))
+
+	var refused *QuotaError
+	for _, user := range []string{"alice", "bob", "carol"} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/jobs", nil)
+		c.Request.RemoteAddr = "192.0.2.1:5000"
+		c.Request.Header.Set("X-Forwarded-User", user)
+		refused = hub.AdmitJob(hub.quotaKey(c), "r1")
+	}
+	if refused == nil {
+		t.Error("a new X-Forwarded-User on each request got around the session rate")
+	}
+}
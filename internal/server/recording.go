@@ -0,0 +1,115 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/recording"
+)
+
+// WithRecording enables asciicast recording of sessions into sink
+func WithRecording(sink recording.Sink, policy recording.Policy) HubOption {
+	return func(h *Hub) {
+		h.recordings = sink
+		h.recordPolicy = policy
+	}
+}
+
+// Recordings returns the recording sink, or nil when recording is disabled
+func (h *Hub) Recordings() recording.Sink {
+	return h.recordings
+}
+
+// startRecording begins recording a session if the policy or client asks for it
+// Returns whether a recording was started
+func (h *Hub) startRecording(sessionID string, command []string, requested bool) bool {
+	if h.recordings == nil || !(requested || h.recordPolicy.All) {
+		return false
+	}
+
+	w, err := h.recordings.Create(sessionID)
+	if err != nil {
+		h.log.Error("Failed to create recording", logging.SessionID(sessionID), logging.Err(err))
+		return false
+	}
+
+	if len(command) == 0 {
+		command = []string{"/bin/bash"}
+	}
+
+	// The command line itself may carry credentials
+	commandLine, _ := h.recordPolicy.Redactor.Redact([]byte(strings.Join(command, " ")))
+
+	rec, err := recording.NewRecorder(w, recording.Header{
+		Width:   80,
+		Height:  24,
+		Command: string(commandLine),
+		Title:   sessionID,
+		Env:     map[string]string{"TERM": "xterm-256color"},
+	}, h.recordPolicy.Redactor)
+	if err != nil {
+		w.Close()
+		h.log.Error("Failed to start recording", logging.SessionID(sessionID), logging.Err(err))
+		return false
+	}
+
+	h.recMu.Lock()
+	h.recorders[sessionID] = rec
+	h.recMu.Unlock()
+
+	h.log.Info("Recording session", logging.SessionID(sessionID))
+	return true
+}
+
+// recorder returns the active recorder for a session, if any
+func (h *Hub) recorder(sessionID string) *recording.Recorder {
+	h.recMu.Lock()
+	defer h.recMu.Unlock()
+	return h.recorders[sessionID]
+}
+
+// RecordOutput appends PTY output to the session's recording
+func (h *Hub) RecordOutput(sessionID string, data []byte) {
+	if rec := h.recorder(sessionID); rec != nil {
+		if err := rec.Output(data); err != nil {
+			h.log.Error("Failed to record output", logging.SessionID(sessionID), logging.Err(err))
+		}
+	}
+}
+
+// RecordInput appends client input to the session's recording when input capture is enabled
+func (h *Hub) RecordInput(sessionID string, data []byte) {
+	if !h.recordPolicy.Input {
+		return
+	}
+	if rec := h.recorder(sessionID); rec != nil {
+		if err := rec.Input(data); err != nil {
+			h.log.Error("Failed to record input", logging.SessionID(sessionID), logging.Err(err))
+		}
+	}
+}
+
+// RecordResize appends a terminal resize to the session's recording
+func (h *Hub) RecordResize(sessionID string, cols, rows int) {
+	if rec := h.recorder(sessionID); rec != nil {
+		if err := rec.Resize(cols, rows); err != nil {
+			h.log.Error("Failed to record resize", logging.SessionID(sessionID), logging.Err(err))
+		}
+	}
+}
+
+// stopRecording finalizes a session's recording
+func (h *Hub) stopRecording(sessionID string) {
+	h.recMu.Lock()
+	rec, exists := h.recorders[sessionID]
+	delete(h.recorders, sessionID)
+	h.recMu.Unlock()
+
+	if !exists {
+		return
+	}
+
+	if err := rec.Close(); err != nil {
+		h.log.Error("Failed to close recording", logging.SessionID(sessionID), logging.Err(err))
+	}
+}
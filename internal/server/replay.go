@@ -0,0 +1,192 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/codervisor/agent-relay/internal/recording"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// HandleRecordingDownload serves a session's asciicast v2 recording
+// Endpoint: GET /api/sessions/:id/recording
+func HandleRecordingDownload(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sink := hub.Recordings()
+		if sink == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "recording is disabled"})
+			return
+		}
+
+		sessionID := c.Param("id")
+		r, err := sink.Open(sessionID)
+		if errors.Is(err, recording.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "recording not found"})
+			return
+		}
+		if err != nil {
+			requestLog(hub, c).Error("Failed to open recording", logging.SessionID(sessionID), logging.Err(err))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to open recording"})
+			return
+		}
+		defer r.Close()
+
+		c.Header("Content-Disposition", `attachment; filename="`+sessionID+`.cast"`)
+		c.DataFromReader(http.StatusOK, -1, "application/x-asciicast", r, nil)
+	}
+}
+
+// HandleReplayConnection streams a recording to a browser with its original timing
+// Output is sent as binary frames and resizes as control messages, the same
+// framing as a live terminal, so the xterm.js frontend can render it unchanged
+// Endpoint: /ws/replay/:id?speed=1&max_idle=2
+func HandleReplayConnection(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sink := hub.Recordings()
+		if sink == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "recording is disabled"})
+			return
+		}
+
+		sessionID := c.Param("id")
+		logger := logging.Component(hub.Logger(), "ws").With(
+			logging.ClientID(uuid.NewString()), logging.SessionID(sessionID), logging.RemoteAddr(c.ClientIP()))
+		r, err := sink.Open(sessionID)
+		if errors.Is(err, recording.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "recording not found"})
+			return
+		}
+		if err != nil {
+			logger.Error("Failed to open recording", logging.Err(err))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "failed to open recording"})
+			return
+		}
+		defer r.Close()
+
+		speed := queryFloat(c, "speed", 1)
+		if speed <= 0 {
+			speed = 1
+		}
+		maxIdle := time.Duration(queryFloat(c, "max_idle", 0) * float64(time.Second))
+
+		conn, err := hub.upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			logger.Warn("Failed to upgrade replay connection", logging.Err(err))
+			return
+		}
+		defer conn.Close()
+
+		// Drain client frames so close handshakes and disconnects are noticed
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		go closeOnShutdown(hub, conn, done)
+
+		if err := replayRecording(conn, sessionID, r, speed, maxIdle, done); err != nil {
+			logger.Info("Replay stopped", logging.Err(err))
+			return
+		}
+
+		conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "replay complete"))
+	}
+}
+
+// replayRecording writes each recorded event to conn once its timestamp is reached
+// speed divides delays; idle gaps longer than maxIdle (if non-zero) are shortened to it
+func replayRecording(conn *websocket.Conn, sessionID string, r io.Reader, speed float64, maxIdle time.Duration, done <-chan struct{}) error {
+	reader, err := recording.NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	writeControl := func(msgType protocol.MessageType, payload interface{}) error {
+		data, err := json.Marshal(protocol.Message{Type: msgType, Payload: payload})
+		if err != nil {
+			return err
+		}
+		return conn.WriteMessage(websocket.TextMessage, data)
+	}
+
+	if err := writeControl(protocol.MessageTypeSessionStarted, protocol.SessionStartedPayload{SessionID: sessionID}); err != nil {
+		return err
+	}
+	if err := writeControl(protocol.MessageTypeResize, resizePayload(sessionID, reader.Header.Width, reader.Header.Height)); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	var elapsed, last time.Duration
+
+	for {
+		ev, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		gap := time.Duration(ev.Time*float64(time.Second)) - last
+		last += gap
+		if maxIdle > 0 && gap > maxIdle {
+			gap = maxIdle
+		}
+		elapsed += time.Duration(float64(gap) / speed)
+
+		select {
+		case <-done:
+			return errors.New("client disconnected")
+		case <-time.After(time.Until(start.Add(elapsed))):
+		}
+
+		switch ev.Type {
+		case recording.EventOutput:
+			err = conn.WriteMessage(websocket.BinaryMessage, []byte(ev.Data))
+		case recording.EventResize:
+			var cols, rows int
+			if parts := strings.SplitN(ev.Data, "x", 2); len(parts) == 2 {
+				cols, _ = strconv.Atoi(parts[0])
+				rows, _ = strconv.Atoi(parts[1])
+			}
+			err = writeControl(protocol.MessageTypeResize, resizePayload(sessionID, cols, rows))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeControl(protocol.MessageTypeSessionEnded, protocol.SessionEndedPayload{SessionID: sessionID})
+}
+
+// resizePayload includes the session ID the runner finds the session's PTY by
+func resizePayload(sessionID string, cols, rows int) interface{} {
+	return struct {
+		SessionID string `json:"session_id"`
+		protocol.ResizePayload
+	}{sessionID, protocol.ResizePayload{Rows: rows, Cols: cols}}
+}
+
+// queryFloat parses an optional float query parameter
+func queryFloat(c *gin.Context, key string, defaultValue float64) float64 {
+	v, err := strconv.ParseFloat(c.Query(key), 64)
+	if err != nil {
+		return defaultValue
+	}
+	return v
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/codervisor/agent-relay/internal/store"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	shutdownReason      = "hq shutting down"
+	shutdownPollEvery   = 50 * time.Millisecond
+	shutdownCleanupWait = 2 * time.Second // How long connections closed at the deadline get to persist their state
+)
+
+// shutdownPeer is a websocket HQ says goodbye to
+type shutdownPeer struct {
+	conn  *websocket.Conn
+	write func(data []byte) error // Serialized with the connection's other writers
+}
+
+// ShuttingDown reports whether Shutdown has been called
+func (h *Hub) ShuttingDown() bool {
+	select {
+	case <-h.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown tells every runner and client that HQ is going away, closes their
+// websockets and waits for their state to be persisted
+// Connections still open when ctx is done are cut; the error is then ctx's
+func (h *Hub) Shutdown(ctx context.Context, reconnectAfter time.Duration) error {
+	h.mu.Lock()
+	h.reconnectAfter = reconnectAfter
+	h.mu.Unlock()
+	h.shutdownOnce.Do(func() { close(h.shutdown) })
+
+	// Runners are still connected, so sessions blocked on a human hear why they were refused
+	h.cancelApprovals(func(store.ApprovalRecord) bool { return true }, shutdownReason)
+
+	msg, err := json.Marshal(protocol.Message{
+		Type: protocol.MessageTypeServerShutdown,
+		Payload: protocol.ServerShutdownPayload{
+			ReconnectAfter: int(reconnectAfter.Round(time.Second) / time.Second),
+			Reason:         shutdownReason,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode server_shutdown: %w", err)
+	}
+
+	peers := h.shutdownPeers()
+	h.log.Info("Shutting down", "connections", len(peers))
+
+	// Close frames go out with WriteControl, which is safe alongside other writers
+	closeFrame := websocket.FormatCloseMessage(websocket.CloseServiceRestart, shutdownReason)
+	for _, p := range peers {
+		if err := p.write(msg); err != nil {
+			p.conn.Close()
+			continue
+		}
+		p.conn.WriteControl(websocket.CloseMessage, closeFrame, time.Now().Add(time.Second))
+	}
+
+	// Each connection's read loop ends once the peer answers the close frame,
+	// and its cleanup persists what became of its sessions and jobs
+	err = h.waitForConnections(ctx)
+	if err != nil {
+		h.log.Warn("Shutdown deadline reached, cutting remaining connections")
+		for _, p := range peers {
+			p.conn.Close()
+		}
+		cleanup, cancel := context.WithTimeout(context.Background(), shutdownCleanupWait)
+		defer cancel()
+		h.waitForConnections(cleanup)
+	}
+
+	h.stopAllRecordings()
+	h.log.Info("Shutdown complete")
+	return err
+}
+
+// shutdownPeers snapshots every websocket HQ holds open
+func (h *Hub) shutdownPeers() []shutdownPeer {
+	var peers []shutdownPeer
+
+	h.mu.RLock()
+	for _, client := range h.clients {
+		client := client
+		peers = append(peers, shutdownPeer{conn: client.Conn, write: func(data []byte) error {
+			return client.WriteMessage(websocket.TextMessage, data)
+		}})
+	}
+	for _, runner := range h.runners {
+		runner := runner
+		peers = append(peers, shutdownPeer{conn: runner.Conn, write: func(data []byte) error {
+			return runner.WriteMessage(websocket.TextMessage, data)
+		}})
+	}
+	h.mu.RUnlock()
+
+	h.approvalMu.Lock()
+	subs := h.approvalSubscribers()
+	h.approvalMu.Unlock()
+	for _, sub := range subs {
+		sub := sub
+		peers = append(peers, shutdownPeer{conn: sub.conn, write: func(data []byte) error {
+			sub.writeMu.Lock()
+			defer sub.writeMu.Unlock()
+			return sub.conn.WriteMessage(websocket.TextMessage, data)
+		}})
+	}
+	return peers
+}
+
+// waitForConnections blocks until every runner, client and reviewer has disconnected
+func (h *Hub) waitForConnections(ctx context.Context) error {
+	ticker := time.NewTicker(shutdownPollEvery)
+	defer ticker.Stop()
+
+	for {
+		h.mu.RLock()
+		open := len(h.runners) + len(h.clients)
+		h.mu.RUnlock()
+		h.approvalMu.Lock()
+		open += len(h.approvalSubs)
+		h.approvalMu.Unlock()
+
+		if open == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// stopAllRecordings flushes recordings whose sessions never reported an end
+func (h *Hub) stopAllRecordings() {
+	h.recMu.Lock()
+	ids := make([]string, 0, len(h.recorders))
+	for id := range h.recorders {
+		ids = append(ids, id)
+	}
+	h.recMu.Unlock()
+
+	for _, id := range ids {
+		h.stopRecording(id)
+	}
+}
+
+// closeOnShutdown closes conn with a close frame when HQ shuts down, until done closes
+// For connections HQ does not track, such as replays
+func closeOnShutdown(hub *Hub, conn *websocket.Conn, done <-chan struct{}) {
+	select {
+	case <-hub.shutdown:
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseServiceRestart, shutdownReason), time.Now().Add(time.Second))
+		conn.Close()
+	case <-done:
+	}
+}
+
+// ShutdownGuard refuses new requests and websocket upgrades once HQ is shutting down
+func ShutdownGuard(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hub.ShuttingDown() {
+			c.Next()
+			return
+		}
+
+		hub.mu.RLock()
+		retry := hub.reconnectAfter
+		hub.mu.RUnlock()
+		if retry > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(retry.Round(time.Second)/time.Second)))
+		}
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": shutdownReason})
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/codervisor/agent-relay/internal/tlsutil"
+)
+
+// errRunnerCertRequired rejects runners that connect without a verified client certificate
+var errRunnerCertRequired = errors.New("a client certificate is required")
+
+// WithRunnerCertificates makes every runner present a verified client certificate
+// Runners that present one are always bound to it, whether or not it is required
+func WithRunnerCertificates(require bool) HubOption {
+	return func(h *Hub) {
+		h.requireRunnerCert = require
+	}
+}
+
+// VerifyRunnerCert checks a runner's client certificate against the ID it registers with
+// The certificate's common name or one of its DNS SANs must be the runner ID
+func (h *Hub) VerifyRunnerCert(state *tls.ConnectionState, runnerID string) error {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		if h.requireRunnerCert {
+			return errRunnerCertRequired
+		}
+		return nil
+	}
+
+	identities := tlsutil.Identities(state.VerifiedChains[0][0])
+	if !slices.Contains(identities, runnerID) {
+		return fmt.Errorf("client certificate for %s does not name runner %s", strings.Join(identities, ", "), runnerID)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/codervisor/agent-relay/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = tracing.Tracer("server")
+
+// Startup spans of sessions whose client or runner left before the session started fail with these
+var (
+	errClientGone = errors.New("client disconnected before the session started")
+	errRunnerGone = errors.New("runner disconnected before the session started")
+)
+
+// awaitSessionStart holds a session's hq.start_session span until the runner answers
+func (h *Hub) awaitSessionStart(sessionID string, span trace.Span) {
+	h.traceMu.Lock()
+	defer h.traceMu.Unlock()
+	h.starting[sessionID] = span
+}
+
+// sessionStartAnswered ends a session's hq.start_session span, failed with err if set
+// It does nothing once the span has ended
+func (h *Hub) sessionStartAnswered(sessionID string, err error) {
+	h.traceMu.Lock()
+	span, ok := h.starting[sessionID]
+	delete(h.starting, sessionID)
+	h.traceMu.Unlock()
+
+	if ok {
+		tracing.End(span, err)
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/google/uuid"
+)
+
+// DefaultMaxTransferSize caps a single file transfer relayed through HQ
+const DefaultMaxTransferSize = 100 << 20
+
+// transferTimeout bounds how long HQ waits for a runner to respond during a transfer
+const transferTimeout = 30 * time.Second
+
+// WithMaxTransferSize caps the bytes HQ relays per file transfer; 0 means no limit
+func WithMaxTransferSize(n int64) HubOption {
+	return func(h *Hub) {
+		h.maxTransferSize = n
+	}
+}
+
+// MaxTransferSize returns the per-transfer byte limit; 0 means no limit
+func (h *Hub) MaxTransferSize() int64 {
+	return h.maxTransferSize
+}
+
+// transferError is a failure reported by the runner for a transfer
+type transferError struct {
+	Code    string
+	Message string
+}
+
+func (e *transferError) Error() string {
+	return e.Message
+}
+
+// transfer is a file upload or download in flight between an HTTP request and a runner
+type transfer struct {
+	id       string
+	runnerID string
+	control  chan protocol.Message // file_ready, file_end, file_complete or error from the runner
+	data     chan []byte           // Download chunks from the runner
+	aborted  chan struct{}
+	err      error
+	once     sync.Once
+}
+
+// abort fails the transfer, waking whoever is waiting on it
+func (t *transfer) abort(err error) {
+	t.once.Do(func() {
+		t.err = err
+		close(t.aborted)
+	})
+}
+
+// await waits for the runner's next control message and decodes it into v
+// A runner error is returned as *transferError
+func (t *transfer) await(ctx context.Context, want protocol.MessageType, v interface{}) error {
+	timeout := time.NewTimer(transferTimeout)
+	defer timeout.Stop()
+
+	select {
+	case msg := <-t.control:
+		return decodeTransferControl(msg, want, v)
+	case <-t.aborted:
+		return t.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeout.C:
+		return errors.New("timed out waiting for runner")
+	}
+}
+
+// check reports a runner error or abort without blocking
+func (t *transfer) check() error {
+	select {
+	case msg := <-t.control:
+		return decodeTransferControl(msg, protocol.MessageTypeError, nil)
+	case <-t.aborted:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// decodeTransferControl converts a runner message into the expected payload or an error
+func decodeTransferControl(msg protocol.Message, want protocol.MessageType, v interface{}) error {
+	if msg.Type == protocol.MessageTypeError {
+		var payload protocol.ErrorPayload
+		if err := protocol.DecodePayload(msg, &payload); err != nil {
+			return err
+		}
+		return &transferError{Code: payload.Code, Message: payload.Message}
+	}
+	if msg.Type != want || v == nil {
+		return fmt.Errorf("unexpected %s from runner", msg.Type)
+	}
+	return protocol.DecodePayload(msg, v)
+}
+
+// openTransfer registers a new transfer with a connected runner
+func (h *Hub) openTransfer(runnerID string) (*transfer, *RunnerConn, error) {
+	runner, exists := h.GetRunner(runnerID)
+	if !exists {
+		return nil, nil, fmt.Errorf("runner %s not found", runnerID)
+	}
+
+	t := &transfer{
+		id:       uuid.NewString(),
+		runnerID: runnerID,
+		control:  make(chan protocol.Message, 4),
+		data:     make(chan []byte, protocol.FileWindowChunks),
+		aborted:  make(chan struct{}),
+	}
+
+	h.transferMu.Lock()
+	h.transfers[t.id] = t
+	h.transferMu.Unlock()
+
+	return t, runner, nil
+}
+
+// closeTransfer forgets a finished transfer; late frames for it are dropped
+func (h *Hub) closeTransfer(t *transfer) {
+	h.transferMu.Lock()
+	delete(h.transfers, t.id)
+	h.transferMu.Unlock()
+}
+
+// lookupTransfer returns an active transfer by ID
+// Only the runner a transfer was opened with may feed it
+func (h *Hub) lookupTransfer(runnerID, id string) (*transfer, bool) {
+	h.transferMu.Lock()
+	defer h.transferMu.Unlock()
+	t, exists := h.transfers[id]
+	if !exists || t.runnerID != runnerID {
+		return nil, false
+	}
+	return t, true
+}
+
+// DeliverTransferChunk hands a binary frame from a runner to its transfer
+// Returns false if id is not a transfer, so the frame is routed as PTY output
+func (h *Hub) DeliverTransferChunk(runnerID, id string, data []byte) bool {
+	t, exists := h.lookupTransfer(runnerID, id)
+	if !exists {
+		return false
+	}
+
+	// Runners hold to the flow-control window, so a full buffer means a misbehaving
+	// runner; failing the transfer keeps the read loop from blocking other sessions
+	select {
+	case t.data <- data:
+	default:
+		t.abort(errors.New("runner exceeded the transfer window"))
+	}
+	return true
+}
+
+// DeliverTransferControl hands a control message from a runner to its transfer
+func (h *Hub) DeliverTransferControl(runnerID, id string, msg protocol.Message) {
+	t, exists := h.lookupTransfer(runnerID, id)
+	if !exists {
+		h.log.Warn("Dropping message for unknown transfer", logging.RunnerID(runnerID), "type", msg.Type, "transfer_id", id)
+		return
+	}
+
+	select {
+	case t.control <- msg:
+	default:
+		t.abort(fmt.Errorf("unexpected %s from runner", msg.Type))
+	}
+}
+
+// abortRunnerTransfers fails every transfer with a runner that disconnected
+func (h *Hub) abortRunnerTransfers(runnerID string) {
+	h.transferMu.Lock()
+	defer h.transferMu.Unlock()
+
+	for _, t := range h.transfers {
+		if t.runnerID == runnerID {
+			t.abort(errors.New("runner disconnected"))
+		}
+	}
+}
+
+// transferFrame prefixes a chunk with its transfer ID for the runner websocket
+// Format: [transfer_id(36 bytes)][chunk]
+func transferFrame(id string, chunk []byte) []byte {
+	frame := make([]byte, 36, 36+len(chunk))
+	copy(frame, id)
+	return append(frame, chunk...)
+}
@@ -1,96 +1,138 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 
+	"github.com/codervisor/agent-relay/internal/audit"
+	"github.com/codervisor/agent-relay/internal/logging"
 	"github.com/codervisor/agent-relay/internal/protocol"
+	"github.com/codervisor/agent-relay/internal/store"
+	"github.com/codervisor/agent-relay/internal/tracing"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow all origins for development
-		// TODO: Restrict in production
-		return true
-	},
-}
-
 // HandleRunnerConnection handles incoming runner WebSocket connections
 // Endpoint: /ws/runner
 func HandleRunnerConnection(hub *Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		remoteAddr := c.ClientIP()
+		logger := logging.Component(hub.Logger(), "ws").With(logging.RemoteAddr(remoteAddr))
+
+		recordRejection := func(runnerID, reason string) {
+			hub.RunnerRejected()
+			hub.Audit().Record(audit.Event{
+				Type:       audit.EventRunnerRejected,
+				RunnerID:   runnerID,
+				RemoteAddr: remoteAddr,
+				Details:    map[string]interface{}{"reason": reason},
+			})
+		}
+
+		// Refused before the upgrade so a runner reconnecting in a tight loop costs little
+		if err := hub.admitRegistration(remoteAddr); err != nil {
+			logger.Warn("Refusing runner registration", "retry_after", err.RetryAfter, logging.Err(err))
+			recordRejection("", err.Message)
+			abortWithQuota(c, err)
+			return
+		}
+
+		conn, err := hub.upgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
-			log.Printf("[WS] Failed to upgrade runner connection: %v", err)
+			logger.Warn("Failed to upgrade runner connection", logging.Err(err))
 			return
 		}
 
+		reject := func(runnerID, reason string) {
+			recordRejection(runnerID, reason)
+			conn.Close()
+		}
+
 		// Read registration message
 		var msg protocol.Message
 		if err := conn.ReadJSON(&msg); err != nil {
-			log.Printf("[WS] Failed to read registration message: %v", err)
-			conn.Close()
+			logger.Warn("Failed to read registration message", logging.Err(err))
+			reject("", "unreadable registration message")
 			return
 		}
 
 		if msg.Type != protocol.MessageTypeRegister {
-			log.Printf("[WS] Expected register message, got: %s", msg.Type)
-			conn.Close()
+			logger.Warn("Expected register message", "type", msg.Type)
+			reject("", "expected register message")
 			return
 		}
 
 		// Parse registration payload
-		payloadBytes, err := json.Marshal(msg.Payload)
-		if err != nil {
-			log.Printf("[WS] Failed to marshal payload: %v", err)
-			conn.Close()
+		var regPayload protocol.RegisterPayload
+		if err := protocol.DecodePayload(msg, &regPayload); err != nil {
+			logger.Warn("Malformed registration payload", logging.Err(err))
+			reject("", "malformed registration payload")
 			return
 		}
 
-		var regPayload protocol.RegisterPayload
-		if err := json.Unmarshal(payloadBytes, &regPayload); err != nil {
-			log.Printf("[WS] Failed to parse registration payload: %v", err)
-			conn.Close()
+		logger = logger.With(logging.RunnerID(regPayload.RunnerID), logging.Epoch(regPayload.Epoch))
+
+		if !hub.AuthenticateRunner(regPayload.Token) {
+			logger.Warn("Runner token rejected", "empty", regPayload.Token == "")
+			reject(regPayload.RunnerID, "invalid token")
 			return
 		}
-
-		// TODO: Validate token
-		if regPayload.Token == "" {
-			log.Printf("[WS] Empty token in registration")
-			conn.Close()
+		if err := hub.VerifyRunnerCert(c.Request.TLS, regPayload.RunnerID); err != nil {
+			logger.Warn("Runner certificate rejected", logging.Err(err))
+			reject(regPayload.RunnerID, err.Error())
 			return
 		}
 
 		// Register runner in hub
-		if err := hub.RegisterRunner(regPayload.RunnerID, conn); err != nil {
-			log.Printf("[WS] Failed to register runner: %v", err)
-			conn.Close()
+		if err := hub.RegisterRunner(conn, regPayload, logger); err != nil {
+			logger.Warn("Failed to register runner", logging.Err(err))
+			reject(regPayload.RunnerID, err.Error())
 			return
 		}
 
-		log.Printf("[WS] Runner connected: %s", regPayload.RunnerID)
+		hub.Audit().Record(audit.Event{
+			Type:       audit.EventRunnerRegistered,
+			RunnerID:   regPayload.RunnerID,
+			RemoteAddr: remoteAddr,
+		})
+
+		logger.Info("Runner connected")
 
 		// Start message routing loop
-		runnerMessageLoop(hub, regPayload.RunnerID, conn)
+		runnerMessageLoop(hub, regPayload.RunnerID, conn, logger)
 	}
 }
 
 // runnerMessageLoop handles messages from a runner
-func runnerMessageLoop(hub *Hub, runnerID string, conn *websocket.Conn) {
+func runnerMessageLoop(hub *Hub, runnerID string, conn *websocket.Conn, logger *slog.Logger) {
 	defer func() {
 		hub.UnregisterRunner(runnerID)
 		conn.Close()
-		log.Printf("[WS] Runner disconnected: %s", runnerID)
+		logger.Info("Runner disconnected")
 	}()
 
+	limits := hub.newRunnerLimits()
+	refuse := func(quotaErr *QuotaError) {
+		hub.metrics.quotaExceeded(quotaErr.Code)
+		logger.Warn("Runner exceeded a quota", "code", quotaErr.Code, logging.Err(quotaErr))
+		hub.recordPolicyDenied(audit.Event{RunnerID: runnerID}, "message", quotaErr.Code, quotaErr.Message)
+		if runner, ok := hub.GetRunner(runnerID); ok {
+			runner.WriteMessage(websocket.TextMessage, quotaFrame("", quotaErr))
+		}
+	}
+
 	for {
-		messageType, data, err := conn.ReadMessage()
+		messageType, data, err := limits.readMessage(conn, refuse)
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("[WS] Runner read error: %v", err)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseServiceRestart) {
+				logger.Warn("Runner read error", logging.Err(err))
 			}
 			break
 		}
@@ -99,45 +141,158 @@ func runnerMessageLoop(hub *Hub, runnerID string, conn *websocket.Conn) {
 		if messageType == websocket.TextMessage {
 			var msg protocol.Message
 			if err := json.Unmarshal(data, &msg); err != nil {
-				log.Printf("[WS] Failed to parse message from runner: %v", err)
+				logger.Warn("Failed to parse message from runner", logging.Err(err))
 				continue
 			}
 
 			// Route control messages to appropriate clients
-			handleRunnerControlMessage(hub, runnerID, msg)
+			handleRunnerControlMessage(hub, runnerID, msg, data, logger)
 		} else if messageType == websocket.BinaryMessage {
 			// Binary messages contain session ID prefix (first 36 bytes for UUID)
 			// Format: [session_id(36 bytes)][pty_data]
 			if len(data) < 36 {
-				log.Printf("[WS] Invalid binary message: too short")
+				logger.Warn("Invalid binary message: too short", "bytes", len(data))
 				continue
 			}
 
 			sessionID := string(data[:36])
 			ptyData := data[36:]
 
+			if hub.DeliverTransferChunk(runnerID, sessionID, ptyData) || hub.ReceiveArtifactChunk(runnerID, sessionID, ptyData) {
+				continue
+			}
+
+			hub.RecordOutput(sessionID, ptyData)
+
 			// Route PTY data to client
 			if err := hub.RouteToClient(sessionID, websocket.BinaryMessage, ptyData); err != nil {
-				log.Printf("[WS] Failed to route PTY data to client: %v", err)
+				logger.Debug("Failed to route PTY data to client", logging.SessionID(sessionID), logging.Err(err))
 			}
 		}
 	}
 }
 
 // handleRunnerControlMessage processes control messages from runners
-func handleRunnerControlMessage(hub *Hub, runnerID string, msg protocol.Message) {
+// Session-scoped messages are recorded and forwarded verbatim to the session's client
+func handleRunnerControlMessage(hub *Hub, runnerID string, msg protocol.Message, data []byte, logger *slog.Logger) {
+	var sessionID string
+
 	switch msg.Type {
 	case protocol.MessageTypeSessionStarted:
-		log.Printf("[WS] Session started on runner %s", runnerID)
-		// Forward to client if needed
+		var payload protocol.SessionStartedPayload
+		if err := protocol.DecodePayload(msg, &payload); err != nil {
+			logger.Warn("Malformed message from runner", "type", msg.Type, logging.Err(err))
+			return
+		}
+		sessionID = payload.SessionID
+		logger.Info("Session started", logging.SessionID(sessionID))
+		hub.sessionStartAnswered(sessionID, nil)
 	case protocol.MessageTypeSessionEnded:
-		log.Printf("[WS] Session ended on runner %s", runnerID)
-		// Forward to client and cleanup
+		var payload protocol.SessionEndedPayload
+		if err := protocol.DecodePayload(msg, &payload); err != nil {
+			logger.Warn("Malformed message from runner", "type", msg.Type, logging.Err(err))
+			return
+		}
+		sessionID = payload.SessionID
+		logger.Info("Session ended", logging.SessionID(sessionID), "exit_code", payload.ExitCode,
+			"artifacts", payload.Artifacts, "reason", payload.Reason, "limits_hit", payload.LimitsHit)
+		hub.SessionEnded(runnerID, payload)
+	case protocol.MessageTypeSessionResult:
+		var payload protocol.SessionResultPayload
+		if err := protocol.DecodePayload(msg, &payload); err != nil {
+			logger.Warn("Malformed message from runner", "type", msg.Type, logging.Err(err))
+			return
+		}
+		sessionID = payload.SessionID
+		logger.Info("Session result", logging.SessionID(sessionID), "commits", len(payload.Commits), "files", len(payload.Files))
+		hub.SessionResult(runnerID, payload)
 	case protocol.MessageTypeError:
-		log.Printf("[WS] Error from runner %s: %+v", runnerID, msg.Payload)
-		// Forward to client
+		var payload protocol.ErrorPayload
+		if err := protocol.DecodePayload(msg, &payload); err != nil {
+			logger.Warn("Malformed message from runner", "type", msg.Type, logging.Err(err))
+			return
+		}
+		sessionID = payload.SessionID
+		logger.Warn("Error from runner", logging.SessionID(sessionID), "code", payload.Code, "message", payload.Message, "transfer_id", payload.TransferID)
+		if payload.TransferID != "" {
+			if !hub.AbortArtifact(runnerID, payload.TransferID) {
+				hub.DeliverTransferControl(runnerID, payload.TransferID, msg)
+			}
+			return
+		}
+		if sessionID != "" {
+			if !hub.RunsSession(runnerID, sessionID) {
+				logger.Warn("Ignoring error for session not running on runner", logging.SessionID(sessionID))
+				return
+			}
+			if payload.Code == protocol.ErrCodeCommandNotAllowed {
+				ev := audit.Event{RunnerID: runnerID, SessionID: sessionID}
+				if rec, err := hub.Store().GetSession(context.Background(), sessionID); err == nil {
+					ev.User = rec.User
+				}
+				hub.recordPolicyDenied(ev, string(protocol.MessageTypeStartSession), payload.Code, payload.Message)
+			}
+			hub.sessionStartAnswered(sessionID, errors.New(payload.Message))
+			hub.SessionFailed(runnerID, sessionID)
+		}
+	case protocol.MessageTypeRunnerDraining:
+		var payload protocol.RunnerDrainingPayload
+		if err := protocol.DecodePayload(msg, &payload); err != nil {
+			logger.Warn("Malformed message from runner", "type", msg.Type, logging.Err(err))
+			return
+		}
+		hub.RunnerDraining(runnerID, payload)
+		return
+	case protocol.MessageTypeApprovalRequest:
+		var payload protocol.ApprovalRequestPayload
+		if err := protocol.DecodePayload(msg, &payload); err != nil {
+			logger.Warn("Malformed message from runner", "type", msg.Type, logging.Err(err))
+			return
+		}
+		// HQ fills in the owner and expiry before notifying reviewers
+		hub.RequestApproval(runnerID, payload)
+		return
+	case protocol.MessageTypeArtifact:
+		var payload protocol.ArtifactPayload
+		if err := protocol.DecodePayload(msg, &payload); err != nil {
+			logger.Warn("Malformed message from runner", "type", msg.Type, logging.Err(err))
+			return
+		}
+		if err := hub.StartArtifact(runnerID, payload); err != nil {
+			logger.Warn("Discarding artifact", logging.SessionID(payload.SessionID), "name", payload.Name, logging.Err(err))
+		}
+		return
+	case protocol.MessageTypeFileEnd:
+		var payload protocol.FileEndPayload
+		if err := protocol.DecodePayload(msg, &payload); err != nil {
+			logger.Warn("Malformed message from runner", "type", msg.Type, logging.Err(err))
+			return
+		}
+		if !hub.FinishArtifact(runnerID, payload) {
+			hub.DeliverTransferControl(runnerID, payload.TransferID, msg)
+		}
+		return
+	case protocol.MessageTypeFileReady, protocol.MessageTypeFileComplete:
+		var payload struct {
+			TransferID string `json:"transfer_id"`
+		}
+		if err := protocol.DecodePayload(msg, &payload); err != nil {
+			logger.Warn("Malformed message from runner", "type", msg.Type, logging.Err(err))
+			return
+		}
+		hub.DeliverTransferControl(runnerID, payload.TransferID, msg)
+		return
 	default:
-		log.Printf("[WS] Unknown message type from runner: %s", msg.Type)
+		logger.Warn("Unknown message type from runner", "type", msg.Type)
+		return
+	}
+
+	if sessionID == "" {
+		return
+	}
+
+	if err := hub.RouteToClient(sessionID, websocket.TextMessage, data); err != nil {
+		logger.Warn("Failed to route message to client", logging.SessionID(sessionID), "type", msg.Type, logging.Err(err))
 	}
 }
 
@@ -146,35 +301,41 @@ func handleRunnerControlMessage(hub *Hub, runnerID string, msg protocol.Message)
 func HandleTerminalConnection(hub *Hub) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		runnerID := c.Param("runner_id")
+		logger := logging.Component(hub.Logger(), "ws").With(
+			logging.ClientID(uuid.NewString()), logging.RunnerID(runnerID), logging.RemoteAddr(c.ClientIP()))
 		if runnerID == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "runner_id required"})
 			return
 		}
 
 		// Check if runner exists
-		_, exists := hub.GetRunner(runnerID)
+		runner, exists := hub.GetRunner(runnerID)
 		if !exists {
 			c.JSON(http.StatusNotFound, gin.H{"error": "runner not found"})
 			return
 		}
+		if runner.Draining() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "runner is draining", "code": protocol.ErrCodeRunnerDraining})
+			return
+		}
 
 		// Upgrade connection
-		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		conn, err := hub.upgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
-			log.Printf("[WS] Failed to upgrade terminal connection: %v", err)
+			logger.Warn("Failed to upgrade terminal connection", logging.Err(err))
 			return
 		}
 
 		// Wait for start_session message to get session ID
 		var msg protocol.Message
 		if err := conn.ReadJSON(&msg); err != nil {
-			log.Printf("[WS] Failed to read start_session message: %v", err)
+			logger.Warn("Failed to read start_session message", logging.Err(err))
 			conn.Close()
 			return
 		}
 
 		if msg.Type != protocol.MessageTypeStartSession {
-			log.Printf("[WS] Expected start_session message, got: %s", msg.Type)
+			logger.Warn("Expected start_session message", "type", msg.Type)
 			conn.Close()
 			return
 		}
@@ -182,60 +343,153 @@ func HandleTerminalConnection(hub *Hub) gin.HandlerFunc {
 		// Parse session payload
 		payloadBytes, err := json.Marshal(msg.Payload)
 		if err != nil {
-			log.Printf("[WS] Failed to marshal payload: %v", err)
+			logger.Warn("Failed to marshal payload", logging.Err(err))
 			conn.Close()
 			return
 		}
 
 		var sessionPayload protocol.StartSessionPayload
 		if err := json.Unmarshal(payloadBytes, &sessionPayload); err != nil {
-			log.Printf("[WS] Failed to parse session payload: %v", err)
+			logger.Warn("Failed to parse session payload", logging.Err(err))
 			conn.Close()
 			return
 		}
 
+		// HQ names sessions whose client leaves the ID out; the runner's session_started reports it
+		if sessionPayload.SessionID == "" {
+			sessionPayload.SessionID = uuid.NewString()
+		}
 		sessionID := sessionPayload.SessionID
-		if sessionID == "" {
-			log.Printf("[WS] Empty session ID")
+		if _, err := uuid.Parse(sessionID); err != nil || len(sessionID) != 36 {
+			// Terminal frames to and from the runner carry the ID in a 36-byte prefix
+			logger.Warn("Session ID is not a UUID", "session_id", sessionID)
 			conn.Close()
 			return
 		}
+		logger = logger.With(logging.SessionID(sessionID))
+
+		// The span lasts until the runner answers with session_started or an error
+		ctx, span := tracer.Start(tracing.Extract(c.Request.Context(), msg.Trace), "hq.start_session",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String(logging.KeySessionID, sessionID),
+				attribute.String(logging.KeyRunnerID, runnerID),
+			))
+
+		user := requestUser(c)
+		hub.Audit().Record(audit.Event{
+			Type:       audit.EventClientAuthenticated,
+			User:       user,
+			RunnerID:   runnerID,
+			SessionID:  sessionID,
+			RemoteAddr: c.ClientIP(),
+			Details:    map[string]interface{}{"method": authMethod(c)},
+		})
+
+		// Only jobs are headless; a client cannot exempt its session from idle reaping
+		sessionPayload.Headless = false
+
+		// Expand the agent profile, if any, before the runner sees the request
+		sessionPayload, err = hub.PrepareSession(runnerID, sessionPayload)
+		if err != nil {
+			logger.Warn("Refusing session", logging.Err(err))
+			tracing.End(span, err)
+			code := profileErrorCode(err)
+			hub.recordPolicyDenied(audit.Event{
+				User:       user,
+				RunnerID:   runnerID,
+				SessionID:  sessionID,
+				RemoteAddr: c.ClientIP(),
+			}, string(protocol.MessageTypeStartSession), code, err.Error())
+			conn.WriteJSON(protocol.Message{
+				Type: protocol.MessageTypeError,
+				Payload: protocol.ErrorPayload{
+					SessionID: sessionID,
+					Message:   err.Error(),
+					Code:      code,
+				},
+			})
+			conn.Close()
+			return
+		}
+		msg.Payload = sessionPayload
+		msg.Trace = tracing.Inject(ctx)
 
 		// Register client in hub
-		if err := hub.RegisterClient(sessionID, runnerID, conn); err != nil {
-			log.Printf("[WS] Failed to register client: %v", err)
+		if err := hub.RegisterClient(sessionID, runnerID, user, hub.quotaKey(c), conn, logger); err != nil {
+			logger.Warn("Failed to register client", logging.Err(err))
+			tracing.End(span, err)
+			var quotaErr *QuotaError
+			if errors.As(err, &quotaErr) {
+				hub.recordPolicyDenied(audit.Event{
+					User:       user,
+					RunnerID:   runnerID,
+					SessionID:  sessionID,
+					RemoteAddr: c.ClientIP(),
+				}, string(protocol.MessageTypeStartSession), quotaErr.Code, quotaErr.Message)
+				conn.WriteMessage(websocket.TextMessage, quotaFrame(sessionID, quotaErr))
+			}
 			conn.Close()
 			return
 		}
-
-		log.Printf("[WS] Client connected: session=%s runner=%s", sessionID, runnerID)
-
-		// Forward start_session message to runner with original data
+		hub.awaitSessionStart(sessionID, span)
+		hub.Audit().Record(audit.Event{
+			Type:       audit.EventControlTaken,
+			User:       user,
+			RunnerID:   runnerID,
+			SessionID:  sessionID,
+			RemoteAddr: c.ClientIP(),
+		})
+
+		logger.Info("Client connected")
+
+		hub.RecordSessionStart(store.SessionRecord{
+			ID:         sessionID,
+			RunnerID:   runnerID,
+			User:       user,
+			RemoteAddr: c.ClientIP(),
+			Command:    sessionPayload.Command,
+			Cwd:        sessionPayload.Cwd,
+			Profile:    sessionPayload.Profile,
+		}, sessionPayload.Record)
+
+		// Forward the expanded start_session message to the runner
 		msgBytes, _ := json.Marshal(msg)
 		if err := hub.RouteToRunner(sessionID, websocket.TextMessage, msgBytes); err != nil {
-			log.Printf("[WS] Failed to route start_session to runner: %v", err)
+			logger.Error("Failed to route start_session to runner", logging.Err(err))
+			hub.sessionStartAnswered(sessionID, err)
+			hub.UnregisterClient(sessionID)
+			hub.SessionFailed(runnerID, sessionID)
 			conn.Close()
 			return
 		}
 
 		// Start client message loop
-		clientMessageLoop(hub, sessionID, conn)
+		clientMessageLoop(hub, sessionID, requestDecider(c), conn, logger)
 	}
 }
 
-// clientMessageLoop handles messages from a browser client
-func clientMessageLoop(hub *Hub, sessionID string, conn *websocket.Conn) {
+// clientMessageLoop handles messages from a browser client; user is who connected it, and from where
+func clientMessageLoop(hub *Hub, sessionID string, user Decider, conn *websocket.Conn, logger *slog.Logger) {
 	defer func() {
 		hub.UnregisterClient(sessionID)
 		conn.Close()
-		log.Printf("[WS] Client disconnected: session=%s", sessionID)
+		logger.Info("Client disconnected")
 	}()
 
+	limits := hub.newConnLimits()
+	refuse := func(quotaErr *QuotaError) {
+		hub.metrics.quotaExceeded(quotaErr.Code)
+		logger.Warn("Client exceeded a quota", "code", quotaErr.Code, logging.Err(quotaErr))
+		hub.recordPolicyDenied(audit.Event{User: user.User, SessionID: sessionID}, "message", quotaErr.Code, quotaErr.Message)
+		hub.RouteToClient(sessionID, websocket.TextMessage, quotaFrame(sessionID, quotaErr))
+	}
+
 	for {
-		messageType, data, err := conn.ReadMessage()
+		messageType, data, err := limits.readMessage(conn, refuse)
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("[WS] Client read error: %v", err)
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure, websocket.CloseServiceRestart) {
+				logger.Warn("Client read error", logging.Err(err))
 			}
 			break
 		}
@@ -249,14 +503,51 @@ func clientMessageLoop(hub *Hub, sessionID string, conn *websocket.Conn) {
 
 			fullData := append(paddedSession, data...)
 
+			hub.RecordInput(sessionID, data)
+
 			if err := hub.RouteToRunner(sessionID, websocket.BinaryMessage, fullData); err != nil {
-				log.Printf("[WS] Failed to route input to runner: %v", err)
+				logger.Debug("Failed to route input to runner", logging.Err(err))
 			}
 		} else if messageType == websocket.TextMessage {
-			// Text messages are control messages (resize, etc.)
-			if err := hub.RouteToRunner(sessionID, websocket.TextMessage, data); err != nil {
-				log.Printf("[WS] Failed to route control message to runner: %v", err)
-			}
+			handleClientControlMessage(hub, sessionID, user, data, logger)
 		}
 	}
 }
+
+// handleClientControlMessage applies a control message from a terminal client
+// Clients may only resize their session or decide its approvals; anything else, such as
+// start_session, drain or file_upload, would let them bypass HQ's checks, so it is dropped
+func handleClientControlMessage(hub *Hub, sessionID string, user Decider, data []byte, logger *slog.Logger) {
+	var msg protocol.Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		logger.Warn("Failed to parse message from client", logging.Err(err))
+		return
+	}
+
+	switch msg.Type {
+	case protocol.MessageTypeApprovalDecision:
+		// Decisions stay at HQ, which forwards them to the runner
+		if err := decideFromMessage(hub, msg, sessionID, user); err != nil {
+			reply, _ := json.Marshal(approvalError(err))
+			hub.RouteToClient(sessionID, websocket.TextMessage, reply)
+		}
+	case protocol.MessageTypeResize:
+		var payload protocol.ResizePayload
+		if err := protocol.DecodePayload(msg, &payload); err != nil {
+			logger.Warn("Malformed message from client", "type", msg.Type, logging.Err(err))
+			return
+		}
+		hub.RecordResize(sessionID, payload.Cols, payload.Rows)
+
+		// The session ID is the connection's, whatever the client put in the payload
+		forward, _ := json.Marshal(protocol.Message{
+			Type:    protocol.MessageTypeResize,
+			Payload: resizePayload(sessionID, payload.Cols, payload.Rows),
+		})
+		if err := hub.RouteToRunner(sessionID, websocket.TextMessage, forward); err != nil {
+			logger.Warn("Failed to route control message to runner", logging.Err(err))
+		}
+	default:
+		logger.Warn("Dropping control message clients may not send", "type", msg.Type)
+	}
+}
@@ -0,0 +1,379 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/protocol"
+)
+
+// MemoryStore is a Store kept entirely in process memory
+// Intended for tests and ephemeral deployments; nothing survives a restart
+type MemoryStore struct {
+	runners   map[string]RunnerRecord
+	sessions  map[string]SessionRecord
+	jobs      map[string]JobRecord
+	artifacts map[string]map[string]ArtifactRecord // session_id -> name -> artifact
+	results   map[string]protocol.SessionResult
+	approvals map[string]ApprovalRecord
+	mu        sync.RWMutex
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		runners:   make(map[string]RunnerRecord),
+		sessions:  make(map[string]SessionRecord),
+		jobs:      make(map[string]JobRecord),
+		artifacts: make(map[string]map[string]ArtifactRecord),
+		results:   make(map[string]protocol.SessionResult),
+		approvals: make(map[string]ApprovalRecord),
+	}
+}
+
+// UpsertRunner records a runner registration, preserving FirstSeen
+func (m *MemoryStore) UpsertRunner(ctx context.Context, r RunnerRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, exists := m.runners[r.ID]; exists {
+		r.FirstSeen = existing.FirstSeen
+	}
+	m.runners[r.ID] = r
+	return nil
+}
+
+// MarkRunnerDisconnected records the time a runner went away
+func (m *MemoryStore) MarkRunnerDisconnected(ctx context.Context, id string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r, exists := m.runners[id]
+	if !exists {
+		return ErrNotFound
+	}
+	r.DisconnectedAt = &at
+	m.runners[id] = r
+	return nil
+}
+
+// GetRunner returns a runner record by ID
+func (m *MemoryStore) GetRunner(ctx context.Context, id string) (RunnerRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r, exists := m.runners[id]
+	if !exists {
+		return RunnerRecord{}, ErrNotFound
+	}
+	return r, nil
+}
+
+// ListRunners returns all runner records ordered by ID
+func (m *MemoryStore) ListRunners(ctx context.Context) ([]RunnerRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	runners := make([]RunnerRecord, 0, len(m.runners))
+	for _, r := range m.runners {
+		runners = append(runners, r)
+	}
+	sort.Slice(runners, func(i, j int) bool { return runners[i].ID < runners[j].ID })
+	return runners, nil
+}
+
+// CreateSession stores a new session record
+func (m *MemoryStore) CreateSession(ctx context.Context, s SessionRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions[s.ID] = s
+	return nil
+}
+
+// EndSession marks a running session as finished
+func (m *MemoryStore) EndSession(ctx context.Context, id string, end SessionEnd) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, exists := m.sessions[id]
+	if !exists {
+		return ErrNotFound
+	}
+	if s.Status != SessionStatusRunning {
+		return nil
+	}
+	s.Status = end.Status
+	s.ExitCode = end.ExitCode
+	s.EndedAt = &end.EndedAt
+	s.Reason = end.Reason
+	s.LimitsHit = end.LimitsHit
+	s.Redactions = end.Redactions
+	m.sessions[id] = s
+	return nil
+}
+
+// GetSession returns a session record by ID
+func (m *MemoryStore) GetSession(ctx context.Context, id string) (SessionRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s, exists := m.sessions[id]
+	if !exists {
+		return SessionRecord{}, ErrNotFound
+	}
+	return s, nil
+}
+
+// ListSessions returns matching sessions, most recent first
+func (m *MemoryStore) ListSessions(ctx context.Context, filter SessionFilter) ([]SessionRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessions := make([]SessionRecord, 0)
+	for _, s := range m.sessions {
+		if filter.RunnerID != "" && s.RunnerID != filter.RunnerID {
+			continue
+		}
+		if filter.User != "" && s.User != filter.User {
+			continue
+		}
+		if filter.Status != "" && s.Status != filter.Status {
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].StartedAt.After(sessions[j].StartedAt) })
+
+	if filter.Limit > 0 && len(sessions) > filter.Limit {
+		sessions = sessions[:filter.Limit]
+	}
+	return sessions, nil
+}
+
+// CreateJob stores a new job record
+func (m *MemoryStore) CreateJob(ctx context.Context, j JobRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.jobs[j.ID] = j
+	return nil
+}
+
+// UpdateJob replaces an existing job record
+func (m *MemoryStore) UpdateJob(ctx context.Context, j JobRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.jobs[j.ID]; !exists {
+		return ErrNotFound
+	}
+	m.jobs[j.ID] = j
+	return nil
+}
+
+// GetJob returns a job record by ID
+func (m *MemoryStore) GetJob(ctx context.Context, id string) (JobRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	j, exists := m.jobs[id]
+	if !exists {
+		return JobRecord{}, ErrNotFound
+	}
+	return j, nil
+}
+
+// ListJobs returns matching jobs, oldest first
+func (m *MemoryStore) ListJobs(ctx context.Context, filter JobFilter) ([]JobRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	jobs := make([]JobRecord, 0)
+	for _, j := range m.jobs {
+		if filter.RunnerID != "" && j.RunnerID != filter.RunnerID {
+			continue
+		}
+		if filter.Status != "" && j.Status != filter.Status {
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+
+	if filter.Limit > 0 && len(jobs) > filter.Limit {
+		jobs = jobs[:filter.Limit]
+	}
+	return jobs, nil
+}
+
+// PutArtifact records an artifact, replacing one with the same session and name
+func (m *MemoryStore) PutArtifact(ctx context.Context, a ArtifactRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.artifacts[a.SessionID] == nil {
+		m.artifacts[a.SessionID] = make(map[string]ArtifactRecord)
+	}
+	m.artifacts[a.SessionID][a.Name] = a
+	return nil
+}
+
+// GetArtifact returns an artifact record
+func (m *MemoryStore) GetArtifact(ctx context.Context, sessionID, name string) (ArtifactRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	a, exists := m.artifacts[sessionID][name]
+	if !exists {
+		return ArtifactRecord{}, ErrNotFound
+	}
+	return a, nil
+}
+
+// ListArtifacts returns a session's artifacts ordered by name
+func (m *MemoryStore) ListArtifacts(ctx context.Context, sessionID string) ([]ArtifactRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	artifacts := make([]ArtifactRecord, 0, len(m.artifacts[sessionID]))
+	for _, a := range m.artifacts[sessionID] {
+		artifacts = append(artifacts, a)
+	}
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].Name < artifacts[j].Name })
+	return artifacts, nil
+}
+
+// PutSessionResult records the changes a workspace session made
+func (m *MemoryStore) PutSessionResult(ctx context.Context, sessionID string, r protocol.SessionResult) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.results[sessionID] = r
+	return nil
+}
+
+// GetSessionResult returns the changes a workspace session made
+func (m *MemoryStore) GetSessionResult(ctx context.Context, sessionID string) (protocol.SessionResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	r, exists := m.results[sessionID]
+	if !exists {
+		return protocol.SessionResult{}, ErrNotFound
+	}
+	return r, nil
+}
+
+// CreateApproval stores a new approval request
+func (m *MemoryStore) CreateApproval(ctx context.Context, a ApprovalRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.approvals[a.ID] = a
+	return nil
+}
+
+// DecideApproval resolves a pending approval
+func (m *MemoryStore) DecideApproval(ctx context.Context, id string, d ApprovalDecision) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, exists := m.approvals[id]
+	if !exists {
+		return ErrNotFound
+	}
+	if a.Status != ApprovalStatusPending {
+		return ErrNotPending
+	}
+	a.Status = d.Status
+	a.DecidedAt = &d.DecidedAt
+	a.DecidedBy = d.DecidedBy
+	a.Reason = d.Reason
+	m.approvals[id] = a
+	return nil
+}
+
+// GetApproval returns an approval record by ID
+func (m *MemoryStore) GetApproval(ctx context.Context, id string) (ApprovalRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	a, exists := m.approvals[id]
+	if !exists {
+		return ApprovalRecord{}, ErrNotFound
+	}
+	return a, nil
+}
+
+// ListApprovals returns matching approvals, most recent first
+func (m *MemoryStore) ListApprovals(ctx context.Context, filter ApprovalFilter) ([]ApprovalRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	approvals := make([]ApprovalRecord, 0)
+	for _, a := range m.approvals {
+		if filter.SessionID != "" && a.SessionID != filter.SessionID {
+			continue
+		}
+		if filter.Status != "" && a.Status != filter.Status {
+			continue
+		}
+		approvals = append(approvals, a)
+	}
+	sort.Slice(approvals, func(i, j int) bool { return approvals[i].RequestedAt.After(approvals[j].RequestedAt) })
+
+	if filter.Limit > 0 && len(approvals) > filter.Limit {
+		approvals = approvals[:filter.Limit]
+	}
+	return approvals, nil
+}
+
+// Prune deletes finished records older than the retention policy allows
+func (m *MemoryStore) Prune(ctx context.Context, policy RetentionPolicy, now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	removed := 0
+
+	if before, ok := cutoff(now, policy.Sessions); ok {
+		for id, s := range m.sessions {
+			if s.EndedAt != nil && s.EndedAt.Before(before) {
+				delete(m.sessions, id)
+				removed += 1 + len(m.artifacts[id])
+				delete(m.artifacts, id)
+				if _, exists := m.results[id]; exists {
+					delete(m.results, id)
+					removed++
+				}
+			}
+		}
+	}
+
+	if before, ok := cutoff(now, policy.Jobs); ok {
+		for id, j := range m.jobs {
+			if j.FinishedAt != nil && j.FinishedAt.Before(before) {
+				delete(m.jobs, id)
+				removed++
+			}
+		}
+	}
+
+	if before, ok := cutoff(now, policy.Runners); ok {
+		for id, r := range m.runners {
+			if r.DisconnectedAt != nil && r.DisconnectedAt.Before(before) {
+				delete(m.runners, id)
+				removed++
+			}
+		}
+	}
+
+	return removed, nil
+}
+
+// Close is a no-op for the in-memory store
+func (m *MemoryStore) Close() error {
+	return nil
+}
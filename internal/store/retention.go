@@ -0,0 +1,36 @@
+package store
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+)
+
+// StartPruner periodically applies the retention policy until ctx is cancelled
+func StartPruner(ctx context.Context, s Store, policy RetentionPolicy, interval time.Duration) {
+	if policy.Sessions <= 0 && policy.Jobs <= 0 && policy.Runners <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			removed, err := s.Prune(ctx, policy, time.Now())
+			if err != nil {
+				slog.Error("Prune failed", logging.KeyComponent, "store", logging.Err(err))
+			} else if removed > 0 {
+				slog.Info("Pruned expired records", logging.KeyComponent, "store", "records", removed)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,820 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+	"github.com/codervisor/agent-relay/internal/protocol"
+	_ "modernc.org/sqlite" // Pure-Go SQLite driver, registers "sqlite"
+)
+
+// migrations are applied in order; each entry's index+1 is its schema version
+// Never edit an applied migration, append a new one instead
+var migrations = []string{
+	// 1: initial schema
+	`CREATE TABLE runners (
+		id              TEXT PRIMARY KEY,
+		remote_addr     TEXT NOT NULL DEFAULT '',
+		first_seen      INTEGER NOT NULL,
+		last_connected  INTEGER NOT NULL,
+		disconnected_at INTEGER
+	);
+	CREATE TABLE sessions (
+		id          TEXT PRIMARY KEY,
+		runner_id   TEXT NOT NULL,
+		user        TEXT NOT NULL DEFAULT '',
+		remote_addr TEXT NOT NULL DEFAULT '',
+		command     TEXT NOT NULL DEFAULT '[]',
+		cwd         TEXT NOT NULL DEFAULT '',
+		job_id      TEXT NOT NULL DEFAULT '',
+		status      TEXT NOT NULL,
+		started_at  INTEGER NOT NULL,
+		ended_at    INTEGER,
+		exit_code   INTEGER
+	);
+	CREATE INDEX idx_sessions_runner ON sessions(runner_id);
+	CREATE INDEX idx_sessions_started ON sessions(started_at);
+	CREATE TABLE jobs (
+		id          TEXT PRIMARY KEY,
+		runner_id   TEXT NOT NULL,
+		user        TEXT NOT NULL DEFAULT '',
+		command     TEXT NOT NULL DEFAULT '[]',
+		cwd         TEXT NOT NULL DEFAULT '',
+		status      TEXT NOT NULL,
+		created_at  INTEGER NOT NULL,
+		started_at  INTEGER,
+		finished_at INTEGER,
+		exit_code   INTEGER
+	);
+	CREATE INDEX idx_jobs_status ON jobs(status, created_at);`,
+
+	// 2: session recordings
+	`ALTER TABLE sessions ADD COLUMN recorded INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE jobs ADD COLUMN record INTEGER NOT NULL DEFAULT 0;`,
+
+	// 3: redaction counters
+	`ALTER TABLE sessions ADD COLUMN redactions INTEGER NOT NULL DEFAULT 0;`,
+
+	// 4: artifacts
+	`ALTER TABLE jobs ADD COLUMN artifacts TEXT NOT NULL DEFAULT '[]';
+	CREATE TABLE artifacts (
+		session_id TEXT NOT NULL,
+		name       TEXT NOT NULL,
+		size       INTEGER NOT NULL,
+		sha256     TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (session_id, name)
+	);`,
+
+	// 5: git workspaces
+	`ALTER TABLE jobs ADD COLUMN workspace TEXT NOT NULL DEFAULT 'null';`,
+
+	// 6: workspace session results
+	`CREATE TABLE session_results (
+		session_id TEXT PRIMARY KEY,
+		result     TEXT NOT NULL
+	);`,
+
+	// 7: agent profiles, runner labels and session timeouts
+	`ALTER TABLE runners ADD COLUMN labels TEXT NOT NULL DEFAULT 'null';
+	ALTER TABLE sessions ADD COLUMN profile TEXT NOT NULL DEFAULT '';
+	ALTER TABLE sessions ADD COLUMN reason TEXT NOT NULL DEFAULT '';
+	ALTER TABLE jobs ADD COLUMN profile TEXT NOT NULL DEFAULT '';
+	ALTER TABLE jobs ADD COLUMN env TEXT NOT NULL DEFAULT 'null';
+	ALTER TABLE jobs ADD COLUMN limits TEXT NOT NULL DEFAULT 'null';
+	ALTER TABLE jobs ADD COLUMN timeout INTEGER NOT NULL DEFAULT 0;`,
+
+	// 8: resource limits sessions ran into
+	`ALTER TABLE sessions ADD COLUMN limits_hit TEXT NOT NULL DEFAULT 'null';`,
+
+	// 9: approval gates
+	`CREATE TABLE approvals (
+		id           TEXT PRIMARY KEY,
+		session_id   TEXT NOT NULL,
+		runner_id    TEXT NOT NULL,
+		user         TEXT NOT NULL DEFAULT '',
+		action       TEXT NOT NULL,
+		details      TEXT NOT NULL DEFAULT '',
+		status       TEXT NOT NULL,
+		requested_at INTEGER NOT NULL,
+		expires_at   INTEGER NOT NULL,
+		decided_at   INTEGER,
+		decided_by   TEXT NOT NULL DEFAULT '',
+		reason       TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX idx_approvals_session ON approvals(session_id);
+	CREATE INDEX idx_approvals_status ON approvals(status, requested_at);`,
+
+	// 10: whom jobs count against for quotas
+	`ALTER TABLE jobs ADD COLUMN quota_key TEXT NOT NULL DEFAULT '';
+	UPDATE jobs SET quota_key = user;`,
+}
+
+// SQLiteStore is a Store backed by an embedded SQLite database file
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens (or creates) the database at path and applies pending migrations
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	// SQLite allows a single writer; serialize through one connection
+	db.SetMaxOpenConns(1)
+
+	s := &SQLiteStore{db: db}
+	if err := s.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// migrate applies every migration newer than the recorded schema version
+func (s *SQLiteStore) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %w", version, err)
+		}
+
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply migration %d: %w", version, err)
+		}
+
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`,
+			version, time.Now().UnixNano()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %d: %w", version, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", version, err)
+		}
+
+		slog.Info("Applied migration", logging.KeyComponent, "store", "version", version)
+	}
+
+	return nil
+}
+
+// UpsertRunner records a runner registration, preserving FirstSeen
+func (s *SQLiteStore) UpsertRunner(ctx context.Context, r RunnerRecord) error {
+	labels, err := json.Marshal(r.Labels)
+	if err != nil {
+		return fmt.Errorf("failed to encode labels: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO runners (id, remote_addr, labels, first_seen, last_connected, disconnected_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			remote_addr = excluded.remote_addr,
+			labels = excluded.labels,
+			last_connected = excluded.last_connected,
+			disconnected_at = excluded.disconnected_at`,
+		r.ID, r.RemoteAddr, string(labels), toUnix(r.FirstSeen), toUnix(r.LastConnected), toNullUnix(r.DisconnectedAt))
+	if err != nil {
+		return fmt.Errorf("failed to upsert runner %s: %w", r.ID, err)
+	}
+	return nil
+}
+
+// MarkRunnerDisconnected records the time a runner went away
+func (s *SQLiteStore) MarkRunnerDisconnected(ctx context.Context, id string, at time.Time) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE runners SET disconnected_at = ? WHERE id = ?`, toUnix(at), id)
+	if err != nil {
+		return fmt.Errorf("failed to update runner %s: %w", id, err)
+	}
+	return requireAffected(res)
+}
+
+// GetRunner returns a runner record by ID
+func (s *SQLiteStore) GetRunner(ctx context.Context, id string) (RunnerRecord, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT id, remote_addr, labels, first_seen, last_connected, disconnected_at
+		FROM runners WHERE id = ?`, id)
+	return scanRunner(row)
+}
+
+// ListRunners returns all runner records ordered by ID
+func (s *SQLiteStore) ListRunners(ctx context.Context) ([]RunnerRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, remote_addr, labels, first_seen, last_connected, disconnected_at
+		FROM runners ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list runners: %w", err)
+	}
+	defer rows.Close()
+
+	runners := make([]RunnerRecord, 0)
+	for rows.Next() {
+		r, err := scanRunner(rows)
+		if err != nil {
+			return nil, err
+		}
+		runners = append(runners, r)
+	}
+	return runners, rows.Err()
+}
+
+// CreateSession stores a new session record
+func (s *SQLiteStore) CreateSession(ctx context.Context, rec SessionRecord) error {
+	command, err := json.Marshal(rec.Command)
+	if err != nil {
+		return fmt.Errorf("failed to encode command: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO sessions (id, runner_id, user, remote_addr, command, cwd, job_id, profile, recorded, status, started_at, ended_at, exit_code)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.ID, rec.RunnerID, rec.User, rec.RemoteAddr, string(command), rec.Cwd, rec.JobID, rec.Profile, rec.Recorded,
+		string(rec.Status), toUnix(rec.StartedAt), toNullUnix(rec.EndedAt), toNullInt(rec.ExitCode))
+	if err != nil {
+		return fmt.Errorf("failed to create session %s: %w", rec.ID, err)
+	}
+	return nil
+}
+
+// EndSession marks a running session as finished
+func (s *SQLiteStore) EndSession(ctx context.Context, id string, end SessionEnd) error {
+	limitsHit, err := json.Marshal(end.LimitsHit)
+	if err != nil {
+		return fmt.Errorf("failed to encode limits hit: %w", err)
+	}
+
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE sessions SET status = ?, exit_code = ?, ended_at = ?, reason = ?, limits_hit = ?, redactions = ?
+		WHERE id = ? AND status = ?`,
+		string(end.Status), toNullInt(end.ExitCode), toUnix(end.EndedAt), end.Reason, string(limitsHit), end.Redactions,
+		id, string(SessionStatusRunning))
+	if err != nil {
+		return fmt.Errorf("failed to end session %s: %w", id, err)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Either unknown or already ended; only the former is an error
+		if _, err := s.GetSession(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetSession returns a session record by ID
+func (s *SQLiteStore) GetSession(ctx context.Context, id string) (SessionRecord, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id)
+	return scanSession(row)
+}
+
+// ListSessions returns matching sessions, most recent first
+func (s *SQLiteStore) ListSessions(ctx context.Context, filter SessionFilter) ([]SessionRecord, error) {
+	var where []string
+	var args []interface{}
+
+	if filter.RunnerID != "" {
+		where = append(where, "runner_id = ?")
+		args = append(args, filter.RunnerID)
+	}
+	if filter.User != "" {
+		where = append(where, "user = ?")
+		args = append(args, filter.User)
+	}
+	if filter.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, string(filter.Status))
+	}
+
+	query := `SELECT ` + sessionColumns + ` FROM sessions` + whereClause(where) + ` ORDER BY started_at DESC`
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	defer rows.Close()
+
+	sessions := make([]SessionRecord, 0)
+	for rows.Next() {
+		rec, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, rec)
+	}
+	return sessions, rows.Err()
+}
+
+// CreateJob stores a new job record
+func (s *SQLiteStore) CreateJob(ctx context.Context, j JobRecord) error {
+	command, err := json.Marshal(j.Command)
+	if err != nil {
+		return fmt.Errorf("failed to encode command: %w", err)
+	}
+	artifacts, err := json.Marshal(j.Artifacts)
+	if err != nil {
+		return fmt.Errorf("failed to encode artifact patterns: %w", err)
+	}
+	workspace, err := json.Marshal(j.Workspace)
+	if err != nil {
+		return fmt.Errorf("failed to encode workspace: %w", err)
+	}
+	env, err := json.Marshal(j.Env)
+	if err != nil {
+		return fmt.Errorf("failed to encode env: %w", err)
+	}
+	limits, err := json.Marshal(j.Limits)
+	if err != nil {
+		return fmt.Errorf("failed to encode limits: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO jobs (id, runner_id, user, quota_key, command, cwd, record, artifacts, workspace, profile, env, limits,
+			timeout, status, created_at, started_at, finished_at, exit_code)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		j.ID, j.RunnerID, j.User, j.QuotaKey, string(command), j.Cwd, j.Record, string(artifacts), string(workspace),
+		j.Profile, string(env), string(limits), j.Timeout, string(j.Status),
+		toUnix(j.CreatedAt), toNullUnix(j.StartedAt), toNullUnix(j.FinishedAt), toNullInt(j.ExitCode))
+	if err != nil {
+		return fmt.Errorf("failed to create job %s: %w", j.ID, err)
+	}
+	return nil
+}
+
+// UpdateJob replaces the mutable fields of an existing job record
+func (s *SQLiteStore) UpdateJob(ctx context.Context, j JobRecord) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE jobs SET status = ?, started_at = ?, finished_at = ?, exit_code = ?
+		WHERE id = ?`,
+		string(j.Status), toNullUnix(j.StartedAt), toNullUnix(j.FinishedAt), toNullInt(j.ExitCode), j.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update job %s: %w", j.ID, err)
+	}
+	return requireAffected(res)
+}
+
+// GetJob returns a job record by ID
+func (s *SQLiteStore) GetJob(ctx context.Context, id string) (JobRecord, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+jobColumns+` FROM jobs WHERE id = ?`, id)
+	return scanJob(row)
+}
+
+// ListJobs returns matching jobs, oldest first
+func (s *SQLiteStore) ListJobs(ctx context.Context, filter JobFilter) ([]JobRecord, error) {
+	var where []string
+	var args []interface{}
+
+	if filter.RunnerID != "" {
+		where = append(where, "runner_id = ?")
+		args = append(args, filter.RunnerID)
+	}
+	if filter.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, string(filter.Status))
+	}
+
+	query := `SELECT ` + jobColumns + ` FROM jobs` + whereClause(where) + ` ORDER BY created_at ASC`
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+	defer rows.Close()
+
+	jobs := make([]JobRecord, 0)
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// PutArtifact records an artifact, replacing one with the same session and name
+func (s *SQLiteStore) PutArtifact(ctx context.Context, a ArtifactRecord) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO artifacts (session_id, name, size, sha256, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(session_id, name) DO UPDATE SET
+			size = excluded.size,
+			sha256 = excluded.sha256,
+			created_at = excluded.created_at`,
+		a.SessionID, a.Name, a.Size, a.SHA256, toUnix(a.CreatedAt))
+	if err != nil {
+		return fmt.Errorf("failed to record artifact %s for session %s: %w", a.Name, a.SessionID, err)
+	}
+	return nil
+}
+
+// GetArtifact returns an artifact record
+func (s *SQLiteStore) GetArtifact(ctx context.Context, sessionID, name string) (ArtifactRecord, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+artifactColumns+` FROM artifacts WHERE session_id = ? AND name = ?`,
+		sessionID, name)
+	return scanArtifact(row)
+}
+
+// ListArtifacts returns a session's artifacts ordered by name
+func (s *SQLiteStore) ListArtifacts(ctx context.Context, sessionID string) ([]ArtifactRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+artifactColumns+` FROM artifacts WHERE session_id = ? ORDER BY name`,
+		sessionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list artifacts: %w", err)
+	}
+	defer rows.Close()
+
+	artifacts := make([]ArtifactRecord, 0)
+	for rows.Next() {
+		a, err := scanArtifact(rows)
+		if err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, a)
+	}
+	return artifacts, rows.Err()
+}
+
+// PutSessionResult records the changes a workspace session made
+func (s *SQLiteStore) PutSessionResult(ctx context.Context, sessionID string, r protocol.SessionResult) error {
+	result, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to encode result: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO session_results (session_id, result) VALUES (?, ?)
+		ON CONFLICT(session_id) DO UPDATE SET result = excluded.result`,
+		sessionID, string(result))
+	if err != nil {
+		return fmt.Errorf("failed to record result for session %s: %w", sessionID, err)
+	}
+	return nil
+}
+
+// GetSessionResult returns the changes a workspace session made
+func (s *SQLiteStore) GetSessionResult(ctx context.Context, sessionID string) (protocol.SessionResult, error) {
+	var result string
+	err := s.db.QueryRowContext(ctx, `SELECT result FROM session_results WHERE session_id = ?`, sessionID).Scan(&result)
+	if errors.Is(err, sql.ErrNoRows) {
+		return protocol.SessionResult{}, ErrNotFound
+	}
+	if err != nil {
+		return protocol.SessionResult{}, fmt.Errorf("failed to get result for session %s: %w", sessionID, err)
+	}
+
+	var r protocol.SessionResult
+	if err := json.Unmarshal([]byte(result), &r); err != nil {
+		return protocol.SessionResult{}, fmt.Errorf("failed to decode result for session %s: %w", sessionID, err)
+	}
+	return r, nil
+}
+
+// CreateApproval stores a new approval request
+func (s *SQLiteStore) CreateApproval(ctx context.Context, a ApprovalRecord) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO approvals (`+approvalColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.ID, a.SessionID, a.RunnerID, a.User, a.Action, a.Details, string(a.Status),
+		toUnix(a.RequestedAt), toUnix(a.ExpiresAt), toNullUnix(a.DecidedAt), a.DecidedBy, a.Reason)
+	if err != nil {
+		return fmt.Errorf("failed to create approval %s: %w", a.ID, err)
+	}
+	return nil
+}
+
+// DecideApproval resolves a pending approval
+func (s *SQLiteStore) DecideApproval(ctx context.Context, id string, d ApprovalDecision) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE approvals SET status = ?, decided_at = ?, decided_by = ?, reason = ?
+		WHERE id = ? AND status = ?`,
+		string(d.Status), toUnix(d.DecidedAt), d.DecidedBy, d.Reason,
+		id, string(ApprovalStatusPending))
+	if err != nil {
+		return fmt.Errorf("failed to decide approval %s: %w", id, err)
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Either unknown or already resolved
+		if _, err := s.GetApproval(ctx, id); err != nil {
+			return err
+		}
+		return ErrNotPending
+	}
+	return nil
+}
+
+// GetApproval returns an approval record by ID
+func (s *SQLiteStore) GetApproval(ctx context.Context, id string) (ApprovalRecord, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+approvalColumns+` FROM approvals WHERE id = ?`, id)
+	return scanApproval(row)
+}
+
+// ListApprovals returns matching approvals, most recent first
+func (s *SQLiteStore) ListApprovals(ctx context.Context, filter ApprovalFilter) ([]ApprovalRecord, error) {
+	var where []string
+	var args []interface{}
+
+	if filter.SessionID != "" {
+		where = append(where, "session_id = ?")
+		args = append(args, filter.SessionID)
+	}
+	if filter.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, string(filter.Status))
+	}
+
+	query := `SELECT ` + approvalColumns + ` FROM approvals` + whereClause(where) + ` ORDER BY requested_at DESC`
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list approvals: %w", err)
+	}
+	defer rows.Close()
+
+	approvals := make([]ApprovalRecord, 0)
+	for rows.Next() {
+		a, err := scanApproval(rows)
+		if err != nil {
+			return nil, err
+		}
+		approvals = append(approvals, a)
+	}
+	return approvals, rows.Err()
+}
+
+// Prune deletes finished records older than the retention policy allows
+func (s *SQLiteStore) Prune(ctx context.Context, policy RetentionPolicy, now time.Time) (int, error) {
+	deletes := []struct {
+		retention time.Duration
+		query     string
+	}{
+		{policy.Sessions, `DELETE FROM sessions WHERE ended_at IS NOT NULL AND ended_at < ?`},
+		{policy.Jobs, `DELETE FROM jobs WHERE finished_at IS NOT NULL AND finished_at < ?`},
+		{policy.Runners, `DELETE FROM runners WHERE disconnected_at IS NOT NULL AND disconnected_at < ?`},
+	}
+
+	removed := 0
+	for _, d := range deletes {
+		before, ok := cutoff(now, d.retention)
+		if !ok {
+			continue
+		}
+
+		res, err := s.db.ExecContext(ctx, d.query, toUnix(before))
+		if err != nil {
+			return removed, fmt.Errorf("failed to prune: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		removed += int(n)
+	}
+
+	// Artifacts, results and approvals are only reachable through their session
+	for _, table := range []string{"artifacts", "session_results", "approvals"} {
+		res, err := s.db.ExecContext(ctx, `DELETE FROM `+table+` WHERE session_id NOT IN (SELECT id FROM sessions)`)
+		if err != nil {
+			return removed, fmt.Errorf("failed to prune %s: %w", table, err)
+		}
+		n, _ := res.RowsAffected()
+		removed += int(n)
+	}
+
+	return removed, nil
+}
+
+// Close closes the underlying database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+const sessionColumns = `id, runner_id, user, remote_addr, command, cwd, job_id, profile, recorded, status, started_at, ended_at, exit_code, reason, limits_hit, redactions`
+
+const jobColumns = `id, runner_id, user, quota_key, command, cwd, record, artifacts, workspace, profile, env, limits,
+	timeout, status, created_at, started_at, finished_at, exit_code`
+
+const artifactColumns = `session_id, name, size, sha256, created_at`
+
+const approvalColumns = `id, session_id, runner_id, user, action, details, status, requested_at, expires_at,
+	decided_at, decided_by, reason`
+
+// scanner is satisfied by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRunner(row scanner) (RunnerRecord, error) {
+	var r RunnerRecord
+	var labels string
+	var firstSeen, lastConnected int64
+	var disconnectedAt sql.NullInt64
+
+	if err := row.Scan(&r.ID, &r.RemoteAddr, &labels, &firstSeen, &lastConnected, &disconnectedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return RunnerRecord{}, ErrNotFound
+		}
+		return RunnerRecord{}, fmt.Errorf("failed to scan runner: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(labels), &r.Labels); err != nil {
+		return RunnerRecord{}, fmt.Errorf("failed to decode labels for runner %s: %w", r.ID, err)
+	}
+
+	r.FirstSeen = fromUnix(firstSeen)
+	r.LastConnected = fromUnix(lastConnected)
+	r.DisconnectedAt = fromNullUnix(disconnectedAt)
+	return r, nil
+}
+
+func scanSession(row scanner) (SessionRecord, error) {
+	var rec SessionRecord
+	var command, limitsHit, status string
+	var startedAt int64
+	var endedAt, exitCode sql.NullInt64
+
+	if err := row.Scan(&rec.ID, &rec.RunnerID, &rec.User, &rec.RemoteAddr, &command, &rec.Cwd, &rec.JobID, &rec.Profile,
+		&rec.Recorded, &status, &startedAt, &endedAt, &exitCode, &rec.Reason, &limitsHit, &rec.Redactions); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return SessionRecord{}, ErrNotFound
+		}
+		return SessionRecord{}, fmt.Errorf("failed to scan session: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(command), &rec.Command); err != nil {
+		return SessionRecord{}, fmt.Errorf("failed to decode command for session %s: %w", rec.ID, err)
+	}
+	if err := json.Unmarshal([]byte(limitsHit), &rec.LimitsHit); err != nil {
+		return SessionRecord{}, fmt.Errorf("failed to decode limits hit for session %s: %w", rec.ID, err)
+	}
+	rec.Status = SessionStatus(status)
+	rec.StartedAt = fromUnix(startedAt)
+	rec.EndedAt = fromNullUnix(endedAt)
+	rec.ExitCode = fromNullInt(exitCode)
+	return rec, nil
+}
+
+func scanJob(row scanner) (JobRecord, error) {
+	var j JobRecord
+	var command, artifacts, workspace, env, limits, status string
+	var createdAt int64
+	var startedAt, finishedAt, exitCode sql.NullInt64
+
+	if err := row.Scan(&j.ID, &j.RunnerID, &j.User, &j.QuotaKey, &command, &j.Cwd, &j.Record, &artifacts, &workspace,
+		&j.Profile, &env, &limits, &j.Timeout, &status,
+		&createdAt, &startedAt, &finishedAt, &exitCode); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return JobRecord{}, ErrNotFound
+		}
+		return JobRecord{}, fmt.Errorf("failed to scan job: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(command), &j.Command); err != nil {
+		return JobRecord{}, fmt.Errorf("failed to decode command for job %s: %w", j.ID, err)
+	}
+	if err := json.Unmarshal([]byte(artifacts), &j.Artifacts); err != nil {
+		return JobRecord{}, fmt.Errorf("failed to decode artifact patterns for job %s: %w", j.ID, err)
+	}
+	if err := json.Unmarshal([]byte(workspace), &j.Workspace); err != nil {
+		return JobRecord{}, fmt.Errorf("failed to decode workspace for job %s: %w", j.ID, err)
+	}
+	if err := json.Unmarshal([]byte(env), &j.Env); err != nil {
+		return JobRecord{}, fmt.Errorf("failed to decode env for job %s: %w", j.ID, err)
+	}
+	if err := json.Unmarshal([]byte(limits), &j.Limits); err != nil {
+		return JobRecord{}, fmt.Errorf("failed to decode limits for job %s: %w", j.ID, err)
+	}
+	j.Status = JobStatus(status)
+	j.CreatedAt = fromUnix(createdAt)
+	j.StartedAt = fromNullUnix(startedAt)
+	j.FinishedAt = fromNullUnix(finishedAt)
+	j.ExitCode = fromNullInt(exitCode)
+	return j, nil
+}
+
+func scanArtifact(row scanner) (ArtifactRecord, error) {
+	var a ArtifactRecord
+	var createdAt int64
+
+	if err := row.Scan(&a.SessionID, &a.Name, &a.Size, &a.SHA256, &createdAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ArtifactRecord{}, ErrNotFound
+		}
+		return ArtifactRecord{}, fmt.Errorf("failed to scan artifact: %w", err)
+	}
+
+	a.CreatedAt = fromUnix(createdAt)
+	return a, nil
+}
+
+func scanApproval(row scanner) (ApprovalRecord, error) {
+	var a ApprovalRecord
+	var status string
+	var requestedAt, expiresAt int64
+	var decidedAt sql.NullInt64
+
+	if err := row.Scan(&a.ID, &a.SessionID, &a.RunnerID, &a.User, &a.Action, &a.Details, &status,
+		&requestedAt, &expiresAt, &decidedAt, &a.DecidedBy, &a.Reason); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ApprovalRecord{}, ErrNotFound
+		}
+		return ApprovalRecord{}, fmt.Errorf("failed to scan approval: %w", err)
+	}
+
+	a.Status = ApprovalStatus(status)
+	a.RequestedAt = fromUnix(requestedAt)
+	a.ExpiresAt = fromUnix(expiresAt)
+	a.DecidedAt = fromNullUnix(decidedAt)
+	return a, nil
+}
+
+func whereClause(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+func requireAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Timestamps are stored as Unix nanoseconds so range comparisons stay numeric
+
+func toUnix(t time.Time) int64 {
+	return t.UnixNano()
+}
+
+func fromUnix(n int64) time.Time {
+	return time.Unix(0, n).UTC()
+}
+
+func toNullUnix(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixNano(), Valid: true}
+}
+
+func fromNullUnix(n sql.NullInt64) *time.Time {
+	if !n.Valid {
+		return nil
+	}
+	t := fromUnix(n.Int64)
+	return &t
+}
+
+func toNullInt(v *int) sql.NullInt64 {
+	if v == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(*v), Valid: true}
+}
+
+func fromNullInt(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	v := int(n.Int64)
+	return &v
+}
@@ -0,0 +1,232 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/protocol"
+)
+
+// ErrNotFound is returned when a requested record does not exist
+var ErrNotFound = errors.New("record not found")
+
+// ErrNotPending is returned when deciding an approval that was already resolved
+var ErrNotPending = errors.New("approval is no longer pending")
+
+// SessionStatus describes the lifecycle state of a session
+type SessionStatus string
+
+const (
+	SessionStatusRunning SessionStatus = "running"
+	SessionStatusEnded   SessionStatus = "ended"
+	SessionStatusLost    SessionStatus = "lost" // Runner disconnected before the session ended
+)
+
+// JobStatus describes the lifecycle state of a job
+type JobStatus string
+
+const (
+	JobStatusQueued    JobStatus = "queued"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusSucceeded JobStatus = "succeeded"
+	JobStatusFailed    JobStatus = "failed"
+	JobStatusLost      JobStatus = "lost" // Runner disconnected before the job finished
+)
+
+// Finished reports whether the job has reached a terminal state
+func (s JobStatus) Finished() bool {
+	return s == JobStatusSucceeded || s == JobStatusFailed || s == JobStatusLost
+}
+
+// ApprovalStatus describes where an approval request stands
+type ApprovalStatus string
+
+const (
+	ApprovalStatusPending   ApprovalStatus = "pending"
+	ApprovalStatusApproved  ApprovalStatus = "approved"
+	ApprovalStatusDenied    ApprovalStatus = "denied"
+	ApprovalStatusExpired   ApprovalStatus = "expired"   // Nobody decided before the timeout
+	ApprovalStatusCancelled ApprovalStatus = "cancelled" // The session, runner or HQ went away first
+)
+
+// RunnerRecord is the persisted registration of a runner
+type RunnerRecord struct {
+	ID             string            `json:"id"`
+	RemoteAddr     string            `json:"remote_addr,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	FirstSeen      time.Time         `json:"first_seen"`
+	LastConnected  time.Time         `json:"last_connected"`
+	DisconnectedAt *time.Time        `json:"disconnected_at,omitempty"`
+}
+
+// SessionRecord is the persisted metadata of a terminal session
+type SessionRecord struct {
+	ID         string        `json:"id"`
+	RunnerID   string        `json:"runner_id"`
+	User       string        `json:"user"`
+	RemoteAddr string        `json:"remote_addr,omitempty"`
+	Command    []string      `json:"command"`
+	Cwd        string        `json:"cwd,omitempty"`
+	JobID      string        `json:"job_id,omitempty"`
+	Profile    string        `json:"profile,omitempty"`
+	Recorded   bool          `json:"recorded"`
+	Status     SessionStatus `json:"status"`
+	StartedAt  time.Time     `json:"started_at"`
+	EndedAt    *time.Time    `json:"ended_at,omitempty"`
+	ExitCode   *int          `json:"exit_code,omitempty"`
+	Reason     string        `json:"reason,omitempty"` // Why the runner ended the session, e.g. "timeout"
+	LimitsHit  []string      `json:"limits_hit,omitempty"`
+	Redactions int           `json:"redactions"`
+}
+
+// SessionEnd describes how a session finished
+type SessionEnd struct {
+	Status     SessionStatus
+	ExitCode   *int // Nil when the process exit status is unknown
+	EndedAt    time.Time
+	Reason     string
+	LimitsHit  []string // Resource limits the session ran into
+	Redactions int      // Secrets masked in the session's output
+}
+
+// JobRecord is a unit of non-interactive work queued for a runner
+type JobRecord struct {
+	ID         string                   `json:"id"`
+	RunnerID   string                   `json:"runner_id"`
+	User       string                   `json:"user"`
+	QuotaKey   string                   `json:"-"` // Whom the job counts against for the user quotas: User, or the submitting address
+	Command    []string                 `json:"command"`
+	Cwd        string                   `json:"cwd,omitempty"`
+	Record     bool                     `json:"record,omitempty"`
+	Artifacts  []string                 `json:"artifacts,omitempty"` // Glob patterns collected when the job finishes
+	Workspace  *protocol.WorkspaceSpec  `json:"workspace,omitempty"` // Git checkout the job runs in
+	Profile    string                   `json:"profile,omitempty"`   // Agent profile the job was expanded from
+	Env        map[string]string        `json:"env,omitempty"`
+	Limits     *protocol.ResourceLimits `json:"limits,omitempty"`
+	Timeout    int                      `json:"timeout,omitempty"` // Seconds before the runner kills the job
+	Status     JobStatus                `json:"status"`
+	CreatedAt  time.Time                `json:"created_at"`
+	StartedAt  *time.Time               `json:"started_at,omitempty"`
+	FinishedAt *time.Time               `json:"finished_at,omitempty"`
+	ExitCode   *int                     `json:"exit_code,omitempty"`
+}
+
+// ArtifactRecord describes a file collected from a finished session
+// The content lives in the artifact store under the same session ID and name
+type ArtifactRecord struct {
+	SessionID string    `json:"session_id"`
+	Name      string    `json:"name"` // Slash-separated path relative to the session's working directory
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ApprovalRecord is a request for a human to allow a sensitive action in a session
+type ApprovalRecord struct {
+	ID          string         `json:"id"`
+	SessionID   string         `json:"session_id"`
+	RunnerID    string         `json:"runner_id"`
+	User        string         `json:"user,omitempty"` // Owner of the session
+	Action      string         `json:"action"`
+	Details     string         `json:"details,omitempty"`
+	Status      ApprovalStatus `json:"status"`
+	RequestedAt time.Time      `json:"requested_at"`
+	ExpiresAt   time.Time      `json:"expires_at"`
+	DecidedAt   *time.Time     `json:"decided_at,omitempty"`
+	DecidedBy   string         `json:"decided_by,omitempty"`
+	Reason      string         `json:"reason,omitempty"`
+}
+
+// ApprovalDecision resolves a pending approval
+type ApprovalDecision struct {
+	Status    ApprovalStatus
+	DecidedAt time.Time
+	DecidedBy string // Empty when HQ decided, e.g. on timeout
+	Reason    string
+}
+
+// SessionFilter narrows ListSessions results; zero values match everything
+type SessionFilter struct {
+	RunnerID string
+	User     string
+	Status   SessionStatus
+	Limit    int
+}
+
+// JobFilter narrows ListJobs results; zero values match everything
+type JobFilter struct {
+	RunnerID string
+	Status   JobStatus
+	Limit    int
+}
+
+// ApprovalFilter narrows ListApprovals results; zero values match everything
+type ApprovalFilter struct {
+	SessionID string
+	Status    ApprovalStatus
+	Limit     int
+}
+
+// RetentionPolicy controls how long finished records are kept
+// A zero duration keeps records forever
+type RetentionPolicy struct {
+	Sessions time.Duration // Ended sessions, measured from EndedAt
+	Jobs     time.Duration // Finished jobs, measured from FinishedAt
+	Runners  time.Duration // Disconnected runners, measured from DisconnectedAt
+}
+
+// Store persists HQ state so it survives restarts
+type Store interface {
+	// UpsertRunner records a runner registration, preserving FirstSeen
+	UpsertRunner(ctx context.Context, r RunnerRecord) error
+	// MarkRunnerDisconnected records the time a runner went away
+	MarkRunnerDisconnected(ctx context.Context, id string, at time.Time) error
+	GetRunner(ctx context.Context, id string) (RunnerRecord, error)
+	ListRunners(ctx context.Context) ([]RunnerRecord, error)
+
+	CreateSession(ctx context.Context, s SessionRecord) error
+	// EndSession marks a running session as finished
+	EndSession(ctx context.Context, id string, end SessionEnd) error
+	GetSession(ctx context.Context, id string) (SessionRecord, error)
+	// ListSessions returns matching sessions, most recent first
+	ListSessions(ctx context.Context, filter SessionFilter) ([]SessionRecord, error)
+
+	CreateJob(ctx context.Context, j JobRecord) error
+	UpdateJob(ctx context.Context, j JobRecord) error
+	GetJob(ctx context.Context, id string) (JobRecord, error)
+	// ListJobs returns matching jobs, oldest first so queues drain in order
+	ListJobs(ctx context.Context, filter JobFilter) ([]JobRecord, error)
+
+	// PutArtifact records an artifact, replacing one with the same session and name
+	PutArtifact(ctx context.Context, a ArtifactRecord) error
+	GetArtifact(ctx context.Context, sessionID, name string) (ArtifactRecord, error)
+	// ListArtifacts returns a session's artifacts ordered by name
+	ListArtifacts(ctx context.Context, sessionID string) ([]ArtifactRecord, error)
+
+	// PutSessionResult records the changes a workspace session made
+	PutSessionResult(ctx context.Context, sessionID string, r protocol.SessionResult) error
+	GetSessionResult(ctx context.Context, sessionID string) (protocol.SessionResult, error)
+
+	CreateApproval(ctx context.Context, a ApprovalRecord) error
+	// DecideApproval resolves a pending approval, or returns ErrNotPending if it was already resolved
+	DecideApproval(ctx context.Context, id string, d ApprovalDecision) error
+	GetApproval(ctx context.Context, id string) (ApprovalRecord, error)
+	// ListApprovals returns matching approvals, most recent first
+	ListApprovals(ctx context.Context, filter ApprovalFilter) ([]ApprovalRecord, error)
+
+	// Prune deletes finished records older than the retention policy allows
+	// and returns the number of records removed; artifacts, results and approvals go with their session
+	Prune(ctx context.Context, policy RetentionPolicy, now time.Time) (int, error)
+
+	Close() error
+}
+
+// cutoff returns the time before which records are expired, or false when
+// the retention duration keeps records forever
+func cutoff(now time.Time, retention time.Duration) (time.Time, bool) {
+	if retention <= 0 {
+		return time.Time{}, false
+	}
+	return now.Add(-retention), true
+}
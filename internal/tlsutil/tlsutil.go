@@ -0,0 +1,151 @@
+// Package tlsutil loads the certificates HQ and runners use for TLS and mutual TLS
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/codervisor/agent-relay/internal/logging"
+)
+
+// checkInterval bounds how often a key pair's files are checked for changes
+const checkInterval = time.Second
+
+// KeyPair is a certificate and private key loaded from PEM files
+// It is reloaded when either file changes, so rotated certificates apply to new connections
+type KeyPair struct {
+	certFile, keyFile string
+	log               *slog.Logger
+
+	mu              sync.Mutex
+	cert            *tls.Certificate
+	certMod, keyMod time.Time
+	checked         time.Time
+}
+
+// LoadKeyPair loads the certificate and key in certFile and keyFile
+func LoadKeyPair(certFile, keyFile string, logger *slog.Logger) (*KeyPair, error) {
+	k := &KeyPair{certFile: certFile, keyFile: keyFile, log: logging.Component(logger, "tls")}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// load reads both files if either changed since they were last read
+func (k *KeyPair) load() error {
+	certInfo, err := os.Stat(k.certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(k.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read key: %w", err)
+	}
+	if k.cert != nil && certInfo.ModTime().Equal(k.certMod) && keyInfo.ModTime().Equal(k.keyMod) {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load key pair: %w", err)
+	}
+	if k.cert != nil {
+		k.log.Info("Reloaded certificate", "cert", k.certFile, "not_after", cert.Leaf.NotAfter)
+	}
+	k.cert = &cert
+	k.certMod, k.keyMod = certInfo.ModTime(), keyInfo.ModTime()
+	return nil
+}
+
+// Certificate returns the current certificate, reloading it first if its files changed
+// A reload that fails, e.g. halfway through a rotation, keeps the previous certificate
+func (k *KeyPair) Certificate() *tls.Certificate {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if now := time.Now(); now.Sub(k.checked) >= checkInterval {
+		k.checked = now
+		if err := k.load(); err != nil {
+			k.log.Warn("Failed to reload certificate; using the previous one", "cert", k.certFile, logging.Err(err))
+		}
+	}
+	return k.cert
+}
+
+// Leaf returns the current certificate's parsed leaf
+func (k *KeyPair) Leaf() *x509.Certificate {
+	return k.Certificate().Leaf
+}
+
+// GetCertificate serves the key pair as tls.Config.GetCertificate
+func (k *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return k.Certificate(), nil
+}
+
+// GetClientCertificate presents the key pair as tls.Config.GetClientCertificate
+func (k *KeyPair) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return k.Certificate(), nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("CA bundle " + path + " has no PEM certificates")
+	}
+	return pool, nil
+}
+
+// ServerConfig serves pair's certificate; with clientCAs set, clients may present a
+// certificate, which must be signed by one of them
+func ServerConfig(pair *KeyPair, clientCAs *x509.CertPool) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: pair.GetCertificate,
+	}
+	if clientCAs != nil {
+		// Browsers share HQ's listeners with runners, so certificates are only required where HQ checks for them
+		cfg.ClientCAs = clientCAs
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg
+}
+
+// ClientConfig verifies servers against rootCAs, or the system roots when nil, and
+// presents pair's certificate when it is set
+func ClientConfig(rootCAs *x509.CertPool, pair *KeyPair) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    rootCAs,
+	}
+	if pair != nil {
+		cfg.GetClientCertificate = pair.GetClientCertificate
+	}
+	return cfg
+}
+
+// Identities lists the names a certificate vouches for: its subject common name and DNS SANs
+func Identities(cert *x509.Certificate) []string {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	for _, name := range cert.DNSNames {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
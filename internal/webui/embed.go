@@ -0,0 +1,18 @@
+//go:build embedui
+
+package webui
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// dist is the web build's output, which make build-web writes here
+//
+//go:embed all:dist
+var dist embed.FS
+
+// Embedded returns the frontend built into the binary
+func Embedded() (fs.FS, error) {
+	return fs.Sub(dist, "dist")
+}
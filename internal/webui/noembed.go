@@ -0,0 +1,10 @@
+//go:build !embedui
+
+package webui
+
+import "io/fs"
+
+// Embedded returns the frontend built into the binary; this one was built without it
+func Embedded() (fs.FS, error) {
+	return nil, ErrNotBuilt
+}
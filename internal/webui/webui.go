@@ -0,0 +1,105 @@
+// Package webui serves HQ's web frontend, built into the binary or read from a directory
+package webui
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reserved are path prefixes that belong to HQ rather than the frontend's router,
+// so unknown paths under them are not answered with the frontend
+var reserved = []string{"api/", "ws/"}
+
+// ErrNotBuilt is returned by Embedded for binaries built without the frontend
+var ErrNotBuilt = errors.New("the web UI is not built into this binary; run make build-web build")
+
+// Dir serves the frontend from dir, such as the web build's output while working on it
+func Dir(dir string) (fs.FS, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return os.DirFS(dir), nil
+}
+
+// Handler serves the frontend in fsys for requests no route matched
+// Paths that are not files get index.html so the frontend's router can handle them.
+// Vite's content-hashed assets may be cached for good; everything else is revalidated
+func Handler(fsys fs.FS) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+			return
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+c.Request.URL.Path), "/")
+		if !isFile(fsys, name) {
+			// Missing files with an extension are broken links, not pages
+			if isReserved(name) || path.Ext(name) != "" {
+				c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+				return
+			}
+			name = "index.html"
+		}
+
+		if strings.HasPrefix(name, "assets/") {
+			c.Header("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			c.Header("Cache-Control", "no-cache")
+		}
+		serveFile(c, fsys, name)
+	}
+}
+
+// isReserved reports whether name is under one of HQ's own path prefixes
+func isReserved(name string) bool {
+	for _, prefix := range reserved {
+		if strings.HasPrefix(name+"/", prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isFile reports whether name is a regular file in fsys
+func isFile(fsys fs.FS, name string) bool {
+	if name == "" {
+		return false
+	}
+	info, err := fs.Stat(fsys, name)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// serveFile writes the file, leaving content type, ranges and conditional requests to http.ServeContent
+// http.FileServer is not used because it redirects requests for index.html
+func serveFile(c *gin.Context, fsys fs.FS, name string) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	defer f.Close()
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "file is not seekable"})
+		return
+	}
+	var modTime time.Time // Embedded files have none
+	if info, err := f.Stat(); err == nil {
+		modTime = info.ModTime()
+	}
+	http.ServeContent(c.Writer, c.Request, name, modTime, content)
+}
@@ -5,6 +5,7 @@ import { Dashboard } from '@/pages/Dashboard'
 import { Runners } from '@/pages/Runners'
 import { TerminalPage } from '@/pages/TerminalPage'
 import { Settings } from '@/pages/Settings'
+import { Approvals } from '@/pages/Approvals'
 
 function App() {
   return (
@@ -14,6 +15,7 @@ function App() {
           <Route index element={<Dashboard />} />
           <Route path="runners" element={<Runners />} />
           <Route path="terminal" element={<TerminalPage />} />
+          <Route path="approvals" element={<Approvals />} />
           <Route path="settings" element={<Settings />} />
         </Route>
       </Routes>
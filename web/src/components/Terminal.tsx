@@ -2,31 +2,21 @@ import React, { useEffect, useRef, useState } from 'react';
 import { Terminal as XTerm } from 'xterm';
 import { FitAddon } from 'xterm-addon-fit';
 import { WebLinksAddon } from 'xterm-addon-web-links';
-import { TerminalWebSocket } from '../lib/websocket';
+import { LatencyPayload, TerminalWebSocket } from '../lib/websocket';
 import 'xterm/css/xterm.css';
 
 interface TerminalProps {
   runnerID: string;
-  sessionID?: string;
 }
 
-export const Terminal: React.FC<TerminalProps> = ({ runnerID, sessionID }) => {
+export const Terminal: React.FC<TerminalProps> = ({ runnerID }) => {
   const terminalRef = useRef<HTMLDivElement>(null);
   const xtermRef = useRef<XTerm | null>(null);
   const fitAddonRef = useRef<FitAddon | null>(null);
   const wsRef = useRef<TerminalWebSocket | null>(null);
   const [error, setError] = useState<string | null>(null);
   const [connected, setConnected] = useState(false);
-  const stableSessionIDRef = useRef<string>(sessionID ?? crypto.randomUUID());
-
-  // Keep session ID stable unless an explicit one is provided and changes
-  useEffect(() => {
-    if (sessionID && sessionID !== stableSessionIDRef.current) {
-      stableSessionIDRef.current = sessionID;
-    }
-  }, [sessionID]);
-
-  const stableSessionID = stableSessionIDRef.current;
+  const [latency, setLatency] = useState<LatencyPayload | null>(null);
 
   useEffect(() => {
     if (!terminalRef.current) return;
@@ -56,8 +46,8 @@ export const Terminal: React.FC<TerminalProps> = ({ runnerID, sessionID }) => {
     xtermRef.current = term;
     fitAddonRef.current = fitAddon;
 
-    // Create WebSocket connection
-    const ws = new TerminalWebSocket(runnerID, stableSessionID);
+    // Create WebSocket connection; HQ refuses session IDs already used, so each connection gets its own
+    const ws = new TerminalWebSocket(runnerID, crypto.randomUUID());
     wsRef.current = ws;
 
     // Handle PTY output
@@ -72,9 +62,13 @@ export const Terminal: React.FC<TerminalProps> = ({ runnerID, sessionID }) => {
       term.writeln(`\r\n\x1b[31mError: ${error}\x1b[0m`);
     });
 
+    // Handle latency reports
+    ws.onLatency(setLatency);
+
     // Handle close
     ws.onClose(() => {
       setConnected(false);
+      setLatency(null);
       term.writeln('\r\n\x1b[33mConnection closed\x1b[0m');
     });
 
@@ -116,7 +110,7 @@ export const Terminal: React.FC<TerminalProps> = ({ runnerID, sessionID }) => {
       ws.close();
       term.dispose();
     };
-  }, [runnerID, stableSessionID]);
+  }, [runnerID]);
 
   return (
     <div className="flex flex-col h-full">
@@ -131,6 +125,14 @@ export const Terminal: React.FC<TerminalProps> = ({ runnerID, sessionID }) => {
         </div>
       )}
       <div ref={terminalRef} className="flex-1" />
+      {connected && latency && (
+        <div
+          className="bg-gray-800 text-gray-300 px-4 py-1 text-xs text-right"
+          title={`You ↔ HQ ${latency.client_rtt_ms.toFixed(1)} ms, HQ ↔ runner ${latency.runner_rtt_ms.toFixed(1)} ms`}
+        >
+          Latency to runner: {Math.round(latency.rtt_ms)} ms
+        </div>
+      )}
     </div>
   );
 };
@@ -13,6 +13,7 @@ export function Header() {
       case '/': return 'Dashboard'
       case '/runners': return 'Runners'
       case '/terminal': return 'Terminal'
+      case '/approvals': return 'Approvals'
       case '/settings': return 'Settings'
       default: return 'AgentRelay'
     }
@@ -4,6 +4,7 @@ import {
   LayoutDashboard, 
   Server, 
   Terminal as TerminalIcon, 
+  ShieldCheck,
   Settings 
 } from 'lucide-react'
 import { cn } from '@/lib/utils'
@@ -20,6 +21,7 @@ export function Sidebar({ collapsed = false }: SidebarProps) {
     { path: '/', icon: LayoutDashboard, label: 'Dashboard' },
     { path: '/runners', icon: Server, label: 'Runners' },
     { path: '/terminal', icon: TerminalIcon, label: 'Terminal' },
+    { path: '/approvals', icon: ShieldCheck, label: 'Approvals' },
     { path: '/settings', icon: Settings, label: 'Settings' },
   ]
 
@@ -0,0 +1,15 @@
+// HQ serves the built UI itself; only the Vite dev server runs apart from it
+const devHost = 'localhost:8080'
+
+// Prefix for HQ's REST API; empty when the UI is served by HQ
+export const apiBase = import.meta.env.DEV ? `http://${devHost}` : ''
+
+// hqOrigin is where the UI reaches HQ, for display
+export const hqOrigin = import.meta.env.DEV ? `http://${devHost}` : window.location.origin
+
+// wsUrl returns the websocket URL for one of HQ's /ws endpoints
+export function wsUrl(path: string) {
+  const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:'
+  const host = import.meta.env.DEV ? devHost : window.location.host
+  return `${protocol}//${host}${path}`
+}
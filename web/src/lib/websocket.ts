@@ -4,7 +4,9 @@
  * Handles communication between browser and HQ server for terminal sessions.
  */
 
-type MessageType = 'start_session' | 'resize' | 'error' | 'session_started' | 'session_ended';
+import { wsUrl } from './hq';
+
+type MessageType = 'start_session' | 'resize' | 'error' | 'session_started' | 'session_ended' | 'server_shutdown' | 'latency';
 
 interface Message {
   type: MessageType;
@@ -16,6 +18,13 @@ interface StartSessionPayload {
   command?: string[];
 }
 
+export interface LatencyPayload {
+  session_id: string;
+  client_rtt_ms: number; // Browser <-> HQ
+  runner_rtt_ms: number; // HQ <-> runner; 0 until measured
+  rtt_ms: number; // Browser <-> runner
+}
+
 interface ResizePayload {
   session_id: string;
   rows: number;
@@ -30,6 +39,7 @@ export class TerminalWebSocket {
   private onDataCallback?: (data: ArrayBuffer) => void;
   private onErrorCallback?: (error: string) => void;
   private onCloseCallback?: () => void;
+  private onLatencyCallback?: (latency: LatencyPayload) => void;
   private manuallyClosed = false;
   private hasOpened = false;
 
@@ -37,10 +47,7 @@ export class TerminalWebSocket {
     this.runnerID = runnerID;
     this.sessionID = sessionID;
     
-    // Build WebSocket URL (use ws:// for localhost, wss:// for production)
-    const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-    const host = window.location.hostname === 'localhost' ? 'localhost:8080' : window.location.host;
-    this.url = `${protocol}//${host}/ws/terminal/${runnerID}`;
+    this.url = wsUrl(`/ws/terminal/${runnerID}`);
   }
 
   /**
@@ -162,6 +169,13 @@ export class TerminalWebSocket {
     this.onErrorCallback = callback;
   }
 
+  /**
+   * Register callback for latency reports, sent by HQ after each probe
+   */
+  onLatency(callback: (latency: LatencyPayload) => void): void {
+    this.onLatencyCallback = callback;
+  }
+
   /**
    * Register callback for connection close
    */
@@ -194,6 +208,20 @@ export class TerminalWebSocket {
           this.onCloseCallback();
         }
         break;
+      case 'server_shutdown': {
+        // HQ closes the connection right after this
+        const seconds = msg.payload?.reconnect_after || 0;
+        console.log('[WS] HQ is shutting down:', msg.payload);
+        if (this.onErrorCallback) {
+          this.onErrorCallback(`HQ is restarting; reconnect in ${seconds}s`);
+        }
+        break;
+      }
+      case 'latency':
+        if (this.onLatencyCallback) {
+          this.onLatencyCallback(msg.payload as LatencyPayload);
+        }
+        break;
       case 'error':
         console.error('[WS] Error from server:', msg.payload);
         if (this.onErrorCallback) {
@@ -0,0 +1,231 @@
+import React, { useCallback, useEffect, useState } from 'react'
+import { ShieldCheck, Check, X } from 'lucide-react'
+import { Card, CardContent, CardDescription, CardHeader, CardTitle } from '@/components/ui/card'
+import { Button } from '@/components/ui/button'
+import { Badge } from '@/components/ui/badge'
+import {
+  Table,
+  TableBody,
+  TableCell,
+  TableHead,
+  TableHeader,
+  TableRow,
+} from '@/components/ui/table'
+import { apiBase, wsUrl } from '@/lib/hq'
+
+interface ApprovalRequest {
+  approval_id: string
+  session_id: string
+  action: string
+  details?: string
+  user?: string
+  expires_at?: string
+}
+
+interface ApprovalRecord {
+  id: string
+  session_id: string
+  action: string
+  user?: string
+  status: 'pending' | 'approved' | 'denied' | 'expired' | 'cancelled'
+  requested_at: string
+  decided_by?: string
+  reason?: string
+}
+
+export function Approvals() {
+  const [pending, setPending] = useState<ApprovalRequest[]>([])
+  const [history, setHistory] = useState<ApprovalRecord[]>([])
+  const [connected, setConnected] = useState(false)
+  const [now, setNow] = useState(Date.now())
+
+  const fetchHistory = useCallback(async () => {
+    try {
+      const response = await fetch(`${apiBase}/api/approvals?limit=20`)
+      const data = await response.json()
+      setHistory((data.approvals || []).filter((a: ApprovalRecord) => a.status !== 'pending'))
+    } catch (err) {
+      console.error('Failed to fetch approvals:', err)
+    }
+  }, [])
+
+  // Pending requests stream over /ws/approvals; HQ sends the current ones on connect
+  useEffect(() => {
+    let ws: WebSocket | null = null
+    let retry: ReturnType<typeof setTimeout> | undefined
+    let closed = false
+    let retryDelay = 5000
+
+    const connect = () => {
+      ws = new WebSocket(wsUrl('/ws/approvals'))
+      ws.onopen = () => {
+        setConnected(true)
+        setPending([])
+      }
+      ws.onmessage = (event) => {
+        const msg = JSON.parse(event.data)
+        if (msg.type === 'approval_request') {
+          setPending((prev) => [
+            ...prev.filter((a) => a.approval_id !== msg.payload.approval_id),
+            msg.payload,
+          ])
+        } else if (msg.type === 'approval_decision') {
+          setPending((prev) => prev.filter((a) => a.approval_id !== msg.payload.approval_id))
+          fetchHistory()
+        } else if (msg.type === 'server_shutdown') {
+          retryDelay = Math.max(1000, (msg.payload.reconnect_after || 0) * 1000)
+        }
+      }
+      ws.onclose = () => {
+        setConnected(false)
+        if (!closed) {
+          retry = setTimeout(connect, retryDelay)
+          retryDelay = 5000
+        }
+      }
+    }
+
+    connect()
+    fetchHistory()
+    return () => {
+      closed = true
+      clearTimeout(retry)
+      ws?.close()
+    }
+  }, [fetchHistory])
+
+  useEffect(() => {
+    const interval = setInterval(() => setNow(Date.now()), 1000)
+    return () => clearInterval(interval)
+  }, [])
+
+  const decide = async (id: string, approve: boolean) => {
+    try {
+      const response = await fetch(`${apiBase}/api/approvals/${id}/${approve ? 'approve' : 'deny'}`, {
+        method: 'POST',
+      })
+      if (!response.ok) {
+        const data = await response.json()
+        console.error('Failed to decide approval:', data.error)
+      }
+    } catch (err) {
+      console.error('Failed to decide approval:', err)
+    }
+  }
+
+  const remaining = (expiresAt?: string) => {
+    if (!expiresAt) return '-'
+    const seconds = Math.max(0, Math.round((new Date(expiresAt).getTime() - now) / 1000))
+    return `${Math.floor(seconds / 60)}:${String(seconds % 60).padStart(2, '0')}`
+  }
+
+  const statusVariant = (status: ApprovalRecord['status']) => {
+    switch (status) {
+      case 'approved': return 'default' as const
+      case 'denied': return 'destructive' as const
+      default: return 'secondary' as const
+    }
+  }
+
+  return (
+    <div className="p-6 space-y-6">
+      <div className="flex items-center justify-between">
+        <div>
+          <h2 className="text-3xl font-bold tracking-tight">Approvals</h2>
+          <p className="text-muted-foreground">
+            Sensitive actions waiting for a human decision
+          </p>
+        </div>
+        <Badge variant={connected ? 'default' : 'secondary'}>
+          {connected ? 'live' : 'disconnected'}
+        </Badge>
+      </div>
+
+      <Card>
+        <CardHeader>
+          <CardTitle>Pending</CardTitle>
+          <CardDescription>
+            Requests are denied automatically when they expire
+          </CardDescription>
+        </CardHeader>
+        <CardContent>
+          {pending.length === 0 ? (
+            <div className="flex items-center gap-2 text-sm text-muted-foreground">
+              <ShieldCheck className="h-4 w-4" />
+              Nothing is waiting for approval
+            </div>
+          ) : (
+            <Table>
+              <TableHeader>
+                <TableRow>
+                  <TableHead>Action</TableHead>
+                  <TableHead>Session</TableHead>
+                  <TableHead>User</TableHead>
+                  <TableHead>Expires In</TableHead>
+                  <TableHead className="text-right">Decision</TableHead>
+                </TableRow>
+              </TableHeader>
+              <TableBody>
+                {pending.map((req) => (
+                  <TableRow key={req.approval_id}>
+                    <TableCell>
+                      <code className="text-sm">{req.action}</code>
+                      {req.details && (
+                        <p className="text-xs text-muted-foreground mt-1">{req.details}</p>
+                      )}
+                    </TableCell>
+                    <TableCell className="font-mono text-xs">{req.session_id.slice(0, 8)}</TableCell>
+                    <TableCell>{req.user || '-'}</TableCell>
+                    <TableCell>{remaining(req.expires_at)}</TableCell>
+                    <TableCell className="text-right space-x-2">
+                      <Button size="sm" onClick={() => decide(req.approval_id, true)}>
+                        <Check className="h-4 w-4 mr-1" />
+                        Approve
+                      </Button>
+                      <Button size="sm" variant="destructive" onClick={() => decide(req.approval_id, false)}>
+                        <X className="h-4 w-4 mr-1" />
+                        Deny
+                      </Button>
+                    </TableCell>
+                  </TableRow>
+                ))}
+              </TableBody>
+            </Table>
+          )}
+        </CardContent>
+      </Card>
+
+      <Card>
+        <CardHeader>
+          <CardTitle>Recent Decisions</CardTitle>
+        </CardHeader>
+        <CardContent>
+          <Table>
+            <TableHeader>
+              <TableRow>
+                <TableHead>Status</TableHead>
+                <TableHead>Action</TableHead>
+                <TableHead>Decided By</TableHead>
+                <TableHead>Reason</TableHead>
+                <TableHead>Requested</TableHead>
+              </TableRow>
+            </TableHeader>
+            <TableBody>
+              {history.map((a) => (
+                <TableRow key={a.id}>
+                  <TableCell>
+                    <Badge variant={statusVariant(a.status)}>{a.status}</Badge>
+                  </TableCell>
+                  <TableCell><code className="text-sm">{a.action}</code></TableCell>
+                  <TableCell>{a.decided_by || '-'}</TableCell>
+                  <TableCell>{a.reason || '-'}</TableCell>
+                  <TableCell>{new Date(a.requested_at).toLocaleTimeString()}</TableCell>
+                </TableRow>
+              ))}
+            </TableBody>
+          </Table>
+        </CardContent>
+      </Card>
+    </div>
+  )
+}
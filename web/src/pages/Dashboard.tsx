@@ -4,6 +4,7 @@ import { Activity, Server, Terminal as TerminalIcon, ArrowRight } from 'lucide-r
 import { Card, CardContent, CardDescription, CardHeader, CardTitle } from '@/components/ui/card'
 import { Button } from '@/components/ui/button'
 import { useAppStore } from '@/store/app-store'
+import { apiBase } from '@/lib/hq'
 
 export function Dashboard() {
   const navigate = useNavigate()
@@ -14,7 +15,7 @@ export function Dashboard() {
     // Fetch runners
     const fetchRunners = async () => {
       try {
-        const response = await fetch('http://localhost:8080/api/runners')
+        const response = await fetch(`${apiBase}/api/runners`)
         const data = await response.json()
         const runnerList = (data.runners || []).map((id: string) => ({
           id,
@@ -13,6 +13,7 @@ import {
   TableRow,
 } from '@/components/ui/table'
 import { useAppStore, type Runner } from '@/store/app-store'
+import { apiBase } from '@/lib/hq'
 
 export function Runners() {
   const navigate = useNavigate()
@@ -21,11 +22,12 @@ export function Runners() {
   useEffect(() => {
     const fetchRunners = async () => {
       try {
-        const response = await fetch('http://localhost:8080/api/runners')
+        const response = await fetch(`${apiBase}/api/runners`)
         const data = await response.json()
+        const draining: string[] = data.draining || []
         const runnerList = (data.runners || []).map((id: string) => ({
           id,
-          status: 'online' as const,
+          status: draining.includes(id) ? 'draining' as const : 'online' as const,
           hostname: id,
           lastSeen: new Date(),
           activeSessions: 0
@@ -41,6 +43,22 @@ export function Runners() {
     return () => clearInterval(interval)
   }, [setRunners])
 
+  // The runner finishes its sessions, starts no new ones and then exits
+  const handleDrain = async (runner: Runner) => {
+    if (!window.confirm(`Drain ${runner.id}? It will exit once its sessions end.`)) return
+    try {
+      const response = await fetch(`${apiBase}/api/runners/${runner.id}/drain`, { method: 'POST' })
+      if (!response.ok) {
+        const data = await response.json()
+        console.error('Failed to drain runner:', data.error)
+        return
+      }
+      setRunners(runners.map((r) => (r.id === runner.id ? { ...r, status: 'draining' as const } : r)))
+    } catch (err) {
+      console.error('Failed to drain runner:', err)
+    }
+  }
+
   const handleConnect = (runner: Runner) => {
     const sessionId = crypto.randomUUID()
     addSession({
@@ -118,7 +136,15 @@ export function Runners() {
                         ? new Date(runner.lastSeen).toLocaleTimeString() 
                         : '-'}
                     </TableCell>
-                    <TableCell className="text-right">
+                    <TableCell className="text-right space-x-2">
+                      <Button
+                        size="sm"
+                        variant="outline"
+                        onClick={() => handleDrain(runner)}
+                        disabled={runner.status !== 'online'}
+                      >
+                        Drain
+                      </Button>
                       <Button
                         size="sm"
                         onClick={() => handleConnect(runner)}
@@ -4,6 +4,7 @@ import { Separator } from '@/components/ui/separator'
 import { useAppStore } from '@/store/app-store'
 import { Button } from '@/components/ui/button'
 import { Moon, Sun, Monitor } from 'lucide-react'
+import { hqOrigin } from '@/lib/hq'
 
 export function Settings() {
   const { theme, setTheme } = useAppStore()
@@ -70,7 +71,7 @@ export function Settings() {
           <div className="space-y-2">
             <label className="text-sm font-medium">HQ Server URL</label>
             <p className="text-sm text-muted-foreground">
-              Currently using: <code className="bg-muted px-1 py-0.5 rounded">http://localhost:8080</code>
+              Currently using: <code className="bg-muted px-1 py-0.5 rounded">{hqOrigin}</code>
             </p>
             <p className="text-xs text-muted-foreground">
               Server URL is automatically detected based on your current location.
@@ -79,7 +79,6 @@ export function TerminalPage() {
             <div className="flex-1 overflow-hidden">
               <TerminalComponent 
                 runnerID={session.runnerId}
-                sessionID={session.id}
               />
             </div>
           </TabsContent>
@@ -2,7 +2,7 @@ import { create } from 'zustand'
 
 export interface Runner {
   id: string
-  status: 'online' | 'offline'
+  status: 'online' | 'offline' | 'draining'
   hostname?: string
   ip?: string
   lastSeen?: Date
@@ -9,6 +9,11 @@ export default defineConfig({
       '@': path.resolve(__dirname, './src'),
     },
   },
+  build: {
+    // Embedded into the HQ binary by make build; see internal/webui
+    outDir: '../internal/webui/dist',
+    emptyOutDir: true,
+  },
   server: {
     port: 3000,
     proxy: {